@@ -4,26 +4,87 @@ import logging
 import asyncio
 import httpx
 from contextlib import asynccontextmanager
-from fastapi import FastAPI, HTTPException, Depends, Request
-from fastapi.responses import StreamingResponse
+from fastapi import FastAPI, HTTPException, Depends, Header, Request
+from fastapi.responses import StreamingResponse, JSONResponse, PlainTextResponse
+from fastapi.exceptions import RequestValidationError
 from fastapi.middleware.cors import CORSMiddleware
+from starlette.background import BackgroundTask
 from sse_starlette.sse import EventSourceResponse
 
-from config import MODEL_MAP, KIRO_BASE_URL, get_register_config
-from models import ChatCompletionRequest
+from config import LOG_LEVEL, DEMO_MODE, HEALTH_DEEP_TIMEOUT_SECONDS, METRICS_ENABLED, METRICS_TOKEN, get_register_config
+from errors import localize, respond_error, respond_claude_error
+from models import ChatCompletionRequest, CompletionRequest
 from models.claude_schemas import ClaudeRequest
-from auth import verify_api_key, token_manager
-from services import create_non_streaming_response, create_streaming_response
-from services.claude_converter import convert_claude_to_codewhisperer_request
-from services.claude_stream_handler import ClaudeStreamHandler
+from auth import verify_api_key, verify_admin_api_key, require_capacity, token_manager, stream_limiter, StreamLimitError
+from auth.api_key import api_key_label
+from auth.token_manager import UnknownAccountError
+from services import create_non_streaming_response, create_multi_choice_response, create_streaming_response
+from services.claude_converter import (
+    convert_claude_to_codewhisperer_request, convert_openai_to_claude_request, claude_tool_fingerprints,
+)
+from services.conversation_cache import conversation_cache, conversation_key, CONVERSATION_ID_HEADER
+from services.claude_stream_handler import (
+    ClaudeStreamHandler,
+    ClaudeMessageAssembler,
+    estimate_input_token_breakdown,
+)
+from services.upstream import UpstreamStream, deep_probe_upstream, UpstreamError, no_token_error, iter_response_bytes
+from services.error_mapper import claude_error_from_upstream, stream_error_stop_reason
+from parsers.stream_parser import EventStreamErrorBudgetExhausted
+from services.tool_utils import build_tool_name_map, ToolNameError, TrailingToolUseError, ToolChoiceError
+from services.request_sampler import request_sampler
+from services.metrics import (
+    MetricsMiddleware,
+    registry as metrics_registry,
+    accounts_total as metrics_accounts_total,
+    available_accounts as metrics_available_accounts,
+)
+from services.request_limits import MaxBodySizeMiddleware, log_preview
+from services.ip_rate_limit import IpRateLimitMiddleware
+from services.anthropic_headers import AnthropicHeadersMiddleware
+from services.openai_params import validate_openai_params, UnsupportedParameterError
+from services.legacy_completions import to_chat_request, to_text_completion, text_completion_stream
+from services.load_shed import LoadShedMiddleware, load_shedder
+from services.circuit_breaker import upstream_breaker, STATE_CLOSED
+from services.journal import request_journal
+from services.usage_store import usage_store, report_to_csv, UsageQueryError, DEFAULT_PAGE_DAYS
+from services.access_log import AccessLogMiddleware
+from services.demo_upstream import DemoOptionError, parse_demo_options, set_demo_options
+from services.compression import ResponseCompressionMiddleware
+from services.shutdown import ShutdownGuardMiddleware, shutdown_coordinator, run_server
+from services import tokenizer
+from services.stream_mode import resolve_stream_mode
+from services.capabilities import build_capabilities
+from services.model_mapping import is_valid_model, listed_models, accepted_model_names
+from services.image_input import inline_remote_images, ImageInputError
+from services.response_shape import resolve_response_shape, project_response, SHAPE_LEAN, RESPONSE_SHAPE_HEADER
+from services.token_calibration import calibrate
+from services.request_context import annotate_request, current_request_context
+from services.request_snapshot import client_request_source, preserve_original
+from services.debug_info import debug_http_exception_handler
+from services.stream_keepalive import keepalive_stream, claude_keepalive_frame, CLAUDE_FINAL_MARKER
+from services.upstream_network import load_upstream_network
+from services.request_validation import api_validation_exception_handler
+from services.accounting import RequestAccounting, OUTCOME_PROXY_ERROR, classify_status
+from services.block_limits import BlockLimitError
+from services.stream_outcome import StreamOutcome, StreamEndReason, track_stream, release_stream_resources
+from services.sse_writer import SSEResponse, StreamLifecycle
+from services.stream_timeouts import (
+    REQUEST_TIMEOUT_HEADER,
+    StreamTimeoutError,
+    start_request_deadline,
+    with_stream_timeouts,
+)
 from storage import init_db, close_db, AccountStore, get_db
 from register import task_manager, RegisterTask, auto_register, AutoRegisterOptions
 
 # Configure logging
-logging.basicConfig(level=logging.INFO)  # for dev
-# logging.basicConfig(level=logging.WARNING)
+logging.basicConfig(level=LOG_LEVEL)
 logger = logging.getLogger(__name__)
 
+# 进程启动时间，用于健康检查中的 uptime
+START_TIME = time.time()
+
 
 async def execute_register_task(task: RegisterTask) -> dict:
     """执行注册任务的回调函数"""
@@ -46,6 +107,26 @@ async def execute_register_task(task: RegisterTask) -> dict:
 @asynccontextmanager
 async def lifespan(app: FastAPI):
     """应用生命周期管理"""
+    # 过载保护的后台采样（没有配置阈值时不启动）
+    load_shedder.start()
+    # 加载用量快照并定期写入（没有设置 USAGE_STORE_PATH 时只在内存中统计）
+    usage_store.start()
+
+    if DEMO_MODE:
+        # 演示模式：不初始化数据库和账号，所有上游请求由内置假上游回显
+        logger.warning("=" * 60)
+        logger.warning("🎭 DEMO_MODE 已开启：使用内置假上游，不会访问 CodeWhisperer")
+        logger.warning("🎭 响应内容为请求回显，仅用于验证客户端集成")
+        logger.warning("=" * 60)
+        yield
+        await load_shedder.stop()
+        await usage_store.stop()
+        await asyncio.to_thread(request_journal.flush)
+        return
+    
+    # 校验上游地址和网络设置（静态地址映射 / TLS SNI 覆盖），配置错误时启动失败
+    load_upstream_network()
+
     # 启动时初始化数据库
     await init_db()
     logger.info("数据库连接已初始化")
@@ -55,7 +136,11 @@ async def lifespan(app: FastAPI):
     logger.info("注册任务管理器已初始化")
     
     yield
-    
+
+    await load_shedder.stop()
+    await usage_store.stop()
+    # 写完尚未落盘的审计日志
+    await asyncio.to_thread(request_journal.flush)
     # 关闭时清理数据库连接
     await close_db()
     logger.info("数据库连接已关闭")
@@ -77,6 +162,56 @@ app.add_middleware(
     allow_methods=["*"],
     allow_headers=["*"],
 )
+app.add_middleware(MaxBodySizeMiddleware)
+app.add_middleware(ShutdownGuardMiddleware)
+# 过载时拒绝新的生成请求（529）
+app.add_middleware(LoadShedMiddleware)
+# 在读取请求体之前按客户端 IP 限流
+app.add_middleware(IpRateLimitMiddleware)
+# Claude 接口：校验 anthropic-version、解析 anthropic-beta，响应回显 anthropic-version
+app.add_middleware(AnthropicHeadersMiddleware)
+# 带 X-Kiro-Debug 且有权限的请求，错误响应附带上游调用明细
+app.add_exception_handler(HTTPException, debug_http_exception_handler)
+app.add_exception_handler(RequestValidationError, api_validation_exception_handler)
+
+
+if DEMO_MODE:
+    @app.middleware("http")
+    async def mark_demo_response(request: Request, call_next):
+        """演示模式下为所有响应添加标记头；查询参数 tps / chunk / tool / seed 控制假上游的输出节奏"""
+        try:
+            set_demo_options(parse_demo_options(request.query_params))
+        except DemoOptionError as e:
+            error = respond_error(400, "invalid_demo_option", reason=e)
+            return JSONResponse(status_code=error.status_code, content={"detail": error.detail})
+        response = await call_next(request)
+        response.headers["X-Kiro-Demo"] = "true"
+        return response
+
+
+if METRICS_ENABLED:
+    app.add_middleware(MetricsMiddleware)
+    metrics_accounts_total.set_function(lambda: len(token_manager.configs))
+    metrics_available_accounts.set_function(token_manager.available_count)
+
+    @app.get("/metrics")
+    async def prometheus_metrics(authorization: str = Header(None)):
+        """Prometheus 指标（设置了 METRICS_TOKEN 时需要 Bearer 认证，不使用 API_KEY）"""
+        if METRICS_TOKEN and authorization != f"Bearer {METRICS_TOKEN}":
+            raise respond_error(401, "invalid_api_key")
+        return PlainTextResponse(metrics_registry.render(), media_type="text/plain; version=0.0.4")
+
+
+# 按 Accept-Encoding 压缩非流式 JSON 响应（SSE 不压缩），其他中间件直接返回的 JSON 错误同样压缩
+app.add_middleware(ResponseCompressionMiddleware)
+# 最后注册，作为最外层中间件，其他中间件直接返回的响应也会被记录
+app.add_middleware(AccessLogMiddleware)
+
+
+@app.get("/v1/capabilities")
+async def capabilities(api_key: str = Depends(verify_api_key)):
+    """当前部署支持的功能和限制"""
+    return build_capabilities()
 
 
 @app.get("/v1/models")
@@ -91,7 +226,7 @@ async def list_models(api_key: str = Depends(verify_api_key)):
                 "created": int(time.time()),
                 "owned_by": "ki2api"
             }
-            for model_id in MODEL_MAP.keys()
+            for model_id in listed_models()
         ]
     }
 
@@ -99,42 +234,176 @@ async def list_models(api_key: str = Depends(verify_api_key)):
 @app.post("/v1/chat/completions")
 async def create_chat_completion(
     request: ChatCompletionRequest,
-    api_key: str = Depends(verify_api_key)
+    http_request: Request,
+    api_key: str = Depends(require_capacity)
 ):
     """Create a chat completion"""
-    logger.info(f"📥 COMPLETE REQUEST: {request.model_dump_json(indent=2)}")
+    response = await run_chat_completion(request, http_request, api_key)
+    if isinstance(response, StreamingResponse):
+        return response
+    shape = resolve_response_shape(http_request.headers.get(RESPONSE_SHAPE_HEADER))
+    if shape == SHAPE_LEAN:
+        return project_response(response.model_dump(), shape)
+    return response
+
+
+@app.post("/v1/completions")
+async def create_completion(
+    request: CompletionRequest,
+    http_request: Request,
+    api_key: str = Depends(require_capacity)
+):
+    """旧版补全接口：prompt 转换为一条 user 消息后按聊天接口处理，响应改写为 text_completion"""
+    # 快照保存的是客户端发送的旧版请求
+    request = preserve_original(request)
+    try:
+        chat_request = to_chat_request(request)
+    except UnsupportedParameterError as e:
+        raise respond_error(400, "unsupported_parameter", param=e.param, param_name=e.param, reason=e.reason)
+    echo_prefix = chat_request.messages[0].content if request.echo else ""
+
+    response = await run_chat_completion(chat_request, http_request, api_key)
+    if isinstance(response, StreamingResponse):
+        response.body_iterator = text_completion_stream(response.body_iterator, echo_prefix)
+        return response
+    return to_text_completion(response, echo_prefix)
+
+
+def check_model(model: str, claude: bool = False):
+    """模型不在映射中时返回 400（claude 为 True 时使用 Claude 错误格式）；model 已经过 MODEL_ALIASES 改写"""
+    if is_valid_model(model):
+        return
+    available = ", ".join(accepted_model_names())
+    if claude:
+        raise respond_claude_error(400, "model_not_found", "invalid_request_error", model=model, available=available)
+    raise respond_error(400, "model_not_found", param="model", model=model, available=available)
+
+
+async def run_chat_completion(request: ChatCompletionRequest, http_request: Request, api_key: str):
+    """
+    聊天补全的公共处理：校验请求后按流式 / 非流式调用上游
+
+    返回 StreamingResponse 或 ChatCompletionResponse（响应形状由调用方决定）
+    """
+    # 后续步骤（例如改写远程图片）可能原地修改请求：处理深拷贝，客户端请求的快照保存在请求上下文中
+    request = preserve_original(request)
+    annotate_request(key_label=api_key_label(api_key))
+    logger.info(f"📥 COMPLETE REQUEST: {log_preview(request.model_dump_json(indent=2))}")
 
     # Validate messages have content
     for i, msg in enumerate(request.messages):
         if msg.content is None and msg.role != "assistant":
             logger.warning(f"Message {i} with role '{msg.role}' has None content")
 
-    if request.model not in MODEL_MAP:
-        raise HTTPException(
-            status_code=400,
-            detail={
-                "error": {
-                    "message": f"The model '{request.model}' does not exist or you do not have access to it.",
-                    "type": "invalid_request_error",
-                    "param": "model",
-                    "code": "model_not_found"
-                }
-            }
+    check_model(request.model)
+
+    # 校验 image_url 内容块，开启 IMAGE_URL_FETCH_ENABLED 时下载远程图片并改写为 data: URL
+    try:
+        await inline_remote_images(request)
+    except ImageInputError as e:
+        raise respond_error(400, e.code, param="messages", **e.params)
+
+    stream = resolve_stream_mode(bool(request.stream), http_request.headers.get("accept"))
+
+    # 上游无法实现的参数返回 400，可以安全忽略的参数记录警告后忽略（STRICT_OPENAI_PARAMS 时同样返回 400）
+    try:
+        validate_openai_params(request, stream=stream)
+    except UnsupportedParameterError as e:
+        raise respond_error(400, "unsupported_parameter", param=e.param, param_name=e.param, reason=e.reason)
+
+    # X-Conversation-Id 标识的对话沿用上一轮的上游 conversationId
+    conversation = conversation_key(api_key_label(api_key), http_request.headers.get(CONVERSATION_ID_HEADER))
+
+    # 上游时限：UPSTREAM_TIMEOUT，客户端可以用 X-Request-Timeout 缩短
+    try:
+        start_request_deadline(http_request.headers.get(REQUEST_TIMEOUT_HEADER))
+    except ValueError as e:
+        raise respond_error(
+            400, "invalid_request_timeout", param=REQUEST_TIMEOUT_HEADER,
+            value=http_request.headers.get(REQUEST_TIMEOUT_HEADER), reason=e,
         )
 
     # 根据请求类型调用相应的处理函数，实现真正的流式/非流式处理
-    if request.stream:
+    if stream:
         logger.info("🌊 使用真正的流式处理")
-        return await create_streaming_response(request)
+        try:
+            lease = stream_limiter.acquire(api_key)
+        except StreamLimitError as e:
+            raise respond_error(
+                429, "too_many_streams", "rate_limit_error", api_code="concurrent_stream_limit",
+                headers={"Retry-After": str(e.retry_after)}, active=e.active, limit=e.limit,
+            )
+        try:
+            return await create_streaming_response(request, http_request, lease, conversation)
+        except BaseException:
+            # 响应创建之前失败（例如请求校验不通过），名额不会交给 track_stream，在这里释放
+            lease.release()
+            raise
     else:
         logger.info("📄 使用非流式处理")
-        return await create_non_streaming_response(request)
+        if request.n and request.n > 1:
+            return await create_multi_choice_response(request, request.n)
+        return await create_non_streaming_response(request, conversation)
 
 
 @app.get("/health")
-async def health_check():
-    """Health check endpoint"""
-    return {"status": "healthy", "service": "Ki2API", "version": "3.2.0"}
+async def health_check(deep: bool = False):
+    """
+    健康检查（无需认证）
+
+    - ok: 有可用账号且最近一次 token 刷新成功
+    - degraded: 部分账号不可用，或最近一次刷新失败，或上游熔断器没有闭合，或过载保护正在拒绝请求
+    - down: 没有可用账号，或 deep=true 时上游不可达、取不到 token 或 token 被上游拒绝，或正在优雅关闭；
+      返回 503，便于负载均衡摘除
+    """
+    result = {
+        "status": "ok",
+        "service": "Ki2API",
+        "version": app.version,
+        "uptime_seconds": int(time.time() - START_TIME),
+        "demo_mode": DEMO_MODE,
+    }
+
+    if DEMO_MODE:
+        result["tokens"] = {"total": 1, "available": 1, "last_refresh": None}
+    else:
+        try:
+            await token_manager.initialize()
+            tokens = token_manager.get_health()
+        except Exception as e:
+            logger.error(f"健康检查时初始化 TokenManager 失败: {e}")
+            tokens = {"total": 0, "available": 0, "last_refresh": None, "error": str(e)}
+        result["tokens"] = tokens
+
+        if tokens["available"] == 0:
+            result["status"] = "down"
+        elif tokens["available"] < tokens["total"] or tokens["last_refresh"]["ok"] is False:
+            result["status"] = "degraded"
+
+    if upstream_breaker.enabled:
+        result["circuit_breaker"] = upstream_breaker.status()
+        if result["circuit_breaker"]["state"] != STATE_CLOSED and result["status"] == "ok":
+            result["status"] = "degraded"
+
+    if load_shedder.enabled:
+        result["load_shed"] = load_shedder.status()
+        if load_shedder.shedding and result["status"] == "ok":
+            result["status"] = "degraded"
+
+    if shutdown_coordinator.draining:
+        result["status"] = "down"
+        result["shutting_down"] = True
+
+    result["tokens_available"] = result["tokens"]["available"]
+
+    if deep:
+        upstream = await deep_probe_upstream(HEALTH_DEEP_TIMEOUT_SECONDS)
+        result["upstream"] = upstream
+        if not upstream["reachable"] or not upstream["token_available"] or upstream.get("token_usable") is False:
+            result["status"] = "down"
+
+    status_code = 503 if result["status"] == "down" else 200
+    return JSONResponse(status_code=status_code, content=result)
 
 
 @app.get("/v1/token/status")
@@ -146,6 +415,63 @@ async def token_status(api_key: str = Depends(verify_api_key)):
     }
 
 
+@app.get("/v1/usage")
+async def token_usage(api_key: str = Depends(verify_api_key)):
+    """各账号的剩余额度、最近刷新时间、过期时间和健康状态（只读，不消耗额度）"""
+    return {
+        "object": "usage",
+        **token_manager.get_usage(),
+    }
+
+
+@app.get("/admin/usage")
+async def admin_usage(
+    http_request: Request,
+    starting_at: str,
+    ending_at: str = None,
+    tz: str = None,
+    limit: int = DEFAULT_PAGE_DAYS,
+    page: str = None,
+    api_key: str = Depends(verify_admin_api_key),
+):
+    """
+    按天、Key 和模型汇总的用量报表（请求数、input / output token、估算费用）
+
+    区间为 [starting_at, ending_at)，按 tz 时区划分日期；按天分页，next_page 原样作为 page 传回。
+    Accept: text/csv 时返回 CSV，分页信息放在 X-Has-More / X-Next-Page 头中
+    """
+    try:
+        report = usage_store.daily_report(starting_at, ending_at, tz, limit, page)
+    except UsageQueryError as e:
+        raise respond_error(400, "invalid_usage_query", param=e.param, param_name=e.param, reason=e.reason)
+    if "text/csv" in http_request.headers.get("accept", ""):
+        headers = {"X-Has-More": str(report["has_more"]).lower()}
+        if report["next_page"]:
+            headers["X-Next-Page"] = report["next_page"]
+        return PlainTextResponse(report_to_csv(report), media_type="text/csv", headers=headers)
+    return report
+
+
+@app.post("/admin/refresh-token")
+async def admin_refresh_token(account: str = None, api_key: str = Depends(verify_admin_api_key)):
+    """
+    丢弃缓存的 access token 并立即刷新（refresh token 在外部轮换后，不必等缓存过期、期间一直返回 403）
+
+    account 为账号序号（从 0 开始）或账号名时只刷新该账号，否则刷新全部账号；
+    有账号刷新失败时返回 502，错误体中同样列出每个账号的结果
+    """
+    try:
+        results = await token_manager.force_refresh(account)
+    except UnknownAccountError:
+        raise respond_error(404, "account_not_found", param="account", account=account)
+    failed = [result["name"] for result in results if not result["ok"]]
+    if failed:
+        error = respond_error(502, "token_refresh_failed", "api_error", accounts=", ".join(failed))
+        error.detail["accounts"] = results
+        raise error
+    return {"object": "token_refresh", "accounts": results}
+
+
 @app.post("/v1/token/reset")
 async def reset_tokens(api_key: str = Depends(verify_api_key)):
     """重置所有 token 的耗尽状态"""
@@ -164,146 +490,327 @@ async def reset_tokens(api_key: str = Depends(verify_api_key)):
 @app.post("/v1/messages")
 async def create_message(
     request: ClaudeRequest,
-    api_key: str = Depends(verify_api_key)
+    http_request: Request,
+    api_key: str = Depends(require_capacity)
 ):
     """
     Claude API 兼容的消息创建端点
     参考 amazonq2api 模块实现
     """
-    logger.info(f"📥 收到 Claude API 请求: model={request.model}, stream={request.stream}")
-    logger.debug(f"📥 完整请求: {request.model_dump_json(indent=2)}")
+    context = current_request_context()
+    betas = context.anthropic_betas if context else None
+    logger.info(
+        f"📥 收到 Claude API 请求: model={request.model}, stream={request.stream}"
+        + (f", anthropic-beta={','.join(betas)}" if betas else "")
+    )
+    if logger.isEnabledFor(logging.DEBUG):
+        logger.debug(f"📥 完整请求: {log_preview(request.model_dump_json(indent=2))}")
     
+    # 处理深拷贝，客户端请求的快照保存在请求上下文中
+    request = preserve_original(request)
+    annotate_request(key_label=api_key_label(api_key))
+    check_model(request.model, claude=True)
+    # 请求体 stream 与 Accept 头协商后的最终响应方式，计量和响应都以它为准
+    stream = resolve_stream_mode(bool(request.stream), http_request.headers.get("accept"))
+    accounting = RequestAccounting("claude", request.model, stream=stream)
+    accounting.request_source = client_request_source(request)
+    lease = None
+    # X-Conversation-Id（优先）或 metadata.user_id 标识的对话沿用上一轮的上游 conversationId
+    conversation = conversation_key(
+        api_key_label(api_key),
+        http_request.headers.get(CONVERSATION_ID_HEADER) or (request.metadata or {}).get("user_id"),
+    )
     try:
+        # 上游时限：UPSTREAM_TIMEOUT，客户端可以用 X-Request-Timeout 缩短
+        try:
+            start_request_deadline(http_request.headers.get(REQUEST_TIMEOUT_HEADER))
+        except ValueError as e:
+            raise respond_claude_error(
+                400, "invalid_request_timeout", "invalid_request_error",
+                value=http_request.headers.get(REQUEST_TIMEOUT_HEADER), reason=e,
+            )
+
         # 转换为 CodeWhisperer 请求
-        codewhisperer_request = convert_claude_to_codewhisperer_request(request)
-        logger.debug(f"🔄 转换后的请求: {json.dumps(codewhisperer_request, indent=2, ensure_ascii=False)[:2000]}...")
+        try:
+            tool_names = build_tool_name_map([tool.name for tool in request.tools or []])
+        except ToolNameError as e:
+            raise respond_claude_error(400, "invalid_tool_name", "invalid_request_error", name=e.name, rule=e.rule)
+        try:
+            codewhisperer_request = convert_claude_to_codewhisperer_request(
+                request, tool_names, conversation_cache.lookup(conversation), conversation_cache.declared_tools(conversation)
+            )
+        except TrailingToolUseError as e:
+            raise respond_claude_error(400, "trailing_tool_use", "invalid_request_error", ids=", ".join(e.tool_use_ids))
+        except ToolChoiceError as e:
+            raise respond_claude_error(400, "invalid_tool_choice", "invalid_request_error", reason=e.reason)
+        if logger.isEnabledFor(logging.DEBUG):
+            logger.debug(f"🔄 转换后的请求: {json.dumps(codewhisperer_request, indent=2, ensure_ascii=False)[:2000]}...")
+
+        # 流式请求占用一个每 Key 并发名额，在获取 token 和请求上游之前检查
+        if stream:
+            try:
+                lease = stream_limiter.acquire(api_key)
+            except StreamLimitError as e:
+                raise respond_claude_error(
+                    429, "too_many_streams", "rate_limit_error",
+                    headers={"Retry-After": str(e.retry_after)}, active=e.active, limit=e.limit,
+                )
         
         # 获取 token
         token = await token_manager.get_token()
         if not token:
-            raise HTTPException(
-                status_code=401,
-                detail={
-                    "type": "error",
-                    "error": {
-                        "type": "authentication_error",
-                        "message": "No access token available. Please check your KIRO_AUTH_CONFIG configuration."
-                    }
-                }
-            )
-        
-        headers = {
-            "Authorization": f"Bearer {token}",
-            "Content-Type": "application/json",
-            "Accept": "text/event-stream"
-        }
+            raise claude_error_from_upstream(no_token_error())
         
+        outcome = StreamOutcome("claude", request.model, accounting, lease)
+        # 在返回响应之前复制请求信息，保活和写出只依赖 lifecycle
+        lifecycle = StreamLifecycle()
+        upstream = UpstreamStream(codewhisperer_request, token, accounting)
+
+        # 403 刷新重试和 429 切换账号都在这里完成；在返回 SSE 响应之前等待上游 200，
+        # 失败时可以返回带正确状态码的错误（例如限流返回 429 + Retry-After），而不是 200 里的 error 事件
+        try:
+            response = await upstream.open()
+        except UpstreamError as e:
+            await upstream.aclose()
+            raise claude_error_from_upstream(e)
+        except StreamTimeoutError as e:
+            # 超过上游时限时还没有写出任何数据（流式请求同样如此），返回 504
+            await upstream.aclose()
+            logger.error(f"⏱️ 上游超时: {e}")
+            raise respond_claude_error(504, "upstream_timeout", "timeout_error", seconds=e.seconds)
+        conversation_cache.remember(
+            conversation, codewhisperer_request["conversationState"]["conversationId"], claude_tool_fingerprints(request)
+        )
+
+        sample = request_sampler.start(
+            accounting.request_id, "claude", request.model_dump(exclude_none=True), codewhisperer_request
+        )
+
+        # 非流式响应：读完上游响应后用同一个流处理器汇总为一条消息
+        if not stream:
+            handler = ClaudeStreamHandler(request.model, request, tool_names)
+            annotate_request(message_id=handler.message_id)
+            accounting.response_source = handler.output_text
+            assembler = ClaudeMessageAssembler(handler)
+            try:
+                # 边接收边汇总，不保留原始响应体和中间的 SSE 事件；只受请求的上游时限约束
+                async for chunk in with_stream_timeouts(iter_response_bytes(response), 0, 0):
+                    if sample:
+                        sample.feed(chunk)
+                    for event in handler.handle_chunk(chunk):
+                        assembler.feed(event)
+                    if handler.should_stop:
+                        break
+                if sample and not handler.should_stop:
+                    sample.finish(response.status_code)
+                for event in handler.finalize():
+                    assembler.feed(event)
+            except StreamTimeoutError as e:
+                logger.error(f"⏱️ 上游超时: {e}")
+                raise respond_claude_error(504, "upstream_timeout", "timeout_error", seconds=e.seconds)
+            except BlockLimitError as e:
+                accounting.finish("error", outcome_class=OUTCOME_PROXY_ERROR)
+                raise respond_claude_error(502, "upstream_block_limit", "api_error", limit=e.limit, kind=e.kind)
+            except EventStreamErrorBudgetExhausted as e:
+                logger.error(f"❌ 上游响应无法解析: {e}")
+                raise respond_claude_error(502, "api_call_failed", "api_error", detail=str(e))
+            finally:
+                await upstream.aclose()
+
+            message = assembler.message
+            if logger.isEnabledFor(logging.DEBUG):
+                logger.debug(f"📤 非流式响应: {log_preview(json.dumps(message, ensure_ascii=False))}")
+            accounting.input_tokens = message["usage"]["input_tokens"]
+            accounting.output_tokens = message["usage"]["output_tokens"]
+            accounting.finish("ok")
+            return project_response(message, resolve_response_shape(http_request.headers.get(RESPONSE_SHAPE_HEADER)))
+
         # 流式响应
         async def generate_stream():
-            handler = ClaudeStreamHandler(request.model, request)
-            max_retries = 3
-            
-            timeout = httpx.Timeout(connect=30.0, read=None, write=30.0, pool=30.0)
+            handler = ClaudeStreamHandler(request.model, request, tool_names)
+            annotate_request(message_id=handler.message_id)
+            accounting.usage_source = lambda: (handler.input_tokens, handler.output_token_count())
+            accounting.response_source = handler.output_text
             
-            async with httpx.AsyncClient(timeout=timeout) as client:
-                current_headers = headers.copy()
+            try:
+                # 真正的流式处理；上游卡住时由 with_stream_timeouts 结束
+                async for chunk in with_stream_timeouts(iter_response_bytes(response)):
+                    if sample:
+                        sample.feed(chunk)
+                    for event in handler.handle_chunk(chunk):
+                        yield event
+                    if handler.max_tokens_reached:
+                        # 达到 max_tokens：不再读取上游，以 stop_reason=max_tokens 正常结束
+                        outcome.end(StreamEndReason.MAX_TOKENS_ENFORCED, f"max_tokens={request.max_tokens}")
+                        break
+                    if handler.stop_sequence_reached:
+                        # 命中 stop_sequences：不再读取上游，以 stop_reason=stop_sequence 正常结束
+                        outcome.end(StreamEndReason.STOP_SEQUENCE, f"stop_sequence={handler.stop_filter.matched!r}")
+                        break
+                if sample and not handler.should_stop:
+                    sample.finish(response.status_code)
                 
-                for attempt in range(max_retries):
-                    try:
-                        async with client.stream(
-                            "POST",
-                            KIRO_BASE_URL,
-                            headers=current_headers,
-                            json=codewhisperer_request
-                        ) as response:
-                            logger.info(f"📤 STREAM RESPONSE STATUS: {response.status_code} (attempt {attempt + 1})")
-                            
-                            # 处理 403 - 刷新 token 并重试
-                            if response.status_code == 403 and attempt < max_retries - 1:
-                                logger.info("收到403响应，尝试刷新token...")
-                                new_token = await token_manager.refresh_tokens()
-                                if new_token:
-                                    current_headers["Authorization"] = f"Bearer {new_token}"
-                                    continue
-                                else:
-                                    token_manager.mark_token_error()
-                                    new_token = await token_manager.get_token()
-                                    if new_token:
-                                        current_headers["Authorization"] = f"Bearer {new_token}"
-                                        continue
-                                    yield f'event: error\ndata: {{"type":"error","error":{{"type":"authentication_error","message":"Token refresh failed"}}}}\n\n'
-                                    return
-                            
-                            # 处理 429 - 速率限制
-                            if response.status_code == 429:
-                                logger.warning("收到429响应（速率限制），尝试切换账号...")
-                                token_manager.mark_token_exhausted("rate_limit_429")
-                                
-                                if attempt < max_retries - 1:
-                                    new_token = await token_manager.get_token()
-                                    if new_token:
-                                        current_headers["Authorization"] = f"Bearer {new_token}"
-                                        logger.info("已切换到新账号，重试请求...")
-                                        continue
-                                
-                                yield f'event: error\ndata: {{"type":"error","error":{{"type":"rate_limit_error","message":"All accounts rate limited. Please try again later."}}}}\n\n'
-                                return
-                            
-                            if response.status_code != 200:
-                                error_text = await response.aread()
-                                logger.error(f"API 错误: {response.status_code} - {error_text}")
-                                yield f'event: error\ndata: {{"type":"error","error":{{"type":"api_error","message":"API error: {response.status_code}"}}}}\n\n'
-                                return
-                            
-                            # 真正的流式处理
-                            async for chunk in response.aiter_bytes():
-                                for event in handler.handle_chunk(chunk):
-                                    yield event
-                            
-                            # 发送收尾事件
-                            for event in handler.finalize():
-                                yield event
-                            
-                            return  # 成功完成
-                    
-                    except httpx.HTTPStatusError as e:
-                        logger.error(f"HTTP ERROR in stream: {e}")
-                        yield f'event: error\ndata: {{"type":"error","error":{{"type":"api_error","message":"{str(e)}"}}}}\n\n'
-                        return
-                    except Exception as e:
-                        logger.error(f"Stream error: {e}")
-                        import traceback
-                        traceback.print_exc()
-                        yield f'event: error\ndata: {{"type":"error","error":{{"type":"internal_error","message":"{str(e)}"}}}}\n\n'
-                        return
+                # 发送收尾事件
+                for event in handler.finalize():
+                    yield event
+            
+            except StreamTimeoutError as e:
+                logger.error(f"⏱️ Stream timeout: {e}")
+                outcome.end(e.end_reason, str(e))
+                for event in handler.abort("timeout_error", str(e)):
+                    yield event
+            except BlockLimitError as e:
+                # 上游发出过多的内容块或工具调用：不再读取上游，以 error 事件结束
+                outcome.end(
+                    StreamEndReason.BLOCK_LIMIT, f"{e} (content_blocks={e.blocks}, tool_calls={e.tool_calls})"
+                )
+                for event in handler.abort("api_error", str(e)):
+                    yield event
+            except EventStreamErrorBudgetExhausted as e:
+                # 上游数据连续无法解析：不再读取上游，以 error 事件结束
+                logger.error(f"❌ Stream error: {e}")
+                outcome.end(StreamEndReason.ERROR_BUDGET_EXHAUSTED, str(e))
+                for event in handler.abort("api_error", str(e)):
+                    yield event
+            except httpx.HTTPStatusError as e:
+                logger.error(f"HTTP ERROR in stream: {e}")
+                outcome.end(StreamEndReason.UPSTREAM_ERROR, str(e))
+                # 之前可能还没有发出 message_start：由 handler 补齐事件序列再报告错误
+                for event in handler.abort("api_error", str(e), stream_error_stop_reason(e)):
+                    yield event
+            except Exception as e:
+                logger.error(f"Stream error: {e}")
+                import traceback
+                traceback.print_exc()
+                outcome.end(StreamEndReason.UPSTREAM_ERROR, str(e))
+                for event in handler.abort("internal_error", str(e), stream_error_stop_reason(e)):
+                    yield event
+            finally:
+                await upstream.aclose()
         
-        return StreamingResponse(
-            generate_stream(),
+        return SSEResponse(
+            track_stream(
+                keepalive_stream(
+                    generate_stream(), claude_keepalive_frame(), CLAUDE_FINAL_MARKER, lifecycle=lifecycle
+                ),
+                outcome, http_request,
+            ),
+            outcome=outcome,
+            lifecycle=lifecycle,
             media_type="text/event-stream",
             headers={
                 "Cache-Control": "no-cache",
                 "Connection": "keep-alive",
                 "Content-Type": "text/event-stream",
                 "X-Accel-Buffering": "no"
-            }
+            },
+            background=BackgroundTask(release_stream_resources, outcome, upstream),
         )
     
-    except HTTPException:
+    except HTTPException as e:
+        if lease:
+            lease.release()
+        accounting.finish("error", outcome_class=classify_status(e.status_code))
         raise
     except Exception as e:
+        if lease:
+            lease.release()
+        accounting.finish("error", outcome_class=OUTCOME_PROXY_ERROR)
         logger.error(f"处理请求时发生错误: {e}")
         import traceback
         traceback.print_exc()
-        raise HTTPException(
-            status_code=500,
-            detail={
-                "type": "error",
-                "error": {
-                    "type": "internal_error",
-                    "message": f"Internal server error: {str(e)}"
-                }
-            }
-        )
+        raise respond_claude_error(500, "internal_error", "internal_error", detail=str(e))
+
+
+@app.post("/v1/messages/count_tokens")
+async def count_message_tokens(
+    request: ClaudeRequest,
+    http_request: Request,
+    api_key: str = Depends(verify_api_key)
+):
+    """
+    Claude API 兼容的 token 计数端点
+    计数后端由 TOKENIZER_BACKEND 决定：默认粗略估算，配置 BPE 编码时精确分词。
+    与 /v1/messages 一样按 X-Conversation-Id / metadata.user_id 找到对话，开启工具压缩时已声明过的工具按压缩后的定义计数
+    """
+    check_model(request.model, claude=True)
+    conversation = conversation_key(
+        api_key_label(api_key),
+        http_request.headers.get(CONVERSATION_ID_HEADER) or (request.metadata or {}).get("user_id"),
+    )
+    estimate = estimate_input_token_breakdown(request, conversation_cache.declared_tools(conversation))
+    logger.info(
+        f"🔢 count_tokens: model={request.model}, input_tokens={estimate.input_tokens}"
+        + (f", cache_read_input_tokens={estimate.cache_read_input_tokens}" if estimate.has_cache_control else "")
+    )
+    result = {"input_tokens": estimate.input_tokens}
+    if estimate.has_cache_control:
+        # 带 cache_control 时区分可缓存的前缀（按缓存已写入估算）和其余输入；input_tokens 仍为总数
+        result["cache_read_input_tokens"] = estimate.cache_read_input_tokens
+        result["uncached_input_tokens"] = estimate.uncached_input_tokens
+    return result
+
+
+@app.post("/v1/chat/completions/count_tokens")
+async def count_chat_tokens(
+    request: ChatCompletionRequest,
+    http_request: Request,
+    api_key: str = Depends(verify_api_key)
+):
+    """
+    OpenAI 格式的 token 计数端点
+    请求体与 /v1/chat/completions 相同，转换为 Claude 请求后与 /v1/messages/count_tokens 共用估算逻辑
+    """
+    check_model(request.model)
+    conversation = conversation_key(api_key_label(api_key), http_request.headers.get(CONVERSATION_ID_HEADER))
+    try:
+        input_tokens = estimate_input_token_breakdown(
+            convert_openai_to_claude_request(request), conversation_cache.declared_tools(conversation)
+        ).input_tokens
+    except ToolChoiceError as e:
+        raise respond_error(400, "invalid_tool_choice", param="tool_choice", reason=e.reason)
+    logger.info(f"🔢 chat count_tokens: model={request.model}, input_tokens={input_tokens}")
+    return {"object": "token_count", "model": request.model, "input_tokens": input_tokens}
+
+
+# ============================================================================
+# Token 估算校准端点
+# ============================================================================
+
+from pydantic import BaseModel, Field
+from typing import List
+
+
+class CalibrationSample(BaseModel):
+    """校准样本：文本及其真实 token 数"""
+    text: str
+    expected_tokens: int = Field(ge=0)
+
+
+class CalibrationRequest(BaseModel):
+    """校准请求"""
+    samples: List[CalibrationSample] = Field(min_length=1)
+    apply: bool = False  # 为 true 时立即在运行时应用建议参数（重启后恢复默认）
+
+
+@app.post("/admin/tokenizer/calibrate")
+async def calibrate_tokenizer(
+    request: CalibrationRequest,
+    api_key: str = Depends(verify_admin_api_key)
+):
+    """
+    用已知 token 数的语料评估粗略估算的误差
+    返回逐条误差、整体 MAPE 以及按字符类别（latin / cjk / code）拟合的建议参数；
+    apply 会改变所有 Key 的 token 计数，因此只接受 ADMIN_API_KEY
+    """
+    result = calibrate([sample.model_dump() for sample in request.samples], tokenizer.estimator_multipliers)
+    suggested = result.pop("suggested")
+    result["applied"] = False
+    if request.apply:
+        tokenizer.estimator_multipliers = suggested
+        result["applied"] = True
+        logger.warning(f"🔢 已应用新的 token 估算参数: {vars(suggested)}")
+    return result
 
 
 # ============================================================================
@@ -369,7 +876,7 @@ async def get_account_detail(
     account = await store.find_by_id(account_id)
 
     if not account:
-        raise HTTPException(status_code=404, detail="账号不存在")
+        raise HTTPException(status_code=404, detail=localize("account_not_found"))
 
     return {
         "success": True,
@@ -448,7 +955,7 @@ async def update_account(
     )
 
     if not account:
-        raise HTTPException(status_code=404, detail="账号不存在")
+        raise HTTPException(status_code=404, detail=localize("account_not_found"))
 
     return {
         "success": True,
@@ -471,7 +978,7 @@ async def delete_account(
     deleted = await store.delete(account_id)
 
     if not deleted:
-        raise HTTPException(status_code=404, detail="账号不存在")
+        raise HTTPException(status_code=404, detail=localize("account_not_found"))
 
     return {
         "success": True,
@@ -505,7 +1012,7 @@ async def create_register_task(request: CreateRegisterTaskRequest):
     if not config.gptmail:
         raise HTTPException(
             status_code=400,
-            detail="未配置 GPTMail API，无法使用自动注册功能。请设置 GPTMAIL_API_KEY 环境变量。"
+            detail=localize("gptmail_not_configured")
         )
     
     from register.task_manager import RegisterTaskOptions
@@ -534,7 +1041,7 @@ async def get_register_task(task_id: str):
     task = task_manager.get_task(task_id)
     
     if not task:
-        raise HTTPException(status_code=404, detail="任务不存在")
+        raise HTTPException(status_code=404, detail=localize("task_not_found"))
     
     return {
         "success": True,
@@ -554,7 +1061,7 @@ async def get_register_task_logs(task_id: str, request: Request):
     task = task_manager.get_task(task_id)
     
     if not task:
-        raise HTTPException(status_code=404, detail="任务不存在")
+        raise HTTPException(status_code=404, detail=localize("task_not_found"))
     
     # 检查是否请求 SSE
     accept = request.headers.get("accept", "")
@@ -677,18 +1184,18 @@ async def cancel_register_task(task_id: str):
     task = task_manager.get_task(task_id)
     
     if not task:
-        raise HTTPException(status_code=404, detail="任务不存在")
+        raise HTTPException(status_code=404, detail=localize("task_not_found"))
     
     if task.status.value == "running":
-        raise HTTPException(status_code=400, detail="无法取消正在运行的任务")
+        raise HTTPException(status_code=400, detail=localize("task_running"))
     
     if task.status.value in ("completed", "failed"):
-        raise HTTPException(status_code=400, detail="任务已结束，无法取消")
+        raise HTTPException(status_code=400, detail=localize("task_finished"))
     
     success = task_manager.cancel_task(task_id)
     
     if not success:
-        raise HTTPException(status_code=400, detail="取消任务失败")
+        raise HTTPException(status_code=400, detail=localize("task_cancel_failed"))
     
     return {
         "success": True,
@@ -705,8 +1212,11 @@ async def root():
         "version": "4.0.0",
         "endpoints": {
             "models": "/v1/models",
+            "capabilities": "/v1/capabilities",
             "chat": "/v1/chat/completions",
             "messages": "/v1/messages",
+            "count_tokens": "/v1/messages/count_tokens",
+            "chat_count_tokens": "/v1/chat/completions/count_tokens",
             "health": "/health",
             "token_status": "/v1/token/status",
             "token_reset": "/v1/token/reset",
@@ -732,5 +1242,4 @@ async def root():
 
 
 if __name__ == "__main__":
-    import uvicorn
-    uvicorn.run(app, host="0.0.0.0", port=8989)
+    run_server(app, host="0.0.0.0", port=8989)
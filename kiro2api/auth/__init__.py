@@ -1,9 +1,19 @@
-from .api_key import verify_api_key
+from .api_key import verify_api_key, verify_admin_api_key
 from .token_manager import TokenManager, MultiAccountTokenManager, token_manager
 from .config import AuthConfig, load_auth_configs
+from .capacity import require_capacity
+from .stream_limits import stream_limiter, StreamLimitError, StreamLease
+from .rate_limits import rate_limiter, RateLimitExceeded
 
 __all__ = [
     "verify_api_key",
+    "verify_admin_api_key",
+    "require_capacity",
+    "stream_limiter",
+    "StreamLimitError",
+    "StreamLease",
+    "rate_limiter",
+    "RateLimitExceeded",
     "TokenManager",
     "MultiAccountTokenManager",
     "token_manager",
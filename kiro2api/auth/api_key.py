@@ -1,46 +1,54 @@
-from fastapi import Header, HTTPException
+from typing import Optional
 
-from config import API_KEY
+from fastapi import Header, Request
 
+from config import API_KEY, PRIORITY_API_KEYS, ADMIN_API_KEY
+from errors import respond_error
+from .audit import emit_auth_event, DECISION_ACCEPTED, DECISION_REJECTED
 
-async def verify_api_key(authorization: str = Header(None)):
+
+def api_key_label(api_key: str) -> Optional[str]:
+    """Key 在配置中的标签（default / priority-N），用于审计，不暴露 Key 本身"""
+    if api_key == API_KEY:
+        return "default"
+    if api_key in PRIORITY_API_KEYS:
+        return f"priority-{PRIORITY_API_KEYS.index(api_key) + 1}"
+    return None
+
+
+async def verify_api_key(request: Request, authorization: str = Header(None)):
     if not authorization:
-        raise HTTPException(
-            status_code=401,
-            detail={
-                "error": {
-                    "message": "You didn't provide an API key.",
-                    "type": "invalid_request_error",
-                    "param": None,
-                    "code": "invalid_api_key"
-                }
-            }
-        )
+        emit_auth_event(request, DECISION_REJECTED, "missing_api_key")
+        raise respond_error(401, "missing_api_key", api_code="invalid_api_key")
     
     if not authorization.startswith("Bearer "):
-        raise HTTPException(
-            status_code=401,
-            detail={
-                "error": {
-                    "message": "Invalid API key format. Expected 'Bearer <key>'",
-                    "type": "invalid_request_error",
-                    "param": None,
-                    "code": "invalid_api_key"
-                }
-            }
-        )
+        emit_auth_event(request, DECISION_REJECTED, "invalid_api_key_format")
+        raise respond_error(401, "invalid_api_key_format", api_code="invalid_api_key")
     
     api_key = authorization.replace("Bearer ", "")
-    if api_key != API_KEY:
-        raise HTTPException(
-            status_code=401,
-            detail={
-                "error": {
-                    "message": "Invalid API key provided",
-                    "type": "invalid_request_error",
-                    "param": None,
-                    "code": "invalid_api_key"
-                }
-            }
-        )
+    label = api_key_label(api_key)
+    if label is None:
+        emit_auth_event(request, DECISION_REJECTED, "invalid_api_key", api_key=api_key)
+        raise respond_error(401, "invalid_api_key")
+    emit_auth_event(request, DECISION_ACCEPTED, "ok", key_label=label)
+    return api_key
+
+
+async def verify_admin_api_key(request: Request, authorization: str = Header(None)):
+    """管理端点的认证：只接受 ADMIN_API_KEY，没有配置时管理端点不可用"""
+    if not ADMIN_API_KEY:
+        emit_auth_event(request, DECISION_REJECTED, "admin_api_key_not_configured")
+        raise respond_error(403, "admin_api_key_not_configured")
+    if not authorization:
+        emit_auth_event(request, DECISION_REJECTED, "missing_api_key")
+        raise respond_error(401, "missing_api_key", api_code="invalid_api_key")
+    if not authorization.startswith("Bearer "):
+        emit_auth_event(request, DECISION_REJECTED, "invalid_api_key_format")
+        raise respond_error(401, "invalid_api_key_format", api_code="invalid_api_key")
+
+    api_key = authorization.replace("Bearer ", "")
+    if api_key != ADMIN_API_KEY:
+        emit_auth_event(request, DECISION_REJECTED, "invalid_admin_api_key", api_key=api_key)
+        raise respond_error(401, "invalid_admin_api_key", api_code="invalid_api_key")
+    emit_auth_event(request, DECISION_ACCEPTED, "ok", key_label="admin")
     return api_key
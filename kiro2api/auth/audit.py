@@ -0,0 +1,126 @@
+"""
+认证审计事件
+每一次 API Key 校验（通过或拒绝）都生成一条结构化审计事件，发送到独立的审计 sink，与普通日志分开，
+便于安全团队留存和做入侵检测。事件中不包含 Key 本身：通过时记录匹配到的 Key 标签，拒绝时记录 Key 的短指纹
+
+- log（默认）: 以 JSON 写入名为 kiro2api.audit 的 logger（INFO 级别），可单独配置 handler
+- file: 逐行追加 JSON 到 AUTH_AUDIT_FILE
+- none: 不记录
+也可以在运行时用 set_audit_sink() 替换为自定义实现
+"""
+
+import json
+import hashlib
+import logging
+import threading
+from dataclasses import dataclass, asdict, field
+from datetime import datetime, timezone
+from typing import Optional, Protocol
+
+from fastapi import Request
+
+from config import AUTH_AUDIT_SINK, AUTH_AUDIT_FILE
+
+logger = logging.getLogger(__name__)
+audit_logger = logging.getLogger("kiro2api.audit")
+
+DECISION_ACCEPTED = "accepted"
+DECISION_REJECTED = "rejected"
+
+
+@dataclass
+class AuthAuditEvent:
+    decision: str
+    reason: str
+    path: str
+    method: str
+    client_ip: Optional[str]
+    key_label: Optional[str] = None
+    key_fingerprint: Optional[str] = None
+    forwarded_for: Optional[str] = None
+    user_agent: Optional[str] = None
+    timestamp: str = field(default_factory=lambda: datetime.now(timezone.utc).isoformat())
+
+    def to_json(self) -> str:
+        return json.dumps(asdict(self), ensure_ascii=False)
+
+
+class AuditSink(Protocol):
+    def emit(self, event: AuthAuditEvent) -> None: ...
+
+
+class LoggingAuditSink:
+    """写入 kiro2api.audit logger"""
+
+    def emit(self, event: AuthAuditEvent) -> None:
+        audit_logger.info(event.to_json())
+
+
+class JsonlFileAuditSink:
+    """逐行追加 JSON 到文件"""
+
+    def __init__(self, path: str):
+        self.path = path
+        self._lock = threading.Lock()
+
+    def emit(self, event: AuthAuditEvent) -> None:
+        line = event.to_json() + "\n"
+        with self._lock:
+            with open(self.path, "a", encoding="utf-8") as f:
+                f.write(line)
+
+
+class NullAuditSink:
+    def emit(self, event: AuthAuditEvent) -> None:
+        pass
+
+
+def create_audit_sink(kind: str = AUTH_AUDIT_SINK) -> AuditSink:
+    if kind == "file":
+        return JsonlFileAuditSink(AUTH_AUDIT_FILE)
+    if kind == "none":
+        return NullAuditSink()
+    if kind != "log":
+        logger.warning(f"⚠️ 未知的 AUTH_AUDIT_SINK={kind}，使用 log")
+    return LoggingAuditSink()
+
+
+_sink: AuditSink = create_audit_sink()
+
+
+def set_audit_sink(sink: AuditSink):
+    """替换审计 sink（例如接入外部 SIEM）"""
+    global _sink
+    _sink = sink
+
+
+def key_fingerprint(api_key: str) -> str:
+    """Key 的短指纹，用于关联同一个错误 Key 的多次尝试，无法还原出 Key"""
+    return hashlib.sha256(api_key.encode("utf-8")).hexdigest()[:12]
+
+
+def emit_auth_event(
+    request: Optional[Request],
+    decision: str,
+    reason: str,
+    key_label: Optional[str] = None,
+    api_key: Optional[str] = None,
+):
+    """生成并发送一条认证审计事件，sink 出错不影响请求处理"""
+    headers = request.headers if request is not None else {}
+    client = getattr(request, "client", None) if request is not None else None
+    event = AuthAuditEvent(
+        decision=decision,
+        reason=reason,
+        path=request.url.path if request is not None else "",
+        method=request.method if request is not None else "",
+        client_ip=client.host if client else None,
+        key_label=key_label,
+        key_fingerprint=key_fingerprint(api_key) if api_key and decision == DECISION_REJECTED else None,
+        forwarded_for=headers.get("x-forwarded-for"),
+        user_agent=headers.get("user-agent"),
+    )
+    try:
+        _sink.emit(event)
+    except Exception as e:
+        logger.warning(f"写入认证审计事件失败: {e}")
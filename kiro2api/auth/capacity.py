@@ -0,0 +1,40 @@
+"""
+容量保留
+可用账号数低于 MIN_AVAILABLE_ACCOUNTS 时拒绝普通请求，只放行 PRIORITY_API_KEYS 中的 Key，
+为关键流量保留剩余的账号；同时执行每个 Key 的请求速率限制（RATE_LIMIT_RPM，优先级 Key 同样受限）
+"""
+
+import logging
+
+from fastapi import Header, Request
+
+from config import DEMO_MODE, MIN_AVAILABLE_ACCOUNTS, PRIORITY_API_KEYS
+from errors import respond_error
+from .api_key import verify_api_key
+from .rate_limits import rate_limiter, RateLimitExceeded
+from .token_manager import token_manager
+
+logger = logging.getLogger(__name__)
+
+
+async def require_capacity(request: Request, authorization: str = Header(None)) -> str:
+    """在 verify_api_key 的基础上检查请求速率和可用账号数，用于会消耗上游额度的端点"""
+    api_key = await verify_api_key(request, authorization)
+    try:
+        rate_limiter.check(api_key)
+    except RateLimitExceeded as e:
+        raise respond_error(
+            429, "key_rate_limited", "rate_limit_error", api_code="rate_limited",
+            headers={"Retry-After": str(e.retry_after)}, limit=e.limit, retry_after=e.retry_after,
+        )
+    if MIN_AVAILABLE_ACCOUNTS <= 0 or DEMO_MODE or api_key in PRIORITY_API_KEYS:
+        return api_key
+
+    available = token_manager.available_count()
+    if available < MIN_AVAILABLE_ACCOUNTS:
+        logger.warning(f"⚠️ 可用账号 {available} 低于保留下限 {MIN_AVAILABLE_ACCOUNTS}，拒绝非优先级请求")
+        raise respond_error(
+            503, "capacity_reserved", "api_error",
+            available=available, minimum=MIN_AVAILABLE_ACCOUNTS,
+        )
+    return api_key
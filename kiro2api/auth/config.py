@@ -21,6 +21,7 @@ class AuthConfig:
     account_type: str = "kiro"  # 账号类型: "kiro" 或 "amazonq"
     client_id: Optional[str] = None  # Amazon Q 账号需要
     client_secret: Optional[str] = None  # Amazon Q 账号需要
+    quota: Optional[int] = None  # 可选的请求额度（次数），用尽后不再选择，重置 token 状态时恢复；为空表示不限
 
     def __post_init__(self):
         if not self.refresh_token:
@@ -119,15 +120,19 @@ def _parse_single_config(item: dict, index: int) -> Optional[AuthConfig]:
     access_token = item.get("accessToken") or item.get("access_token")
     disabled = item.get("disabled", False)
     name = item.get("name", f"account_{index + 1}")
+    quota = item.get("quota")
     
     if not refresh_token:
         raise ValueError("refreshToken 是必需的")
+    if quota is not None and (not isinstance(quota, int) or quota < 0):
+        raise ValueError("quota 必须是非负整数")
     
     return AuthConfig(
         refresh_token=refresh_token,
         access_token=access_token,
         disabled=disabled,
-        name=name
+        name=name,
+        quota=quota,
     )
 
 
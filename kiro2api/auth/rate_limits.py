@@ -0,0 +1,112 @@
+"""
+每个 API Key 的请求速率限制
+避免团队共用代理时单个 Key 用光所有账号的额度：每个 Key 一个令牌桶，容量为 RATE_LIMIT_RPM，
+按每分钟 RATE_LIMIT_RPM 个的速度补充，没有令牌时返回 429 并在 Retry-After 中给出下一个令牌的到达时间
+
+与 stream_limits 一样按 Key 的标签（default / priority-N）计数，不保存 Key 本身；令牌桶补满后即与新建的桶等价，
+定期清理这类桶，Key 变化频繁时内存也不会持续增长。流式请求的并发数由 stream_limits 限制
+
+令牌桶本身（TokenBucketLimiter）与键无关，按客户端 IP 的限流（services/ip_rate_limit.py）同样使用它
+"""
+
+import math
+import time
+import logging
+from typing import Callable, Dict, Optional, Tuple
+
+from config import RATE_LIMIT_RPM
+from .api_key import api_key_label
+
+logger = logging.getLogger(__name__)
+
+# 清理已补满的令牌桶的最小间隔（秒）
+CLEANUP_INTERVAL_SECONDS = 60
+
+
+class RateLimitExceeded(Exception):
+    """该 Key 的请求速率已达上限"""
+
+    def __init__(self, limit: int, retry_after: int):
+        super().__init__(f"rate limit {limit}/min exceeded, retry after {retry_after}s")
+        self.limit = limit
+        self.retry_after = retry_after
+
+
+class TokenBucketLimiter:
+    """
+    按键（Key 标签、客户端 IP 等）分桶的令牌桶：容量为 burst，每分钟补充 rate_per_minute 个令牌
+
+    check / take 中没有 await，在同一个事件循环里的并发请求之间是原子的
+    """
+
+    def __init__(self, rate_per_minute: int, burst: int = 0, clock: Callable[[], float] = time.monotonic):
+        self.rate_per_minute = rate_per_minute
+        # burst <= 0 时与每分钟的速率相同
+        self.burst = burst if burst > 0 else rate_per_minute
+        self._clock = clock
+        # 键 -> (剩余令牌数, 上次补充时间)
+        self.buckets: Dict[str, Tuple[float, float]] = {}
+        self._last_cleanup = clock()
+
+    @property
+    def enabled(self) -> bool:
+        return self.rate_per_minute > 0
+
+    def _refill(self, tokens: float, updated: float, now: float) -> float:
+        return min(float(self.burst), tokens + (now - updated) * self.rate_per_minute / 60.0)
+
+    def _cleanup(self, now: float):
+        """移除已经补满的令牌桶（与不存在等价，即一段时间没有请求的键）"""
+        if now - self._last_cleanup < CLEANUP_INTERVAL_SECONDS:
+            return
+        self._last_cleanup = now
+        for key, (tokens, updated) in list(self.buckets.items()):
+            if self._refill(tokens, updated, now) >= self.burst:
+                del self.buckets[key]
+
+    def take(self, key: str) -> Optional[int]:
+        """消耗一个令牌；成功时返回 None，没有令牌时返回下一个令牌到达前的秒数"""
+        if not self.enabled:
+            return None
+        now = self._clock()
+        self._cleanup(now)
+        tokens, updated = self.buckets.get(key, (float(self.burst), now))
+        tokens = self._refill(tokens, updated, now)
+        if tokens < 1:
+            self.buckets[key] = (tokens, now)
+            return max(1, math.ceil((1 - tokens) * 60.0 / self.rate_per_minute))
+        self.buckets[key] = (tokens - 1, now)
+        return None
+
+    def available(self, key: str) -> Optional[int]:
+        """该键当前可用的请求数，不限制时返回 None"""
+        if not self.enabled:
+            return None
+        now = self._clock()
+        tokens, updated = self.buckets.get(key, (float(self.burst), now))
+        return int(self._refill(tokens, updated, now))
+
+
+class KeyRateLimiter(TokenBucketLimiter):
+    def __init__(self, rpm: int = RATE_LIMIT_RPM, clock: Callable[[], float] = time.monotonic):
+        super().__init__(rpm, rpm, clock)
+
+    @property
+    def rpm(self) -> int:
+        return self.rate_per_minute
+
+    def check(self, api_key: str):
+        """消耗一个令牌，没有令牌时抛出 RateLimitExceeded；rpm <= 0 时不限制"""
+        key = api_key_label(api_key) or "unknown"
+        retry_after = self.take(key)
+        if retry_after is not None:
+            logger.warning(f"⚠️ Key {key} 的请求速率已达上限 {self.rpm}/min，{retry_after} 秒后可重试")
+            raise RateLimitExceeded(self.rpm, retry_after)
+
+    def remaining(self, api_key: str) -> Optional[int]:
+        """该 Key 当前可用的请求数，不限制时返回 None"""
+        return self.available(api_key_label(api_key) or "unknown")
+
+
+# 全局单例
+rate_limiter = KeyRateLimiter()
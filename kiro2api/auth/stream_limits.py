@@ -0,0 +1,77 @@
+"""
+每个 API Key 的并发流数限制
+避免单个 Key 同时打开大量流式请求占满账号，超过 MAX_CONCURRENT_STREAMS_PER_KEY 时返回 429；非流式请求不受限制
+
+按 Key 的标签（default / priority-N）计数，不保存 Key 本身。获取到的 StreamLease 随流一起传给 track_stream，
+流从任何路径结束时释放；release() 可以重复调用，兜底清理和 finally 都可以安全地调用
+"""
+
+import logging
+from typing import Dict, Optional
+
+from config import MAX_CONCURRENT_STREAMS_PER_KEY
+from .api_key import api_key_label
+
+logger = logging.getLogger(__name__)
+
+
+# 并发流数超限时建议的重试间隔（秒）；无法预知已有的流何时结束，给出一个较短的固定值
+STREAM_LIMIT_RETRY_AFTER_SECONDS = 1
+
+
+class StreamLimitError(Exception):
+    """该 Key 的并发流数已达上限"""
+
+    def __init__(self, active: int, limit: int):
+        super().__init__(f"{active} active streams, limit {limit}")
+        self.active = active
+        self.limit = limit
+        self.retry_after = STREAM_LIMIT_RETRY_AFTER_SECONDS
+
+
+class StreamLease:
+    """一个流占用的并发名额"""
+
+    def __init__(self, limiter: Optional["StreamConcurrencyLimiter"], key: str):
+        self._limiter = limiter
+        self.key = key
+        self.released = False
+
+    def release(self):
+        if self.released:
+            return
+        self.released = True
+        if self._limiter:
+            self._limiter._release(self.key)
+
+
+class StreamConcurrencyLimiter:
+    def __init__(self, limit: int = MAX_CONCURRENT_STREAMS_PER_KEY):
+        self.limit = limit
+        self.active: Dict[str, int] = {}
+
+    def acquire(self, api_key: str) -> StreamLease:
+        """占用一个并发名额，已达上限时抛出 StreamLimitError；limit <= 0 时不限制"""
+        key = api_key_label(api_key) or "unknown"
+        if self.limit <= 0:
+            return StreamLease(None, key)
+        active = self.active.get(key, 0)
+        if active >= self.limit:
+            logger.warning(f"⚠️ Key {key} 的并发流数已达上限: {active}/{self.limit}")
+            raise StreamLimitError(active, self.limit)
+        self.active[key] = active + 1
+        return StreamLease(self, key)
+
+    def _release(self, key: str):
+        remaining = self.active.get(key, 0) - 1
+        if remaining > 0:
+            self.active[key] = remaining
+        else:
+            self.active.pop(key, None)
+
+    def active_streams(self, api_key: str) -> int:
+        return self.active.get(api_key_label(api_key) or "unknown", 0)
+
+
+# 全局单例
+stream_limiter = StreamConcurrencyLimiter()
@@ -1,6 +1,6 @@
 """
 多账号 Token 管理器
-实现轮询选择策略、token 缓存和自动刷新
+实现可配置的选择策略（顺序 / 轮询 / 最久未使用）、token 缓存和自动刷新
 
 支持两种数据源：
 1. 数据库（优先）- 从 PostgreSQL 读取 type='kiro' 的账号
@@ -15,6 +15,7 @@ from typing import Optional, List
 from dataclasses import dataclass, field
 from datetime import datetime, timedelta
 
+from config import KIRO_TOKEN_STRATEGY, TOKEN_UNHEALTHY_COOLDOWN_SECONDS, DEMO_MODE
 from .config import AuthConfig, load_auth_configs
 
 logger = logging.getLogger(__name__)
@@ -30,6 +31,7 @@ class CachedToken:
     expires_at: Optional[datetime] = None
     is_exhausted: bool = False  # 标记 token 是否已耗尽（429 错误）
     error_count: int = 0  # 连续错误计数
+    unhealthy_until: Optional[datetime] = None  # 403 冷却截止时间，期间不参与选择
 
     def is_expired(self, ttl_seconds: int = 3300) -> bool:
         """检查 token 是否过期（默认 55 分钟）"""
@@ -37,9 +39,56 @@ class CachedToken:
             return datetime.now() >= self.expires_at
         return (datetime.now() - self.cached_at).total_seconds() > ttl_seconds
 
+    def is_cooling_down(self) -> bool:
+        """检查 token 是否处于 403 冷却期"""
+        return self.unhealthy_until is not None and datetime.now() < self.unhealthy_until
+
     def is_usable(self) -> bool:
         """检查 token 是否可用"""
-        return not self.is_exhausted and not self.is_expired() and self.error_count < 3
+        return (
+            not self.is_exhausted
+            and not self.is_cooling_down()
+            and not self.is_expired()
+            and self.error_count < 3
+        )
+
+
+@dataclass
+class SelectedToken:
+    """
+    get_token 选中的账号及其 access token
+
+    并发请求之间 current_index 随时会变，403 / 429 / 出错的处理都针对发起该次上游调用的账号，
+    因此调用方保存选中结果，并显式传给 mark_* / handle_forbidden
+    """
+    access_token: str
+    # 演示模式下没有账号配置
+    config: Optional[AuthConfig] = None
+
+    @property
+    def name(self) -> Optional[str]:
+        return self.config.name if self.config else None
+
+
+def create_token_preview(token: Optional[str]) -> str:
+    """生成脱敏的 token 预览，用于日志"""
+    if not token:
+        return "<empty>"
+    if len(token) <= 12:
+        return "***"
+    return f"{token[:6]}...{token[-4:]}"
+
+
+class UnknownAccountError(LookupError):
+    """按序号或账号名找不到账号"""
+
+
+def mask_email(name: Optional[str]) -> Optional[str]:
+    """账号名是邮箱时脱敏为 ab***@example.com，其他名称原样返回"""
+    if not name or "@" not in name:
+        return name
+    local, _, domain = name.partition("@")
+    return f"{local[:2]}***@{domain}"
 
 
 class MultiAccountTokenManager:
@@ -48,7 +97,8 @@ class MultiAccountTokenManager:
 
     功能：
     - 支持多个 Kiro 账号配置
-    - 轮询策略选择可用 token
+    - 可配置的选择策略（KIRO_TOKEN_STRATEGY）：sequential / round_robin / lru
+    - 403 的 token 进入冷却期，冷却期内被跳过
     - 自动刷新过期 token
     - 错误处理和故障转移
     - 支持从数据库或配置文件加载账号
@@ -56,12 +106,25 @@ class MultiAccountTokenManager:
 
     REFRESH_URL = "https://prod.us-east-1.auth.desktop.kiro.dev/refreshToken"
     TOKEN_TTL_SECONDS = 3300  # 55 分钟 TTL
+    STRATEGIES = ("sequential", "round_robin", "lru", "most_remaining")
+    # 刷新后这么短时间内仍然 403，说明刷新无济于事，直接进入冷却
+    RECENT_REFRESH_SECONDS = 60
 
     def __init__(self):
         self.configs: List[AuthConfig] = []
         self.cached_tokens: dict[str, CachedToken] = {}
-        self.current_index: int = 0
+        # 每个账号已使用的请求次数（按账号名），与 token 缓存分开保存，刷新 token 不会清零
+        self.usage_counts: dict[str, int] = {}
+        self.current_index: int = 0  # 最近一次提供 token 的配置索引
+        self._round_robin_next: int = 0
+        self.strategy = KIRO_TOKEN_STRATEGY if KIRO_TOKEN_STRATEGY in self.STRATEGIES else "sequential"
+        if self.strategy != KIRO_TOKEN_STRATEGY:
+            logger.warning(f"未知的 KIRO_TOKEN_STRATEGY={KIRO_TOKEN_STRATEGY}，回退到 sequential")
         self.refresh_lock = asyncio.Lock()
+        # 最近一次 token 刷新的结果（用于健康检查）
+        self.last_refresh_at: Optional[datetime] = None
+        self.last_refresh_ok: Optional[bool] = None
+        self.last_refresh_error: Optional[str] = None
         self._initialized = False
         self._use_database = False  # 是否使用数据库
 
@@ -155,6 +218,7 @@ class MultiAccountTokenManager:
             if db_configs:
                 self.configs = db_configs
                 self.current_index = 0
+                self._round_robin_next = 0
                 logger.info(f"已重新加载 {len(self.configs)} 个账号配置")
                 return True
             return False
@@ -179,15 +243,58 @@ class MultiAccountTokenManager:
         except Exception as e:
             logger.warning(f"预热 token 失败: {e}")
     
-    async def get_token(self) -> Optional[str]:
+    def _candidate_indices(self) -> List[int]:
+        """按选择策略返回本次尝试的配置索引顺序"""
+        total = len(self.configs)
+        
+        if self.strategy == "round_robin":
+            start = self._round_robin_next % total
+            return [(start + i) % total for i in range(total)]
+        
+        if self.strategy == "most_remaining":
+            # 剩余额度多的优先；额度相同（包括都不限额）时从轮询位置开始依次排列
+            start = self._round_robin_next % total
+            def priority(index: int):
+                remaining = self.remaining_quota(self.configs[index])
+                return (-(remaining if remaining is not None else float("inf")), (index - start) % total)
+            return sorted(range(total), key=priority)
+        
+        if self.strategy == "lru":
+            def last_used(index: int) -> datetime:
+                cached = self.cached_tokens.get(self.configs[index].name)
+                return cached.last_used if cached else datetime.min
+            return sorted(range(total), key=last_used)
+        
+        # sequential: 从当前索引开始，当前 token 可用就一直使用
+        return [(self.current_index + i) % total for i in range(total)]
+    
+    def _select(self, index: int, cached: CachedToken) -> SelectedToken:
+        """记录被选中的 token 并返回选中结果"""
+        self.current_index = index
+        self._round_robin_next = index + 1
+        cached.last_used = datetime.now()
+        self.usage_counts[cached.config.name] = self.usage_counts.get(cached.config.name, 0) + 1
+        if logger.isEnabledFor(logging.DEBUG):
+            logger.debug(
+                f"选中 token: {cached.config.name} ({create_token_preview(cached.access_token)}), "
+                f"策略: {self.strategy}"
+            )
+        return SelectedToken(cached.access_token, cached.config)
+    
+    async def get_token(self) -> Optional[SelectedToken]:
         """
-        获取可用的 access token
+        获取可用的 access token 及其账号
         
-        使用轮询策略：
-        1. 从当前索引开始查找可用 token
-        2. 如果当前 token 不可用，切换到下一个
+        1. 按 KIRO_TOKEN_STRATEGY 决定的顺序查找可用 token
+        2. 跳过已耗尽（429）和处于 403 冷却期的 token
         3. 自动刷新过期的 token
+        
+        演示模式下不加载任何账号配置，直接返回固定的演示 token（没有账号）
         """
+        if DEMO_MODE:
+            from services.demo_upstream import DEMO_TOKEN
+            return SelectedToken(DEMO_TOKEN)
+        
         if not self._initialized:
             await self.initialize()
         
@@ -195,48 +302,57 @@ class MultiAccountTokenManager:
             logger.error("没有可用的认证配置")
             return None
         
-        # 尝试所有配置
-        for _ in range(len(self.configs)):
-            config = self.configs[self.current_index]
+        for index in self._candidate_indices():
+            config = self.configs[index]
             cache_key = config.name
             
             # 检查缓存
             cached = self.cached_tokens.get(cache_key)
             
+            if self.is_quota_depleted(config):
+                logger.debug(f"跳过额度已用尽的 token: {config.name}")
+                continue
+            
+            if cached and (cached.is_exhausted or cached.is_cooling_down()):
+                logger.debug(f"跳过不可用 token: {config.name} (exhausted={cached.is_exhausted}, "
+                             f"cooling_down={cached.is_cooling_down()})")
+                continue
+            
             if cached and cached.is_usable():
-                # 使用缓存的 token
-                cached.last_used = datetime.now()
-                logger.debug(f"使用缓存 token: {config.name}")
-                return cached.access_token
+                return self._select(index, cached)
             
             # 需要刷新 token
             try:
                 new_token = await self._refresh_single_token(config)
                 if new_token:
-                    self.cached_tokens[cache_key] = CachedToken(
-                        config=config,
-                        access_token=new_token
-                    )
+                    cached = CachedToken(config=config, access_token=new_token)
+                    self.cached_tokens[cache_key] = cached
                     logger.info(f"刷新 token 成功: {config.name}")
-                    return new_token
+                    return self._select(index, cached)
             except Exception as e:
                 logger.warning(f"刷新 token 失败 ({config.name}): {e}")
-            
-            # 当前配置失败，切换到下一个
-            self._move_to_next()
         
-        logger.error("所有 token 都不可用")
+        if self.all_quota_depleted():
+            logger.error("所有账号的请求额度都已用尽")
+        else:
+            logger.error("所有 token 都不可用")
         return None
     
-    async def refresh_tokens(self) -> Optional[str]:
+    async def refresh_tokens(self, account: SelectedToken) -> Optional[SelectedToken]:
         """
-        刷新当前 token（用于 403 错误后的重试）
+        刷新 account 所属账号的 token（用于 403 错误后的重试）
+
+        等待刷新锁期间其他请求已经刷新过该账号（缓存的 token 与 account 的不同且可用）时，直接使用缓存的 token
         """
         async with self.refresh_lock:
-            if not self.configs:
+            config = account.config
+            if config is None:
                 return None
             
-            config = self.configs[self.current_index]
+            cached = self.cached_tokens.get(config.name)
+            if cached and cached.access_token != account.access_token and cached.is_usable():
+                logger.info(f"token 已被其他请求刷新: {config.name}")
+                return SelectedToken(cached.access_token, config)
             
             try:
                 new_token = await self._refresh_single_token(config)
@@ -248,7 +364,7 @@ class MultiAccountTokenManager:
                     # 更新环境变量（向后兼容）
                     os.environ["KIRO_ACCESS_TOKEN"] = new_token
                     logger.info(f"token 刷新成功: {config.name}")
-                    return new_token
+                    return SelectedToken(new_token, config)
             except Exception as e:
                 logger.error(f"token 刷新失败: {e}")
             
@@ -262,17 +378,27 @@ class MultiAccountTokenManager:
         
         try:
             if config.account_type == "amazonq":
-                return await self._refresh_amazonq_token(config)
+                token = await self._refresh_amazonq_token(config)
             else:
-                return await self._refresh_kiro_token(config)
+                token = await self._refresh_kiro_token(config)
+            self._record_refresh(bool(token), None if token else "empty access token")
+            return token
                 
         except httpx.HTTPStatusError as e:
             logger.error(f"刷新 token HTTP 错误 ({config.account_type}): {e.response.status_code}")
+            self._record_refresh(False, f"HTTP {e.response.status_code}")
             raise
         except Exception as e:
             logger.error(f"刷新 token 失败 ({config.account_type}): {e}")
+            self._record_refresh(False, str(e))
             raise
     
+    def _record_refresh(self, ok: bool, error: Optional[str] = None):
+        """记录最近一次刷新结果"""
+        self.last_refresh_at = datetime.now()
+        self.last_refresh_ok = ok
+        self.last_refresh_error = error
+    
     async def _refresh_kiro_token(self, config: AuthConfig) -> Optional[str]:
         """刷新 Kiro 账号的 token"""
         async with httpx.AsyncClient() as client:
@@ -333,61 +459,250 @@ class MultiAccountTokenManager:
             logger.debug(f"Amazon Q token 刷新成功，有效期: {data.get('expiresIn')} 秒")
             return access_token
     
-    def mark_token_exhausted(self, reason: str = "unknown"):
+    def _resolve_accounts(self, account: Optional[str]) -> List[int]:
+        """account 为账号序号（从 0 开始）或账号名时返回该账号，为空时返回全部账号"""
+        if account is None or not account.strip():
+            return list(range(len(self.configs)))
+        account = account.strip()
+        if account.isdigit() and int(account) < len(self.configs):
+            return [int(account)]
+        for index, config in enumerate(self.configs):
+            if config.name == account:
+                return [index]
+        raise UnknownAccountError(account)
+
+    async def force_refresh(self, account: Optional[str] = None) -> List[dict]:
+        """
+        丢弃缓存的 access token 并立即刷新，返回每个账号的结果（脱敏的 token 预览和过期时间，或失败原因）
+
+        refresh token 在外部轮换后使用，不必等缓存的 access token 过期；丢弃缓存同时清除该账号的耗尽、冷却和错误计数。
+        刷新失败的账号不保留缓存，之后 get_token 会再次尝试刷新。account 不存在时抛出 UnknownAccountError
+        """
+        if not self._initialized:
+            await self.initialize()
+        indices = self._resolve_accounts(account)
+        results = []
+        async with self.refresh_lock:
+            for index in indices:
+                config = self.configs[index]
+                self.cached_tokens.pop(config.name, None)
+                result = {"index": index, "name": mask_email(config.name), "account_type": config.account_type}
+                try:
+                    token = await self._refresh_single_token(config)
+                    error = None if token else "empty access token"
+                except httpx.HTTPStatusError as e:
+                    token, error = None, f"HTTP {e.response.status_code}"
+                except Exception as e:
+                    token, error = None, str(e) or type(e).__name__
+                if token:
+                    cached = CachedToken(config=config, access_token=token)
+                    self.cached_tokens[config.name] = cached
+                    result.update(
+                        ok=True,
+                        token_preview=create_token_preview(token),
+                        expires_at=self.token_expires_at(cached).isoformat(),
+                    )
+                    logger.info(f"🔄 强制刷新 token 成功: {config.name} ({create_token_preview(token)})")
+                else:
+                    result.update(ok=False, error=error)
+                    logger.error(f"❌ 强制刷新 token 失败: {config.name}: {error}")
+                results.append(result)
+        return results
+
+    def mark_token_exhausted(self, account: SelectedToken, reason: str = "unknown"):
         """
-        标记当前 token 为已耗尽（通常因为 429 错误）
+        标记 account 所属账号已耗尽（通常因为 429 错误）
         并切换到下一个账号
         """
-        if not self.configs:
+        config = account.config
+        if config is None:
             return
         
-        config = self.configs[self.current_index]
-        cache_key = config.name
-        
-        if cache_key in self.cached_tokens:
-            self.cached_tokens[cache_key].is_exhausted = True
+        cached = self.cached_tokens.get(config.name)
+        if cached:
+            cached.is_exhausted = True
             logger.warning(f"Token 已耗尽 ({config.name}): {reason}")
         
         # 切换到下一个账号
-        self._move_to_next()
-        logger.info(f"切换到下一个账号: {self.configs[self.current_index].name}")
+        self._move_past(config)
     
-    def mark_token_error(self):
-        """标记当前 token 出现错误"""
-        if not self.configs:
+    def mark_token_unhealthy(self, account: SelectedToken, reason: str = "403"):
+        """
+        将 account 所属账号标记为不健康（通常因为 403 错误）
+        冷却 TOKEN_UNHEALTHY_COOLDOWN_SECONDS 秒，期间选择器会跳过它
+
+        没有其他可用账号时不进入冷却：隔离唯一的账号只会让之后的所有请求在冷却期内都取不到 token
+        """
+        config = account.config
+        if config is None:
             return
         
-        config = self.configs[self.current_index]
-        cache_key = config.name
+        cached = self.cached_tokens.get(config.name)
+        if not cached:
+            return
+        if not any(other.name != config.name and self._is_available(other) for other in self.configs):
+            logger.warning(
+                f"Token 返回 403 ({config.name}, {create_token_preview(cached.access_token)}): "
+                f"{reason}，没有其他可用账号，不进入冷却"
+            )
+            return
+        cached.unhealthy_until = datetime.now() + timedelta(seconds=TOKEN_UNHEALTHY_COOLDOWN_SECONDS)
+        logger.warning(
+            f"Token 标记为不健康 ({config.name}, {create_token_preview(cached.access_token)}): "
+            f"{reason}，冷却 {TOKEN_UNHEALTHY_COOLDOWN_SECONDS} 秒"
+        )
         
-        if cache_key in self.cached_tokens:
-            self.cached_tokens[cache_key].error_count += 1
-            if self.cached_tokens[cache_key].error_count >= 3:
+        self._move_past(config)
+    
+    async def handle_forbidden(self, account: SelectedToken) -> Optional[SelectedToken]:
+        """
+        处理上游 403：先尝试刷新 account 所属账号的 token；
+        如果该 token 刚刷新过仍然 403 或刷新失败，则标记为不健康并切换到下一个可用 token
+        """
+        config = account.config
+        if config is None:
+            return None
+        
+        cached = self.cached_tokens.get(config.name)
+        # 只有返回 403 的正是刚刷新得到的 token 时才说明刷新无济于事；缓存已被其他请求换成新 token 时照常刷新（直接使用新 token）
+        recently_refreshed = (
+            cached is not None
+            and cached.access_token == account.access_token
+            and (datetime.now() - cached.cached_at).total_seconds() < self.RECENT_REFRESH_SECONDS
+        )
+        
+        if not recently_refreshed:
+            refreshed = await self.refresh_tokens(account)
+            if refreshed:
+                return refreshed
+        
+        self.mark_token_unhealthy(account, "403" if not recently_refreshed else "403 after refresh")
+        return await self.get_token()
+    
+    def mark_token_error(self, account: Optional[SelectedToken]):
+        """标记 account 所属账号出现错误，连续出错 3 次后不再被选中"""
+        config = account.config if account else None
+        if config is None:
+            return
+        
+        cached = self.cached_tokens.get(config.name)
+        if cached:
+            cached.error_count += 1
+            if cached.error_count >= 3:
                 logger.warning(f"Token 错误次数过多，标记为不可用: {config.name}")
-                self._move_to_next()
+                self._move_past(config)
     
     def reset_all_exhausted(self):
         """重置所有 token 的耗尽状态（可用于定时任务）"""
         for cached in self.cached_tokens.values():
             cached.is_exhausted = False
             cached.error_count = 0
-        logger.info("已重置所有 token 的状态")
+            cached.unhealthy_until = None
+        self.usage_counts.clear()
+        logger.info("已重置所有 token 的状态和额度用量")
     
-    def _move_to_next(self):
-        """移动到下一个配置"""
-        if len(self.configs) > 1:
+    def _move_past(self, config: AuthConfig):
+        """
+        current_index 仍指向 config 时移动到下一个配置（sequential 策略从这里继续）；
+        其他请求已经切换过时不再移动，避免跳过健康的账号
+        """
+        if len(self.configs) > 1 and 0 <= self.current_index < len(self.configs) \
+                and self.configs[self.current_index].name == config.name:
             self.current_index = (self.current_index + 1) % len(self.configs)
+            logger.info(f"切换到下一个账号: {self.configs[self.current_index].name}")
+    
+    def remaining_quota(self, config: AuthConfig) -> Optional[int]:
+        """账号剩余的请求额度，没有配置 quota 时为 None（不限）"""
+        if config.quota is None:
+            return None
+        return max(0, config.quota - self.usage_counts.get(config.name, 0))
+    
+    def is_quota_depleted(self, config: AuthConfig) -> bool:
+        return self.remaining_quota(config) == 0
+    
+    def all_quota_depleted(self) -> bool:
+        """所有账号都配置了额度且都已用尽"""
+        return bool(self.configs) and all(self.is_quota_depleted(config) for config in self.configs)
     
+    def available_count(self) -> int:
+        """
+        当前可参与选择的账号数量
+
+        尚未缓存或已过期的 token 可以刷新后使用，同样计入；已耗尽、冷却中、连续出错或额度用尽的不计入
+        """
+        return sum(1 for config in self.configs if self._is_available(config))
+    
+    def _is_available(self, config: AuthConfig) -> bool:
+        if self.is_quota_depleted(config):
+            return False
+        cached = self.cached_tokens.get(config.name)
+        return cached is None or not (cached.is_exhausted or cached.is_cooling_down() or cached.error_count >= 3)
+    
+    def get_health(self) -> dict:
+        """健康检查用的精简状态"""
+        return {
+            "total": len(self.configs),
+            "available": self.available_count(),
+            "last_refresh": {
+                "ok": self.last_refresh_ok,
+                "at": self.last_refresh_at.isoformat() if self.last_refresh_at else None,
+                "error": self.last_refresh_error,
+            },
+        }
+    
+    def token_expires_at(self, cached: CachedToken) -> datetime:
+        """缓存的 access token 的过期时间（刷新响应没有给出时按 TOKEN_TTL_SECONDS 计算）"""
+        return cached.expires_at or cached.cached_at + timedelta(seconds=self.TOKEN_TTL_SECONDS)
+
+    def get_usage(self) -> dict:
+        """
+        每个账号的额度和 token 状态（用于 /v1/usage）
+
+        只读取已有状态，不会刷新 token、也不计入账号的请求次数；账号名和 token 都经过脱敏
+        """
+        accounts = []
+        for config in self.configs:
+            cached = self.cached_tokens.get(config.name)
+            expires_at = self.token_expires_at(cached) if cached else None
+            accounts.append({
+                "name": mask_email(config.name),
+                "account_type": config.account_type,
+                "token_preview": create_token_preview(cached.access_token) if cached else None,
+                "quota": config.quota,
+                "used": self.usage_counts.get(config.name, 0),
+                "available": self.remaining_quota(config),
+                "last_refresh": cached.cached_at.isoformat() if cached else None,
+                "expires_at": expires_at.isoformat() if expires_at else None,
+                "unhealthy": bool(cached and (cached.is_exhausted or cached.is_cooling_down() or cached.error_count >= 3)),
+                "unhealthy_until": cached.unhealthy_until.isoformat() if cached and cached.unhealthy_until else None,
+            })
+        return {
+            "total": len(self.configs),
+            "available": self.available_count(),
+            "accounts": accounts,
+        }
+
     def get_status(self) -> dict:
         """获取 token 管理器状态（用于健康检查）"""
         return {
+            "strategy": self.strategy,
             "total_configs": len(self.configs),
             "current_index": self.current_index,
             "current_account": self.configs[self.current_index].name if self.configs else None,
+            "quotas": {
+                config.name: {
+                    "quota": config.quota,
+                    "used": self.usage_counts.get(config.name, 0),
+                    "remaining": self.remaining_quota(config),
+                }
+                for config in self.configs
+            },
             "cached_tokens": {
                 name: {
                     "is_usable": cached.is_usable(),
                     "is_exhausted": cached.is_exhausted,
+                    "is_cooling_down": cached.is_cooling_down(),
+                    "unhealthy_until": cached.unhealthy_until.isoformat() if cached.unhealthy_until else None,
                     "error_count": cached.error_count,
                     "cached_at": cached.cached_at.isoformat(),
                     "last_used": cached.last_used.isoformat(),
@@ -417,13 +732,20 @@ class TokenManager:
                 import concurrent.futures
                 with concurrent.futures.ThreadPoolExecutor() as pool:
                     future = pool.submit(asyncio.run, self._manager.get_token())
-                    return future.result()
+                    selected = future.result()
             else:
-                return loop.run_until_complete(self._manager.get_token())
+                selected = loop.run_until_complete(self._manager.get_token())
         except RuntimeError:
             # 没有事件循环，创建一个新的
-            return asyncio.run(self._manager.get_token())
+            selected = asyncio.run(self._manager.get_token())
+        return selected.access_token if selected else None
     
     async def refresh_tokens(self) -> Optional[str]:
-        """刷新 token"""
-        return await self._manager.refresh_tokens()
+        """刷新最近一次提供 token 的账号"""
+        manager = self._manager
+        if not 0 <= manager.current_index < len(manager.configs):
+            return None
+        config = manager.configs[manager.current_index]
+        cached = manager.cached_tokens.get(config.name)
+        selected = await manager.refresh_tokens(SelectedToken(cached.access_token if cached else "", config))
+        return selected.access_token if selected else None
@@ -8,15 +8,58 @@ load_dotenv()
 
 # API Key for authentication
 API_KEY = os.getenv("API_KEY", "ki2api-key-2024")
+# 优先级 API Key（逗号分隔），同样可以访问 API，并且不受 MIN_AVAILABLE_ACCOUNTS 的容量保留限制
+PRIORITY_API_KEYS = [key.strip() for key in os.getenv("PRIORITY_API_KEYS", "").split(",") if key.strip()]
+# 管理端点（/admin/usage、/admin/refresh-token、/admin/tokenizer/calibrate）使用的独立 Key，API_KEY 和优先级 Key 不能访问；为空时管理端点返回 403
+ADMIN_API_KEY = os.getenv("ADMIN_API_KEY", "")
+# 认证审计事件的去向：log（kiro2api.audit logger，INFO）/ file（追加到 AUTH_AUDIT_FILE）/ none
+AUTH_AUDIT_SINK = os.getenv("AUTH_AUDIT_SINK", "log").lower()
+AUTH_AUDIT_FILE = os.getenv("AUTH_AUDIT_FILE", "auth_audit.jsonl")
+# 可用账号数低于该值时拒绝普通请求（返回 503），为优先级 Key 保留容量；0 表示不限制
+MIN_AVAILABLE_ACCOUNTS = int(os.getenv("MIN_AVAILABLE_ACCOUNTS", "0"))
+# 每个 API Key 同时进行的流式请求数上限，超过返回 429；0 表示不限制，非流式请求不受影响
+# 也可以用别名 RATE_LIMIT_CONCURRENT 设置，两者都设置时以 MAX_CONCURRENT_STREAMS_PER_KEY 为准
+MAX_CONCURRENT_STREAMS_PER_KEY = int(os.getenv("MAX_CONCURRENT_STREAMS_PER_KEY", os.getenv("RATE_LIMIT_CONCURRENT", "0")))
+# 每个 API Key 每分钟的请求数上限（令牌桶，允许突发到该值），超过返回 429 和 Retry-After；0 表示不限制
+RATE_LIMIT_RPM = int(os.getenv("RATE_LIMIT_RPM", "0"))
+# 每个客户端 IP 每分钟的请求数上限（令牌桶，0 表示不限制），突发容量默认与之相同
+IP_RATE_LIMIT_RPM = int(os.getenv("IP_RATE_LIMIT_RPM", "0"))
+IP_RATE_LIMIT_BURST = int(os.getenv("IP_RATE_LIMIT_BURST", "0"))
+# 位于反向代理之后时按 X-Forwarded-For 的第一个地址识别客户端（只应在代理会覆盖该头时开启）
+IP_RATE_LIMIT_TRUST_FORWARDED = os.getenv("IP_RATE_LIMIT_TRUST_FORWARDED", "false").lower() in ("1", "true", "yes")
+# 允许通过 X-Kiro-Debug 请求头在错误响应中查看上游调用明细的 Key 标签（逗号分隔，如 default,priority-1；* 表示全部），默认不允许
+DEBUG_KEY_LABELS = [label.strip() for label in os.getenv("DEBUG_KEY_LABELS", "").split(",") if label.strip()]
+
+# 返回给客户端的错误消息语言（en / zh），服务端日志不受影响
+ERROR_LOCALE = os.getenv("ERROR_LOCALE", "en").lower()
+
+# 演示模式：使用内置的假上游回显请求，不需要任何 Kiro 凭证和数据库
+DEMO_MODE = os.getenv("DEMO_MODE", "false").lower() in ("true", "1", "yes")
 
 # Legacy single account config (向后兼容)
 # 新版本使用 KIRO_AUTH_CONFIG，见 auth/config.py
 KIRO_ACCESS_TOKEN = os.getenv("KIRO_ACCESS_TOKEN")
 KIRO_REFRESH_TOKEN = os.getenv("KIRO_REFRESH_TOKEN")
 
+# 多账号 token 选择策略: sequential（顺序，当前 token 不可用才切换）、round_robin（轮询）、lru（最久未使用优先）、
+# most_remaining（剩余额度最多优先，额度相同时轮询）
+KIRO_TOKEN_STRATEGY = os.getenv("KIRO_TOKEN_STRATEGY", "sequential").lower()
+# 触发 403 的 token 被标记为不健康后的冷却时间（秒），冷却期内不会被选中
+TOKEN_UNHEALTHY_COOLDOWN_SECONDS = int(os.getenv("TOKEN_UNHEALTHY_COOLDOWN_SECONDS", "300"))
+
 # Kiro/CodeWhisperer API endpoints
-KIRO_BASE_URL = "https://codewhisperer.us-east-1.amazonaws.com/generateAssistantResponse"
-PROFILE_ARN = "arn:aws:codewhisperer:us-east-1:699475941385:profile/EHGA3GRVQMUK"
+# 上游区域，决定默认的上游地址
+KIRO_REGION = os.getenv("KIRO_REGION", "us-east-1").strip()
+# 上游接口的完整 URL，可指向其他区域或本地模拟服务（集成测试）；Host 头和 TLS 校验名称由 URL 推导
+KIRO_BASE_URL = os.getenv(
+    "KIRO_UPSTREAM_URL", f"https://codewhisperer.{KIRO_REGION}.amazonaws.com/generateAssistantResponse"
+).strip()
+# CodeWhisperer profile ARN，随请求发送；切换到其他区域时需要设置为该区域的 profile
+PROFILE_ARN = os.getenv("KIRO_PROFILE_ARN", "arn:aws:codewhisperer:us-east-1:699475941385:profile/EHGA3GRVQMUK").strip()
+# 上游主机的静态地址映射（逗号分隔的 host=ip），连接时使用映射的 IP，Host 头和 TLS 校验仍使用原主机名
+UPSTREAM_HOST_MAP = os.getenv("UPSTREAM_HOST_MAP", "")
+# 覆盖上游 TLS SNI 和证书校验使用的名称（经由证书名称不同的内部网关转发时使用），默认与 URL 主机名相同
+UPSTREAM_TLS_SERVER_NAME = os.getenv("UPSTREAM_TLS_SERVER_NAME", "").strip()
 
 # Model mapping
 MODEL_MAP = {
@@ -26,6 +69,238 @@ MODEL_MAP = {
     "claude-haiku-4-5-20251001":"claude-haiku-4.5"
 }
 DEFAULT_MODEL = "claude-sonnet-4-5-20250929"
+# 自定义模型映射，合并覆盖 MODEL_MAP：JSON 字符串（如 {"claude-sonnet-4*": "claude-sonnet-4"}）或 JSON 文件路径；
+# 键支持 * 通配，精确匹配优先
+MODEL_MAPPING = os.getenv("MODEL_MAPPING", "")
+# 模型别名：客户端使用的模型名（如 gpt-4o）在解析请求时改写为规范的模型名（如 claude-sonnet-4-5-20250929），
+# 之后的校验、映射、计量和响应中的 model 都使用规范名称；JSON 字符串或 JSON 文件路径，只做精确匹配
+MODEL_ALIASES = os.getenv("MODEL_ALIASES", "")
+
+# ==============================================================================
+# 请求大小与日志配置
+# ==============================================================================
+# 请求体大小上限（字节），超过返回 413；0 表示不限制
+MAX_REQUEST_BODY_BYTES = int(os.getenv("MAX_REQUEST_BODY_BYTES", str(32 * 1024 * 1024)))
+# 单张图片解码后的大小上限（字节），超过返回 400；0 表示不限制
+MAX_IMAGE_BYTES = int(os.getenv("MAX_IMAGE_BYTES", str(5 * 1024 * 1024)))
+# OpenAI image_url 为 http(s) 地址时由服务端下载（默认关闭，关闭时返回 400，只接受 data: URL）
+IMAGE_URL_FETCH_ENABLED = os.getenv("IMAGE_URL_FETCH_ENABLED", "false").lower() in ("true", "1", "yes")
+# 下载远程图片的超时（秒）
+IMAGE_URL_FETCH_TIMEOUT = float(os.getenv("IMAGE_URL_FETCH_TIMEOUT", "10"))
+# 日志中请求/响应内容的最大预览长度（字符）；0 表示不截断
+LOG_BODY_PREVIEW_CHARS = int(os.getenv("LOG_BODY_PREVIEW_CHARS", "4000"))
+# 日志级别：DEBUG / INFO / WARNING / ERROR；调试日志只在 DEBUG 时才格式化内容，热路径上关闭时没有额外开销
+LOG_LEVEL = os.getenv("LOG_LEVEL", "INFO").upper()
+# 每个请求结束时输出一条 JSON 访问日志（logger kiro2api.access）
+ACCESS_LOG_ENABLED = os.getenv("ACCESS_LOG_ENABLED", "true").lower() in ("true", "1", "yes")
+# 不记录访问日志的路径（逗号分隔，精确匹配），默认跳过健康检查和指标抓取
+ACCESS_LOG_SKIP_PATHS = [
+    path.strip()
+    for path in os.getenv("ACCESS_LOG_SKIP_PATHS", "/health,/metrics").split(",")
+    if path.strip()
+]
+# 访问日志的级别（默认 INFO），可以调成 DEBUG 后与 LOG_LEVEL 配合按需开启
+ACCESS_LOG_LEVEL = os.getenv("ACCESS_LOG_LEVEL", "INFO").upper()
+# 访问日志中记录的请求头（逗号分隔，不区分大小写），值经过与请求采样相同的脱敏处理
+ACCESS_LOG_HEADERS = [
+    name.strip()
+    for name in os.getenv("ACCESS_LOG_HEADERS", "user-agent,x-forwarded-for,anthropic-version,anthropic-beta").split(",")
+    if name.strip()
+]
+
+# ==============================================================================
+# 对话历史窗口配置
+# ==============================================================================
+# 只把最近 N 轮 user/assistant 对话发送到上游（0 表示不限制，发送完整历史）
+HISTORY_WINDOW_TURNS = int(os.getenv("HISTORY_WINDOW_TURNS", "0"))
+# 为 true 时，input token 估算也基于窗口裁剪后的历史
+HISTORY_WINDOW_AFFECTS_COUNT = os.getenv("HISTORY_WINDOW_AFFECTS_COUNT", "false").lower() in ("true", "1", "yes")
+# 客户端对话标识（X-Conversation-Id / metadata.user_id）到上游 conversationId 的映射条数上限，0 表示关闭（每个请求都是新对话）
+CONVERSATION_CACHE_SIZE = int(os.getenv("CONVERSATION_CACHE_SIZE", "10000"))
+# 映射超过该秒数未使用后过期，0 表示不过期（仍受条数上限约束）
+CONVERSATION_TTL_SECONDS = float(os.getenv("CONVERSATION_TTL_SECONDS", "3600"))
+
+# ==============================================================================
+# OpenAI 参数配置
+# ==============================================================================
+# 上游无法实现但可以安全忽略的 OpenAI 参数（presence_penalty、seed 等）：false 时记录警告后忽略，true 时返回 400
+STRICT_OPENAI_PARAMS = os.getenv("STRICT_OPENAI_PARAMS", "false").lower() in ("true", "1", "yes")
+# 非流式请求 n 的上限：n > 1 时按顺序发起 n 次上游请求，合并为 n 个 choice；默认 1，即 n > 1 返回 400（流式请求始终只支持 n = 1）
+OPENAI_MAX_N = int(os.getenv("OPENAI_MAX_N", "1"))
+
+# ==============================================================================
+# Anthropic 请求头配置
+# ==============================================================================
+# Claude 接口接受的 anthropic-version（逗号分隔），其他版本返回 400；第一个为请求没有带这个头时使用的版本，为空时不校验
+ANTHROPIC_VERSIONS = [
+    version.strip()
+    for version in os.getenv("ANTHROPIC_VERSIONS", "2023-06-01,2023-01-01").split(",")
+    if version.strip()
+]
+
+# ==============================================================================
+# 功能开关配置
+# ==============================================================================
+# 请求级功能开关定义：JSON 字符串或 JSON 文件路径，如 {"upstream_prefetch": {"default": false, "percentage": 5, "keys": {"priority-1": true}}}
+FEATURE_FLAGS = os.getenv("FEATURE_FLAGS", "")
+
+# ==============================================================================
+# 工具定义配置
+# ==============================================================================
+# 压缩工具定义（发送到上游和 token 估算一致），默认关闭：同一个请求的 tools 中完全相同的重复定义只保留一份；
+# 带对话标识的多轮对话中，前几轮已经发送过的相同工具只发送名称和 schema（见 services/tool_utils.py compact_repeated_tools）
+TOOL_COMPACTION_ENABLED = os.getenv("TOOL_COMPACTION_ENABLED", "false").lower() in ("true", "1", "yes")
+# 工具名不符合 ^[a-zA-Z0-9_-]{1,64}$ 时的处理：reject（返回 400）/ sanitize（转换为合法名称，响应中还原原名）
+TOOL_NAME_POLICY = os.getenv("TOOL_NAME_POLICY", "reject").lower()
+# tool_result 文本超过该字节数时按换行拆分为多段（每段仍带 tool_use_id），0 表示不拆分
+TOOL_RESULT_SPLIT_BYTES = int(os.getenv("TOOL_RESULT_SPLIT_BYTES", "0"))
+# 对话以 assistant 的 tool_use 结尾、没有 tool_result 时：reject（返回 400）/ complete（视为工具已执行但无结果）/ continue（提示模型继续）
+TRAILING_TOOL_USE_POLICY = os.getenv("TRAILING_TOOL_USE_POLICY", "reject").lower()
+
+# ==============================================================================
+# Token 计数配置
+# ==============================================================================
+# estimate: 按字符数粗略估算；cl100k_base / o200k_base: 使用 tiktoken BPE 分词精确计数
+TOKENIZER_BACKEND = os.getenv("TOKENIZER_BACKEND", "estimate").lower()
+# 在代理侧按请求的 max_tokens（OpenAI 也接受 max_completion_tokens）截断输出，上游请求不支持该参数
+ENFORCE_MAX_TOKENS = os.getenv("ENFORCE_MAX_TOKENS", "true").lower() in ("true", "1", "yes")
+
+# ==============================================================================
+# 流式响应配置
+# ==============================================================================
+# 在流末尾追加一行 SSE 注释（": stats end_reason=..."），说明流的结束原因和统计信息
+STREAM_STATS_COMMENT = os.getenv("STREAM_STATS_COMMENT", "false").lower() in ("true", "1", "yes")
+# 流式响应超过该秒数没有发出事件时发送保活帧（Claude 为 ping 事件，OpenAI 为 ": keepalive" 注释）；0 表示关闭
+STREAM_KEEPALIVE_SECONDS = float(os.getenv("STREAM_KEEPALIVE_SECONDS", "15"))
+# 流式响应读取上游时的空闲超时（秒，没有收到任何数据）和总时长上限（秒）；0 表示关闭
+STREAM_IDLE_TIMEOUT_SECONDS = float(os.getenv("STREAM_IDLE_TIMEOUT_SECONDS", "120"))
+STREAM_TOTAL_TIMEOUT_SECONDS = float(os.getenv("STREAM_TOTAL_TIMEOUT_SECONDS", "900"))
+# 单个响应中内容块（Claude 的 content_block）和工具调用的数量上限，超过时中止响应（结束原因 block_limit）；0 表示不限
+STREAM_MAX_CONTENT_BLOCKS = int(os.getenv("STREAM_MAX_CONTENT_BLOCKS", "1000"))
+STREAM_MAX_TOOL_CALLS = int(os.getenv("STREAM_MAX_TOOL_CALLS", "256"))
+# 调试用：流结束之后仍有写出时抛出异常（默认记录错误日志并丢弃该写出）
+STREAM_LIFECYCLE_STRICT = os.getenv("STREAM_LIFECYCLE_STRICT", "false").lower() in ("true", "1", "yes")
+# 每次交给解析器的上游响应块的最大字节数（与网络实际收到的块相比只拆分、不等待凑满）；0 表示按收到的块原样处理
+STREAM_READ_CHUNK_BYTES = int(os.getenv("STREAM_READ_CHUNK_BYTES", "8192"))
+# 实验性：流式请求在返回 SSE 响应之前就提前发起上游请求，缩短首 token 延迟
+UPSTREAM_PREFETCH = os.getenv("UPSTREAM_PREFETCH", "false").lower() in ("true", "1", "yes")
+# 上游 event-stream 帧的 CRC 校验：lenient（默认，记录日志并丢弃损坏的帧）/ strict（中止响应）/ off（不校验）
+EVENT_STREAM_CRC_MODE = os.getenv("EVENT_STREAM_CRC_MODE", "lenient").lower()
+# 请求体 stream 字段与 Accept 头冲突时以哪一方为准：body（默认）/ accept
+STREAM_MODE_RESOLUTION = os.getenv("STREAM_MODE_RESOLUTION", "body").lower()
+# 上游给出无法识别的结束原因时对客户端使用的结束原因（end_turn / max_tokens / stop_sequence / tool_use）
+UNKNOWN_STOP_REASON_FALLBACK = os.getenv("UNKNOWN_STOP_REASON_FALLBACK", "end_turn").lower()
+
+# ==============================================================================
+# 响应字段裁剪配置
+# ==============================================================================
+# 非流式响应的默认形态：full（完整字段）/ lean（省略 LEAN_RESPONSE_OMIT_FIELDS 中的字段），可被 X-Response-Shape 头覆盖
+RESPONSE_SHAPE = os.getenv("RESPONSE_SHAPE", "full").lower()
+# lean 形态省略的顶层字段（逗号分隔）
+LEAN_RESPONSE_OMIT_FIELDS = [
+    field.strip()
+    for field in os.getenv("LEAN_RESPONSE_OMIT_FIELDS", "usage,system_fingerprint,created,stop_sequence").split(",")
+    if field.strip()
+]
+
+# ==============================================================================
+# 响应压缩配置
+# ==============================================================================
+# 客户端声明 Accept-Encoding: gzip / deflate 时压缩非流式 JSON 响应；SSE 流式响应从不压缩
+RESPONSE_COMPRESSION_ENABLED = os.getenv("RESPONSE_COMPRESSION_ENABLED", "true").lower() in ("true", "1", "yes")
+# 响应体小于该字节数时不压缩（压缩收益抵不上开销）
+RESPONSE_COMPRESSION_MIN_BYTES = int(os.getenv("RESPONSE_COMPRESSION_MIN_BYTES", "1024"))
+
+# ==============================================================================
+# 上游重试配置
+# ==============================================================================
+# 上游返回 500/502/503/504 或网络错误时的最大尝试次数（含第一次），1 表示不重试
+UPSTREAM_RETRY_MAX_ATTEMPTS = int(os.getenv("UPSTREAM_RETRY_MAX_ATTEMPTS", "3"))
+# 重试的基础等待时间（秒），按指数退避（base * 2^n）并加随机抖动
+UPSTREAM_RETRY_BASE_DELAY = float(os.getenv("UPSTREAM_RETRY_BASE_DELAY", "0.5"))
+# 单个请求调用上游的总时限（秒，含重试和读取响应），客户端可以用 X-Request-Timeout 缩短；0 表示不限
+UPSTREAM_TIMEOUT = float(os.getenv("UPSTREAM_TIMEOUT", "300"))
+
+# ==============================================================================
+# 请求采样配置（离线回放用）
+# ==============================================================================
+# 采样比例（0~1），0 表示关闭；命中的请求连同上游响应脱敏后写成 JSON fixture
+REQUEST_SAMPLE_RATE = float(os.getenv("REQUEST_SAMPLE_RATE", "0"))
+# fixture 保存目录
+REQUEST_SAMPLE_DIR = os.getenv("REQUEST_SAMPLE_DIR", "samples")
+# 最多保存的 fixture 数量，达到后不再写入
+REQUEST_SAMPLE_MAX_FIXTURES = int(os.getenv("REQUEST_SAMPLE_MAX_FIXTURES", "200"))
+
+# ==============================================================================
+# 审计日志配置（按 Key 记录请求和响应）
+# ==============================================================================
+# 需要记录的 Key 标签（逗号分隔，如 default,priority-1；* 表示全部），为空时不记录
+JOURNAL_KEY_LABELS = [label.strip() for label in os.getenv("JOURNAL_KEY_LABELS", "").split(",") if label.strip()]
+# 追加写入的 JSONL 文件，超过 JOURNAL_MAX_BYTES 后轮转为 <path>.1 ... <path>.N（0 表示不轮转）
+JOURNAL_PATH = os.getenv("JOURNAL_PATH", "journal/requests.jsonl")
+JOURNAL_MAX_BYTES = int(os.getenv("JOURNAL_MAX_BYTES", str(100 * 1024 * 1024)))
+JOURNAL_BACKUP_COUNT = int(os.getenv("JOURNAL_BACKUP_COUNT", "5"))
+# 请求和响应内容的记录方式：full（原文）/ hash（只记录 sha256）
+JOURNAL_CONTENT = os.getenv("JOURNAL_CONTENT", "full").lower()
+# 等待写入的记录数上限，写入跟不上时丢弃新记录（不阻塞请求）
+JOURNAL_QUEUE_SIZE = int(os.getenv("JOURNAL_QUEUE_SIZE", "1000"))
+# 写入失败或丢弃记录时 POST 告警的地址，为空时只记录错误日志；同类告警最多每 JOURNAL_ALERT_INTERVAL_SECONDS 秒发送一次
+JOURNAL_ALERT_WEBHOOK_URL = os.getenv("JOURNAL_ALERT_WEBHOOK_URL", "")
+JOURNAL_ALERT_INTERVAL_SECONDS = float(os.getenv("JOURNAL_ALERT_INTERVAL_SECONDS", "300"))
+
+# ==============================================================================
+# 用量统计配置（/admin/usage）
+# ==============================================================================
+# 按小时、Key、模型汇总的用量快照文件；为空时只在内存中统计，重启后清零
+USAGE_STORE_PATH = os.getenv("USAGE_STORE_PATH", "")
+# 用量快照的写入间隔（秒），有新用量时才写入；关闭时也会写入一次
+USAGE_FLUSH_SECONDS = float(os.getenv("USAGE_FLUSH_SECONDS", "60"))
+# 用量保留天数，更早的小时桶在写入快照时删除
+USAGE_RETENTION_DAYS = int(os.getenv("USAGE_RETENTION_DAYS", "90"))
+# 估算费用使用的单价（美元 / 百万 token），合并覆盖内置价格：JSON 字符串（如 {"claude-sonnet-4*": {"input": 3, "output": 15}}），
+# 键为模型名，支持 * 通配，精确匹配优先，其次最长的通配规则
+USAGE_PRICING = os.getenv("USAGE_PRICING", "")
+
+# ==============================================================================
+# 监控指标配置
+# ==============================================================================
+# 开启后提供 Prometheus 格式的 /metrics 端点
+METRICS_ENABLED = os.getenv("METRICS_ENABLED", "false").lower() in ("true", "1", "yes")
+# 访问 /metrics 需要的 Bearer token，为空时不需要认证（不使用 API_KEY，便于只把指标开放给监控系统）
+METRICS_TOKEN = os.getenv("METRICS_TOKEN", "")
+
+# ==============================================================================
+# 上游熔断配置
+# ==============================================================================
+# 连续多少次上游调用失败（网络错误、500/502/503/504）后熔断，熔断期间请求直接返回 503；0 表示不熔断
+CIRCUIT_BREAKER_FAILURE_THRESHOLD = int(os.getenv("CIRCUIT_BREAKER_FAILURE_THRESHOLD", "5"))
+# 熔断持续时间（秒），之后放行一个探测请求，成功则恢复
+CIRCUIT_BREAKER_OPEN_SECONDS = float(os.getenv("CIRCUIT_BREAKER_OPEN_SECONDS", "30"))
+
+# ==============================================================================
+# 健康检查配置
+# ==============================================================================
+# /health?deep=true 上游可达性检查的超时（秒）
+HEALTH_DEEP_TIMEOUT_SECONDS = float(os.getenv("HEALTH_DEEP_TIMEOUT_SECONDS", "3"))
+
+# ==============================================================================
+# 优雅关闭配置
+# ==============================================================================
+# 收到 SIGTERM / SIGINT 后等待进行中的流式响应正常结束的最长时间（秒），期间新请求返回 503
+SHUTDOWN_DRAIN_TIMEOUT_SECONDS = float(os.getenv("SHUTDOWN_DRAIN_TIMEOUT_SECONDS", "30"))
+
+# ==============================================================================
+# 过载保护配置
+# ==============================================================================
+# 进程常驻内存（MB）或进行中的流数量达到第一级阈值时拒绝新的生成请求（529），达到第二级阈值时还会逐个中断最早的流；0 表示不按该项判断
+LOAD_SHED_MEMORY_MB = float(os.getenv("LOAD_SHED_MEMORY_MB", "0"))
+LOAD_SHED_MEMORY_HARD_MB = float(os.getenv("LOAD_SHED_MEMORY_HARD_MB", "0"))
+LOAD_SHED_STREAMS = int(os.getenv("LOAD_SHED_STREAMS", "0"))
+LOAD_SHED_STREAMS_HARD = int(os.getenv("LOAD_SHED_STREAMS_HARD", "0"))
+# 读数低于阈值 × 该比例时才降回低一级（滞回）
+LOAD_SHED_RECOVERY_RATIO = float(os.getenv("LOAD_SHED_RECOVERY_RATIO", "0.9"))
+# 采样间隔（秒）
+LOAD_SHED_INTERVAL_SECONDS = float(os.getenv("LOAD_SHED_INTERVAL_SECONDS", "1"))
 
 # ==============================================================================
 # OIDC 配置 (AWS OIDC 设备授权)
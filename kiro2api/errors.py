@@ -0,0 +1,188 @@
+"""
+客户端错误消息目录
+按错误代码查找返回给客户端的消息，语言由 ERROR_LOCALE 决定（默认英文）；服务端日志保持原样
+"""
+
+import logging
+from typing import Dict, Optional
+
+from fastapi import HTTPException
+
+from config import ERROR_LOCALE
+
+logger = logging.getLogger(__name__)
+
+DEFAULT_LOCALE = "en"
+
+MESSAGES = {
+    "en": {
+        "missing_api_key": "You didn't provide an API key.",
+        "invalid_api_key_format": "Invalid API key format. Expected 'Bearer <key>'",
+        "invalid_api_key": "Invalid API key provided",
+        "invalid_admin_api_key": "Invalid admin API key provided. Admin endpoints only accept ADMIN_API_KEY.",
+        "admin_api_key_not_configured": "Admin endpoints are disabled. Set ADMIN_API_KEY to enable them.",
+        "model_not_found": "The model '{model}' does not exist or you do not have access to it. Available models: {available}.",
+        "no_messages": "No conversation messages found",
+        "invalid_json": "The request body is not valid JSON: {reason}",
+        "invalid_request_body": "Invalid request body at '{field}': {reason}",
+        "request_too_large": "Request body too large. The maximum allowed size is {limit} bytes.",
+        "invalid_base64_body": "The request body is declared as base64 ({declared}) but is not valid base64: {reason}",
+        "unsupported_parameter": "Unsupported parameter '{param_name}': {reason}.",
+        "invalid_usage_query": "Invalid usage query parameter '{param_name}': {reason}.",
+        "invalid_request_timeout": "Invalid X-Request-Timeout header '{value}': {reason}.",
+        "invalid_demo_option": "Invalid demo mode query parameter: {reason}.",
+        "unsupported_anthropic_version": "Unsupported anthropic-version '{version}'. Supported versions: {supported}.",
+        "invalid_tool_name": "Invalid tool name '{name}': {rule}",
+        "invalid_image_url": "Invalid image_url: {reason}",
+        "unsupported_image_type": "Unsupported image type '{media_type}'. Supported types: {supported}.",
+        "image_too_large": "Image is too large ({size} bytes). The maximum allowed size is {limit} bytes.",
+        "image_url_fetch_disabled": "Remote image URLs are not supported by this server; send the image as a base64 data: URL instead.",
+        "image_fetch_failed": "Failed to fetch image from {url}: {reason}",
+        "invalid_tool_choice": "Invalid tool_choice: {reason}",
+        "trailing_tool_use": "The conversation ends with an assistant tool_use ({ids}) that has no tool_result. Send the tool results in the next message before requesting a completion.",
+        "key_rate_limited": "Rate limit exceeded for this API key: {limit} requests per minute. Retry after {retry_after} seconds.",
+        "ip_rate_limited": "Rate limit exceeded for this client IP: {limit} requests per minute. Retry after {retry_after} seconds.",
+        "too_many_streams": "Too many concurrent streams for this API key: {active} active, {limit} allowed. Wait for a stream to finish and retry.",
+        "shutting_down": "The server is shutting down. Please retry the request.",
+        "overloaded": "The server is overloaded. Please retry the request later.",
+        "upstream_circuit_open": "The upstream service is failing and requests are temporarily paused. Retry after {retry_after} seconds.",
+        "no_token_available": "No access token available. Please check your KIRO_AUTH_CONFIG configuration.",
+        "token_invalid": "Token refresh failed and no backup accounts available",
+        "rate_limited": "All accounts rate limited. Please try again later.",
+        "quota_depleted": "All accounts have used up their configured request quota. Reset the token status or add accounts.",
+        "capacity_reserved": "Available accounts ({available}) are below the reserved minimum ({minimum}); only priority API keys are accepted right now. Please try again later.",
+        "upstream_error": "Upstream API error: {status}",
+        "upstream_empty_stream": "The upstream returned an empty response stream. Please retry the request.",
+        "upstream_error_detail": "Upstream API error: {status} ({detail})",
+        "api_call_failed": "API call failed: {detail}",
+        "account_not_found": "No account with index or name '{account}'.",
+        "token_refresh_failed": "Token refresh failed for: {accounts}.",
+        "upstream_timeout": "The upstream did not respond within {seconds:g} seconds.",
+        "upstream_block_limit": "The upstream response exceeded the limit of {limit} {kind}.",
+        "internal_error": "Internal server error: {detail}",
+        "account_not_found": "Account not found",
+        "task_not_found": "Task not found",
+        "task_running": "Cannot cancel a running task",
+        "task_finished": "Task has already finished and cannot be cancelled",
+        "task_cancel_failed": "Failed to cancel task",
+        "gptmail_not_configured": "GPTMail API is not configured, auto registration is unavailable. Please set the GPTMAIL_API_KEY environment variable.",
+    },
+    "zh": {
+        "missing_api_key": "未提供 API 密钥。",
+        "invalid_api_key_format": "API 密钥格式错误，应为 'Bearer <key>'",
+        "invalid_api_key": "API 密钥无效",
+        "invalid_admin_api_key": "管理 API 密钥无效，管理端点只接受 ADMIN_API_KEY",
+        "admin_api_key_not_configured": "管理端点未启用，请设置 ADMIN_API_KEY",
+        "model_not_found": "模型 '{model}' 不存在或无权访问。可用模型: {available}。",
+        "no_messages": "未找到对话消息",
+        "invalid_json": "请求体不是合法的 JSON: {reason}",
+        "invalid_request_body": "请求体字段 '{field}' 不合法: {reason}",
+        "request_too_large": "请求体过大，最大允许 {limit} 字节。",
+        "invalid_base64_body": "请求体声明为 base64（{declared}），但不是有效的 base64：{reason}",
+        "unsupported_parameter": "不支持的参数 '{param_name}'：{reason}。",
+        "invalid_usage_query": "用量查询参数 '{param_name}' 无效：{reason}。",
+        "invalid_request_timeout": "X-Request-Timeout 请求头 '{value}' 无效：{reason}。",
+        "invalid_demo_option": "演示模式查询参数无效：{reason}。",
+        "unsupported_anthropic_version": "不支持的 anthropic-version '{version}'，支持的版本：{supported}。",
+        "invalid_tool_name": "工具名 '{name}' 不合法: {rule}",
+        "invalid_image_url": "image_url 不合法: {reason}",
+        "unsupported_image_type": "不支持的图片类型 '{media_type}'，支持: {supported}。",
+        "image_too_large": "图片过大（{size} 字节），最大允许 {limit} 字节。",
+        "image_url_fetch_disabled": "服务器不支持远程图片 URL，请以 base64 data: URL 发送图片。",
+        "image_fetch_failed": "下载图片 {url} 失败: {reason}",
+        "invalid_tool_choice": "tool_choice 不合法: {reason}",
+        "trailing_tool_use": "对话以 assistant 的 tool_use（{ids}）结尾，但缺少对应的 tool_result。请先在下一条消息中发送工具执行结果。",
+        "key_rate_limited": "该 API 密钥的请求速率超过上限：每分钟 {limit} 次。请在 {retry_after} 秒后重试。",
+        "ip_rate_limited": "该客户端 IP 的请求速率超过上限：每分钟 {limit} 次。请在 {retry_after} 秒后重试。",
+        "too_many_streams": "该 API 密钥的并发流过多：当前 {active} 个，最多允许 {limit} 个。请等待已有的流结束后重试。",
+        "shutting_down": "服务正在关闭，请重试请求。",
+        "overloaded": "服务过载，请稍后重试。",
+        "upstream_circuit_open": "上游服务连续出错，请求已暂时停止转发。请在 {retry_after} 秒后重试。",
+        "no_token_available": "没有可用的访问令牌，请检查 KIRO_AUTH_CONFIG 配置。",
+        "token_invalid": "Token 刷新失败，且没有可用的备用账号",
+        "rate_limited": "所有账号均被限流，请稍后重试。",
+        "quota_depleted": "所有账号配置的请求额度都已用尽，请重置 token 状态或添加账号。",
+        "capacity_reserved": "可用账号数（{available}）低于保留下限（{minimum}），当前只接受优先级 API Key 的请求，请稍后重试。",
+        "upstream_error": "上游 API 错误: {status}",
+        "upstream_empty_stream": "上游返回了空的响应流，请重试。",
+        "upstream_error_detail": "上游 API 错误: {status}（{detail}）",
+        "api_call_failed": "API 调用失败: {detail}",
+        "account_not_found": "找不到序号或名称为 '{account}' 的账号。",
+        "token_refresh_failed": "以下账号刷新 token 失败：{accounts}。",
+        "upstream_timeout": "上游在 {seconds:g} 秒内没有完成响应。",
+        "upstream_block_limit": "上游响应超过了 {limit} 个 {kind} 的上限。",
+        "internal_error": "服务器内部错误: {detail}",
+        "account_not_found": "账号不存在",
+        "task_not_found": "任务不存在",
+        "task_running": "无法取消正在运行的任务",
+        "task_finished": "任务已结束，无法取消",
+        "task_cancel_failed": "取消任务失败",
+        "gptmail_not_configured": "未配置 GPTMail API，无法使用自动注册功能。请设置 GPTMAIL_API_KEY 环境变量。",
+    },
+}
+
+
+def localize(code: str, locale: Optional[str] = None, **params) -> str:
+    """
+    查找错误代码对应的消息
+
+    当前语言缺少该代码时回退到英文，英文也没有时直接返回代码本身
+    """
+    catalog = MESSAGES.get(locale or ERROR_LOCALE) or MESSAGES[DEFAULT_LOCALE]
+    template = catalog.get(code) or MESSAGES[DEFAULT_LOCALE].get(code)
+    if template is None:
+        logger.warning(f"⚠️ 未知的错误代码: {code}")
+        return code
+    try:
+        return template.format(**params)
+    except (KeyError, IndexError):
+        return template
+
+
+def respond_error(
+    status_code: int,
+    code: str,
+    error_type: str = "invalid_request_error",
+    param: Optional[str] = None,
+    api_code: Optional[str] = None,
+    headers: Optional[Dict[str, str]] = None,
+    **params,
+) -> HTTPException:
+    """
+    构造 OpenAI 格式的错误响应
+
+    code 是消息目录中的键；api_code 是响应体里的 error.code，默认与 code 相同
+    """
+    return HTTPException(
+        status_code=status_code,
+        detail={
+            "error": {
+                "message": localize(code, **params),
+                "type": error_type,
+                "param": param,
+                "code": api_code or code,
+            }
+        },
+        headers=headers,
+    )
+
+
+def respond_claude_error(
+    status_code: int,
+    code: str,
+    error_type: str = "api_error",
+    headers: Optional[Dict[str, str]] = None,
+    **params,
+) -> HTTPException:
+    """构造 Claude 格式的错误响应"""
+    return HTTPException(
+        status_code=status_code,
+        detail={
+            "type": "error",
+            "error": {
+                "type": error_type,
+                "message": localize(code, **params),
+            }
+        },
+        headers=headers,
+    )
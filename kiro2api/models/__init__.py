@@ -6,6 +6,7 @@ from .schemas import (
     Function,
     Tool,
     ChatCompletionRequest,
+    CompletionRequest,
     Usage,
     ResponseMessage,
     Choice,
@@ -38,6 +39,7 @@ __all__ = [
     "Function",
     "Tool",
     "ChatCompletionRequest",
+    "CompletionRequest",
     "Usage",
     "ResponseMessage",
     "Choice",
@@ -5,9 +5,11 @@ Claude API 数据结构定义
 
 import time
 import uuid
-from pydantic import BaseModel, Field
+from pydantic import BaseModel, Field, field_validator
 from typing import List, Optional, Dict, Any, Union
 
+from .schemas import ModelName
+
 
 # ============================================================================
 # Claude API 请求数据结构
@@ -17,6 +19,8 @@ class ClaudeTextContent(BaseModel):
     """Claude 文本内容块"""
     type: str = "text"
     text: str
+    # 提示缓存断点（{"type": "ephemeral"}），上游不支持，只在 token 计数中区分可缓存的前缀
+    cache_control: Optional[Dict[str, Any]] = None
 
 
 class ClaudeImageSource(BaseModel):
@@ -30,6 +34,7 @@ class ClaudeImageContent(BaseModel):
     """Claude 图片内容块"""
     type: str = "image"
     source: ClaudeImageSource
+    cache_control: Optional[Dict[str, Any]] = None
 
 
 class ClaudeToolUseContent(BaseModel):
@@ -38,6 +43,7 @@ class ClaudeToolUseContent(BaseModel):
     id: str
     name: str
     input: Dict[str, Any]
+    cache_control: Optional[Dict[str, Any]] = None
 
 
 class ClaudeToolResultContent(BaseModel):
@@ -46,6 +52,7 @@ class ClaudeToolResultContent(BaseModel):
     tool_use_id: str
     content: Union[str, List[Dict[str, Any]]]
     status: Optional[str] = "success"
+    cache_control: Optional[Dict[str, Any]] = None
 
 
 # Claude 内容块的联合类型
@@ -72,23 +79,51 @@ class ClaudeTool(BaseModel):
     name: str
     description: str
     input_schema: Dict[str, Any]
+    cache_control: Optional[Dict[str, Any]] = None
 
 
 class ClaudeSystemBlock(BaseModel):
-    """Claude System Prompt 块"""
+    """Claude System Prompt 块（只支持 text 类型）"""
     type: str = "text"
     text: str
+    cache_control: Optional[Dict[str, Any]] = None
+
+    @field_validator("type")
+    @classmethod
+    def _text_only(cls, value: str) -> str:
+        if value != "text":
+            raise ValueError(f"system blocks must be of type 'text', got '{value}'")
+        return value
 
 
 class ClaudeRequest(BaseModel):
     """Claude API 请求"""
-    model: str
+    model: ModelName
     messages: List[ClaudeMessage]
     max_tokens: Optional[int] = 4096
     temperature: Optional[float] = None
     tools: Optional[List[ClaudeTool]] = None
+    # {"type": "auto" | "any" | "none"} 或 {"type": "tool", "name": ...}，上游不支持，由代理近似实现
+    tool_choice: Optional[Union[str, Dict[str, Any]]] = None
     stream: Optional[bool] = True
-    system: Optional[Union[str, List[ClaudeSystemBlock]]] = None
+    # 上游不支持，由代理在输出文本上执行
+    stop_sequences: Optional[List[str]] = None
+    # 接受字符串、text 块数组或 null，统一为 text 块列表
+    system: Optional[List[ClaudeSystemBlock]] = None
+    # 只使用 user_id：作为对话标识沿用上游 conversationId（见 services/conversation_cache.py）
+    metadata: Optional[Dict[str, Any]] = None
+
+    @field_validator("system", mode="before")
+    @classmethod
+    def _normalize_system(cls, value):
+        """字符串形式的 system 转换为单个 text 块，空字符串视为没有 system"""
+        if isinstance(value, str):
+            return [{"type": "text", "text": value}] if value else None
+        return value
+
+    def system_text(self) -> str:
+        """system prompt 的纯文本（多个块以换行拼接）"""
+        return "\n".join(block.text for block in self.system or [])
 
 
 # ============================================================================
@@ -108,6 +143,9 @@ class ClaudeResponseContentBlock(BaseModel):
     id: Optional[str] = None
     name: Optional[str] = None
     input: Optional[Dict[str, Any]] = None
+    # thinking 块
+    thinking: Optional[str] = None
+    signature: Optional[str] = None
 
 
 class ClaudeResponse(BaseModel):
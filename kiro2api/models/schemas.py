@@ -1,8 +1,18 @@
 import time
 import uuid
 import logging
-from pydantic import BaseModel, Field
-from typing import List, Optional, Dict, Any, Union
+from pydantic import AfterValidator, BaseModel, Field
+from typing import Annotated, List, Optional, Dict, Any, Union
+
+
+def _canonical_model(value: str) -> str:
+    # 延迟导入：services 包在导入时依赖本模块
+    from services.model_mapping import canonical_model_name
+    return canonical_model_name(value)
+
+
+# 请求中的模型名：解析时应用 MODEL_ALIASES，之后的校验、映射和计量看到的都是规范名称
+ModelName = Annotated[str, AfterValidator(_canonical_model)]
 
 logger = logging.getLogger(__name__)
 
@@ -67,11 +77,13 @@ class Tool(BaseModel):
 
 
 class ChatCompletionRequest(BaseModel):
-    model: str
+    model: ModelName
     messages: List[ChatMessage]
     temperature: Optional[float] = 0.7
-    max_tokens: Optional[int] = 4000
+    max_tokens: Optional[int] = None
+    max_completion_tokens: Optional[int] = None
     stream: Optional[bool] = False
+    n: Optional[int] = 1
     top_p: Optional[float] = 1.0
     frequency_penalty: Optional[float] = 0.0
     presence_penalty: Optional[float] = 0.0
@@ -79,6 +91,44 @@ class ChatCompletionRequest(BaseModel):
     user: Optional[str] = None
     tools: Optional[List[Tool]] = None
     tool_choice: Optional[Union[str, Dict[str, Any]]] = "auto"
+    stream_options: Optional[Dict[str, Any]] = None
+    # 以下参数上游不支持，只用于校验（见 services/openai_params.py）
+    logprobs: Optional[bool] = None
+    top_logprobs: Optional[int] = None
+    response_format: Optional[Dict[str, Any]] = None
+    logit_bias: Optional[Dict[str, float]] = None
+    seed: Optional[int] = None
+
+    def include_stream_usage(self) -> bool:
+        """stream_options.include_usage：流式响应在 [DONE] 之前追加一个带 usage 的 chunk"""
+        return bool((self.stream_options or {}).get("include_usage"))
+
+    def output_token_limit(self) -> Optional[int]:
+        """输出 token 上限：max_completion_tokens 优先，其次兼容旧的 max_tokens"""
+        return self.max_completion_tokens or self.max_tokens
+
+
+class CompletionRequest(BaseModel):
+    """旧版 /v1/completions 请求（prompt 代替 messages），转换为聊天请求处理，见 services/legacy_completions.py"""
+    model: ModelName
+    prompt: Union[str, List[str], List[int], List[List[int]], None] = None
+    suffix: Optional[str] = None
+    # 旧接口默认 16，这里不设默认值，与聊天接口一样不限制
+    max_tokens: Optional[int] = None
+    temperature: Optional[float] = 0.7
+    top_p: Optional[float] = 1.0
+    n: Optional[int] = 1
+    best_of: Optional[int] = None
+    stream: Optional[bool] = False
+    stream_options: Optional[Dict[str, Any]] = None
+    logprobs: Optional[int] = None
+    echo: Optional[bool] = False
+    stop: Optional[Union[str, List[str]]] = None
+    presence_penalty: Optional[float] = 0.0
+    frequency_penalty: Optional[float] = 0.0
+    logit_bias: Optional[Dict[str, float]] = None
+    seed: Optional[int] = None
+    user: Optional[str] = None
 
 
 class Usage(BaseModel):
@@ -92,6 +142,8 @@ class Usage(BaseModel):
 class ResponseMessage(BaseModel):
     role: str
     content: Optional[str] = None
+    # 推理内容（extended thinking），与 DeepSeek / OpenRouter 等兼容接口的字段一致
+    reasoning_content: Optional[str] = None
     tool_calls: Optional[List[ToolCall]] = None
 
 
@@ -100,6 +152,8 @@ class Choice(BaseModel):
     message: ResponseMessage
     logprobs: Optional[Any] = None
     finish_reason: str
+    # 命中的停止序列（finish_reason 为 stop 时），与 vLLM 等兼容接口的扩展字段一致
+    stop_reason: Optional[str] = None
 
 
 class StreamChoice(BaseModel):
@@ -107,6 +161,7 @@ class StreamChoice(BaseModel):
     delta: Dict[str, Any]
     logprobs: Optional[Any] = None
     finish_reason: Optional[str] = None
+    stop_reason: Optional[str] = None
 
 
 class ChatCompletionResponse(BaseModel):
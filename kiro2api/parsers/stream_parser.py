@@ -1,22 +1,96 @@
 import re
 import json
+import zlib
 import struct
 import logging
-from typing import List, Dict, Any
+from typing import List, Dict, Any, Tuple
+
+from config import EVENT_STREAM_CRC_MODE
 
 logger = logging.getLogger(__name__)
 
+# 帧的最小长度：prelude（总长度 4 + 头部长度 4 + prelude CRC 4）+ 消息 CRC 4
+MIN_FRAME_LEN = 16
+
+# CRC 校验模式：strict 校验失败时抛出 EventStreamCorruptionError；lenient 记录日志并丢弃损坏的帧；off 不校验
+CRC_MODE_STRICT = "strict"
+CRC_MODE_LENIENT = "lenient"
+CRC_MODE_OFF = "off"
+
+
+class EventStreamCorruptionError(ValueError):
+    """event-stream 帧的 CRC 校验失败（strict 模式）"""
+
+
+class EventStreamErrorBudgetExhausted(ValueError):
+    """连续的解析错误超过 max_errors，之后的数据已无法可靠地对齐到帧，流以 error_budget_exhausted 结束"""
+
+
+def _crc32(data: bytes) -> int:
+    return zlib.crc32(data) & 0xFFFFFFFF
+
 
 class CodeWhispererStreamParser:
-    def __init__(self):
+    def __init__(self, crc_mode: str = EVENT_STREAM_CRC_MODE):
         self.buffer = b''
         self.error_count = 0
         self.max_errors = 5
+        self.crc_mode = crc_mode
+        # 因 CRC 校验失败丢弃的帧数（lenient 模式）
+        self.crc_errors = 0
+        # prelude 损坏后正在寻找下一个有效的帧起点（可能跨多次 parse 调用）
+        self._resyncing = False
+
+    def _crc_mismatch(self, message: str):
+        """strict 模式抛出异常，lenient 模式记录日志（计入连续解析错误），由调用方丢弃该帧"""
+        self.crc_errors += 1
+        if self.crc_mode == CRC_MODE_STRICT:
+            self.buffer = b''
+            raise EventStreamCorruptionError(message)
+        logger.error(f"❌ event-stream 帧损坏，已丢弃: {message}")
+        self._parse_error()
+
+    def _parse_error(self):
+        """记录一次解析错误；连续错误超过 max_errors 时清空缓冲区并抛出 EventStreamErrorBudgetExhausted"""
+        self.error_count += 1
+        if self.error_count > self.max_errors:
+            logger.error("Too many parsing errors, clearing buffer")
+            self.buffer = b''
+            raise EventStreamErrorBudgetExhausted(f"more than {self.max_errors} consecutive event-stream parsing errors")
+
+    def _skip_to_next_prelude(self) -> bool:
+        """
+        prelude 损坏时帧长度不可信：跳到下一个 prelude CRC 正确的位置并返回 True；
+        找不到时只保留末尾可能属于下一帧的字节，返回 False，等待更多数据后继续寻找
+        """
+        for offset in range(0, len(self.buffer) - 11):
+            total_len, header_len, prelude_crc = struct.unpack('>III', self.buffer[offset:offset + 12])
+            if (
+                total_len >= MIN_FRAME_LEN
+                and header_len <= total_len - MIN_FRAME_LEN
+                and _crc32(self.buffer[offset:offset + 8]) == prelude_crc
+            ):
+                self.buffer = self.buffer[offset:]
+                return True
+        self.buffer = self.buffer[-11:]
+        return False
 
     def parse(self, chunk: bytes) -> List[Dict[str, Any]]:
-        """解析AWS事件流格式的数据块"""
+        """
+        解析AWS事件流格式的数据块
+
+        帧可能在任意字节处被拆到两次读取中：不完整的帧保留在 buffer 里，与后续数据拼接后再解析，
+        每次只返回已经完整接收的帧对应的事件
+
+        crc_mode 不为 off 时校验 prelude CRC 和消息 CRC：prelude 损坏时帧长度不可信，向后寻找下一个 prelude CRC 正确的位置重新对齐；
+        消息 CRC 不匹配时丢弃整帧。strict 模式下两种情况都抛出 EventStreamCorruptionError。
+        丢弃的帧和无法解析的字节都计为解析错误，连续超过 max_errors 次（中间没有解析出事件）时抛出 EventStreamErrorBudgetExhausted
+        """
         self.buffer += chunk
-        logger.debug(f"Parser received {len(chunk)} bytes. Buffer size: {len(self.buffer)}")
+        # 每个数据块都会经过这里，调试日志关闭时不格式化日志内容（事件 dict 的 repr 开销不小）
+        debug = logger.isEnabledFor(logging.DEBUG)
+        if debug:
+            logger.debug(f"Parser received {len(chunk)} bytes. Buffer size: {len(self.buffer)}")
         events = []
         
         if len(self.buffer) < 12:
@@ -24,17 +98,33 @@ class CodeWhispererStreamParser:
             
         while len(self.buffer) >= 12:
             try:
+                if self._resyncing:
+                    if not self._skip_to_next_prelude():
+                        break
+                    self._resyncing = False
+
                 header_bytes = self.buffer[0:8]
                 total_len, header_len = struct.unpack('>II', header_bytes)
+
+                if self.crc_mode != CRC_MODE_OFF:
+                    (prelude_crc,) = struct.unpack('>I', self.buffer[8:12])
+                    if _crc32(header_bytes) != prelude_crc:
+                        self._crc_mismatch(f"prelude CRC mismatch (total_len={total_len}, header_len={header_len})")
+                        self._resyncing = True
+                        continue
+
+                # 长度小于最小帧长时不会消耗任何字节，不处理会死循环；逐字节跳过，重新对齐到下一帧
+                if total_len < MIN_FRAME_LEN or header_len > total_len - MIN_FRAME_LEN:
+                    logger.error(f"Invalid frame prelude: total_len={total_len}, header_len={header_len}")
+                    self.buffer = self.buffer[1:]
+                    self._parse_error()
+                    continue
                 
                 # 安全检查
                 if total_len > 2000000 or header_len > 2000000:
                     logger.error(f"Unreasonable header values: total_len={total_len}, header_len={header_len}")
                     self.buffer = self.buffer[8:]
-                    self.error_count += 1
-                    if self.error_count > self.max_errors:
-                        logger.error("Too many parsing errors, clearing buffer")
-                        self.buffer = b''
+                    self._parse_error()
                     continue
 
                 # 等待完整帧
@@ -45,6 +135,12 @@ class CodeWhispererStreamParser:
                 frame = self.buffer[:total_len]
                 self.buffer = self.buffer[total_len:]
 
+                if self.crc_mode != CRC_MODE_OFF:
+                    (message_crc,) = struct.unpack('>I', frame[-4:])
+                    if _crc32(frame[:-4]) != message_crc:
+                        self._crc_mismatch(f"message CRC mismatch (total_len={total_len})")
+                        continue
+
                 # 提取有效载荷
                 payload_start = 8 + header_len
                 payload_end = total_len - 4  # 减去尾部CRC
@@ -65,29 +161,24 @@ class CodeWhispererStreamParser:
                         json_payload = payload_str[json_start_index:]
                         event_data = json.loads(json_payload)
                         events.append(event_data)
-                        logger.debug(f"Successfully parsed event: {event_data}")
+                        self.error_count = 0
+                        if debug:
+                            logger.debug(f"Successfully parsed event: {event_data}")
                 except json.JSONDecodeError as e:
                     logger.error(f"JSON decode error: {e}")
                     continue
 
+            except (EventStreamCorruptionError, EventStreamErrorBudgetExhausted):
+                raise
             except struct.error as e:
                 logger.error(f"Struct unpack error: {e}")
                 self.buffer = self.buffer[1:]
-                self.error_count += 1
-                if self.error_count > self.max_errors:
-                    logger.error("Too many parsing errors, clearing buffer")
-                    self.buffer = b''
+                self._parse_error()
             except Exception as e:
                 logger.error(f"Unexpected error during parsing: {str(e)}")
                 self.buffer = self.buffer[1:]
-                self.error_count += 1
-                if self.error_count > self.max_errors:
-                    logger.error("Too many parsing errors, clearing buffer")
-                    self.buffer = b''
+                self._parse_error()
         
-        if events:
-            self.error_count = 0
-            
         return events
 
     def flush(self) -> List[Dict[str, Any]]:
@@ -115,6 +206,7 @@ class CodeWhispererStreamParser:
                     event_data = json.loads(match)
                     if event_data:  # 确保不是空对象
                         events.append(event_data)
+                        self.error_count = 0
                         logger.debug(f"Flush extracted event: {event_data}")
                 except json.JSONDecodeError:
                     continue
@@ -152,6 +244,66 @@ class CodeWhispererStreamParser:
         return len(self.buffer)
 
 
+# event-stream 头的值类型对应的定长字节数（bool 类型没有值，字符串和字节数组带 2 字节长度前缀）
+_HEADER_FIXED_SIZES = {0: 0, 1: 0, 2: 1, 3: 2, 4: 4, 5: 8, 8: 8, 9: 16}
+
+
+def parse_event_stream_headers(data: bytes) -> Dict[str, Any]:
+    """解析一帧 event-stream 的头部（:event-type、:message-type、:exception-type 等）"""
+    headers: Dict[str, Any] = {}
+    offset = 0
+    while offset < len(data):
+        name_len = data[offset]
+        name = data[offset + 1:offset + 1 + name_len].decode("utf-8", errors="replace")
+        offset += 1 + name_len
+        value_type = data[offset]
+        offset += 1
+        if value_type in (6, 7):
+            (value_len,) = struct.unpack(">H", data[offset:offset + 2])
+            raw = data[offset + 2:offset + 2 + value_len]
+            headers[name] = raw.decode("utf-8", errors="replace") if value_type == 7 else raw
+            offset += 2 + value_len
+        elif value_type in _HEADER_FIXED_SIZES:
+            size = _HEADER_FIXED_SIZES[value_type]
+            headers[name] = value_type == 0 if size == 0 else data[offset:offset + size]
+            offset += size
+        else:
+            raise ValueError(f"unknown event-stream header type {value_type}")
+    return headers
+
+
+def looks_like_event_stream(body: bytes) -> bool:
+    """按前导字节（prelude 长度和 prelude CRC）判断是否为 event-stream 编码"""
+    if len(body) < 16:
+        return False
+    total_len, header_len = struct.unpack(">II", body[:8])
+    (prelude_crc,) = struct.unpack(">I", body[8:12])
+    return (
+        16 <= total_len <= len(body)
+        and header_len <= total_len - 16
+        and zlib.crc32(body[:8]) & 0xFFFFFFFF == prelude_crc
+    )
+
+
+def decode_event_stream_frames(body: bytes) -> List[Tuple[Dict[str, Any], bytes]]:
+    """把完整的 event-stream 字节解码为 (头部, payload) 列表，遇到不完整或损坏的帧即停止"""
+    frames = []
+    offset = 0
+    while len(body) - offset >= MIN_FRAME_LEN:
+        total_len, header_len = struct.unpack(">II", body[offset:offset + 8])
+        if total_len < MIN_FRAME_LEN or offset + total_len > len(body) or header_len > total_len - MIN_FRAME_LEN:
+            break
+        frame = body[offset:offset + total_len]
+        try:
+            headers = parse_event_stream_headers(frame[12:12 + header_len])
+        except (ValueError, IndexError, struct.error) as e:
+            logger.warning(f"event-stream 头部解析失败: {e}")
+            break
+        frames.append((headers, frame[12 + header_len:total_len - 4]))
+        offset += total_len
+    return frames
+
+
 class SimpleResponseParser:
     @staticmethod
     def parse_event_stream_to_json(raw_data: bytes) -> Dict[str, Any]:
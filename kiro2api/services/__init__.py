@@ -1,9 +1,10 @@
 from .request_builder import build_codewhisperer_request
 from .response_handler import (
-    call_kiro_api,
+    iter_kiro_events,
     estimate_tokens,
     create_usage_stats,
     create_non_streaming_response,
+    create_multi_choice_response,
     create_streaming_response,
 )
 from .claude_converter import convert_claude_to_codewhisperer_request
@@ -11,10 +12,11 @@ from .claude_stream_handler import ClaudeStreamHandler, handle_claude_stream
 
 __all__ = [
     "build_codewhisperer_request",
-    "call_kiro_api",
+    "iter_kiro_events",
     "estimate_tokens",
     "create_usage_stats",
     "create_non_streaming_response",
+    "create_multi_choice_response",
     "create_streaming_response",
     "convert_claude_to_codewhisperer_request",
     "ClaudeStreamHandler",
@@ -0,0 +1,123 @@
+"""
+访问日志
+每个 HTTP 请求结束时输出一条 JSON 访问日志（logger kiro2api.access，级别由 ACCESS_LOG_LEVEL 控制），汇总：
+
+- request_id、message_id、方法、路径、匹配的路由、客户端 IP、ACCESS_LOG_HEADERS 中列出的请求头（经过脱敏）
+- HTTP 状态码、最后一次上游调用的状态码和请求 ID、请求结果类别、耗时、请求/响应字节数
+- 模型、是否流式、input/output token 数（由处理器通过 annotate_request 写入请求上下文，没有时为 null）
+- 请求级警告（add_request_warning，没有时为 null）
+- 流式响应按事件类型的个数和字节数（stream_events，非流式请求为 null）
+- 本请求求值过的功能开关及结果（feature_flags，没有时为 null）
+
+流式响应在最后一个字节写出后才记录。响应都带 X-Request-ID 头，与访问日志、计量记录中的 request_id 一致；
+调用过上游的响应（包括错误响应）还带 X-Upstream-Request-Id 头，值为上游返回的请求 ID；
+ACCESS_LOG_SKIP_PATHS 中的路径（默认健康检查和指标）不记录
+"""
+
+import json
+import time
+import logging
+
+from config import ACCESS_LOG_ENABLED, ACCESS_LOG_SKIP_PATHS, ACCESS_LOG_LEVEL, ACCESS_LOG_HEADERS
+from services.accounting import classify_status
+from services.request_context import REQUEST_ID_HEADER, UPSTREAM_REQUEST_ID_HEADER, start_request_context
+from services.request_sampler import redact
+
+logger = logging.getLogger(__name__)
+access_logger = logging.getLogger("kiro2api.access")
+
+
+class AccessLogMiddleware:
+    """
+    ASGI 中间件：为请求分配 request_id，记录读取和写出的字节数、状态码，请求结束时输出一条访问日志
+
+    应作为最外层中间件注册，这样 413 等由其他中间件直接返回的响应也会被记录
+    """
+
+    def __init__(
+        self,
+        app,
+        enabled: bool = ACCESS_LOG_ENABLED,
+        skip_paths=ACCESS_LOG_SKIP_PATHS,
+        level: str = ACCESS_LOG_LEVEL,
+        headers=ACCESS_LOG_HEADERS,
+    ):
+        self.app = app
+        self.enabled = enabled
+        self.skip_paths = set(skip_paths)
+        level_value = logging.getLevelName(level)
+        self.level = level_value if isinstance(level_value, int) else logging.INFO
+        self.headers = [name.lower() for name in headers]
+
+    async def __call__(self, scope, receive, send):
+        if scope["type"] != "http":
+            await self.app(scope, receive, send)
+            return
+
+        headers = dict(scope.get("headers") or [])
+        client_request_id = headers.get(REQUEST_ID_HEADER.encode(), b"").decode("latin-1")
+        context = start_request_context(client_request_id)
+        started = time.monotonic()
+        status_code = 500
+        bytes_in = 0
+        bytes_out = 0
+
+        async def receive_wrapper():
+            nonlocal bytes_in
+            message = await receive()
+            if message["type"] == "http.request":
+                bytes_in += len(message.get("body", b""))
+            return message
+
+        async def send_wrapper(message):
+            nonlocal status_code, bytes_out
+            if message["type"] == "http.response.start":
+                status_code = message["status"]
+                message = dict(message)
+                message["headers"] = list(message.get("headers") or []) + [
+                    (REQUEST_ID_HEADER.encode(), context.request_id.encode())
+                ]
+                if context.upstream_request_id:
+                    message["headers"].append(
+                        (UPSTREAM_REQUEST_ID_HEADER.encode(), context.upstream_request_id.encode("latin-1"))
+                    )
+            elif message["type"] == "http.response.body":
+                bytes_out += len(message.get("body", b""))
+            await send(message)
+
+        try:
+            await self.app(scope, receive_wrapper, send_wrapper)
+        finally:
+            path = scope.get("path", "")
+            if self.enabled and path not in self.skip_paths and access_logger.isEnabledFor(self.level):
+                client = scope.get("client")
+                route = scope.get("route")
+                entry = {
+                    "request_id": context.request_id,
+                    "message_id": context.message_id,
+                    "method": scope.get("method", ""),
+                    "path": path,
+                    "route": getattr(route, "path", None),
+                    "client_ip": client[0] if client else None,
+                    "model": context.model,
+                    "stream": context.stream,
+                    "status": status_code,
+                    "upstream_status": context.upstream_status,
+                    "upstream_request_id": context.upstream_request_id,
+                    "class": context.outcome_class or classify_status(status_code),
+                    "duration_ms": int((time.monotonic() - started) * 1000),
+                    "bytes_in": bytes_in,
+                    "bytes_out": bytes_out,
+                    "input_tokens": context.input_tokens,
+                    "output_tokens": context.output_tokens,
+                    "warnings": context.warnings or None,
+                    "stream_events": context.stream_events,
+                    "feature_flags": context.feature_flags or None,
+                }
+                if self.headers:
+                    entry["headers"] = redact({
+                        name: headers[name.encode()].decode("latin-1")
+                        for name in self.headers
+                        if name.encode() in headers
+                    })
+                access_logger.log(self.level, json.dumps(entry, ensure_ascii=False))
@@ -0,0 +1,237 @@
+"""
+请求计量
+计量分两个层级，都发布到 completion_bus 上，由订阅者各取所需：
+
+- 上游调用级（UpstreamCallRecord）：每一次实际发往 CodeWhisperer 的 HTTP 调用一条，
+  带 attempt 序号和 fanout 标签（primary / retry_forbidden / retry_rate_limited / retry_transient / retry_conversation），预算按这一层扣减
+- 客户端请求级（ClientRequestRecord）：每个 API 请求恰好一条，汇总该请求的 token 和上游调用次数，限流按这一层计数
+
+重试、切换账号等额外的上游调用只会增加上游调用级记录，不会让客户端请求级记录重复
+
+每次上游调用还会在请求内记录一条明细（脱敏的 token、模型、耗时、状态码或错误，以及之后的决定：
+accept / retry / fallback 切换账号 / abort），客户端带 X-Kiro-Debug 且有权限时附在错误响应中
+
+客户端请求级记录带 outcome_class，区分请求失败的责任方，告警和账号错误计数按它区分：
+success / client_error（请求本身不合法、客户端断开）/ upstream_error（上游或账号的问题）/ proxy_error（代理自身的异常）
+
+客户端请求级记录还带 API Key 标签和 transcript()：按需取出客户端请求体和模型输出（审计日志使用），
+不需要的订阅者不调用就不会产生额外开销
+"""
+
+import time
+import logging
+from dataclasses import dataclass, field
+from typing import Any, Callable, Dict, List, Optional, Tuple
+
+from services.request_context import current_request_context, new_request_id, annotate_request
+
+logger = logging.getLogger(__name__)
+
+FANOUT_PRIMARY = "primary"
+FANOUT_RETRY_FORBIDDEN = "retry_forbidden"
+FANOUT_RETRY_RATE_LIMITED = "retry_rate_limited"
+FANOUT_RETRY_TRANSIENT = "retry_transient"
+# 上游拒绝沿用的 conversationId 后换新对话重试
+FANOUT_RETRY_CONVERSATION = "retry_conversation"
+
+# 上游调用之后的决定
+DECISION_ACCEPT = "accept"
+DECISION_RETRY = "retry"
+DECISION_FALLBACK = "fallback"
+DECISION_ABORT = "abort"
+
+OUTCOME_SUCCESS = "success"
+OUTCOME_CLIENT_ERROR = "client_error"
+OUTCOME_UPSTREAM_ERROR = "upstream_error"
+OUTCOME_PROXY_ERROR = "proxy_error"
+
+# 由上游或账号状态导致的错误状态码（401 为上游 token 失效，API Key 校验在计量开始之前完成）
+UPSTREAM_ERROR_STATUSES = (401, 403, 429, 502, 503, 504)
+
+
+def classify_status(status_code: int) -> str:
+    """按返回给客户端的状态码判断请求结果的类别"""
+    if status_code < 400:
+        return OUTCOME_SUCCESS
+    if status_code in UPSTREAM_ERROR_STATUSES:
+        return OUTCOME_UPSTREAM_ERROR
+    if status_code < 500:
+        return OUTCOME_CLIENT_ERROR
+    return OUTCOME_PROXY_ERROR
+
+
+@dataclass
+class UpstreamCallRecord:
+    """一次实际的上游调用"""
+    request_id: str
+    attempt: int
+    fanout: str
+    account: Optional[str]
+    status_code: Optional[int]
+    latency_ms: int
+    error: Optional[str] = None
+    timestamp: float = field(default_factory=time.time)
+    upstream_request_id: Optional[str] = None
+
+
+@dataclass
+class ClientRequestRecord:
+    """一次客户端 API 请求的汇总"""
+    request_id: str
+    api: str
+    model: str
+    stream: bool
+    status: str
+    upstream_calls: int
+    input_tokens: int
+    output_tokens: int
+    duration_ms: int
+    end_reason: Optional[str] = None
+    outcome_class: str = OUTCOME_SUCCESS
+    timestamp: float = field(default_factory=time.time)
+    key_label: Optional[str] = None
+    # 返回 {"request": 客户端请求体, "response": 模型输出文本}，没有时为 None
+    transcript: Optional[Callable[[], Dict[str, Any]]] = field(default=None, repr=False, compare=False)
+
+
+class CompletionBus:
+    """进程内的计量事件总线，订阅者抛出的异常不会影响请求处理"""
+
+    def __init__(self):
+        self._subscribers: List[Callable] = []
+
+    def subscribe(self, callback: Callable):
+        self._subscribers.append(callback)
+
+    def publish(self, record):
+        for callback in self._subscribers:
+            try:
+                callback(record)
+            except Exception as e:
+                logger.error(f"计量订阅者处理失败: {e}")
+
+
+# 全局单例
+completion_bus = CompletionBus()
+
+
+class RequestAccounting:
+    """
+    单个客户端请求的计量上下文
+
+    上游执行器每发出一次调用就调用 record_upstream_call；请求结束时调用 finish，
+    finish 只在第一次调用时发布记录，保证客户端请求级记录恰好一条
+    """
+
+    def __init__(self, api: str, model: str, stream: bool):
+        # 与访问日志、X-Request-ID 响应头使用同一个 request_id
+        self._context = current_request_context()
+        self.request_id = self._context.request_id if self._context else new_request_id()
+        annotate_request(model=model, stream=stream)
+        self.api = api
+        self.model = model
+        self.stream = stream
+        self.started_at = time.monotonic()
+        self.upstream_calls = 0
+        self.input_tokens = 0
+        self.output_tokens = 0
+        # 流式请求在结束时才知道 token 数，由处理器提供 (input_tokens, output_tokens)
+        self.usage_source: Optional[Callable[[], Tuple[int, int]]] = None
+        # 客户端请求体和模型输出文本，由处理器提供，只在订阅者调用 transcript() 时才取值
+        self.request_source: Optional[Callable[[], Dict[str, Any]]] = None
+        self.response_source: Optional[Callable[[], str]] = None
+        self.key_label = self._context.key_label if self._context else None
+        self._finished = False
+        # 本请求的上游调用明细，与请求上下文共享
+        self.attempts: List[Dict[str, Any]] = []
+        if self._context:
+            self._context.upstream_attempts = self.attempts
+
+    def record_upstream_call(
+        self,
+        status_code: Optional[int],
+        latency_ms: int,
+        fanout: str = FANOUT_PRIMARY,
+        account: Optional[str] = None,
+        error: Optional[str] = None,
+        model: Optional[str] = None,
+        token_preview: Optional[str] = None,
+        upstream_request_id: Optional[str] = None,
+    ):
+        self.upstream_calls += 1
+        annotate_request(upstream_status=status_code)
+        self.attempts.append({
+            "attempt": self.upstream_calls,
+            "fanout": fanout,
+            "account": account,
+            "token": token_preview,
+            "model": model,
+            "duration_ms": latency_ms,
+            "status": status_code,
+            "error": error,
+            "upstream_request_id": upstream_request_id,
+            "decision": None,
+        })
+        completion_bus.publish(UpstreamCallRecord(
+            request_id=self.request_id,
+            attempt=self.upstream_calls,
+            fanout=fanout,
+            account=account,
+            status_code=status_code,
+            latency_ms=latency_ms,
+            error=error,
+            upstream_request_id=upstream_request_id,
+        ))
+
+    def record_decision(self, decision: str, reason: Optional[str] = None):
+        """记录最近一次上游调用之后的决定（accept / retry / fallback / abort）"""
+        if not self.attempts:
+            return
+        self.attempts[-1]["decision"] = decision
+        if reason and not self.attempts[-1]["error"]:
+            self.attempts[-1]["error"] = reason
+
+    def transcript(self) -> Dict[str, Any]:
+        return {
+            "request": self.request_source() if self.request_source else None,
+            "response": self.response_source() if self.response_source else None,
+        }
+
+    def finish(self, status: str, end_reason: Optional[str] = None, outcome_class: Optional[str] = None) -> bool:
+        """
+        发布客户端请求级记录，已经发布过时返回 False
+
+        outcome_class 未指定时，status 为 ok 记为 success，否则记为 proxy_error
+        """
+        if self._finished:
+            return False
+        self._finished = True
+        outcome_class = outcome_class or (OUTCOME_SUCCESS if status == "ok" else OUTCOME_PROXY_ERROR)
+
+        if self.usage_source:
+            try:
+                self.input_tokens, self.output_tokens = self.usage_source()
+            except Exception as e:
+                logger.warning(f"获取请求 token 统计失败: {e}")
+
+        if self._context:
+            self._context.outcome_class = outcome_class
+            self._context.input_tokens = self.input_tokens
+            self._context.output_tokens = self.output_tokens
+
+        completion_bus.publish(ClientRequestRecord(
+            request_id=self.request_id,
+            api=self.api,
+            model=self.model,
+            stream=self.stream,
+            status=status,
+            upstream_calls=self.upstream_calls,
+            input_tokens=self.input_tokens,
+            output_tokens=self.output_tokens,
+            duration_ms=int((time.monotonic() - self.started_at) * 1000),
+            end_reason=end_reason,
+            outcome_class=outcome_class,
+            key_label=self.key_label,
+            transcript=self.transcript,
+        ))
+        return True
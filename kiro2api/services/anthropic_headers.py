@@ -0,0 +1,98 @@
+"""
+anthropic-version / anthropic-beta 请求头
+Anthropic SDK 总会发送 anthropic-version，部分配置还会发送 anthropic-beta；Claude 接口（/v1/messages 系列）按真实 API 的方式处理：
+
+- anthropic-version：不在 ANTHROPIC_VERSIONS 中时返回 400 invalid_request_error；没有这个头时按默认版本处理（方便 curl 调试）
+- anthropic-beta：逗号分隔的 beta 标记，可以出现多次。上游没有对应的开关，已知的标记照常接受，
+  未知的标记记录请求级警告后忽略；解析结果写入请求上下文，由处理函数记录到日志
+- 响应（包括错误响应）都带 anthropic-version 头，值为请求使用的版本
+"""
+
+import logging
+from typing import List, Optional
+
+from fastapi.responses import JSONResponse
+
+from config import ANTHROPIC_VERSIONS
+from errors import respond_claude_error
+from services.request_context import add_request_warning, annotate_request
+from services.request_validation import CLAUDE_PATH_PREFIX
+
+logger = logging.getLogger(__name__)
+
+VERSION_HEADER = b"anthropic-version"
+BETA_HEADER = b"anthropic-beta"
+
+# 没有 anthropic-version 头时使用的版本（ANTHROPIC_VERSIONS 中的第一个）
+DEFAULT_ANTHROPIC_VERSION = ANTHROPIC_VERSIONS[0] if ANTHROPIC_VERSIONS else "2023-06-01"
+
+# 已知的 beta 标记：上游没有对应开关，请求和响应格式不受影响，接受后只记录到日志
+KNOWN_BETAS = frozenset({
+    "token-efficient-tools-2025-02-19",
+    "context-1m-2025-08-07",
+    "interleaved-thinking-2025-05-14",
+    "fine-grained-tool-streaming-2025-05-14",
+    "output-128k-2025-02-19",
+    "prompt-caching-2024-07-31",
+    "extended-cache-ttl-2025-04-11",
+})
+
+
+def parse_betas(values: List[bytes]) -> List[str]:
+    """合并所有 anthropic-beta 头中的标记（去重，保持顺序）"""
+    betas = []
+    for value in values:
+        for beta in value.decode("latin-1").split(","):
+            beta = beta.strip()
+            if beta and beta not in betas:
+                betas.append(beta)
+    return betas
+
+
+class AnthropicHeadersMiddleware:
+    """ASGI 中间件：校验 Claude 接口的 anthropic-version，解析 anthropic-beta，并在响应中回显 anthropic-version"""
+
+    def __init__(self, app, versions: List[str] = ANTHROPIC_VERSIONS):
+        self.app = app
+        self.versions = versions
+
+    async def __call__(self, scope, receive, send):
+        if scope["type"] != "http" or not scope.get("path", "").startswith(CLAUDE_PATH_PREFIX):
+            await self.app(scope, receive, send)
+            return
+
+        raw_headers = scope.get("headers") or []
+        requested: Optional[str] = None
+        beta_values = []
+        for name, value in raw_headers:
+            name = name.lower()
+            if name == VERSION_HEADER:
+                requested = value.decode("latin-1").strip()
+            elif name == BETA_HEADER:
+                beta_values.append(value)
+
+        if requested is not None and self.versions and requested not in self.versions:
+            logger.warning(f"⚠️ 不支持的 anthropic-version: {requested}")
+            error = respond_claude_error(
+                400, "unsupported_anthropic_version", "invalid_request_error",
+                version=requested, supported=", ".join(self.versions),
+            )
+            response = JSONResponse(status_code=error.status_code, content={"detail": error.detail})
+            await response(scope, receive, send)
+            return
+
+        version = requested or DEFAULT_ANTHROPIC_VERSION
+        betas = parse_betas(beta_values)
+        unknown = [beta for beta in betas if beta not in KNOWN_BETAS]
+        if unknown:
+            logger.warning(f"⚠️ 忽略未知的 anthropic-beta: {', '.join(unknown)}")
+            add_request_warning(f"ignored unknown anthropic-beta flags: {', '.join(unknown)}")
+        annotate_request(anthropic_version=version, anthropic_betas=betas or None)
+
+        async def send_with_version(message):
+            if message["type"] == "http.response.start":
+                message = dict(message)
+                message["headers"] = list(message.get("headers") or []) + [(VERSION_HEADER, version.encode("latin-1"))]
+            await send(message)
+
+        await self.app(scope, receive, send_with_version)
@@ -0,0 +1,62 @@
+"""
+单个响应的内容块和工具调用数量上限
+流处理器为每个内容块和工具调用保存状态（块索引、工具调用 id 和参数），上游异常时可能在一个响应里发出成千上万个块，
+连接保持打开期间这些状态会一直增长。OpenAIStreamHandler 和 ClaudeStreamHandler 在分配新的块 / 工具调用之前
+经过 BlockLimits 计数：
+
+- 内容块：Claude 的 content_block（text / thinking / tool_use），上限 STREAM_MAX_CONTENT_BLOCKS
+- 工具调用：两个接口的 tool_use / tool_calls，上限 STREAM_MAX_TOOL_CALLS
+
+超过上限时抛出 BlockLimitError（尚未为该块分配任何状态），由各接口按上游错误的方式收尾：
+流式响应在流内报错结束（结束原因 block_limit，计为 proxy_error），非流式响应返回 502。两个值为 0 时分别不限
+"""
+
+import logging
+from typing import Optional
+
+from config import STREAM_MAX_CONTENT_BLOCKS, STREAM_MAX_TOOL_CALLS
+
+logger = logging.getLogger(__name__)
+
+KIND_CONTENT_BLOCKS = "content blocks"
+KIND_TOOL_CALLS = "tool calls"
+
+
+class BlockLimitError(Exception):
+    """响应中的内容块或工具调用超过上限"""
+
+    def __init__(self, kind: str, limit: int, blocks: int, tool_calls: int):
+        super().__init__(f"upstream response exceeded the limit of {limit} {kind}")
+        self.kind = kind
+        self.limit = limit
+        self.blocks = blocks
+        self.tool_calls = tool_calls
+
+
+class BlockLimits:
+    """单个响应已分配的内容块和工具调用计数"""
+
+    def __init__(self, max_blocks: Optional[int] = None, max_tool_calls: Optional[int] = None):
+        # 未指定时使用创建时的 STREAM_MAX_CONTENT_BLOCKS / STREAM_MAX_TOOL_CALLS
+        self.max_blocks = STREAM_MAX_CONTENT_BLOCKS if max_blocks is None else max_blocks
+        self.max_tool_calls = STREAM_MAX_TOOL_CALLS if max_tool_calls is None else max_tool_calls
+        self.blocks = 0
+        self.tool_calls = 0
+
+    def _exceeded(self, kind: str, limit: int) -> BlockLimitError:
+        logger.error(
+            f"❌ 上游响应超过 {kind} 上限 {limit}，中止响应 (content_blocks={self.blocks}, tool_calls={self.tool_calls})"
+        )
+        return BlockLimitError(kind, limit, self.blocks, self.tool_calls)
+
+    def add_block(self):
+        """分配新的内容块之前调用，超过上限时抛出 BlockLimitError"""
+        if self.max_blocks > 0 and self.blocks >= self.max_blocks:
+            raise self._exceeded(KIND_CONTENT_BLOCKS, self.max_blocks)
+        self.blocks += 1
+
+    def add_tool_call(self):
+        """分配新的工具调用之前调用，超过上限时抛出 BlockLimitError"""
+        if self.max_tool_calls > 0 and self.tool_calls >= self.max_tool_calls:
+            raise self._exceeded(KIND_TOOL_CALLS, self.max_tool_calls)
+        self.tool_calls += 1
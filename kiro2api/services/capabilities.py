@@ -0,0 +1,117 @@
+"""
+能力说明文档（GET /v1/capabilities）
+客户端据此判断当前部署支持哪些功能（图片、工具、JSON 模式、可恢复流等）以及各项限制，而不是逐个试错
+
+文档在每次请求时从实际执行这些功能和限制的模块上读取当前值组装，不单独维护一份配置，避免与真实行为不一致
+"""
+
+from typing import Any, Dict, Optional
+
+import config
+from services import anthropic_headers, conversation_cache, feature_flags, image_input, ip_rate_limit, openai_params, model_mapping, request_builder, request_limits, response_shape, stream_mode, tokenizer, tool_utils, upstream
+from auth import capacity, rate_limits, stream_limits
+
+# 文档结构版本，字段含义变化时递增
+CAPABILITIES_VERSION = 1
+
+# 各模型的上下文窗口（token），上游没有提供查询接口，按 Claude 模型的公开规格填写，仅供客户端参考
+DEFAULT_CONTEXT_WINDOW = 200000
+
+# 各接口支持的功能
+API_CAPABILITIES: Dict[str, Dict[str, Any]] = {
+    "openai_chat_completions": {
+        "path": "/v1/chat/completions",
+        "streaming": True,
+        "tools": True,
+        "vision": True,
+        "json_mode": False,
+        "reasoning": True,
+        "stop_sequences": True,
+        "tool_choice": True,
+        "resumable_streams": False,
+        "count_tokens": "/v1/chat/completions/count_tokens",
+    },
+    "openai_completions": {
+        "path": "/v1/completions",
+        "streaming": True,
+        "tools": False,
+        "vision": False,
+        "json_mode": False,
+        "reasoning": False,
+        "stop_sequences": True,
+        "tool_choice": False,
+        "resumable_streams": False,
+        "count_tokens": None,
+    },
+    "anthropic_messages": {
+        "path": "/v1/messages",
+        "streaming": True,
+        "tools": True,
+        "vision": True,
+        "json_mode": False,
+        "reasoning": True,
+        "stop_sequences": True,
+        "tool_choice": True,
+        "resumable_streams": False,
+        "count_tokens": "/v1/messages/count_tokens",
+    },
+}
+
+
+def _limit(value: int) -> Optional[int]:
+    """0 表示不限制，对外统一输出为 null"""
+    return value if value > 0 else None
+
+
+def build_capabilities() -> Dict[str, Any]:
+    return {
+        "object": "capabilities",
+        "version": CAPABILITIES_VERSION,
+        "apis": API_CAPABILITIES,
+        "models": [
+            {
+                "id": model_id,
+                "upstream_model": upstream_model,
+                "context_window": DEFAULT_CONTEXT_WINDOW,
+                "tools": True,
+                "vision": True,
+            }
+            for model_id, upstream_model in model_mapping.MODEL_MAP.items()
+            if model_id in model_mapping.listed_models()
+        ],
+        "model_patterns": {pattern: model_mapping.MODEL_MAP[pattern] for pattern in model_mapping.MODEL_PATTERNS},
+        "features": {
+            "demo_mode": upstream.DEMO_MODE,
+            "metrics": config.METRICS_ENABLED,
+            "max_tokens_enforced": tokenizer.ENFORCE_MAX_TOKENS,
+            "tokenizer": tokenizer.TOKENIZER_BACKEND,
+            "tool_compaction": request_builder.TOOL_COMPACTION_ENABLED,
+            "tool_name_policy": tool_utils.TOOL_NAME_POLICY,
+            "trailing_tool_use_policy": tool_utils.TRAILING_TOOL_USE_POLICY,
+            "response_shapes": [response_shape.SHAPE_FULL, response_shape.SHAPE_LEAN],
+            "default_response_shape": response_shape.RESPONSE_SHAPE,
+            "stream_mode_resolution": stream_mode.STREAM_MODE_RESOLUTION,
+            "upstream_prefetch": upstream.UPSTREAM_PREFETCH,
+            "image_url_fetch": image_input.IMAGE_URL_FETCH_ENABLED,
+            "anthropic_versions": anthropic_headers.ANTHROPIC_VERSIONS,
+            "anthropic_betas": sorted(anthropic_headers.KNOWN_BETAS),
+            "conversation_cache": conversation_cache.conversation_cache.enabled,
+            "response_formats": list(openai_params.SUPPORTED_RESPONSE_FORMATS),
+            "feature_flags": feature_flags.feature_flags.describe(),
+        },
+        "limits": {
+            "max_request_body_bytes": _limit(request_limits.MAX_REQUEST_BODY_BYTES),
+            "max_tools": None,
+            "max_image_bytes": _limit(image_input.MAX_IMAGE_BYTES),
+            "max_choices": openai_params.OPENAI_MAX_N,
+            "tool_result_split_bytes": _limit(tool_utils.TOOL_RESULT_SPLIT_BYTES),
+            "upstream_retry_max_attempts": upstream.UPSTREAM_RETRY_MAX_ATTEMPTS,
+            "rate_limits": {
+                "failover_attempts": upstream.MAX_RATE_LIMIT_ATTEMPTS,
+                "min_available_accounts": _limit(capacity.MIN_AVAILABLE_ACCOUNTS),
+                "max_concurrent_streams_per_key": _limit(stream_limits.stream_limiter.limit),
+                "requests_per_minute_per_key": _limit(rate_limits.rate_limiter.rpm),
+                "requests_per_minute_per_ip": _limit(ip_rate_limit.ip_rate_limiter.rate_per_minute),
+            },
+        },
+    }
@@ -0,0 +1,119 @@
+"""
+上游熔断器
+CodeWhisperer 故障时，每个请求都要等满超时和重试才失败，客户端看到的是成片的慢响应；
+连续 CIRCUIT_BREAKER_FAILURE_THRESHOLD 次上游调用失败（网络错误、500/502/503/504）后熔断：
+
+- closed：正常放行，任何非 5xx 的上游响应（包括 4xx）都会把连续失败次数清零
+- open：直接拒绝（由调用方返回 503 和 Retry-After），不访问上游；CIRCUIT_BREAKER_OPEN_SECONDS 秒后进入 half_open
+- half_open：只放行一个探测请求，成功则恢复 closed，失败则重新 open；其余请求在探测期间照常拒绝。
+  探测请求被取消、没有报告结果时，超过 CIRCUIT_BREAKER_OPEN_SECONDS 后允许下一个探测
+
+403 / 429 等账号问题由 token 轮换处理，不计入熔断
+"""
+
+import time
+import logging
+import threading
+from typing import Any, Callable, Dict, Optional
+
+from config import CIRCUIT_BREAKER_FAILURE_THRESHOLD, CIRCUIT_BREAKER_OPEN_SECONDS
+
+logger = logging.getLogger(__name__)
+
+STATE_CLOSED = "closed"
+STATE_OPEN = "open"
+STATE_HALF_OPEN = "half_open"
+
+
+class CircuitOpenError(Exception):
+    """熔断器打开，请求未发往上游"""
+
+    def __init__(self, retry_after: int):
+        super().__init__(f"upstream circuit open, retry after {retry_after}s")
+        self.retry_after = retry_after
+
+
+class CircuitBreaker:
+    def __init__(
+        self,
+        failure_threshold: int = CIRCUIT_BREAKER_FAILURE_THRESHOLD,
+        open_seconds: float = CIRCUIT_BREAKER_OPEN_SECONDS,
+        clock: Callable[[], float] = time.monotonic,
+    ):
+        self.failure_threshold = failure_threshold
+        self.open_seconds = open_seconds
+        self._clock = clock
+        self._lock = threading.Lock()
+        self.state = STATE_CLOSED
+        self.consecutive_failures = 0
+        self.opened_at: Optional[float] = None
+        self._probe_started_at: Optional[float] = None
+        self.open_count = 0
+
+    @property
+    def enabled(self) -> bool:
+        return self.failure_threshold > 0
+
+    def _retry_after(self, now: float) -> int:
+        return max(1, int(self.open_seconds - (now - (self.opened_at or now)) + 0.999))
+
+    def before_call(self):
+        """发起上游调用之前调用；熔断期间抛出 CircuitOpenError"""
+        if not self.enabled:
+            return
+        with self._lock:
+            now = self._clock()
+            if self.state == STATE_CLOSED:
+                return
+            if self.state == STATE_OPEN:
+                if now - self.opened_at < self.open_seconds:
+                    raise CircuitOpenError(self._retry_after(now))
+                self.state = STATE_HALF_OPEN
+                self._probe_started_at = None
+                logger.info("🔌 上游熔断器进入 half_open，放行一个探测请求")
+            # half_open：同一时间只放行一个探测请求
+            if self._probe_started_at is not None and now - self._probe_started_at < self.open_seconds:
+                raise CircuitOpenError(1)
+            self._probe_started_at = now
+
+    def record_success(self):
+        if not self.enabled:
+            return
+        with self._lock:
+            if self.state != STATE_CLOSED:
+                logger.info(f"✅ 上游熔断器恢复 closed（{self.state} 期间的请求成功）")
+            self.state = STATE_CLOSED
+            self.consecutive_failures = 0
+            self.opened_at = None
+            self._probe_started_at = None
+
+    def record_failure(self, reason: str = ""):
+        if not self.enabled:
+            return
+        with self._lock:
+            self.consecutive_failures += 1
+            if self.state == STATE_HALF_OPEN or (
+                self.state == STATE_CLOSED and self.consecutive_failures >= self.failure_threshold
+            ):
+                logger.error(
+                    f"🔌 上游熔断器打开: 连续失败 {self.consecutive_failures} 次（{reason}），"
+                    f"{self.open_seconds:g} 秒内的请求直接返回 503"
+                )
+                self.state = STATE_OPEN
+                self.opened_at = self._clock()
+                self._probe_started_at = None
+                self.open_count += 1
+
+    def status(self) -> Dict[str, Any]:
+        with self._lock:
+            now = self._clock()
+            return {
+                "state": self.state,
+                "consecutive_failures": self.consecutive_failures,
+                "retry_after_seconds": self._retry_after(now) if self.state == STATE_OPEN else None,
+                "open_count": self.open_count,
+            }
+
+
+# 全局单例
+upstream_breaker = CircuitBreaker()
@@ -10,10 +10,18 @@ import uuid
 import copy
 import base64
 import logging
-from typing import List, Dict, Any, Optional
+from typing import List, Dict, Any, Optional, Tuple, FrozenSet
 
-from config import MODEL_MAP, DEFAULT_MODEL, PROFILE_ARN
-from models.claude_schemas import ClaudeRequest, ClaudeMessage
+from config import PROFILE_ARN, HISTORY_WINDOW_TURNS, TOOL_COMPACTION_ENABLED
+from services.model_mapping import resolve_model, default_upstream_model
+from models.claude_schemas import ClaudeRequest, ClaudeMessage, ClaudeTool
+from models.schemas import ChatCompletionRequest
+from services.tool_utils import (
+    compact_tool_specifications, compact_repeated_tools, tool_fingerprint, tool_fingerprints, format_tool_result, ToolNameMap, trailing_tool_use_content,
+    parse_tool_choice, apply_tool_choice, TOOL_CHOICE_AUTO, TOOL_CHOICE_TOOL, tool_use_ids,
+)
+from services.request_limits import log_preview
+from services.request_context import add_request_warning
 
 logger = logging.getLogger(__name__)
 
@@ -21,15 +29,15 @@ logger = logging.getLogger(__name__)
 def map_claude_model_to_codewhisperer(claude_model: str) -> str:
     """
     将 Claude 模型名称映射到 CodeWhisperer 模型
-    完全基于 config.py 中的 MODEL_MAP 配置，只支持精确匹配
+    使用合并了 MODEL_MAPPING 的映射表，支持精确匹配和通配规则，未匹配时使用默认模型
     """
-    # 精确匹配
-    if claude_model in MODEL_MAP:
-        logger.info(f"✅ 模型匹配: {claude_model} -> {MODEL_MAP[claude_model]}")
-        return MODEL_MAP[claude_model]
+    upstream_model = resolve_model(claude_model)
+    if upstream_model:
+        logger.info(f"✅ 模型匹配: {claude_model} -> {upstream_model}")
+        return upstream_model
     
     # 使用默认模型
-    default_value = MODEL_MAP.get(DEFAULT_MODEL)
+    default_value = default_upstream_model()
     if default_value:
         logger.info(f"⚠️ 模型未匹配，使用默认值: {claude_model} -> {default_value}")
         return default_value
@@ -96,28 +104,74 @@ def extract_images_from_claude_content(content) -> List[Dict[str, Any]]:
     return images
 
 
-def convert_claude_to_codewhisperer_request(request: ClaudeRequest) -> Dict[str, Any]:
+def _is_tool_result_only(msg: ClaudeMessage) -> bool:
+    """判断 user 消息是否只包含 tool_result（属于上一轮工具调用的结果，而不是新的一轮对话）"""
+    if msg.role != "user" or not isinstance(msg.content, list) or not msg.content:
+        return False
+    for block in msg.content:
+        block_type = block.get("type") if isinstance(block, dict) else getattr(block, "type", None)
+        if block_type != "tool_result":
+            return False
+    return True
+
+
+def apply_history_window(
+    messages: List[ClaudeMessage],
+    max_turns: int
+) -> Tuple[List[ClaudeMessage], int]:
+    """
+    对话历史窗口：只保留最近 max_turns 轮历史和当前消息
+
+    以真实的 user 消息（非纯 tool_result）作为每一轮的起点进行切分，
+    因此 tool_use 与对应的 tool_result 总是落在同一侧，不会被窗口边界拆散。
+
+    Returns:
+        (窗口裁剪后的消息列表, 被省略的轮数)
+    """
+    if max_turns <= 0 or len(messages) <= 1:
+        return messages, 0
+
+    history_messages = messages[:-1]
+    turn_starts = [
+        i for i, msg in enumerate(history_messages)
+        if msg.role == "user" and not _is_tool_result_only(msg)
+    ]
+
+    if len(turn_starts) <= max_turns:
+        return messages, 0
+
+    cut_index = turn_starts[-max_turns]
+    omitted_turns = len(turn_starts) - max_turns
+    return history_messages[cut_index:] + [messages[-1]], omitted_turns
+
+
+def claude_tool_fingerprints(request: ClaudeRequest) -> FrozenSet[str]:
+    """请求中工具定义的指纹，上游接受请求后记入对话缓存"""
+    return tool_fingerprints((tool.name, tool.description, tool.input_schema) for tool in request.tools or [])
+
+
+def convert_claude_to_codewhisperer_request(
+    request: ClaudeRequest,
+    tool_names: Optional[ToolNameMap] = None,
+    conversation_id: Optional[str] = None,
+    declared_tools: FrozenSet[str] = frozenset(),
+) -> Dict[str, Any]:
     """
     将 Claude API 请求转换为 CodeWhisperer API 请求
     与 request_builder.py (OpenAI格式) 发送的字段完全一致
+
+    tool_names 为 TOOL_NAME_POLICY=sanitize 时的工具名映射，工具定义和历史中的工具名都使用转换后的名称；
+    conversation_id 为沿用的上游对话 id，为空时生成新的；
+    declared_tools 为这个上游对话前几轮已经发送过的工具指纹（见 claude_tool_fingerprints），开启工具压缩时省略它们的描述
     """
+    tool_names = tool_names or ToolNameMap()
     logger.info(f"🔄 request model: {request.model}")
     codewhisperer_model = map_claude_model_to_codewhisperer(request.model)
-    conversation_id = str(uuid.uuid4())
+    # 沿用客户端对话的上游 conversationId（见 services/conversation_cache.py），没有时开始新对话
+    conversation_id = conversation_id or str(uuid.uuid4())
     
-    # 提取 system prompt
-    system_prompt = ""
-    if request.system:
-        if isinstance(request.system, str):
-            system_prompt = request.system
-        elif isinstance(request.system, list):
-            system_parts = []
-            for block in request.system:
-                if hasattr(block, "type") and block.type == "text":
-                    system_parts.append(block.text)
-                elif isinstance(block, dict) and block.get("type") == "text":
-                    system_parts.append(block.get("text", ""))
-            system_prompt = "\n".join(system_parts)
+    # 提取 system prompt（字符串和 text 块数组两种形式在模型校验时已统一为块列表）
+    system_prompt = request.system_text()
     
     # 转换消息为类似 OpenAI 格式的处理
     conversation_messages = []
@@ -127,6 +181,15 @@ def convert_claude_to_codewhisperer_request(request: ClaudeRequest) -> Dict[str,
     if not conversation_messages:
         raise ValueError("No conversation messages found")
     
+    # 应用历史窗口，只把最近 N 轮发送到上游
+    conversation_messages, omitted_turns = apply_history_window(conversation_messages, HISTORY_WINDOW_TURNS)
+    if omitted_turns:
+        logger.warning(
+            f"⚠️ 历史窗口生效: 省略了 {omitted_turns} 轮历史对话 "
+            f"(HISTORY_WINDOW_TURNS={HISTORY_WINDOW_TURNS})"
+        )
+        add_request_warning(f"history window omitted {omitted_turns} turns (HISTORY_WINDOW_TURNS={HISTORY_WINDOW_TURNS})")
+    
     # 构建历史记录 - 与 OpenAI 格式完全一致
     history = []
     
@@ -149,16 +212,16 @@ def convert_claude_to_codewhisperer_request(request: ClaudeRequest) -> Dict[str,
                     for block in msg.content:
                         if isinstance(block, dict):
                             if block.get("type") == "tool_result":
-                                tool_use_id = block.get("tool_use_id", "unknown")
+                                tool_use_id = tool_use_ids.upstream_id(block.get("tool_use_id", "unknown"))
                                 result_content = block.get("content", "")
                                 if isinstance(result_content, str):
-                                    tool_results.append(f"[Tool result for {tool_use_id}]: {result_content}")
+                                    tool_results.extend(format_tool_result("Tool result for", tool_use_id, result_content))
                                 elif isinstance(result_content, list):
                                     result_text = "".join([
                                         item.get("text", "") for item in result_content 
                                         if isinstance(item, dict) and item.get("type") == "text"
                                     ])
-                                    tool_results.append(f"[Tool result for {tool_use_id}]: {result_text}")
+                                    tool_results.extend(format_tool_result("Tool result for", tool_use_id, result_text))
                             elif block.get("type") == "text":
                                 text_parts.append(block.get("text", ""))
                     
@@ -178,7 +241,7 @@ def convert_claude_to_codewhisperer_request(request: ClaudeRequest) -> Dict[str,
                     for block in msg.content:
                         if isinstance(block, dict):
                             if block.get("type") == "tool_use":
-                                func_name = block.get("name", "unknown")
+                                func_name = tool_names.upstream_name(block.get("name", "unknown"))
                                 args = json.dumps(block.get("input", {}))
                                 tool_descriptions.append(f"[Called {func_name} with args: {args}]")
                             elif block.get("type") == "text":
@@ -264,16 +327,16 @@ def convert_claude_to_codewhisperer_request(request: ClaudeRequest) -> Dict[str,
             for block in current_message.content:
                 if isinstance(block, dict):
                     if block.get("type") == "tool_result":
-                        tool_use_id = block.get("tool_use_id", "unknown")
+                        tool_use_id = tool_use_ids.upstream_id(block.get("tool_use_id", "unknown"))
                         result_content = block.get("content", "")
                         if isinstance(result_content, str):
-                            tool_results.append(f"[Tool execution completed for {tool_use_id}]: {result_content}")
+                            tool_results.extend(format_tool_result("Tool execution completed for", tool_use_id, result_content))
                         elif isinstance(result_content, list):
                             result_text = "".join([
                                 item.get("text", "") for item in result_content 
                                 if isinstance(item, dict) and item.get("type") == "text"
                             ])
-                            tool_results.append(f"[Tool execution completed for {tool_use_id}]: {result_text}")
+                            tool_results.extend(format_tool_result("Tool execution completed for", tool_use_id, result_text))
                     elif block.get("type") == "text":
                         text_parts.append(block.get("text", ""))
             
@@ -283,15 +346,15 @@ def convert_claude_to_codewhisperer_request(request: ClaudeRequest) -> Dict[str,
                     current_content += "\n" + "".join(text_parts)
     
     elif current_message.role == "assistant":
-        # 如果最后一条消息是助手消息且包含 tool_use
+        # 如果最后一条消息是助手消息且包含 tool_use，按 TRAILING_TOOL_USE_POLICY 处理缺少的 tool_result
         if isinstance(current_message.content, list):
-            tool_descriptions = []
-            for block in current_message.content:
-                if isinstance(block, dict) and block.get("type") == "tool_use":
-                    func_name = block.get("name", "unknown")
-                    tool_descriptions.append(f"Continue after calling {func_name}")
-            if tool_descriptions:
-                current_content = "; ".join(tool_descriptions)
+            trailing_calls = [
+                (tool_use_ids.upstream_id(block.get("id", "unknown")), tool_names.upstream_name(block.get("name", "unknown")))
+                for block in current_message.content
+                if isinstance(block, dict) and block.get("type") == "tool_use"
+            ]
+            if trailing_calls:
+                current_content = trailing_tool_use_content(trailing_calls)
             else:
                 current_content = "Continue the conversation"
         else:
@@ -324,16 +387,28 @@ def convert_claude_to_codewhisperer_request(request: ClaudeRequest) -> Dict[str,
     
     # 添加工具上下文 - 与 OpenAI 格式一致
     user_input_message_context = {}
-    if request.tools:
-        user_input_message_context["tools"] = [
-            {
-                "toolSpecification": {
-                    "name": tool.name,
-                    "description": tool.description or "",
-                    "inputSchema": {"json": tool.input_schema or {}}
-                }
-            } for tool in request.tools
-        ]
+    tool_specs = [
+        {
+            "toolSpecification": {
+                "name": tool_names.upstream_name(tool.name),
+                "description": tool.description or "",
+                "inputSchema": {"json": tool.input_schema or {}}
+            }
+        } for tool in request.tools or []
+    ]
+    if tool_specs and TOOL_COMPACTION_ENABLED:
+        tool_specs, _ = compact_repeated_tools(
+            tool_specs,
+            [tool_fingerprint(tool.name, tool.description, tool.input_schema) for tool in request.tools],
+            declared_tools,
+        )
+        tool_specs, _ = compact_tool_specifications(tool_specs)
+    # 上游不支持 tool_choice，按 apply_tool_choice 的方式近似实现；格式错误时抛出 ToolChoiceError 由调用方返回 400
+    tool_specs, tool_instruction = apply_tool_choice(tool_specs, parse_tool_choice(request.tool_choice), tool_names)
+    if tool_specs:
+        user_input_message_context["tools"] = tool_specs
+    if tool_instruction:
+        codewhisperer_request["conversationState"]["currentMessage"]["userInputMessage"]["content"] += f"\n\n{tool_instruction}"
     
     # 添加图片 - 与 OpenAI 格式一致
     if images:
@@ -355,5 +430,90 @@ def convert_claude_to_codewhisperer_request(request: ClaudeRequest) -> Dict[str,
             if "bytes" in img.get("source", {}):
                 img["source"]["bytes"] = img["source"]["bytes"][:20] + "..."
     
-    logger.info(f"🔄 COMPLETE CODEWHISPERER REQUEST: {json.dumps(log_request, indent=2)}")
+    logger.info(f"🔄 COMPLETE CODEWHISPERER REQUEST: {log_preview(json.dumps(log_request, indent=2))}")
     return codewhisperer_request
+
+
+def _openai_content_to_claude_blocks(content) -> List[Dict[str, Any]]:
+    """将 OpenAI 消息内容转换为 Claude 内容块（文本和图片）"""
+    if content is None:
+        return []
+    if isinstance(content, str):
+        return [{"type": "text", "text": content}]
+
+    blocks = []
+    for part in content:
+        part_type = getattr(part, "type", None)
+        if part_type == "text" and part.text:
+            blocks.append({"type": "text", "text": part.text})
+        elif part_type == "image_url" and part.image_url:
+            url = part.image_url.url
+            match = re.match(r"data:([^;]+);base64,(.*)", url, re.DOTALL)
+            if match:
+                source = {"type": "base64", "media_type": match.group(1), "data": match.group(2)}
+            else:
+                source = {"type": "url", "url": url}
+            blocks.append({"type": "image", "source": source})
+    return blocks
+
+
+def _openai_tool_choice_to_claude(tool_choice) -> Optional[Dict[str, Any]]:
+    """OpenAI tool_choice 转换为 Anthropic 格式（auto 时省略）；格式错误时抛出 ToolChoiceError"""
+    choice = parse_tool_choice(tool_choice)
+    if choice.mode == TOOL_CHOICE_AUTO:
+        return None
+    if choice.mode == TOOL_CHOICE_TOOL:
+        return {"type": "tool", "name": choice.name}
+    return {"type": choice.mode}
+
+
+def convert_openai_to_claude_request(request: ChatCompletionRequest) -> ClaudeRequest:
+    """
+    将 OpenAI 格式的请求转换为 Claude 请求
+    目前用于 token 计数，使两种格式共用同一套估算逻辑
+    """
+    system_parts = []
+    messages = []
+
+    for msg in request.messages:
+        if msg.role == "system":
+            system_parts.append(msg.get_content_text())
+        elif msg.role == "tool":
+            block = {"type": "tool_result", "tool_use_id": msg.tool_call_id or "", "content": msg.get_content_text()}
+            messages.append(ClaudeMessage(role="user", content=[block]))
+        else:
+            blocks = _openai_content_to_claude_blocks(msg.content)
+            for tool_call in msg.tool_calls or []:
+                arguments = tool_call.function.get("arguments", "")
+                try:
+                    tool_input = json.loads(arguments) if isinstance(arguments, str) and arguments else {}
+                except json.JSONDecodeError:
+                    tool_input = {"arguments": arguments}
+                if not isinstance(tool_input, dict):
+                    tool_input = {"arguments": tool_input}
+                blocks.append({
+                    "type": "tool_use",
+                    "id": tool_call.id,
+                    "name": tool_call.function.get("name", ""),
+                    "input": tool_input,
+                })
+            messages.append(ClaudeMessage(role=msg.role, content=blocks))
+
+    tools = None
+    if request.tools:
+        tools = [
+            ClaudeTool(
+                name=tool.function.name,
+                description=tool.function.description or "",
+                input_schema=tool.function.parameters or {},
+            )
+            for tool in request.tools
+        ]
+
+    return ClaudeRequest(
+        model=request.model,
+        messages=messages,
+        tools=tools,
+        tool_choice=_openai_tool_choice_to_claude(request.tool_choice),
+        system="\n".join(system_parts) or None,
+    )
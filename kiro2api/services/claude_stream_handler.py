@@ -7,10 +7,20 @@ Claude SSE 流处理器
 import json
 import uuid
 import logging
-from typing import List, Dict, Any, Optional, Generator, AsyncGenerator
+from dataclasses import dataclass
+from typing import List, Dict, Any, Optional, Tuple, Generator, AsyncGenerator, FrozenSet
 
+from config import HISTORY_WINDOW_TURNS, HISTORY_WINDOW_AFFECTS_COUNT, TOOL_COMPACTION_ENABLED
 from parsers.stream_parser import CodeWhispererStreamParser
 from models.claude_schemas import ClaudeRequest
+from services.claude_converter import apply_history_window
+from services.tool_utils import tool_fingerprint, format_tool_result, ToolNameMap, ToolUseIdMap
+from services.tokenizer import count_text_tokens, OutputTokenBudget
+from services.image_tokens import estimate_image_tokens
+from services.reasoning import extract_reasoning
+from services.stop_reasons import normalize_stop_reason, upstream_stop_reason
+from services.stop_sequences import StopSequenceFilter
+from services.block_limits import BlockLimits
 
 logger = logging.getLogger(__name__)
 
@@ -21,8 +31,13 @@ def build_claude_sse_event(event_type: str, data: Dict[str, Any]) -> str:
     return f"event: {event_type}\ndata: {json_data}\n\n"
 
 
+def new_message_id() -> str:
+    """生成 Claude 格式的消息 ID，流式 message_start 与非流式响应使用同一格式"""
+    return f"msg_{uuid.uuid4().hex}"
+
+
 def build_claude_message_start_event(
-    conversation_id: str,
+    message_id: str,
     model: str = "claude-sonnet-4.5",
     input_tokens: int = 0
 ) -> str:
@@ -30,7 +45,7 @@ def build_claude_message_start_event(
     data = {
         "type": "message_start",
         "message": {
-            "id": conversation_id,
+            "id": message_id,
             "type": "message",
             "role": "assistant",
             "content": [],
@@ -43,16 +58,41 @@ def build_claude_message_start_event(
     return build_claude_sse_event("message_start", data)
 
 
-def build_claude_content_block_start_event(index: int) -> str:
-    """构建 content_block_start 事件（文本类型）"""
+# content_block_start 中各类型内容块必须带齐的字段及初始值，部分强类型 SDK 缺少字段（例如文本块的空 text）时会解析失败
+CONTENT_BLOCK_START_DEFAULTS: Dict[str, Dict[str, Any]] = {
+    "text": {"text": ""},
+    "tool_use": {"id": "", "name": "", "input": {}},
+    "thinking": {"thinking": ""},
+}
+
+
+def normalize_content_block(block: Dict[str, Any]) -> Dict[str, Any]:
+    """补齐 content_block_start 中内容块缺少的字段；所有 content_block_start 事件都经过这里"""
+    defaults = CONTENT_BLOCK_START_DEFAULTS.get(block.get("type"), {})
+    normalized = {"type": block.get("type")}
+    for key, default in defaults.items():
+        value = block.get(key)
+        normalized[key] = value if value is not None else (dict(default) if isinstance(default, dict) else default)
+    for key, value in block.items():
+        normalized.setdefault(key, value)
+    return normalized
+
+
+def build_claude_block_start_event(index: int, content_block: Dict[str, Any]) -> str:
+    """构建 content_block_start 事件，内容块按类型补齐为完整结构"""
     data = {
         "type": "content_block_start",
         "index": index,
-        "content_block": {"type": "text", "text": ""}
+        "content_block": normalize_content_block(content_block)
     }
     return build_claude_sse_event("content_block_start", data)
 
 
+def build_claude_content_block_start_event(index: int) -> str:
+    """构建 content_block_start 事件（文本类型）"""
+    return build_claude_block_start_event(index, {"type": "text"})
+
+
 def build_claude_content_block_delta_event(index: int, text: str) -> str:
     """构建 content_block_delta 事件"""
     data = {
@@ -81,13 +121,14 @@ def build_claude_ping_event() -> str:
 def build_claude_message_stop_event(
     input_tokens: int,
     output_tokens: int,
-    stop_reason: str = "end_turn"
+    stop_reason: str = "end_turn",
+    stop_sequence: Optional[str] = None,
 ) -> str:
     """构建 message_delta 和 message_stop 事件"""
     # 先发送 message_delta
     delta_data = {
         "type": "message_delta",
-        "delta": {"stop_reason": stop_reason, "stop_sequence": None},
+        "delta": {"stop_reason": stop_reason, "stop_sequence": stop_sequence},
         "usage": {"input_tokens": input_tokens, "output_tokens": output_tokens}
     }
     delta_event = build_claude_sse_event("message_delta", delta_data)
@@ -103,18 +144,34 @@ def build_claude_message_stop_event(
     return delta_event + stop_event
 
 
+def build_claude_error_event(error_type: str, message: str) -> str:
+    """构建 error 事件"""
+    return build_claude_sse_event("error", {"type": "error", "error": {"type": error_type, "message": message}})
+
+
 def build_claude_tool_use_start_event(index: int, tool_use_id: str, tool_name: str) -> str:
-    """构建 tool use 类型的 content_block_start 事件"""
+    """构建 tool use 类型的 content_block_start 事件（input 为空对象，参数由后续 input_json_delta 给出）"""
+    return build_claude_block_start_event(index, {"type": "tool_use", "id": tool_use_id, "name": tool_name})
+
+
+def build_claude_thinking_delta_event(index: int, thinking: str) -> str:
+    """构建 thinking 内容的 content_block_delta 事件"""
     data = {
-        "type": "content_block_start",
+        "type": "content_block_delta",
         "index": index,
-        "content_block": {
-            "type": "tool_use",
-            "id": tool_use_id,
-            "name": tool_name
-        }
+        "delta": {"type": "thinking_delta", "thinking": thinking}
     }
-    return build_claude_sse_event("content_block_start", data)
+    return build_claude_sse_event("content_block_delta", data)
+
+
+def build_claude_signature_delta_event(index: int, signature: str) -> str:
+    """构建 thinking 块签名的 content_block_delta 事件"""
+    data = {
+        "type": "content_block_delta",
+        "index": index,
+        "delta": {"type": "signature_delta", "signature": signature}
+    }
+    return build_claude_sse_event("content_block_delta", data)
 
 
 def build_claude_tool_use_input_delta_event(index: int, input_json_delta: str) -> str:
@@ -131,61 +188,179 @@ def build_claude_tool_use_input_delta_event(index: int, input_json_delta: str) -
 
 
 def count_tokens(text: str) -> int:
-    """计算文本的 token 数量（简化估算）"""
-    if not text:
-        return 0
-    # 简化估算：平均每 4 个字符约等于 1 个 token
-    return max(1, len(text) // 4)
+    """计算文本的 token 数量（后端由 TOKENIZER_BACKEND 决定，默认粗略估算）"""
+    return count_text_tokens(text)
 
 
-def estimate_input_tokens(request_data: ClaudeRequest) -> int:
-    """估算输入 token 数量"""
+def json_text(value: Any) -> str:
+    """结构化内容（tool_use 参数等）计数时使用的 JSON 文本；保留非 ASCII 字符，\\u 转义会把中文等高估数倍"""
+    return json.dumps(value, ensure_ascii=False)
+
+
+def tool_result_content(content: Any) -> Tuple[str, int]:
+    """
+    tool_result 内容计数用的文本和图片 token 数
+
+    content 可以是字符串或内容块数组：text 块取文本、image 块按尺寸计、text 类型的 document 块取文本，
+    其他块（search_result 等）和非数组的结构化内容按 JSON 计，不会被漏掉
+    """
+    if content is None:
+        return "", 0
+    if isinstance(content, str):
+        return content, 0
+    if not isinstance(content, list):
+        return json_text(content), 0
+    texts = []
+    image_tokens = 0
+    for item in content:
+        if isinstance(item, str):
+            texts.append(item)
+        elif not isinstance(item, dict):
+            texts.append(json_text(item))
+        elif item.get("type") == "text":
+            texts.append(item.get("text", ""))
+        elif item.get("type") == "image":
+            image_tokens += estimate_image_tokens(item.get("source") or {})
+        elif item.get("type") == "document" and (item.get("source") or {}).get("type") == "text":
+            texts.append(item["source"].get("data", ""))
+        else:
+            texts.append(json_text(item))
+    return "".join(texts), image_tokens
+
+
+# 能被缓存的最短前缀（Sonnet / Opus 的下限；Haiku 为 2048，这里统一按 1024 估算），更短的前缀不会写入缓存
+PROMPT_CACHE_MIN_TOKENS = 1024
+
+
+@dataclass
+class InputTokenEstimate:
+    """输入 token 估算结果"""
+    input_tokens: int
+    # 到最后一个 cache_control 断点为止（含）的前缀 token 数：缓存命中时按缓存读取计费的部分
+    cache_read_input_tokens: int = 0
+    # 请求中是否有 cache_control 标记
+    has_cache_control: bool = False
+
+    @property
+    def uncached_input_tokens(self) -> int:
+        return self.input_tokens - self.cache_read_input_tokens
+
+
+def _has_cache_control(block: Any) -> bool:
+    value = block.get("cache_control") if isinstance(block, dict) else getattr(block, "cache_control", None)
+    return bool(value)
+
+
+class _InputCollector:
+    """按 API 的前缀顺序（tools → system → messages）收集计数用的文本和图片 token，记录最后一个 cache_control 断点"""
+
+    def __init__(self):
+        self.text_parts: List[str] = []
+        self.image_tokens = 0
+        # 最后一个断点处的文本段数和图片 token 数
+        self.cached_parts = 0
+        self.cached_image_tokens = 0
+        self.has_cache_control = False
+
+    def mark(self, block: Any):
+        """block 收集完之后调用：带 cache_control 时把到此为止的内容记为可缓存前缀"""
+        if _has_cache_control(block):
+            self.has_cache_control = True
+            self.cached_parts = len(self.text_parts)
+            self.cached_image_tokens = self.image_tokens
+
+    def add_block(self, block: Dict[str, Any]):
+        if block.get("type") == "image":
+            self.image_tokens += estimate_image_tokens(block.get("source") or {})
+        elif block.get("type") == "text":
+            self.text_parts.append(block.get("text", ""))
+        elif block.get("type") == "tool_use":
+            self.text_parts.append(block.get("id", ""))
+            self.text_parts.append(block.get("name", ""))
+            self.text_parts.append(json_text(block.get("input", {})))
+        elif block.get("type") == "tool_result":
+            result_text, result_image_tokens = tool_result_content(block.get("content", ""))
+            self.image_tokens += result_image_tokens
+            # 带 tool_use_id 前缀计数，开启拆分时按拆分后的多段计数（每段都带前缀）
+            self.text_parts.extend(format_tool_result(
+                "Tool result for", block.get("tool_use_id", "unknown"), result_text
+            ))
+        self.mark(block)
+
+    def estimate(self) -> InputTokenEstimate:
+        # 图片按尺寸单独计算，不参与文本分词
+        total = count_tokens("\n".join(self.text_parts)) + self.image_tokens
+        cached = 0
+        if self.has_cache_control:
+            cached = count_tokens("\n".join(self.text_parts[:self.cached_parts])) + self.cached_image_tokens
+            cached = min(cached, total) if cached >= PROMPT_CACHE_MIN_TOKENS else 0
+        return InputTokenEstimate(total, cached, self.has_cache_control)
+
+
+def estimate_input_token_breakdown(
+    request_data: ClaudeRequest, declared_tools: FrozenSet[str] = frozenset()
+) -> InputTokenEstimate:
+    """
+    估算输入 token 数量，并按 cache_control 断点区分可缓存的前缀
+
+    开启 TOOL_COMPACTION_ENABLED 时按实际发往上游的工具定义计数：同一请求中重复的定义只计一次，
+    declared_tools（对话缓存中这个对话已经发送过的工具指纹）中的工具与 compact_repeated_tools 一样不计描述
+
+    与 API 一样按 tools → system → messages 的顺序确定前缀：到最后一个带 cache_control 的工具、system 块或内容块为止（含）
+    的部分计入 cache_read_input_tokens（假设缓存已经写入；前缀短于 PROMPT_CACHE_MIN_TOKENS 时不会被缓存，记为 0）。
+    input_tokens 始终是全部输入的总数，与不带 cache_control 时相同
+    """
     try:
-        text_parts = []
-        
+        collector = _InputCollector()
+
+        # 统计 tools 定义（开启工具压缩时，完全相同的定义只计算一次，前几轮已声明过的工具不计描述）
+        if request_data.tools:
+            counted_tools = set()
+            for tool in request_data.tools:
+                repeated = False
+                if TOOL_COMPACTION_ENABLED:
+                    fingerprint = tool_fingerprint(tool.name, tool.description, tool.input_schema)
+                    if fingerprint in counted_tools:
+                        collector.mark(tool)
+                        continue
+                    counted_tools.add(fingerprint)
+                    repeated = fingerprint in declared_tools
+                collector.text_parts.append(tool.name)
+                if not repeated:
+                    collector.text_parts.append(tool.description)
+                collector.text_parts.append(json_text(tool.input_schema))
+                collector.mark(tool)
+
         # 统计 system prompt
-        if request_data.system:
-            if isinstance(request_data.system, str):
-                text_parts.append(request_data.system)
-            elif isinstance(request_data.system, list):
-                for block in request_data.system:
-                    if hasattr(block, "type") and block.type == "text":
-                        text_parts.append(block.text)
-        
-        # 统计所有消息内容
-        for msg in request_data.messages:
+        for block in request_data.system or []:
+            collector.text_parts.append(block.text)
+            collector.mark(block)
+
+        # 统计所有消息内容（开启 HISTORY_WINDOW_AFFECTS_COUNT 时与发送到上游的窗口保持一致）
+        messages = request_data.messages
+        if HISTORY_WINDOW_AFFECTS_COUNT:
+            messages, _ = apply_history_window(messages, HISTORY_WINDOW_TURNS)
+
+        for msg in messages:
             content = msg.content
             if isinstance(content, str):
-                text_parts.append(content)
+                collector.text_parts.append(content)
             elif isinstance(content, list):
                 for block in content:
+                    if hasattr(block, "model_dump"):
+                        block = block.model_dump()
                     if isinstance(block, dict):
-                        if block.get("type") == "text":
-                            text_parts.append(block.get("text", ""))
-                        elif block.get("type") == "tool_use":
-                            text_parts.append(block.get("name", ""))
-                            text_parts.append(json.dumps(block.get("input", {})))
-                        elif block.get("type") == "tool_result":
-                            result_content = block.get("content", "")
-                            if isinstance(result_content, str):
-                                text_parts.append(result_content)
-                            elif isinstance(result_content, list):
-                                for item in result_content:
-                                    if isinstance(item, dict) and item.get("type") == "text":
-                                        text_parts.append(item.get("text", ""))
-        
-        # 统计 tools 定义
-        if request_data.tools:
-            for tool in request_data.tools:
-                text_parts.append(tool.name)
-                text_parts.append(tool.description)
-                text_parts.append(json.dumps(tool.input_schema))
-        
-        full_text = "\n".join(text_parts)
-        return count_tokens(full_text)
+                        collector.add_block(block)
+
+        return collector.estimate()
     except Exception as e:
         logger.warning(f"估算输入 token 失败: {e}")
-        return 0
+        return InputTokenEstimate(0)
+
+
+def estimate_input_tokens(request_data: ClaudeRequest) -> int:
+    """估算输入 token 数量"""
+    return estimate_input_token_breakdown(request_data).input_tokens
 
 
 class ClaudeStreamHandler:
@@ -194,8 +369,15 @@ class ClaudeStreamHandler:
     将 CodeWhisperer 响应转换为 Claude 格式的 SSE 事件
     """
     
-    def __init__(self, model: str = "claude-sonnet-4.5", request_data: Optional[ClaudeRequest] = None):
+    def __init__(
+        self,
+        model: str = "claude-sonnet-4.5",
+        request_data: Optional[ClaudeRequest] = None,
+        tool_names: Optional[ToolNameMap] = None,
+    ):
         self.model = model
+        # 上游返回的是转换后的工具名，发给客户端前还原为原名
+        self.tool_names = tool_names or ToolNameMap()
         self.parser = CodeWhispererStreamParser()
         
         # 响应文本累积缓冲区
@@ -209,15 +391,35 @@ class ClaudeStreamHandler:
         self.content_block_start_sent = False
         self.content_block_stop_sent = False
         self.message_start_sent = False
+        # 已发出 content_block_start、还没有发出 content_block_stop 的内容块索引
+        self.open_blocks: set = set()
         
-        # 对话 ID
+        # 对话 ID（上游的 conversationId）和返回给客户端的消息 ID
         self.conversation_id: Optional[str] = None
+        self.message_id = new_message_id()
         
         # Tool use 相关状态
         self.current_tool_use: Optional[Dict[str, str]] = None
         self.tool_input_buffer: List[str] = []
         self.processed_tool_use_ids: set = set()
+        # 上游 toolUseId 到返回给客户端的 toolu_ id 的分配（保证格式和消息内唯一）
+        self.tool_use_ids = ToolUseIdMap()
         self.all_tool_inputs: List[str] = []
+
+        # 内容块和工具调用的数量上限（STREAM_MAX_CONTENT_BLOCKS / STREAM_MAX_TOOL_CALLS）
+        self.block_limits = BlockLimits()
+
+        # thinking 块状态（推理内容与文本可能交替出现，每段推理是一个独立的 thinking 块）
+        self.thinking_block_open = False
+        self.thinking_buffer: List[str] = []
+
+        # 上游事件中带的结束原因（已归一化），没有时为 None
+        self.upstream_stop_reason: Optional[str] = None
+        
+        # 按请求的 max_tokens 限制输出，达到上限后不再处理上游事件
+        self.output_budget = OutputTokenBudget(request_data.max_tokens if request_data else None)
+        # 在代理侧执行请求的 stop_sequences
+        self.stop_filter = StopSequenceFilter(request_data.stop_sequences if request_data else None)
         
         # 估算输入 token 数量
         if request_data:
@@ -230,43 +432,63 @@ class ClaudeStreamHandler:
         else:
             self.input_tokens = 0
     
+    @property
+    def max_tokens_reached(self) -> bool:
+        """输出已达到 max_tokens，调用方应停止读取上游并调用 finalize()"""
+        return self.output_budget.exhausted
+
+    @property
+    def stop_sequence_reached(self) -> bool:
+        """输出命中了 stop_sequences，调用方应停止读取上游并调用 finalize()"""
+        return self.stop_filter.matched is not None
+
+    @property
+    def should_stop(self) -> bool:
+        return self.max_tokens_reached or self.stop_sequence_reached
+    
     def handle_chunk(self, chunk: bytes) -> Generator[str, None, None]:
         """处理数据块并返回 Claude 格式的事件"""
         messages = self.parser.parse(chunk)
         
-        for message in messages:
+        for message in self.stop_filter.filter(messages):
             yield from self._process_event(message)
     
     def _process_event(self, event: Dict[str, Any]) -> Generator[str, None, None]:
         """处理单个事件"""
+        if self.max_tokens_reached:
+            return
+
+        stop_reason = upstream_stop_reason(event)
+        if stop_reason:
+            self.upstream_stop_reason = normalize_stop_reason(stop_reason, "claude")
+        
+        # 上游不一定先发 initial-response 事件：任何事件之前都先保证已发出 message_start
+        yield from self.ensure_message_start()
+
         # 检测事件类型
         if "conversationId" in event:
             # initial-response 事件
             self.conversation_id = event.get("conversationId", str(uuid.uuid4()))
-            
-            if not self.message_start_sent:
-                yield build_claude_message_start_event(
-                    self.conversation_id,
-                    self.model,
-                    self.input_tokens
-                )
-                self.message_start_sent = True
-                yield build_claude_ping_event()
         
         elif "content" in event:
             # assistantResponseEvent 文本事件
-            content = event.get("content", "")
+            content = self.output_budget.consume(event.get("content", ""))
+
+            # 推理内容之后的文本开始新的 text 块
+            yield from self._close_thinking_block()
             
             # 如果之前有 tool use 块未关闭，先关闭它
-            if self.current_tool_use and not self.content_block_stop_sent:
-                yield build_claude_content_block_stop_event(self.content_block_index)
+            if self.current_tool_use:
+                yield from self._stop_block(self.content_block_index)
                 self.content_block_stop_sent = True
                 self.current_tool_use = None
             
-            # 首次收到内容时，发送 content_block_start
-            if not self.content_block_start_sent:
+            # 首次收到内容时，或当前块已经关闭（例如 toolUses 事件之后又有文本）时，发送 content_block_start
+            if not self.content_block_start_sent or self.content_block_index not in self.open_blocks:
+                self.block_limits.add_block()
                 self.content_block_index += 1
                 yield build_claude_content_block_start_event(self.content_block_index)
+                self.open_blocks.add(self.content_block_index)
                 self.content_block_start_sent = True
                 self.content_block_started = True
             
@@ -281,42 +503,116 @@ class ClaudeStreamHandler:
             
             # 检查是否需要发送 content_block_stop
             if self.content_block_started and not self.content_block_stop_sent:
-                yield build_claude_content_block_stop_event(self.content_block_index)
+                yield from self._stop_block(self.content_block_index)
                 self.content_block_stop_sent = True
         
         elif "toolUseId" in event or "name" in event:
             # toolUseEvent 事件
+            yield from self._close_thinking_block()
             yield from self._handle_tool_use_event(event)
+
+        else:
+            reasoning = extract_reasoning(event)
+            if reasoning:
+                yield from self._handle_reasoning(reasoning.text, reasoning.signature)
+
+    def ensure_message_start(self) -> Generator[str, None, None]:
+        """
+        还没有发出 message_start 时发出（随后是一个 ping）
+
+        Anthropic 的流式协议要求 message_start 是第一个事件，严格的 SDK 在它之前收到
+        content_block_* / message_delta / error 时会解析失败
+        """
+        if not self.message_start_sent:
+            self.message_start_sent = True
+            yield build_claude_message_start_event(self.message_id, self.model, self.input_tokens)
+            yield build_claude_ping_event()
+
+    def _stop_block(self, index: int) -> Generator[str, None, None]:
+        """发出 content_block_stop；每个块只发出一次"""
+        if index in self.open_blocks:
+            self.open_blocks.discard(index)
+            yield build_claude_content_block_stop_event(index)
+
+    def _close_open_blocks(self) -> Generator[str, None, None]:
+        """
+        按索引顺序关闭所有未结束的内容块（message_delta 之前调用）
+
+        上游可能在块的中途直接结束（例如工具调用没有 stop 事件），严格的 SDK 遇到未关闭的块会报错，
+        这里补发缺少的 content_block_stop
+        """
+        stale = sorted(index for index in self.open_blocks if index != self.content_block_index)
+        if stale:
+            logger.warning(f"⚠️ 补发未关闭内容块的 content_block_stop: {stale}")
+        for index in sorted(self.open_blocks):
+            yield from self._stop_block(index)
+        self.content_block_stop_sent = True
+        self.thinking_block_open = False
+        self.current_tool_use = None
+
+    def _handle_reasoning(self, text: str, signature: Optional[str]) -> Generator[str, None, None]:
+        """推理内容以 thinking 块转发：需要时先关闭当前的 text 块，再打开新的 thinking 块"""
+        if not self.thinking_block_open:
+            if self.content_block_start_sent and not self.content_block_stop_sent and not self.current_tool_use:
+                yield from self._stop_block(self.content_block_index)
+                # 之后的文本开始新的 text 块
+                self.content_block_start_sent = False
+                self.content_block_started = False
+                self.content_block_stop_sent = False
+            self.block_limits.add_block()
+            self.content_block_index += 1
+            yield build_claude_block_start_event(self.content_block_index, {"type": "thinking"})
+            self.open_blocks.add(self.content_block_index)
+            self.thinking_block_open = True
+
+        text = self.output_budget.consume(text)
+        if text:
+            self.thinking_buffer.append(text)
+            yield build_claude_thinking_delta_event(self.content_block_index, text)
+        if signature:
+            yield build_claude_signature_delta_event(self.content_block_index, signature)
+
+    def _close_thinking_block(self) -> Generator[str, None, None]:
+        if self.thinking_block_open:
+            yield from self._stop_block(self.content_block_index)
+            self.thinking_block_open = False
     
     def _handle_tool_use_event(self, event: Dict[str, Any]) -> Generator[str, None, None]:
         """处理 tool use 事件"""
         tool_use_id = event.get("toolUseId")
-        tool_name = event.get("name")
+        tool_name = self.tool_names.client_name(event.get("name"))
         tool_input = event.get("input")
         is_stop = event.get("stop", False)
         
-        logger.debug(f"Tool use 事件 - ID: {tool_use_id}, Name: {tool_name}, Stop: {is_stop}")
+        if logger.isEnabledFor(logging.DEBUG):
+            logger.debug(f"Tool use 事件 - ID: {tool_use_id}, Name: {tool_name}, Stop: {is_stop}")
         
         # 如果是新 tool use 事件的开始
         if tool_use_id and tool_name and not self.current_tool_use:
             logger.info(f"开始新的 tool use: {tool_name} (ID: {tool_use_id})")
             
-            # 如果之前有文本块未关闭，先关闭它
-            if self.content_block_start_sent and not self.content_block_stop_sent:
-                yield build_claude_content_block_stop_event(self.content_block_index)
+            # 如果之前有文本块未关闭，先关闭它（_stop_block 对已关闭的块不会重复发出）
+            if self.content_block_start_sent:
+                yield from self._stop_block(self.content_block_index)
                 self.content_block_stop_sent = True
             
+            # 超过内容块或工具调用上限时在分配任何状态之前中止
+            self.block_limits.add_tool_call()
+            self.block_limits.add_block()
+
             # 记录这个 tool_use_id 为已处理
             self.processed_tool_use_ids.add(tool_use_id)
+            client_tool_use_id = self.tool_use_ids.assign(tool_use_id)
             
             # 内容块索引递增
             self.content_block_index += 1
             
             # 发送 content_block_start (tool_use type)
-            yield build_claude_tool_use_start_event(self.content_block_index, tool_use_id, tool_name)
+            yield build_claude_tool_use_start_event(self.content_block_index, client_tool_use_id, tool_name)
+            self.open_blocks.add(self.content_block_index)
             
             self.content_block_started = True
-            self.current_tool_use = {"toolUseId": tool_use_id, "name": tool_name}
+            self.current_tool_use = {"toolUseId": tool_use_id, "id": client_tool_use_id, "name": tool_name}
             self.tool_input_buffer = []
         
         # 累积 input 片段
@@ -328,8 +624,10 @@ class ClaudeStreamHandler:
             else:
                 input_fragment = str(tool_input)
             
-            self.tool_input_buffer.append(input_fragment)
-            yield build_claude_tool_use_input_delta_event(self.content_block_index, input_fragment)
+            input_fragment = self.output_budget.consume(input_fragment)
+            if input_fragment:
+                self.tool_input_buffer.append(input_fragment)
+                yield build_claude_tool_use_input_delta_event(self.content_block_index, input_fragment)
         
         # 如果是 stop 事件，发送 content_block_stop
         if is_stop and self.current_tool_use:
@@ -339,7 +637,7 @@ class ClaudeStreamHandler:
             # 保存完整的 tool input 用于 token 统计
             self.all_tool_inputs.append(full_input)
             
-            yield build_claude_content_block_stop_event(self.content_block_index)
+            yield from self._stop_block(self.content_block_index)
             
             # 重置状态
             self.content_block_stop_sent = False
@@ -348,36 +646,71 @@ class ClaudeStreamHandler:
             self.current_tool_use = None
             self.tool_input_buffer = []
     
+    def output_text(self) -> str:
+        """目前已收到的推理内容、文本和工具参数（流中途结束时也可调用）"""
+        pending_input = "".join(self.tool_input_buffer) if self.current_tool_use else ""
+        return "".join(self.thinking_buffer) + "".join(self.response_buffer) + "".join(self.all_tool_inputs) + pending_input
+
+    def output_token_count(self) -> int:
+        """按目前已收到的文本和工具参数计算 output token（流中途结束时也可调用）"""
+        return count_tokens(self.output_text())
+    
     def finalize(self) -> Generator[str, None, None]:
         """流结束时的收尾处理"""
-        # 只有当 content_block_started 且尚未发送 content_block_stop 时才发送
-        if self.content_block_started and not self.content_block_stop_sent:
-            yield build_claude_content_block_stop_event(self.content_block_index)
-            self.content_block_stop_sent = True
+        for event in self.stop_filter.flush():
+            yield from self._process_event(event)
+        # 上游没有返回任何事件时也发出完整的 message_start ... message_stop
+        yield from self.ensure_message_start()
+        yield from self._close_thinking_block()
+        # message_delta 之前关闭所有未结束的内容块
+        yield from self._close_open_blocks()
         
         # 计算 output token 数量
         full_text_response = "".join(self.response_buffer)
         full_tool_inputs = "".join(self.all_tool_inputs)
-        output_tokens = count_tokens(full_text_response + full_tool_inputs)
+        output_tokens = self.output_token_count()
         
         logger.info(
             f"Token 统计 - 输入: {self.input_tokens}, 输出: {output_tokens} "
             f"(文本: {len(full_text_response)} 字符, tool inputs: {len(full_tool_inputs)} 字符)"
         )
         
-        yield build_claude_message_stop_event(self.input_tokens, output_tokens, "end_turn")
+        if self.max_tokens_reached:
+            stop_reason = "max_tokens"
+        elif self.stop_sequence_reached:
+            stop_reason = "stop_sequence"
+        else:
+            stop_reason = self.upstream_stop_reason or "end_turn"
+        yield build_claude_message_stop_event(self.input_tokens, output_tokens, stop_reason, self.stop_filter.matched)
+
+    def abort(self, error_type: str, message: str, stop_reason: Optional[str] = None) -> Generator[str, None, None]:
+        """
+        流中途失败时的收尾事件，保证客户端收到的事件序列符合流式协议（message_start 总在最前）
+
+        - 给出 stop_reason（例如上游报告输入过长，映射为 max_tokens）：按正常结束收尾，
+          关闭未结束的内容块后发出带该 stop_reason 的 message_delta 和 message_stop
+        - 否则（默认）：发出 error 事件
+        """
+        yield from self.ensure_message_start()
+        if not stop_reason:
+            yield build_claude_error_event(error_type, message)
+            return
+        yield from self._close_thinking_block()
+        yield from self._close_open_blocks()
+        yield build_claude_message_stop_event(self.input_tokens, self.output_token_count(), stop_reason)
 
 
 async def handle_claude_stream(
     response_body: bytes,
     model: str = "claude-sonnet-4.5",
-    request_data: Optional[ClaudeRequest] = None
+    request_data: Optional[ClaudeRequest] = None,
+    tool_names: Optional[ToolNameMap] = None,
 ) -> AsyncGenerator[str, None]:
     """
     处理 CodeWhisperer 响应并生成 Claude 格式的 SSE 事件
     用于非流式响应的处理
     """
-    handler = ClaudeStreamHandler(model, request_data)
+    handler = ClaudeStreamHandler(model, request_data, tool_names)
     
     # 处理响应体
     for event in handler.handle_chunk(response_body):
@@ -387,3 +720,81 @@ async def handle_claude_stream(
     for event in handler.finalize():
         yield event
 
+
+
+def _parse_sse_events(text: str) -> Generator[Dict[str, Any], None, None]:
+    """解析 build_claude_sse_event 生成的 SSE 文本（一段文本里可能包含多个事件）"""
+    for block in text.split("\n\n"):
+        for line in block.split("\n"):
+            if line.startswith("data: "):
+                yield json.loads(line[len("data: "):])
+
+
+class ClaudeMessageAssembler:
+    """
+    把流处理器生成的 SSE 事件逐个汇总为非流式的 Claude 消息
+
+    与流式路径共用同一个处理器，消息 ID、工具名还原和 token 统计都保持一致；
+    上游没有返回任何内容时 content 为空数组，stop_sequence 始终存在（为 null）
+    """
+
+    def __init__(self, handler: ClaudeStreamHandler):
+        self.message = {
+            "id": handler.message_id,
+            "type": "message",
+            "role": "assistant",
+            "model": handler.model,
+            "content": [],
+            "stop_reason": None,
+            "stop_sequence": None,
+            "usage": {"input_tokens": handler.input_tokens, "output_tokens": 0},
+        }
+        self._blocks: Dict[int, Dict[str, Any]] = {}
+        self._partial_inputs: Dict[int, List[str]] = {}
+
+    def feed(self, sse_text: str):
+        for data in _parse_sse_events(sse_text):
+            self._apply(data)
+
+    def _apply(self, data: Dict[str, Any]):
+        event_type = data.get("type")
+        if event_type == "content_block_start":
+            block = dict(data["content_block"])
+            if block.get("type") == "tool_use":
+                block["input"] = {}
+                self._partial_inputs[data["index"]] = []
+            self._blocks[data["index"]] = block
+            self.message["content"].append(block)
+        elif event_type == "content_block_delta":
+            block = self._blocks.get(data["index"])
+            delta = data.get("delta", {})
+            if block is None:
+                return
+            if delta.get("type") == "text_delta":
+                block["text"] += delta.get("text", "")
+            elif delta.get("type") == "thinking_delta":
+                block["thinking"] += delta.get("thinking", "")
+            elif delta.get("type") == "signature_delta":
+                block["signature"] = delta.get("signature", "")
+            elif delta.get("type") == "input_json_delta":
+                self._partial_inputs[data["index"]].append(delta.get("partial_json", ""))
+        elif event_type == "content_block_stop":
+            raw_input = "".join(self._partial_inputs.pop(data["index"], []))
+            if raw_input:
+                try:
+                    self._blocks[data["index"]]["input"] = json.loads(raw_input)
+                except json.JSONDecodeError:
+                    logger.warning(f"⚠️ tool_use 参数不是有效的 JSON: {raw_input[:200]}")
+        elif event_type == "message_delta":
+            delta = data.get("delta", {})
+            self.message["stop_reason"] = delta.get("stop_reason")
+            self.message["stop_sequence"] = delta.get("stop_sequence")
+            self.message["usage"]["output_tokens"] = data.get("usage", {}).get("output_tokens", 0)
+
+
+def assemble_claude_message(sse_events: List[str], handler: ClaudeStreamHandler) -> Dict[str, Any]:
+    """把已生成的全部 SSE 事件汇总为非流式的 Claude 消息"""
+    assembler = ClaudeMessageAssembler(handler)
+    for text in sse_events:
+        assembler.feed(text)
+    return assembler.message
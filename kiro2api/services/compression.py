@@ -0,0 +1,136 @@
+"""
+响应压缩
+大的非流式 JSON 响应（尤其是带大量工具调用的）压缩后通常只有原来的几分之一。
+客户端在 Accept-Encoding 中声明 gzip 或 deflate（q=0 表示拒绝）时，ResponseCompressionMiddleware 压缩满足以下条件的响应：
+
+- Content-Type 为 JSON（application/json 或 *+json）
+- 响应体一次性写出（非流式），且不小于 RESPONSE_COMPRESSION_MIN_BYTES
+- 响应本身没有 Content-Encoding
+
+text/event-stream 等分多次写出的响应原样透传：压缩器会缓冲数据，SSE 事件不能及时到达客户端
+"""
+
+import gzip
+import zlib
+import logging
+from typing import Optional
+
+from config import RESPONSE_COMPRESSION_ENABLED, RESPONSE_COMPRESSION_MIN_BYTES
+
+logger = logging.getLogger(__name__)
+
+# 同时接受时优先使用 gzip
+SUPPORTED_ENCODINGS = ("gzip", "deflate")
+EVENT_STREAM_CONTENT_TYPE = "text/event-stream"
+
+
+def negotiate_encoding(accept_encoding: str) -> Optional[str]:
+    """按 Accept-Encoding 选择压缩方式；都不接受时返回 None"""
+    accepted = {}
+    for item in accept_encoding.split(","):
+        name, _, params = item.strip().partition(";")
+        name = name.strip().lower()
+        quality = 1.0
+        for param in params.split(";"):
+            key, _, value = param.strip().partition("=")
+            if key.strip().lower() == "q":
+                try:
+                    quality = float(value)
+                except ValueError:
+                    quality = 0.0
+        if name:
+            accepted[name] = quality
+    for encoding in SUPPORTED_ENCODINGS:
+        quality = accepted.get(encoding, accepted.get("*", 0.0))
+        if quality > 0:
+            return encoding
+    return None
+
+
+def is_compressible(content_type: str) -> bool:
+    """JSON 响应可以压缩，SSE 流式响应永远不压缩"""
+    media_type = content_type.split(";")[0].strip().lower()
+    if media_type == EVENT_STREAM_CONTENT_TYPE:
+        return False
+    return media_type == "application/json" or media_type.endswith("+json")
+
+
+def compress(body: bytes, encoding: str) -> bytes:
+    if encoding == "gzip":
+        return gzip.compress(body, compresslevel=6)
+    return zlib.compress(body, 6)
+
+
+class ResponseCompressionMiddleware:
+    """
+    ASGI 中间件：按 Accept-Encoding 压缩非流式 JSON 响应
+
+    不压缩的类型（包括 SSE）和已经编码的响应直接透传；JSON 响应暂存 http.response.start，看到第一条响应体消息后再决定：
+    响应体一次性写出且不小于下限时压缩并改写 Content-Encoding / Content-Length，否则把暂存的消息原样放行
+    """
+
+    def __init__(
+        self,
+        app,
+        enabled: bool = RESPONSE_COMPRESSION_ENABLED,
+        min_bytes: int = RESPONSE_COMPRESSION_MIN_BYTES,
+    ):
+        self.app = app
+        self.enabled = enabled
+        self.min_bytes = min_bytes
+
+    async def __call__(self, scope, receive, send):
+        if scope["type"] != "http" or not self.enabled:
+            await self.app(scope, receive, send)
+            return
+        headers = dict(scope.get("headers") or [])
+        encoding = negotiate_encoding(headers.get(b"accept-encoding", b"").decode("latin-1"))
+        if encoding is None:
+            await self.app(scope, receive, send)
+            return
+
+        start_message = None
+        decided = False
+
+        async def send_wrapper(message):
+            nonlocal start_message, decided
+            if decided:
+                await send(message)
+                return
+            if message["type"] == "http.response.start":
+                names = {name.lower(): value for name, value in message.get("headers") or []}
+                if b"content-encoding" in names or not is_compressible(
+                    names.get(b"content-type", b"").decode("latin-1")
+                ):
+                    # SSE 等不压缩的响应立即放行，响应头不等待第一个事件
+                    decided = True
+                    await send(message)
+                    return
+                start_message = message
+                return
+            if message["type"] != "http.response.body" or start_message is None:
+                await send(message)
+                return
+            decided = True
+            response_headers = list(start_message.get("headers") or [])
+            names = {name.lower(): value for name, value in response_headers}
+            body = message.get("body", b"")
+            if message.get("more_body", False) or len(body) < self.min_bytes:
+                await send(start_message)
+                await send(message)
+                return
+            compressed = compress(body, encoding)
+            response_headers = [
+                (name, value) for name, value in response_headers
+                if name.lower() not in (b"content-length", b"vary")
+            ]
+            vary = names.get(b"vary")
+            response_headers += [
+                (b"content-encoding", encoding.encode()),
+                (b"content-length", str(len(compressed)).encode()),
+                (b"vary", vary + b", Accept-Encoding" if vary else b"Accept-Encoding"),
+            ]
+            await send(dict(start_message, headers=response_headers))
+            await send(dict(message, body=compressed))
+
+        await self.app(scope, receive, send_wrapper)
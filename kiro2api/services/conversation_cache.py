@@ -0,0 +1,134 @@
+"""
+对话连续性
+CodeWhisperer 请求带 conversationState.conversationId，代理默认每个请求生成新的 id，上游无法把多轮请求关联为同一个对话。
+客户端可以给出稳定的对话标识，同一标识的后续请求沿用上一轮发往上游的 conversationId：
+
+- X-Conversation-Id 请求头（两个接口都支持），或 Claude 请求的 metadata.user_id（请求头优先）
+- 标识按 API Key 标签隔离，不同 Key 的相同标识互不影响
+- 映射只保存在进程内：最多 CONVERSATION_CACHE_SIZE 条（按最近使用淘汰），超过 CONVERSATION_TTL_SECONDS 未使用的条目过期
+- 上游拒绝沿用的 conversationId 时（400 / 404，错误信息提到 conversation），丢弃映射、换新的 id 重试一次，客户端无感知
+
+请求本身仍然携带完整的对话历史，沿用 id 只是让上游把它们视为同一个对话；CONVERSATION_CACHE_SIZE 为 0 时关闭。
+每个条目同时记录这个上游对话中已经发送过的工具指纹，开启 TOOL_COMPACTION_ENABLED 时后续轮次据此压缩重复的工具定义
+（见 services/tool_utils.py compact_repeated_tools），count_tokens 也按压缩后的定义计数
+"""
+
+import re
+import time
+import uuid
+import logging
+import threading
+from collections import OrderedDict
+from typing import Callable, Dict, FrozenSet, Iterable, Optional, Tuple
+
+from config import CONVERSATION_CACHE_SIZE, CONVERSATION_TTL_SECONDS
+
+logger = logging.getLogger(__name__)
+
+CONVERSATION_ID_HEADER = "x-conversation-id"
+# 客户端给出的对话标识只在格式安全时使用，避免把任意内容放进内存和日志
+CLIENT_CONVERSATION_ID_PATTERN = re.compile(r"^[A-Za-z0-9._:@-]{1,256}$")
+# 上游拒绝 conversationId 时的状态码
+STALE_CONVERSATION_STATUS_CODES = (400, 404)
+
+
+def conversation_key(key_label: Optional[str], client_id: Optional[str]) -> Optional[str]:
+    """缓存键（API Key 标签 + 客户端对话标识）；没有标识或格式不合法时返回 None"""
+    if not isinstance(client_id, str) or not CLIENT_CONVERSATION_ID_PATTERN.match(client_id):
+        return None
+    return f"{key_label or '-'}:{client_id}"
+
+
+def is_stale_conversation_error(status_code: int, summary: Optional[str]) -> bool:
+    return status_code in STALE_CONVERSATION_STATUS_CODES and "conversation" in (summary or "").lower()
+
+
+class ConversationCache:
+    def __init__(
+        self,
+        max_size: int = CONVERSATION_CACHE_SIZE,
+        ttl_seconds: float = CONVERSATION_TTL_SECONDS,
+        clock: Callable[[], float] = time.monotonic,
+    ):
+        self.max_size = max_size
+        self.ttl_seconds = ttl_seconds
+        self._clock = clock
+        # 缓存键 -> (上游 conversationId, 最近使用时间, 已发送过的工具指纹)
+        self._entries: "OrderedDict[str, Tuple[str, float, FrozenSet[str]]]" = OrderedDict()
+        # 上游 conversationId -> 缓存键，用于上游拒绝时找回并丢弃映射
+        self._keys: Dict[str, str] = {}
+        self._lock = threading.Lock()
+
+    @property
+    def enabled(self) -> bool:
+        return self.max_size > 0
+
+    def __len__(self) -> int:
+        return len(self._entries)
+
+    def _drop(self, key: str):
+        conversation_id, _, _ = self._entries.pop(key)
+        self._keys.pop(conversation_id, None)
+
+    def lookup(self, key: Optional[str]) -> Optional[str]:
+        """沿用的上游 conversationId；没有或已过期时返回 None"""
+        if not self.enabled or key is None:
+            return None
+        with self._lock:
+            entry = self._entries.get(key)
+            if entry is None:
+                return None
+            conversation_id, used_at, tools = entry
+            if self._expired(used_at):
+                self._drop(key)
+                return None
+            self._entries[key] = (conversation_id, self._clock(), tools)
+            self._entries.move_to_end(key)
+            return conversation_id
+
+    def _expired(self, used_at: float) -> bool:
+        return self.ttl_seconds > 0 and self._clock() - used_at > self.ttl_seconds
+
+    def declared_tools(self, key: Optional[str]) -> FrozenSet[str]:
+        """这个对话的上游 conversationId 中已经发送过的工具指纹；没有条目或已过期时为空（不更新最近使用时间）"""
+        if not self.enabled or key is None:
+            return frozenset()
+        with self._lock:
+            entry = self._entries.get(key)
+            if entry is None or self._expired(entry[1]):
+                return frozenset()
+            return entry[2]
+
+    def remember(self, key: Optional[str], conversation_id: str, tools: Iterable[str] = ()):
+        """上游接受请求后记录本轮使用的 conversationId 和发送的工具指纹（同一个上游对话的指纹累积保留）"""
+        if not self.enabled or key is None:
+            return
+        with self._lock:
+            declared = frozenset(tools)
+            if key in self._entries:
+                previous_id, _, previous_tools = self._entries[key]
+                if previous_id == conversation_id:
+                    declared |= previous_tools
+                self._drop(key)
+            self._entries[key] = (conversation_id, self._clock(), declared)
+            self._keys[conversation_id] = key
+            while len(self._entries) > self.max_size:
+                oldest = next(iter(self._entries))
+                self._drop(oldest)
+
+    def is_reused(self, conversation_id: Optional[str]) -> bool:
+        with self._lock:
+            return conversation_id in self._keys
+
+    def reset(self, conversation_id: str) -> str:
+        """上游拒绝沿用的 conversationId：丢弃映射，返回新的 id"""
+        with self._lock:
+            key = self._keys.pop(conversation_id, None)
+            if key is not None and key in self._entries:
+                del self._entries[key]
+        logger.info(f"🔁 上游拒绝沿用的 conversationId {conversation_id}，改用新对话")
+        return str(uuid.uuid4())
+
+
+# 全局单例
+conversation_cache = ConversationCache()
@@ -0,0 +1,59 @@
+"""
+错误响应中的调试信息
+客户端发送 X-Kiro-Debug: 1 且所用 Key 的标签在 DEBUG_KEY_LABELS 中时，错误响应附带 debug 对象，列出每一次上游调用：
+脱敏的 token、账号、模型、耗时、状态码或错误原因，以及之后的决定（retry / fallback / abort）。
+没有请求头或没有权限时不会附带任何调试信息
+"""
+
+from typing import Any, Dict, Optional
+
+from fastapi import Request
+from fastapi.exception_handlers import http_exception_handler
+from fastapi.responses import JSONResponse
+from starlette.exceptions import HTTPException as StarletteHTTPException
+
+from config import DEBUG_KEY_LABELS
+from auth.api_key import api_key_label
+from services.request_context import current_request_context
+
+DEBUG_HEADER = "x-kiro-debug"
+
+
+def debug_permitted(key_label: Optional[str], labels=None) -> bool:
+    labels = DEBUG_KEY_LABELS if labels is None else labels
+    return key_label is not None and ("*" in labels or key_label in labels)
+
+
+def debug_requested(request: Optional[Request]) -> bool:
+    """请求带 X-Kiro-Debug 且所用 Key 有权限"""
+    if request is None:
+        return False
+    if request.headers.get(DEBUG_HEADER, "").strip().lower() not in ("1", "true", "yes"):
+        return False
+    authorization = request.headers.get("authorization") or ""
+    if not authorization.startswith("Bearer "):
+        return False
+    return debug_permitted(api_key_label(authorization[len("Bearer "):]))
+
+
+def debug_payload() -> Dict[str, Any]:
+    context = current_request_context()
+    return {
+        "request_id": context.request_id if context else None,
+        "upstream_attempts": [dict(attempt) for attempt in context.upstream_attempts] if context else [],
+    }
+
+
+def with_debug(body: Any, request: Optional[Request]) -> Any:
+    """请求了调试信息且有权限时，错误体（dict）附带 debug 对象，否则原样返回"""
+    if not isinstance(body, dict) or not debug_requested(request):
+        return body
+    return dict(body, debug=debug_payload())
+
+
+async def debug_http_exception_handler(request: Request, exc: StarletteHTTPException):
+    """与默认的 HTTPException 处理相同，请求了调试信息且有权限时在 detail 中附带 debug 对象"""
+    detail = with_debug(exc.detail, request)
+    if detail is exc.detail:
+        return await http_exception_handler(request, exc)
+    return JSONResponse(status_code=exc.status_code, content={"detail": detail}, headers=getattr(exc, "headers", None))
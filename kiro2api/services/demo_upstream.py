@@ -0,0 +1,206 @@
+"""
+演示模式（DEMO_MODE）的假上游
+不需要任何 Kiro 凭证：把最后一条用户消息原样回显，
+请求带工具时追加一个固定的工具调用，用于验证客户端的端到端集成
+
+返回的是真实的 AWS event-stream 二进制帧，后续解析流程与真实上游完全一致
+
+前端调试渲染时可以在客户端请求的 URL 上加查询参数，模拟真实的输出节奏（例如 /v1/messages?tps=30&chunk=2-12&tool=1&seed=42）：
+
+- tps：每秒输出的 token 数（按 4 个字符约 1 个 token 计），0 或不带时一次性返回
+- chunk：每个文本增量的字符数，固定值（8）或范围（2-12，每次在范围内随机取）
+- tool：注入工具调用的概率（0~1，1 为总是、0 为从不）；不带时请求有工具才追加
+- seed：随机数种子，相同的种子和请求得到完全相同的事件序列（增量切分、工具调用及其 id），便于录制回放
+"""
+
+import json
+import uuid
+import random
+import struct
+import asyncio
+import zlib
+import logging
+from dataclasses import dataclass
+from typing import Any, AsyncIterator, Dict, List, Mapping, Optional, Tuple
+
+import httpx
+
+from services.request_context import annotate_request, current_request_context
+
+logger = logging.getLogger(__name__)
+
+DEMO_TOKEN = "demo-mode-token"
+DEMO_CHUNK_SIZE = 16
+# 按 tps 计算节奏时每个 token 对应的字符数
+DEMO_CHARS_PER_TOKEN = 4
+# tps 的上限，避免误传极大值时等同于不限速却仍然逐帧调度
+DEMO_MAX_TPS = 10000
+
+
+class DemoOptionError(ValueError):
+    """演示模式查询参数无效"""
+
+
+@dataclass
+class DemoOptions:
+    """演示响应的节奏和内容选项（由客户端请求的查询参数给出）"""
+    tps: float = 0
+    chunk_min: int = DEMO_CHUNK_SIZE
+    chunk_max: int = DEMO_CHUNK_SIZE
+    # 注入工具调用的概率，None 表示请求有工具时才追加
+    tool: Optional[float] = None
+    seed: Optional[int] = None
+
+
+def _parse_chunk(value: str) -> Tuple[int, int]:
+    low, _, high = value.partition("-")
+    try:
+        chunk_min, chunk_max = int(low), int(high or low)
+    except ValueError:
+        raise DemoOptionError("chunk must be a size (8) or a range (2-12)")
+    if not 1 <= chunk_min <= chunk_max:
+        raise DemoOptionError("chunk sizes must satisfy 1 <= min <= max")
+    return chunk_min, chunk_max
+
+
+def parse_demo_options(params: Mapping[str, str]) -> DemoOptions:
+    """解析查询参数 tps / chunk / tool / seed，无效时抛出 DemoOptionError"""
+    options = DemoOptions()
+    try:
+        if params.get("tps"):
+            options.tps = float(params["tps"])
+        if params.get("tool"):
+            options.tool = float(params["tool"])
+        if params.get("seed"):
+            options.seed = int(params["seed"])
+    except ValueError as e:
+        raise DemoOptionError(f"invalid demo parameter: {e}")
+    if not 0 <= options.tps <= DEMO_MAX_TPS:
+        raise DemoOptionError(f"tps must be between 0 and {DEMO_MAX_TPS}")
+    if options.tool is not None and not 0 <= options.tool <= 1:
+        raise DemoOptionError("tool must be a probability between 0 and 1")
+    if params.get("chunk"):
+        options.chunk_min, options.chunk_max = _parse_chunk(params["chunk"])
+    return options
+
+
+def set_demo_options(options: DemoOptions):
+    """把本请求的演示选项写入请求上下文，假上游处理该请求时读取"""
+    annotate_request(demo_options=options)
+
+
+def current_demo_options() -> DemoOptions:
+    context = current_request_context()
+    return (context.demo_options if context else None) or DemoOptions()
+
+
+def _encode_header(name: str, value: str) -> bytes:
+    """编码一个字符串类型（type=7）的 event-stream 头"""
+    name_bytes = name.encode("utf-8")
+    value_bytes = value.encode("utf-8")
+    return (
+        struct.pack(">B", len(name_bytes)) + name_bytes
+        + struct.pack(">BH", 7, len(value_bytes)) + value_bytes
+    )
+
+
+def encode_event_stream_message(event_type: str, payload: Dict[str, Any]) -> bytes:
+    """编码一条 AWS event-stream 消息（prelude + prelude CRC + headers + payload + message CRC）"""
+    headers = (
+        _encode_header(":event-type", event_type)
+        + _encode_header(":content-type", "application/json")
+        + _encode_header(":message-type", "event")
+    )
+    payload_bytes = json.dumps(payload, ensure_ascii=False).encode("utf-8")
+    total_len = 12 + len(headers) + len(payload_bytes) + 4
+
+    prelude = struct.pack(">II", total_len, len(headers))
+    prelude_crc = struct.pack(">I", zlib.crc32(prelude) & 0xFFFFFFFF)
+    message = prelude + prelude_crc + headers + payload_bytes
+    return message + struct.pack(">I", zlib.crc32(message) & 0xFFFFFFFF)
+
+
+def _split(text: str, rng: random.Random, options: DemoOptions) -> List[str]:
+    """按 chunk 大小（固定或在范围内随机）切分回复文本"""
+    pieces = []
+    start = 0
+    while start < len(text):
+        size = rng.randint(options.chunk_min, options.chunk_max)
+        pieces.append(text[start:start + size])
+        start += size
+    return pieces or [""]
+
+
+def _should_inject_tool(tools: List[Dict[str, Any]], rng: random.Random, options: DemoOptions) -> bool:
+    if options.tool is None:
+        return bool(tools)
+    # 总是消耗一次随机数，概率取 0 / 1 时序列中其他部分不受影响
+    return rng.random() < options.tool
+
+
+def build_demo_events(
+    request_data: Dict[str, Any], options: Optional[DemoOptions] = None
+) -> List[Tuple[bytes, float]]:
+    """根据 CodeWhisperer 请求构造演示响应的事件帧，返回 (帧, 发出前等待的秒数)"""
+    options = options or DemoOptions()
+    rng = random.Random(options.seed)
+    state = request_data.get("conversationState", {})
+    user_input = state.get("currentMessage", {}).get("userInputMessage", {})
+    content = user_input.get("content", "")
+    tools = user_input.get("userInputMessageContext", {}).get("tools", [])
+
+    frames = [(encode_event_stream_message(
+        "messageMetadataEvent",
+        {"conversationId": state.get("conversationId") or str(uuid.uuid4())}
+    ), 0.0)]
+
+    def delay(text: str) -> float:
+        if options.tps <= 0:
+            return 0.0
+        return max(1, -(-len(text) // DEMO_CHARS_PER_TOKEN)) / options.tps
+
+    reply = f"[demo] {content}"
+    for index, piece in enumerate(_split(reply, rng, options)):
+        # 第一个增量立即发出（首 token 延迟由真实调用方自己模拟），之后按 tps 计算间隔
+        frames.append((
+            encode_event_stream_message("assistantResponseEvent", {"content": piece}),
+            delay(piece) if index else 0.0,
+        ))
+
+    if _should_inject_tool(tools, rng, options):
+        tool_name = tools[0].get("toolSpecification", {}).get("name", "demo_tool") if tools else "demo_tool"
+        tool_use_id = f"tooluse_demo_{rng.getrandbits(48):012x}"
+        tool_input = json.dumps({"demo": True})
+        frames.append((encode_event_stream_message(
+            "toolUseEvent", {"name": tool_name, "toolUseId": tool_use_id, "input": tool_input}
+        ), delay(tool_input)))
+        frames.append((encode_event_stream_message(
+            "toolUseEvent", {"name": tool_name, "toolUseId": tool_use_id, "stop": True}
+        ), 0.0))
+
+    return frames
+
+
+async def _paced(frames: List[Tuple[bytes, float]]) -> AsyncIterator[bytes]:
+    for frame, wait in frames:
+        if wait > 0:
+            await asyncio.sleep(wait)
+        yield frame
+
+
+def demo_upstream_handler(request: httpx.Request) -> httpx.Response:
+    """httpx.MockTransport 的处理函数，模拟 generateAssistantResponse 接口"""
+    try:
+        request_data = json.loads(request.content or b"{}")
+    except json.JSONDecodeError:
+        return httpx.Response(400, json={"message": "Invalid JSON"})
+
+    options = current_demo_options()
+    frames = build_demo_events(request_data, options)
+    headers = {"Content-Type": "application/vnd.amazon.eventstream"}
+    if options.tps > 0:
+        logger.debug(f"🎭 演示模式响应: {len(frames)} 帧，tps={options.tps:g}")
+        return httpx.Response(200, content=_paced(frames), headers=headers)
+    body = b"".join(frame for frame, _ in frames)
+    logger.debug(f"🎭 演示模式响应: {len(body)} bytes")
+    return httpx.Response(200, content=body, headers=headers)
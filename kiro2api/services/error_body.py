@@ -0,0 +1,115 @@
+"""
+上游错误响应体解析
+上游的错误体可能是 JSON，也可能是 event-stream 编码的异常帧（有时 Content-Type 与实际格式不符），
+这里按 Content-Type 和前导字节识别格式，统一提取错误类型和消息，避免把二进制 prelude 原样写进日志和客户端错误
+"""
+
+import json
+import logging
+from dataclasses import dataclass
+from typing import Any, Optional
+
+from parsers.stream_parser import looks_like_event_stream, decode_event_stream_frames
+
+logger = logging.getLogger(__name__)
+
+EVENT_STREAM_CONTENT_TYPE = "application/vnd.amazon.eventstream"
+# 错误消息保留的最大字符数
+MAX_MESSAGE_CHARS = 500
+
+
+@dataclass
+class UpstreamErrorBody:
+    """解析后的上游错误：format 为 json / event-stream / text / empty"""
+    format: str
+    error_type: Optional[str] = None
+    message: str = ""
+    reason: Optional[str] = None
+
+    def is_throttling(self) -> bool:
+        """__type / reason / 异常类型为 Throttling*，或纯文本中包含 ThrottlingException"""
+        if self.format == "text":
+            return "throttlingexception" in self.message.lower()
+        return any("throttling" in (value or "").lower() for value in (self.error_type, self.reason))
+
+    def summary(self) -> str:
+        if self.error_type and self.message:
+            return f"{self.error_type}: {self.message}"
+        return self.error_type or self.message
+
+
+def printable_text(body: bytes) -> str:
+    """把原始字节转为可读文本：无效 UTF-8 和控制字符转义为 \\xNN"""
+    text = body.decode("utf-8", errors="backslashreplace")
+    return "".join(
+        char if char.isprintable() or char in "\n\t" else f"\\x{ord(char):02x}"
+        for char in text
+    )[:MAX_MESSAGE_CHARS]
+
+
+def _from_json(data: Any) -> Optional[UpstreamErrorBody]:
+    if not isinstance(data, dict):
+        return None
+    error_type = data.get("__type") or data.get("reason") or data.get("code")
+    if isinstance(error_type, str) and "#" in error_type:
+        # AWS JSON 协议的 __type 可能带命名空间前缀，例如 com.amazon...#ThrottlingException
+        error_type = error_type.rsplit("#", 1)[1]
+    message = data.get("message") or data.get("Message") or ""
+    reason = data.get("reason")
+    return UpstreamErrorBody(
+        "json",
+        str(error_type) if error_type else None,
+        str(message)[:MAX_MESSAGE_CHARS],
+        str(reason) if reason else None,
+    )
+
+
+def _from_event_stream(body: bytes) -> Optional[UpstreamErrorBody]:
+    frames = decode_event_stream_frames(body)
+    if not frames:
+        return None
+    # 优先取异常/错误帧，没有时取第一帧
+    headers, payload = next(
+        ((h, p) for h, p in frames if h.get(":message-type") in ("exception", "error")),
+        frames[0],
+    )
+    error_type = headers.get(":exception-type") or headers.get(":error-code")
+    message = headers.get(":error-message") or ""
+    try:
+        parsed = _from_json(json.loads(payload)) if payload else None
+    except (ValueError, UnicodeDecodeError):
+        parsed = None
+    reason = None
+    if parsed:
+        error_type = error_type or parsed.error_type
+        message = message or parsed.message
+        reason = parsed.reason
+    elif payload and not message:
+        message = printable_text(payload)
+    return UpstreamErrorBody("event-stream", error_type, str(message)[:MAX_MESSAGE_CHARS], reason)
+
+
+def describe_error_body(body: bytes, content_type: Optional[str] = None) -> UpstreamErrorBody:
+    """
+    识别并解析上游错误体
+
+    Content-Type 为 event-stream 或前导字节符合 event-stream 格式时按帧解码；否则尝试 JSON；
+    都失败时返回转义了二进制字节的原始文本
+    """
+    if not body:
+        return UpstreamErrorBody("empty")
+
+    if EVENT_STREAM_CONTENT_TYPE in (content_type or "").lower() or looks_like_event_stream(body):
+        decoded = _from_event_stream(body)
+        if decoded:
+            return decoded
+        logger.debug("错误体标记为 event-stream 但无法解码，按其他格式处理")
+
+    try:
+        decoded = _from_json(json.loads(body))
+    except (ValueError, UnicodeDecodeError):
+        decoded = None
+    if decoded:
+        return decoded
+
+    return UpstreamErrorBody("text", None, printable_text(body))
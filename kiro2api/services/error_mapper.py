@@ -0,0 +1,141 @@
+"""
+上游错误到客户端错误的映射
+在向客户端写出任何 SSE 事件之前失败时，用这里的函数返回带正确状态码的错误响应；
+SSE 已经开始之后的错误只能在流内收尾，收尾方式由 stream_error_stop_reason 决定（见 ClaudeStreamHandler.abort）
+"""
+
+import math
+import logging
+from typing import Callable, Dict, List, Optional, Tuple
+
+from fastapi import HTTPException
+
+from services.upstream import UpstreamError, UpstreamCircuitOpenError, is_throttling_error
+from services.metrics import upstream_errors_total
+
+logger = logging.getLogger(__name__)
+
+
+# 按优先级排列的重试提示头（秒）；AWS 部分服务使用 x-amzn- / x-amz- 前缀
+RETRY_AFTER_HEADERS = ("retry-after", "x-amzn-retry-after", "x-amz-retry-after")
+# 以毫秒为单位的重试提示头，转换为秒（向上取整）
+RETRY_AFTER_MS_HEADERS = ("retry-after-ms", "x-amzn-retry-after-ms", "x-amz-retry-after-ms")
+
+
+def retry_after_header(headers: Dict[str, str]) -> Optional[str]:
+    """从上游响应头中取出重试提示，统一为 Retry-After 的取值（秒数或 HTTP 日期）"""
+    lowered = {key.lower(): value for key, value in (headers or {}).items()}
+    for key in RETRY_AFTER_HEADERS:
+        value = (lowered.get(key) or "").strip()
+        if value:
+            return value
+    for key in RETRY_AFTER_MS_HEADERS:
+        try:
+            return str(max(1, math.ceil(float(lowered[key]) / 1000)))
+        except (KeyError, ValueError):
+            continue
+    return None
+
+
+def retry_after_headers(e: UpstreamError) -> Optional[Dict[str, str]]:
+    """错误响应需要附带的 Retry-After 头，上游没有给出时返回 None"""
+    retry_after = retry_after_header(e.headers)
+    return {"Retry-After": retry_after} if retry_after else None
+
+
+def circuit_open_strategy(e: UpstreamError) -> Optional[Tuple[int, str]]:
+    """上游熔断器打开：503（附带 Retry-After）"""
+    if isinstance(e, UpstreamCircuitOpenError):
+        return 503, "api_error"
+    return None
+
+
+def throttling_strategy(e: UpstreamError) -> Optional[Tuple[int, str]]:
+    """限流：429，或错误体为 ThrottlingException / reason THROTTLING（JSON、event-stream 异常帧或纯文本）"""
+    content_type = next((v for k, v in e.headers.items() if k.lower() == "content-type"), None)
+    if e.status_code == 429 or e.error_type == "rate_limit_error" or is_throttling_error(e.body, content_type):
+        return 429, "rate_limit_error"
+    return None
+
+
+def authentication_strategy(e: UpstreamError) -> Optional[Tuple[int, str]]:
+    """认证失败：401"""
+    if e.error_type == "authentication_error":
+        return 401, "authentication_error"
+    return None
+
+
+def client_error_strategy(e: UpstreamError) -> Optional[Tuple[int, str]]:
+    """其他上游 4xx：视为请求本身的问题，返回 400"""
+    if 400 <= e.status_code < 500:
+        return 400, "invalid_request_error"
+    return None
+
+
+# 按顺序尝试，第一个返回结果的策略决定下游的状态码和错误类型；都不匹配时返回 502 api_error
+ERROR_STRATEGIES: List[Callable[[UpstreamError], Optional[Tuple[int, str]]]] = [
+    circuit_open_strategy,
+    throttling_strategy,
+    authentication_strategy,
+    client_error_strategy,
+]
+
+
+def map_upstream_error(e: UpstreamError) -> Tuple[int, str]:
+    """返回 UpstreamError 对应的 (下游状态码, 错误类型)"""
+    for strategy in ERROR_STRATEGIES:
+        mapped = strategy(e)
+        if mapped:
+            return mapped
+    return 502, "api_error"
+
+
+def is_client_caused(e: UpstreamError) -> bool:
+    """上游以 4xx 拒绝的是请求本身（映射为 400），不是账号或上游的问题，不应计入账号错误次数"""
+    return map_upstream_error(e)[1] == "invalid_request_error"
+
+
+def record_upstream_error(e: UpstreamError) -> Tuple[int, str]:
+    """映射上游错误并计入 kiro2api_upstream_errors_total，返回 (下游状态码, 错误类型)"""
+    status_code, error_type = map_upstream_error(e)
+    upstream_errors_total.inc(type=error_type)
+    return status_code, error_type
+
+
+# 上游在流中途报告长度超限的标记（错误信息中出现即匹配，不区分大小写），映射为 stop_reason=max_tokens 正常结束
+MAX_TOKENS_ERROR_MARKERS = ("content_length_exceeds_threshold", "contentlengthexceeded")
+
+
+def stream_error_stop_reason(error: BaseException) -> Optional[str]:
+    """流中途的错误按正常结束收尾时的 stop_reason；返回 None 时按默认策略发出 error 事件"""
+    text = str(error).lower()
+    if any(marker in text for marker in MAX_TOKENS_ERROR_MARKERS):
+        return "max_tokens"
+    return None
+
+
+def claude_error_from_upstream(e: UpstreamError) -> HTTPException:
+    """
+    将 UpstreamError 映射为 Claude 格式的错误响应，状态码和错误类型由 ERROR_STRATEGIES 决定
+
+    - 上游熔断: 503 api_error
+    - 限流（429 / ThrottlingException）: 429 rate_limit_error
+    - 认证失败: 401 authentication_error
+    - 上游 4xx: 400 invalid_request_error
+    - 其他: 502 api_error
+
+    上游给出重试提示（Retry-After 或 x-amzn- 等价头）时，都会以 Retry-After 透传给客户端
+    """
+    status_code, error_type = record_upstream_error(e)
+    logger.warning(f"上游错误映射: {e.status_code} -> {status_code} {error_type}")
+    return HTTPException(
+        status_code=status_code,
+        detail={
+            "type": "error",
+            "error": {
+                "type": error_type,
+                "message": e.message,
+            }
+        },
+        headers=retry_after_headers(e),
+    )
@@ -0,0 +1,129 @@
+"""
+请求级功能开关
+有风险的改动可以先只对部分流量或指定的 Key 开启。开关在 FEATURE_FLAGS 中定义（JSON 字符串或 JSON 文件路径）：
+
+    {"upstream_prefetch": {"default": false, "percentage": 5, "keys": {"priority-1": true}}}
+
+对当前请求求值时按以下优先级决定：
+
+1. keys：按 API Key 标签（default / priority-N）强制开启或关闭
+2. percentage：按 request_id 的哈希分桶（0-99），桶号小于百分比时开启；同一开关下同一 request_id 的结果总是相同，
+   客户端重试时带上相同的 X-Request-ID 即可得到相同的结果
+3. default：以上都不适用时的默认状态
+
+代码中用 feature_flags.enabled("name") 查询；未定义的开关总是关闭。同一请求中每个开关只求值一次，
+结果记录在请求上下文中，随访问日志输出（feature_flags），便于把错误与开关状态关联
+"""
+
+import os
+import json
+import hashlib
+import logging
+from dataclasses import dataclass, field
+from typing import Any, Dict, Optional
+
+from config import FEATURE_FLAGS
+from services.request_context import current_request_context
+
+logger = logging.getLogger(__name__)
+
+# 实验性：流式请求在返回 SSE 响应之前就发起上游请求（与 UPSTREAM_PREFETCH=true 效果相同，可以按比例开启）
+FLAG_UPSTREAM_PREFETCH = "upstream_prefetch"
+
+BUCKETS = 100
+
+
+class FeatureFlagError(ValueError):
+    """开关定义格式错误"""
+
+
+@dataclass
+class FeatureFlag:
+    name: str
+    default: bool = False
+    # 开启的流量百分比（0-100），None 表示不按比例
+    percentage: Optional[float] = None
+    # API Key 标签 -> 强制的状态
+    keys: Dict[str, bool] = field(default_factory=dict)
+
+
+def parse_flag(name: str, spec: Any) -> FeatureFlag:
+    """解析单个开关定义；true / false 是只有默认状态的简写"""
+    if isinstance(spec, bool):
+        return FeatureFlag(name, default=spec)
+    if not isinstance(spec, dict):
+        raise FeatureFlagError(f"flag '{name}' must be a boolean or an object")
+    default = spec.get("default", False)
+    percentage = spec.get("percentage")
+    keys = spec.get("keys") or {}
+    if not isinstance(default, bool):
+        raise FeatureFlagError(f"flag '{name}': default must be a boolean")
+    if percentage is not None and (
+        isinstance(percentage, bool) or not isinstance(percentage, (int, float)) or not 0 <= percentage <= 100
+    ):
+        raise FeatureFlagError(f"flag '{name}': percentage must be a number between 0 and 100")
+    if not isinstance(keys, dict) or not all(isinstance(v, bool) for v in keys.values()):
+        raise FeatureFlagError(f"flag '{name}': keys must map key labels to booleans")
+    return FeatureFlag(name, default=default, percentage=percentage, keys=dict(keys))
+
+
+def load_flags(raw: str) -> Dict[str, FeatureFlag]:
+    """解析 FEATURE_FLAGS：以 { 开头按 JSON 解析，否则视为 JSON 文件路径；格式错误时不启用任何开关并记录日志"""
+    raw = (raw or "").strip()
+    if not raw:
+        return {}
+    try:
+        if raw.startswith("{"):
+            data = json.loads(raw)
+        else:
+            with open(os.path.expanduser(raw), "r", encoding="utf-8") as f:
+                data = json.load(f)
+        if not isinstance(data, dict):
+            raise FeatureFlagError("FEATURE_FLAGS must be a JSON object")
+        return {name: parse_flag(name, spec) for name, spec in data.items()}
+    except (OSError, ValueError) as e:
+        logger.error(f"❌ FEATURE_FLAGS 加载失败，所有开关保持关闭: {e}")
+        return {}
+
+
+def rollout_bucket(flag_name: str, subject: str) -> int:
+    """开关名和分桶对象（request_id）确定的桶号（0-99）；不同开关的分桶互相独立"""
+    digest = hashlib.sha256(f"{flag_name}:{subject}".encode("utf-8")).digest()
+    return int.from_bytes(digest[:8], "big") % BUCKETS
+
+
+def evaluate(flag: FeatureFlag, key_label: Optional[str], request_id: Optional[str]) -> bool:
+    """按 keys > percentage > default 的优先级求值"""
+    if key_label is not None and key_label in flag.keys:
+        return flag.keys[key_label]
+    if flag.percentage is not None and request_id:
+        return rollout_bucket(flag.name, request_id) < flag.percentage
+    return flag.default
+
+
+class FeatureFlags:
+    def __init__(self, flags: Optional[Dict[str, FeatureFlag]] = None):
+        self.flags = flags or {}
+
+    def enabled(self, name: str) -> bool:
+        """当前请求是否开启该开关；不在请求上下文中时按默认状态（未定义的开关为关闭）"""
+        flag = self.flags.get(name)
+        if flag is None:
+            return False
+        context = current_request_context()
+        if context is None:
+            return flag.default
+        if name not in context.feature_flags:
+            context.feature_flags[name] = evaluate(flag, context.key_label, context.request_id)
+        return context.feature_flags[name]
+
+    def describe(self) -> Dict[str, Dict[str, Any]]:
+        """开关定义（用于 /v1/capabilities）"""
+        return {
+            name: {"default": flag.default, "percentage": flag.percentage, "keys": sorted(flag.keys)}
+            for name, flag in self.flags.items()
+        }
+
+
+# 全局单例
+feature_flags = FeatureFlags(load_flags(FEATURE_FLAGS))
@@ -0,0 +1,116 @@
+"""
+OpenAI 图片输入（image_url 内容块）
+把 data: URL 解码为 Anthropic 的 {"type": "image", "source": {"type": "base64", ...}} 块，之后与原生 Claude 请求走同一条转换路径；
+http(s) URL 默认拒绝（400），开启 IMAGE_URL_FETCH_ENABLED 后由服务端下载（受 MAX_IMAGE_BYTES 限制）并改写为 data: URL
+"""
+
+import re
+import base64
+import binascii
+import logging
+from typing import Any, Dict, Optional
+
+import httpx
+
+from config import MAX_IMAGE_BYTES, IMAGE_URL_FETCH_ENABLED, IMAGE_URL_FETCH_TIMEOUT
+from models.schemas import ChatCompletionRequest
+
+logger = logging.getLogger(__name__)
+
+# 上游支持的图片类型
+SUPPORTED_IMAGE_MEDIA_TYPES = ("image/jpeg", "image/png", "image/gif", "image/webp")
+MEDIA_TYPE_ALIASES = {"image/jpg": "image/jpeg"}
+
+DATA_URL_PATTERN = re.compile(r"data:([^;,]+);base64,(.*)", re.DOTALL)
+
+
+class ImageInputError(ValueError):
+    """图片输入不合法，code 为 errors.py 中的错误消息键"""
+
+    def __init__(self, code: str, **params):
+        super().__init__(code)
+        self.code = code
+        self.params = params
+
+
+def _normalize_media_type(media_type: str) -> str:
+    media_type = media_type.strip().lower()
+    media_type = MEDIA_TYPE_ALIASES.get(media_type, media_type)
+    if media_type not in SUPPORTED_IMAGE_MEDIA_TYPES:
+        raise ImageInputError(
+            "unsupported_image_type", media_type=media_type, supported=", ".join(SUPPORTED_IMAGE_MEDIA_TYPES)
+        )
+    return media_type
+
+
+def _check_size(size: int):
+    if MAX_IMAGE_BYTES > 0 and size > MAX_IMAGE_BYTES:
+        raise ImageInputError("image_too_large", size=size, limit=MAX_IMAGE_BYTES)
+
+
+def parse_data_url(url: str) -> Dict[str, Any]:
+    """解码 data:image/...;base64,... 为 Anthropic 的 base64 图片 source"""
+    match = DATA_URL_PATTERN.match(url)
+    if not match:
+        raise ImageInputError("invalid_image_url", reason="expected data:<media type>;base64,<data>")
+    media_type = _normalize_media_type(match.group(1))
+    data = match.group(2).strip()
+    try:
+        decoded = base64.b64decode(data, validate=True)
+    except (binascii.Error, ValueError):
+        raise ImageInputError("invalid_image_url", reason="image data is not valid base64")
+    _check_size(len(decoded))
+    return {"type": "base64", "media_type": media_type, "data": data}
+
+
+def image_url_to_claude_block(url: str) -> Dict[str, Any]:
+    """OpenAI image_url 转换为 Anthropic image 块（此时远程 URL 应已被 inline_remote_images 改写）"""
+    if url.startswith(("http://", "https://")):
+        raise ImageInputError("image_url_fetch_disabled")
+    return {"type": "image", "source": parse_data_url(url)}
+
+
+async def fetch_image_as_data_url(url: str, client: Optional[httpx.AsyncClient] = None) -> str:
+    """下载远程图片并转换为 data: URL，超过 MAX_IMAGE_BYTES 时中止下载"""
+    own_client = client is None
+    client = client or httpx.AsyncClient(timeout=IMAGE_URL_FETCH_TIMEOUT, follow_redirects=True)
+    try:
+        async with client.stream("GET", url) as response:
+            if response.status_code != 200:
+                raise ImageInputError("image_fetch_failed", url=url, reason=f"HTTP {response.status_code}")
+            media_type = _normalize_media_type(response.headers.get("content-type", "").split(";", 1)[0])
+            declared = response.headers.get("content-length")
+            if declared and declared.isdigit():
+                _check_size(int(declared))
+            body = bytearray()
+            async for chunk in response.aiter_bytes():
+                body.extend(chunk)
+                _check_size(len(body))
+    except httpx.HTTPError as e:
+        raise ImageInputError("image_fetch_failed", url=url, reason=str(e) or type(e).__name__)
+    finally:
+        if own_client:
+            await client.aclose()
+    logger.info(f"🖼️ 已下载远程图片: {url[:100]} ({media_type}, {len(body)} bytes)")
+    return f"data:{media_type};base64,{base64.b64encode(bytes(body)).decode('ascii')}"
+
+
+async def inline_remote_images(request: ChatCompletionRequest):
+    """
+    处理请求中的远程图片 URL：未开启 IMAGE_URL_FETCH_ENABLED 时返回错误，开启时下载并原地改写为 data: URL
+
+    data: URL 也在这里校验（类型、base64、大小），保证请求构建阶段不会再悄悄丢弃图片
+    """
+    for message in request.messages:
+        if not isinstance(message.content, list):
+            continue
+        for part in message.content:
+            if getattr(part, "type", None) != "image_url" or not part.image_url:
+                continue
+            url = part.image_url.url
+            if url.startswith(("http://", "https://")):
+                if not IMAGE_URL_FETCH_ENABLED:
+                    raise ImageInputError("image_url_fetch_disabled")
+                part.image_url.url = await fetch_image_as_data_url(url)
+            else:
+                parse_data_url(url)
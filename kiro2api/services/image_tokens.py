@@ -0,0 +1,109 @@
+"""
+图片 token 估算
+按 Anthropic 的公式 tokens ≈ (宽 × 高) / 750 估算，超过上限的图片会被上游缩放，因此结果截断到 IMAGE_MAX_TOKENS
+"""
+
+import base64
+import binascii
+import logging
+import math
+import struct
+from typing import Any, Dict, Optional, Tuple
+
+logger = logging.getLogger(__name__)
+
+# 单张图片的 token 上限（约 1.15 百万像素，超过后上游会先缩放）
+IMAGE_MAX_TOKENS = 1600
+# 无法得知尺寸（URL 图片或无法解析的数据）时按上限计，宁可高估
+IMAGE_DEFAULT_TOKENS = IMAGE_MAX_TOKENS
+PIXELS_PER_TOKEN = 750
+
+
+def _png_size(data: bytes) -> Optional[Tuple[int, int]]:
+    if data[:8] != b"\x89PNG\r\n\x1a\n" or len(data) < 24:
+        return None
+    return struct.unpack(">II", data[16:24])
+
+
+def _gif_size(data: bytes) -> Optional[Tuple[int, int]]:
+    if data[:6] not in (b"GIF87a", b"GIF89a") or len(data) < 10:
+        return None
+    return struct.unpack("<HH", data[6:10])
+
+
+def _webp_size(data: bytes) -> Optional[Tuple[int, int]]:
+    if data[:4] != b"RIFF" or data[8:12] != b"WEBP" or len(data) < 30:
+        return None
+    chunk = data[12:16]
+    if chunk == b"VP8 ":
+        width, height = struct.unpack("<HH", data[26:30])
+        return width & 0x3FFF, height & 0x3FFF
+    if chunk == b"VP8L":
+        bits = int.from_bytes(data[21:25], "little")
+        return (bits & 0x3FFF) + 1, ((bits >> 14) & 0x3FFF) + 1
+    if chunk == b"VP8X":
+        return int.from_bytes(data[24:27], "little") + 1, int.from_bytes(data[27:30], "little") + 1
+    return None
+
+
+def _jpeg_size(data: bytes) -> Optional[Tuple[int, int]]:
+    if data[:2] != b"\xff\xd8":
+        return None
+    offset = 2
+    while offset + 4 <= len(data):
+        if data[offset] != 0xFF:
+            offset += 1
+            continue
+        marker = data[offset + 1]
+        # 填充字节和无长度的独立标记
+        if marker == 0xFF or marker in (0x01, 0xD8) or 0xD0 <= marker <= 0xD7:
+            offset += 1 if marker == 0xFF else 2
+            continue
+        length = struct.unpack(">H", data[offset + 2:offset + 4])[0]
+        # SOF0-SOF15（排除 DHT/JPG/DAC）携带图片尺寸
+        if 0xC0 <= marker <= 0xCF and marker not in (0xC4, 0xC8, 0xCC):
+            if offset + 9 > len(data):
+                return None
+            height, width = struct.unpack(">HH", data[offset + 5:offset + 9])
+            return width, height
+        offset += 2 + length
+    return None
+
+
+def image_dimensions(data: bytes) -> Optional[Tuple[int, int]]:
+    """从图片文件头解析宽高，支持 PNG / JPEG / GIF / WEBP"""
+    for parser in (_png_size, _jpeg_size, _gif_size, _webp_size):
+        size = parser(data)
+        if size:
+            return size
+    return None
+
+
+def tokens_for_dimensions(width: int, height: int) -> int:
+    """按 (宽 × 高) / 750 计算，截断到 IMAGE_MAX_TOKENS"""
+    if width <= 0 or height <= 0:
+        return IMAGE_DEFAULT_TOKENS
+    return min(IMAGE_MAX_TOKENS, max(1, math.ceil(width * height / PIXELS_PER_TOKEN)))
+
+
+def estimate_image_tokens(source: Dict[str, Any]) -> int:
+    """
+    估算一个 Claude 图片块 source 的 token 数
+
+    优先使用 source 中显式给出的 width/height，其次解析 base64 数据的文件头，
+    都拿不到尺寸时（例如 URL 图片）按 IMAGE_DEFAULT_TOKENS 计
+    """
+    width, height = source.get("width"), source.get("height")
+    if isinstance(width, int) and isinstance(height, int):
+        return tokens_for_dimensions(width, height)
+
+    if source.get("type") == "base64" and source.get("data"):
+        try:
+            size = image_dimensions(base64.b64decode(source["data"]))
+        except (binascii.Error, ValueError) as e:
+            logger.warning(f"⚠️ 图片 base64 解码失败，按默认值计算 token: {e}")
+            size = None
+        if size:
+            return tokens_for_dimensions(*size)
+
+    return IMAGE_DEFAULT_TOKENS
@@ -0,0 +1,67 @@
+"""
+按客户端 IP 的请求速率限制
+代理同时服务多个团队时，单个失控的客户端（例如重试风暴）可能在 API Key 限流之前就用光账号额度；
+这里在最外层按客户端 IP 做令牌桶限流，超过 IP_RATE_LIMIT_RPM（突发 IP_RATE_LIMIT_BURST）时直接返回 429，
+不读取请求体、不校验 Key、也不访问上游
+
+- 客户端 IP 取自连接地址；开启 IP_RATE_LIMIT_TRUST_FORWARDED 时取 X-Forwarded-For 的第一个地址
+- 健康检查和指标不受限制
+- 令牌桶补满（一段时间没有请求）后会被定期清理，客户端 IP 很多时内存也不会持续增长
+"""
+
+import logging
+from typing import Optional
+
+from fastapi.responses import JSONResponse
+
+from config import IP_RATE_LIMIT_RPM, IP_RATE_LIMIT_BURST, IP_RATE_LIMIT_TRUST_FORWARDED
+from auth.rate_limits import TokenBucketLimiter
+from errors import respond_error, respond_claude_error
+from services.request_validation import CLAUDE_PATH_PREFIX
+
+logger = logging.getLogger(__name__)
+
+# 不受 IP 限流的路径
+IP_RATE_LIMIT_EXEMPT_PATHS = ("/health", "/metrics")
+
+# 全局单例
+ip_rate_limiter = TokenBucketLimiter(IP_RATE_LIMIT_RPM, IP_RATE_LIMIT_BURST)
+
+
+def client_ip(scope, trust_forwarded: bool = IP_RATE_LIMIT_TRUST_FORWARDED) -> Optional[str]:
+    if trust_forwarded:
+        headers = dict(scope.get("headers") or [])
+        forwarded = headers.get(b"x-forwarded-for", b"").decode("latin-1").split(",")[0].strip()
+        if forwarded:
+            return forwarded
+    client = scope.get("client")
+    return client[0] if client else None
+
+
+class IpRateLimitMiddleware:
+    """ASGI 中间件：客户端 IP 的请求速率超过上限时返回 429 rate_limited 和 Retry-After"""
+
+    def __init__(self, app, limiter: TokenBucketLimiter = ip_rate_limiter, trust_forwarded: bool = IP_RATE_LIMIT_TRUST_FORWARDED):
+        self.app = app
+        self.limiter = limiter
+        self.trust_forwarded = trust_forwarded
+
+    async def __call__(self, scope, receive, send):
+        if scope["type"] != "http" or not self.limiter.enabled or scope.get("path") in IP_RATE_LIMIT_EXEMPT_PATHS:
+            await self.app(scope, receive, send)
+            return
+        ip = client_ip(scope, self.trust_forwarded) or "unknown"
+        retry_after = self.limiter.take(ip)
+        if retry_after is None:
+            await self.app(scope, receive, send)
+            return
+
+        logger.warning(f"⚠️ 客户端 {ip} 的请求速率已达上限 {self.limiter.rate_per_minute}/min，{retry_after} 秒后可重试")
+        params = {"limit": self.limiter.rate_per_minute, "retry_after": retry_after}
+        headers = {"Retry-After": str(retry_after)}
+        if scope.get("path", "").startswith(CLAUDE_PATH_PREFIX):
+            error = respond_claude_error(429, "ip_rate_limited", "rate_limit_error", headers=headers, **params)
+        else:
+            error = respond_error(429, "ip_rate_limited", "rate_limit_error", api_code="rate_limited", headers=headers, **params)
+        response = JSONResponse(status_code=error.status_code, content={"detail": error.detail}, headers=error.headers)
+        await response(scope, receive, send)
@@ -0,0 +1,202 @@
+"""
+审计日志（按 Key 记录请求和响应）
+合规需要保留部分 Key 的完整对话记录：JOURNAL_KEY_LABELS 中的 Key 的每个请求结束时，追加一行 JSON 到 JOURNAL_PATH：
+
+- timestamp、request_id、key_label、api、model、stream、request_hash（客户端请求体规范化 JSON 的 sha256）
+- prompt / response：客户端请求体和模型输出（推理内容、文本和工具参数），JOURNAL_CONTENT=hash 时只记录 sha256
+- usage（input / output token）、outcome（status、class、end_reason）、duration_ms
+
+记录来自 completion_bus 上的客户端请求级记录，在请求处理路径上只做入队；写文件在单独的线程中进行，
+不会拖慢请求。队列满（写入跟不上）时丢弃新记录，写入失败时记录错误；两种情况都计入指标，
+并向 JOURNAL_ALERT_WEBHOOK_URL 发送告警（同类告警限频），都不会让请求失败
+
+文件超过 JOURNAL_MAX_BYTES 时按 <path>.1 ... <path>.N 轮转（与 logging 的 RotatingFileHandler 相同），只追加不改写
+"""
+
+import os
+import json
+import time
+import queue
+import hashlib
+import logging
+import threading
+from typing import Any, Dict, List, Optional
+
+import httpx
+
+from config import (
+    JOURNAL_KEY_LABELS, JOURNAL_PATH, JOURNAL_MAX_BYTES, JOURNAL_BACKUP_COUNT, JOURNAL_CONTENT,
+    JOURNAL_QUEUE_SIZE, JOURNAL_ALERT_WEBHOOK_URL, JOURNAL_ALERT_INTERVAL_SECONDS,
+)
+from services.accounting import completion_bus, ClientRequestRecord
+from services.metrics import registry
+
+logger = logging.getLogger(__name__)
+
+CONTENT_FULL = "full"
+CONTENT_HASH = "hash"
+
+journal_records_total = registry.counter(
+    "kiro2api_journal_records_total", "Audit journal records by result (written, dropped, failed).",
+    ("result",),
+)
+
+
+def content_hash(value: Any) -> Optional[str]:
+    if value is None:
+        return None
+    if not isinstance(value, str):
+        value = json.dumps(value, ensure_ascii=False, sort_keys=True, separators=(",", ":"))
+    return "sha256:" + hashlib.sha256(value.encode("utf-8")).hexdigest()
+
+
+def rotate_file(path: str, backup_count: int):
+    """<path>.N-1 -> <path>.N ... <path> -> <path>.1，超出 backup_count 的最旧文件被删除；backup_count 为 0 时直接截断"""
+    if backup_count <= 0:
+        open(path, "w").close()
+        return
+    for n in range(backup_count - 1, 0, -1):
+        older = f"{path}.{n}"
+        if os.path.exists(older):
+            os.replace(older, f"{path}.{n + 1}")
+    os.replace(path, f"{path}.1")
+
+
+class RequestJournal:
+    def __init__(
+        self,
+        key_labels: List[str] = JOURNAL_KEY_LABELS,
+        path: str = JOURNAL_PATH,
+        max_bytes: int = JOURNAL_MAX_BYTES,
+        backup_count: int = JOURNAL_BACKUP_COUNT,
+        content: str = JOURNAL_CONTENT,
+        queue_size: int = JOURNAL_QUEUE_SIZE,
+        alert_webhook_url: str = JOURNAL_ALERT_WEBHOOK_URL,
+        alert_interval: float = JOURNAL_ALERT_INTERVAL_SECONDS,
+    ):
+        self.key_labels = key_labels
+        self.path = path
+        self.max_bytes = max_bytes
+        self.backup_count = backup_count
+        if content not in (CONTENT_FULL, CONTENT_HASH):
+            logger.warning(f"未知的 JOURNAL_CONTENT={content}，按 hash 处理")
+            content = CONTENT_HASH
+        self.content = content
+        self.alert_webhook_url = alert_webhook_url
+        self.alert_interval = alert_interval
+        self._queue: "queue.Queue[Dict[str, Any]]" = queue.Queue(maxsize=max(1, queue_size))
+        self._thread: Optional[threading.Thread] = None
+        self._last_alert: Dict[str, float] = {}
+        self.written = 0
+        self.dropped = 0
+        self.failed = 0
+
+    def wants(self, key_label: Optional[str]) -> bool:
+        return key_label is not None and ("*" in self.key_labels or key_label in self.key_labels)
+
+    def build_entry(self, record: ClientRequestRecord) -> Dict[str, Any]:
+        transcript = record.transcript() if record.transcript else {"request": None, "response": None}
+        prompt, response = transcript.get("request"), transcript.get("response")
+        if self.content == CONTENT_HASH:
+            prompt, response = content_hash(prompt), content_hash(response)
+        return {
+            "timestamp": record.timestamp,
+            "request_id": record.request_id,
+            "key_label": record.key_label,
+            "api": record.api,
+            "model": record.model,
+            "stream": record.stream,
+            "request_hash": content_hash(transcript.get("request")),
+            "prompt": prompt,
+            "response": response,
+            "usage": {"input_tokens": record.input_tokens, "output_tokens": record.output_tokens},
+            "outcome": {"status": record.status, "class": record.outcome_class, "end_reason": record.end_reason},
+            "duration_ms": record.duration_ms,
+        }
+
+    def on_record(self, record):
+        """completion_bus 订阅者：只构造记录并入队，不做任何 IO"""
+        if not isinstance(record, ClientRequestRecord) or not self.wants(record.key_label):
+            return
+        self.submit(self.build_entry(record))
+
+    def submit(self, entry: Dict[str, Any]) -> bool:
+        self._ensure_writer()
+        try:
+            self._queue.put_nowait(entry)
+            return True
+        except queue.Full:
+            self.dropped += 1
+            journal_records_total.inc(result="dropped")
+            logger.error(f"❌ 审计日志队列已满（{self._queue.maxsize}），丢弃记录 {entry.get('request_id')}")
+            self._alert("dropped", f"journal queue full, dropped record {entry.get('request_id')}")
+            return False
+
+    def _ensure_writer(self):
+        if self._thread is None or not self._thread.is_alive():
+            self._thread = threading.Thread(target=self._run, name="kiro2api-journal", daemon=True)
+            self._thread.start()
+
+    def _run(self):
+        while True:
+            entry = self._queue.get()
+            try:
+                self.write(entry)
+            finally:
+                self._queue.task_done()
+
+    def write(self, entry: Dict[str, Any]) -> bool:
+        line = (json.dumps(entry, ensure_ascii=False) + "\n").encode("utf-8")
+        try:
+            directory = os.path.dirname(os.path.abspath(self.path))
+            os.makedirs(directory, exist_ok=True)
+            if self.max_bytes > 0 and os.path.exists(self.path) and os.path.getsize(self.path) + len(line) > self.max_bytes:
+                rotate_file(self.path, self.backup_count)
+            with open(self.path, "ab") as f:
+                f.write(line)
+        except OSError as e:
+            self.failed += 1
+            journal_records_total.inc(result="failed")
+            logger.error(f"❌ 写入审计日志失败: {e}")
+            self._alert("write_failed", f"failed to write journal {self.path}: {e}")
+            return False
+        self.written += 1
+        journal_records_total.inc(result="written")
+        return True
+
+    def flush(self, timeout: float = 5.0) -> bool:
+        """等待队列中的记录写完（关闭时和测试中使用），超时返回 False"""
+        deadline = time.monotonic() + timeout
+        while self._queue.unfinished_tasks:
+            if time.monotonic() >= deadline:
+                return False
+            time.sleep(0.01)
+        return True
+
+    def _alert(self, kind: str, message: str):
+        """同类告警在 alert_interval 内只发送一次；发送失败只记录日志"""
+        now = time.monotonic()
+        last = self._last_alert.get(kind)
+        if last is not None and now - last < self.alert_interval:
+            return
+        self._last_alert[kind] = now
+        if not self.alert_webhook_url:
+            return
+        payload = {"source": "kiro2api", "event": f"journal_{kind}", "message": message, "path": self.path}
+        threading.Thread(target=self._post_alert, args=(payload,), name="kiro2api-journal-alert", daemon=True).start()
+
+    def _post_alert(self, payload: Dict[str, Any]):
+        try:
+            httpx.post(self.alert_webhook_url, json=payload, timeout=5.0)
+        except Exception as e:
+            logger.error(f"发送审计日志告警失败: {e}")
+
+
+# 全局单例
+request_journal = RequestJournal()
+
+if request_journal.key_labels:
+    logger.info(
+        f"📝 审计日志已启用: keys={','.join(request_journal.key_labels)} path={request_journal.path} content={request_journal.content}"
+    )
+    completion_bus.subscribe(request_journal.on_record)
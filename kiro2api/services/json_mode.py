@@ -0,0 +1,134 @@
+"""
+JSON 模式（OpenAI response_format: {"type": "json_object"}）
+上游没有 JSON 模式开关，由代理近似实现：
+
+- 请求：在发往上游的 system prompt 末尾追加 JSON_MODE_INSTRUCTION，要求模型只输出一个 JSON 对象
+- 响应：模型仍可能把 JSON 包在 markdown 代码块里（```json ... ```），文本经过 JsonFenceFilter 去掉开头的代码块标记、
+  结束标记及其后的说明文字，流式和非流式路径共用；没有代码块的输出原样透传
+- 校验：输出结束后检查文本是否为合法 JSON，不合法时记录请求级警告（访问日志的 warnings），响应照常返回
+
+只依赖模型遵循指令，不能保证输出一定是合法 JSON；json_schema 等其他类型仍由 validate_openai_params 返回 400
+"""
+
+import json
+import re
+import logging
+from typing import Any, Dict, Iterable, Iterator, List
+
+from models.schemas import ChatCompletionRequest
+from services.request_context import add_request_warning
+
+logger = logging.getLogger(__name__)
+
+JSON_OBJECT_FORMAT = "json_object"
+
+JSON_MODE_INSTRUCTION = (
+    "Respond only with a single valid JSON object. "
+    "Do not wrap it in markdown code fences and do not add any text before or after the JSON."
+)
+
+FENCE = "```"
+# 开头的代码块标记（```json 等）在换行之前最多这么长，超过时视为普通文本
+MAX_FENCE_LINE = 32
+# 代码块内文本末尾可能属于结束标记的部分（空白加不完整的 ```），暂时保留
+_HELD_TAIL = re.compile(r"\s*`{0,2}$")
+
+
+def json_mode_requested(request: ChatCompletionRequest) -> bool:
+    return (request.response_format or {}).get("type") == JSON_OBJECT_FORMAT
+
+
+def with_json_instruction(system_prompt: str) -> str:
+    """在 system prompt 末尾追加 JSON 模式指令"""
+    return f"{system_prompt}\n\n{JSON_MODE_INSTRUCTION}" if system_prompt else JSON_MODE_INSTRUCTION
+
+
+class JsonFenceFilter:
+    """在上游事件流上去掉包住 JSON 的 markdown 代码块（enabled 为 False 时原样透传）"""
+
+    def __init__(self, enabled: bool = True):
+        self.enabled = enabled
+        # start: 还不能确定是否以代码块开头；fenced: 在代码块内；closed: 代码块已结束；plain: 普通文本
+        self._state = "start"
+        self._held = ""
+        self.stripped = False
+
+    def feed_text(self, text: str) -> str:
+        """输入一段文本，返回现在可以输出的部分"""
+        if not self.enabled or self._state == "plain":
+            return text
+        if self._state == "closed":
+            return ""
+        buffer = self._held + text
+        self._held = ""
+        if self._state == "start":
+            stripped = buffer.lstrip()
+            if not stripped or FENCE.startswith(stripped):
+                self._held = buffer
+                return ""
+            if not stripped.startswith(FENCE):
+                self._state = "plain"
+                return buffer
+            newline = stripped.find("\n")
+            if newline == -1:
+                if len(stripped) <= MAX_FENCE_LINE:
+                    self._held = buffer
+                    return ""
+                self._state = "plain"
+                return buffer
+            self._state = "fenced"
+            self.stripped = True
+            buffer = stripped[newline + 1:]
+        end = buffer.find(FENCE)
+        if end != -1:
+            self._state = "closed"
+            return buffer[:end].rstrip()
+        hold = len(_HELD_TAIL.search(buffer).group(0))
+        self._held = buffer[len(buffer) - hold:] if hold else ""
+        return buffer[:len(buffer) - hold]
+
+    def take_held(self) -> str:
+        """放出暂时保留的文本：开头未确定的部分按原样放出，代码块末尾的空白和反引号丢弃"""
+        held, self._held = self._held, ""
+        if self._state == "start":
+            self._state = "plain"
+            return held
+        return ""
+
+    def filter(self, events: Iterable[Dict[str, Any]]) -> Iterator[Dict[str, Any]]:
+        """过滤一批上游事件；非文本事件（工具调用、推理内容等）之前先放出开头保留的文本"""
+        for event in events:
+            content = event.get("content")
+            if not self.enabled:
+                yield event
+            elif isinstance(content, str):
+                text = self.feed_text(content)
+                if text or not content:
+                    yield dict(event, content=text)
+            else:
+                held = self.take_held()
+                if held:
+                    yield {"content": held}
+                yield event
+
+    def flush(self) -> List[Dict[str, Any]]:
+        """上游结束时放出保留的文本"""
+        held = self.take_held() if self.enabled else ""
+        return [{"content": held}] if held else []
+
+
+def strip_json_fences(text: str) -> str:
+    """对完整文本执行与 JsonFenceFilter 相同的处理"""
+    fence_filter = JsonFenceFilter()
+    return fence_filter.feed_text(text) + fence_filter.take_held()
+
+
+def check_json_output(text: str) -> bool:
+    """JSON 模式的输出是否为合法 JSON；不合法时记录请求级警告"""
+    try:
+        json.loads(text)
+        return True
+    except ValueError:
+        logger.warning(f"⚠️ JSON 模式的输出不是合法 JSON（{len(text)} 字符）")
+        add_request_warning("response_format json_object: the response is not valid JSON")
+        return False
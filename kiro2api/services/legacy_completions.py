@@ -0,0 +1,148 @@
+"""
+OpenAI 旧版补全接口（POST /v1/completions）
+部分旧 SDK 仍然用 prompt 字符串调用 /v1/completions。这里不单独实现一套上游调用：
+
+- 请求：prompt 转换为一条 user 消息，其余参数原样带到聊天请求，之后与 /v1/chat/completions 走同一条处理路径
+  （参数校验、CodeWhisperer 请求、重试、计量、流式保活都相同）
+- 非流式响应：chat.completion 转换为 text_completion（choices[].text）
+- 流式响应：逐个改写聊天接口的 chat.completion.chunk 数据块，错误事件、保活注释和 [DONE] 原样透传
+
+echo=true 时在输出前加上 prompt。多个 prompt（批量）、token 数组形式的 prompt、suffix、best_of > 1 和 logprobs 上游无法实现，返回 400
+"""
+
+import json
+import logging
+from typing import Any, AsyncIterator, Dict, Optional
+
+from models.schemas import ChatCompletionRequest, ChatCompletionResponse, ChatMessage, CompletionRequest
+from services.openai_params import UnsupportedParameterError
+
+logger = logging.getLogger(__name__)
+
+TEXT_COMPLETION_OBJECT = "text_completion"
+
+# 原样带到聊天请求的参数（不支持或可忽略的由 validate_openai_params 统一处理）
+FORWARDED_PARAMS = (
+    "model", "max_tokens", "temperature", "top_p", "n", "stream", "stream_options", "stop",
+    "presence_penalty", "frequency_penalty", "logit_bias", "seed", "user",
+)
+
+
+def prompt_text(request: CompletionRequest) -> str:
+    """取出唯一的 prompt 字符串；批量 prompt 和 token 数组抛出 UnsupportedParameterError"""
+    prompt = request.prompt
+    if prompt is None:
+        return ""
+    if isinstance(prompt, list):
+        if len(prompt) > 1:
+            raise UnsupportedParameterError("prompt", "only a single prompt can be completed per request")
+        prompt = prompt[0] if prompt else ""
+    if not isinstance(prompt, str):
+        raise UnsupportedParameterError("prompt", "token array prompts are not supported; send the prompt as a string")
+    return prompt
+
+
+def to_chat_request(request: CompletionRequest) -> ChatCompletionRequest:
+    """旧版补全请求转换为聊天请求；上游无法实现的旧版参数抛出 UnsupportedParameterError"""
+    if request.suffix:
+        raise UnsupportedParameterError("suffix", "insertion (suffix) is not supported")
+    if request.best_of is not None and request.best_of > 1:
+        raise UnsupportedParameterError("best_of", "only one completion can be generated per request")
+    if request.logprobs is not None:
+        raise UnsupportedParameterError("logprobs", "the upstream does not return token log probabilities")
+    prompt = prompt_text(request)
+    params = {name: getattr(request, name) for name in FORWARDED_PARAMS}
+    return ChatCompletionRequest(messages=[ChatMessage(role="user", content=prompt)], **params)
+
+
+def completion_id(chat_id: str) -> str:
+    return "cmpl-" + chat_id[len("chatcmpl-"):] if chat_id.startswith("chatcmpl-") else chat_id
+
+
+def to_text_completion(response: ChatCompletionResponse, echo_prefix: str = "") -> Dict[str, Any]:
+    """chat.completion 转换为 text_completion（推理内容不属于旧接口的输出，不返回）"""
+    choices = []
+    for choice in response.choices:
+        entry = {
+            "text": echo_prefix + (choice.message.content or ""),
+            "index": choice.index,
+            "logprobs": None,
+            "finish_reason": choice.finish_reason,
+        }
+        if choice.stop_reason is not None:
+            entry["stop_reason"] = choice.stop_reason
+        choices.append(entry)
+    return {
+        "id": completion_id(response.id),
+        "object": TEXT_COMPLETION_OBJECT,
+        "created": response.created,
+        "model": response.model,
+        "system_fingerprint": response.system_fingerprint,
+        "choices": choices,
+        "usage": response.usage.model_dump(),
+    }
+
+
+def _text_chunk(chunk: Dict[str, Any], choices) -> Dict[str, Any]:
+    converted = {
+        "id": completion_id(chunk.get("id", "")),
+        "object": TEXT_COMPLETION_OBJECT,
+        "created": chunk.get("created"),
+        "model": chunk.get("model"),
+        "system_fingerprint": chunk.get("system_fingerprint"),
+        "choices": choices,
+    }
+    if chunk.get("usage") is not None:
+        converted["usage"] = chunk["usage"]
+    return converted
+
+
+def convert_stream_chunk(chunk: Dict[str, Any]) -> Optional[Dict[str, Any]]:
+    """
+    chat.completion.chunk 转换为 text_completion 数据块，返回 None 表示丢弃
+
+    只有角色、推理内容或工具调用、没有文本和结束原因的增量在旧接口中没有对应内容，丢弃；
+    choices 为空的 usage 数据块保留
+    """
+    choices = []
+    for choice in chunk.get("choices") or []:
+        text = (choice.get("delta") or {}).get("content") or ""
+        if not text and choice.get("finish_reason") is None:
+            continue
+        entry = {"text": text, "index": choice.get("index", 0), "logprobs": None, "finish_reason": choice.get("finish_reason")}
+        if choice.get("stop_reason") is not None:
+            entry["stop_reason"] = choice["stop_reason"]
+        choices.append(entry)
+    if chunk.get("choices") and not choices:
+        return None
+    return _text_chunk(chunk, choices)
+
+
+def _sse(data: Dict[str, Any]) -> str:
+    return f"data: {json.dumps(data, ensure_ascii=False)}\n\n"
+
+
+async def text_completion_stream(frames: AsyncIterator[str], echo_prefix: str = "") -> AsyncIterator[str]:
+    """
+    把聊天接口的流式响应改写为旧版补全的流式响应
+
+    错误事件、保活注释和 [DONE] 原样透传；echo 的 prompt 在第一个输出数据块之前单独发出
+    """
+    pending_echo = echo_prefix
+    async for frame in frames:
+        chunk = None
+        if frame.startswith("data: "):
+            try:
+                chunk = json.loads(frame[len("data: "):])
+            except ValueError:
+                chunk = None
+        if not isinstance(chunk, dict) or chunk.get("object") != "chat.completion.chunk":
+            yield frame
+            continue
+        converted = convert_stream_chunk(chunk)
+        if converted is None:
+            continue
+        if pending_echo and converted["choices"]:
+            yield _sse(_text_chunk(chunk, [{"text": pending_echo, "index": 0, "logprobs": None, "finish_reason": None}]))
+            pending_echo = ""
+        yield _sse(converted)
@@ -0,0 +1,211 @@
+"""
+过载保护（load shedding）
+极端负载下与其被 OOM 杀掉，不如主动降级：后台每 LOAD_SHED_INTERVAL_SECONDS 秒采样一次进程内存（RSS）和进行中的流数量，
+按阈值逐级升级：
+
+- reject：内存或流数量达到 LOAD_SHED_MEMORY_MB / LOAD_SHED_STREAMS 时，新的生成请求直接返回 529（code: overloaded），
+  健康检查、管理接口和 count_tokens 不受影响
+- abort：达到 LOAD_SHED_MEMORY_HARD_MB / LOAD_SHED_STREAMS_HARD 时，除了拒绝新请求，每次采样还会中断最早开始的一个流，
+  以对应接口的错误事件结束（Claude: overloaded_error；OpenAI: error 数据块，不发送 [DONE]）
+
+降级带滞回：读数要低于阈值 × LOAD_SHED_RECOVERY_RATIO 才回到低一级，避免在阈值附近反复切换。
+每次升降级、拒绝和中断都记录日志并计入 kiro2api_load_shed_total 指标，当前状态在 /health 中返回；所有阈值为 0 时不启用
+"""
+
+import os
+import json
+import asyncio
+import logging
+from collections import OrderedDict
+from typing import Any, Callable, Dict, Optional
+
+from fastapi.responses import JSONResponse
+
+from config import (
+    LOAD_SHED_MEMORY_MB, LOAD_SHED_MEMORY_HARD_MB, LOAD_SHED_STREAMS, LOAD_SHED_STREAMS_HARD,
+    LOAD_SHED_RECOVERY_RATIO, LOAD_SHED_INTERVAL_SECONDS,
+)
+from errors import localize, respond_error, respond_claude_error
+from services.metrics import registry
+from services.request_validation import CLAUDE_PATH_PREFIX
+
+logger = logging.getLogger(__name__)
+
+LEVEL_NORMAL = 0
+LEVEL_REJECT = 1
+LEVEL_ABORT = 2
+LEVEL_NAMES = {LEVEL_NORMAL: "normal", LEVEL_REJECT: "reject", LEVEL_ABORT: "abort"}
+
+# 过载时拒绝的生成接口（其余接口照常处理）
+GENERATION_PATHS = ("/v1/chat/completions", "/v1/completions", "/v1/messages")
+
+# Anthropic 过载时使用的状态码
+OVERLOADED_STATUS = 529
+
+load_shed_total = registry.counter(
+    "kiro2api_load_shed_total", "Load shedding actions (rejected requests, aborted streams).",
+    ("action",),
+)
+
+
+def read_memory_mb() -> Optional[float]:
+    """当前进程的常驻内存（MB），读取不到时（非 Linux）返回 None，此时只按流数量判断"""
+    try:
+        with open("/proc/self/statm") as f:
+            rss_pages = int(f.read().split()[1])
+        return rss_pages * os.sysconf("SC_PAGE_SIZE") / (1024 * 1024)
+    except (OSError, ValueError, IndexError, AttributeError):
+        return None
+
+
+def overloaded_frame(api: str) -> str:
+    """中断流时发给客户端的最后一个事件"""
+    message = localize("overloaded")
+    if api == "claude":
+        data = {"type": "error", "error": {"type": "overloaded_error", "message": message}}
+        return f"event: error\ndata: {json.dumps(data, ensure_ascii=False)}\n\n"
+    data = {"error": {"message": message, "type": "overloaded_error", "code": "overloaded"}}
+    return f"data: {json.dumps(data, ensure_ascii=False)}\n\n"
+
+
+class LoadShedController:
+    def __init__(
+        self,
+        memory_mb: float = LOAD_SHED_MEMORY_MB,
+        memory_hard_mb: float = LOAD_SHED_MEMORY_HARD_MB,
+        streams: int = LOAD_SHED_STREAMS,
+        streams_hard: int = LOAD_SHED_STREAMS_HARD,
+        recovery_ratio: float = LOAD_SHED_RECOVERY_RATIO,
+        memory_reader: Callable[[], Optional[float]] = read_memory_mb,
+    ):
+        self.memory_mb = memory_mb
+        self.memory_hard_mb = memory_hard_mb
+        self.streams_limit = streams
+        self.streams_hard = streams_hard
+        self.recovery_ratio = recovery_ratio
+        self.memory_reader = memory_reader
+        self.level = LEVEL_NORMAL
+        # 进行中的流，按开始顺序排列（最早的在前）
+        self.streams: "OrderedDict[int, Any]" = OrderedDict()
+        self.last_sample: Dict[str, Optional[float]] = {"memory_mb": None, "active_streams": 0}
+        self.rejected = 0
+        self.aborted = 0
+        self._task: Optional[asyncio.Task] = None
+
+    @property
+    def enabled(self) -> bool:
+        return any(limit > 0 for limit in (self.memory_mb, self.memory_hard_mb, self.streams_limit, self.streams_hard))
+
+    @property
+    def shedding(self) -> bool:
+        return self.level >= LEVEL_REJECT
+
+    def stream_started(self, outcome: Any):
+        self.streams[id(outcome)] = outcome
+
+    def stream_finished(self, outcome: Any):
+        self.streams.pop(id(outcome), None)
+
+    def _level_for(self, memory_mb: Optional[float], active_streams: int, ratio: float = 1.0) -> int:
+        """读数对应的级别；ratio < 1 时按放宽后的阈值判断（用于降级的滞回）"""
+        def over(value, limit) -> bool:
+            return limit > 0 and value is not None and value >= limit * ratio
+
+        if over(memory_mb, self.memory_hard_mb) or over(active_streams, self.streams_hard):
+            return LEVEL_ABORT
+        if over(memory_mb, self.memory_mb) or over(active_streams, self.streams_limit):
+            return LEVEL_REJECT
+        return LEVEL_NORMAL
+
+    def evaluate(self, memory_mb: Optional[float], active_streams: int) -> int:
+        """根据一次读数调整级别，abort 级别下中断最早的流；返回调整后的级别"""
+        self.last_sample = {"memory_mb": memory_mb, "active_streams": active_streams}
+        target = self._level_for(memory_mb, active_streams)
+        if target < self.level:
+            target = max(target, min(self.level, self._level_for(memory_mb, active_streams, self.recovery_ratio)))
+        if target != self.level:
+            log = logger.warning if target > self.level else logger.info
+            log(
+                f"{'🚨' if target > self.level else '✅'} 过载保护: {LEVEL_NAMES[self.level]} -> {LEVEL_NAMES[target]} "
+                f"(memory_mb={memory_mb if memory_mb is None else round(memory_mb)}, active_streams={active_streams})"
+            )
+            self.level = target
+        if self.level == LEVEL_ABORT:
+            self._abort_oldest()
+        return self.level
+
+    def _abort_oldest(self):
+        for outcome in self.streams.values():
+            if not getattr(outcome, "shed", False):
+                outcome.shed = True
+                self.aborted += 1
+                load_shed_total.inc(action="abort")
+                logger.warning(f"🚨 过载保护: 中断最早的流 api={outcome.api} model={outcome.model} duration_ms={outcome.duration_ms}")
+                return
+
+    def sample(self) -> int:
+        return self.evaluate(self.memory_reader(), len(self.streams))
+
+    def reject(self):
+        self.rejected += 1
+        load_shed_total.inc(action="reject")
+
+    def status(self) -> Dict[str, Any]:
+        return {
+            "level": LEVEL_NAMES[self.level],
+            "memory_mb": None if self.last_sample["memory_mb"] is None else round(self.last_sample["memory_mb"], 1),
+            "active_streams": self.last_sample["active_streams"],
+            "rejected_requests": self.rejected,
+            "aborted_streams": self.aborted,
+        }
+
+    async def _run(self, interval: float):
+        while True:
+            try:
+                self.sample()
+            except Exception as e:
+                logger.error(f"过载保护采样失败: {e}")
+            await asyncio.sleep(interval)
+
+    def start(self, interval: float = LOAD_SHED_INTERVAL_SECONDS):
+        if self.enabled and self._task is None:
+            logger.info(
+                f"🛡️ 过载保护已启用: memory_mb={self.memory_mb}/{self.memory_hard_mb} "
+                f"streams={self.streams_limit}/{self.streams_hard} recovery_ratio={self.recovery_ratio}"
+            )
+            self._task = asyncio.create_task(self._run(interval))
+
+    async def stop(self):
+        if self._task is not None:
+            self._task.cancel()
+            try:
+                await self._task
+            except asyncio.CancelledError:
+                pass
+            self._task = None
+
+
+# 全局单例
+load_shedder = LoadShedController()
+
+
+class LoadShedMiddleware:
+    """ASGI 中间件：过载时对生成接口返回 529 overloaded"""
+
+    def __init__(self, app, controller: LoadShedController = load_shedder):
+        self.app = app
+        self.controller = controller
+
+    async def __call__(self, scope, receive, send):
+        if scope["type"] != "http" or not self.controller.shedding or scope.get("path") not in GENERATION_PATHS:
+            await self.app(scope, receive, send)
+            return
+        self.controller.reject()
+        logger.warning(f"🚨 过载保护: 拒绝新请求 {scope.get('path')}")
+        headers = {"Retry-After": str(max(1, int(LOAD_SHED_INTERVAL_SECONDS)))}
+        if scope.get("path", "").startswith(CLAUDE_PATH_PREFIX):
+            error = respond_claude_error(OVERLOADED_STATUS, "overloaded", "overloaded_error", headers=headers)
+        else:
+            error = respond_error(OVERLOADED_STATUS, "overloaded", "overloaded_error", headers=headers)
+        response = JSONResponse(status_code=error.status_code, content={"detail": error.detail}, headers=error.headers)
+        await response(scope, receive, send)
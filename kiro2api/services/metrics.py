@@ -0,0 +1,254 @@
+"""
+Prometheus 指标
+不依赖 prometheus_client，按 Prometheus 文本格式（0.0.4）输出。只用到 counter / histogram / gauge 和文本输出，
+自带实现可以在指标关闭时零开销、不给镜像增加依赖；输出格式与 prometheus_client 相同，Prometheus 直接抓取：
+
+- HTTP 请求数和耗时（按路由、方法、状态码），由 MetricsMiddleware 记录
+- 上游调用耗时（按 fanout、状态码）和 token 用量（按模型），订阅 completion_bus 上的计量记录
+- 上游错误数（按 error_mapper 映射后的错误类型）
+- 客户端请求数（按 API 和结果类别 success / client_error / upstream_error / proxy_error），客户端错误不会混入上游故障
+- 流式响应写出的字节数（按 API），由 track_stream 记录
+- 无法识别的上游结束原因（按 API 和原始值），由 stop_reasons 记录
+- 账号总数和当前可用账号数（gauge，在抓取时读取 token_manager 的实时状态）
+
+METRICS_ENABLED 开启时才注册中间件和 /metrics 端点
+"""
+
+import time
+import logging
+from typing import Callable, Dict, List, Optional, Sequence, Tuple
+
+from services.accounting import completion_bus, UpstreamCallRecord, ClientRequestRecord
+
+logger = logging.getLogger(__name__)
+
+DEFAULT_BUCKETS = (0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300)
+
+LabelValues = Tuple[str, ...]
+
+
+def _escape(value: str) -> str:
+    return value.replace("\\", "\\\\").replace("\n", "\\n").replace('"', '\\"')
+
+
+def _format_labels(names: Sequence[str], values: Sequence[str], extra: Optional[Tuple[str, str]] = None) -> str:
+    pairs = [f'{name}="{_escape(str(value))}"' for name, value in zip(names, values)]
+    if extra:
+        pairs.append(f'{extra[0]}="{extra[1]}"')
+    return "{" + ",".join(pairs) + "}" if pairs else ""
+
+
+def _format_number(value: float) -> str:
+    if value == float("inf"):
+        return "+Inf"
+    return str(int(value)) if float(value).is_integer() else repr(float(value))
+
+
+class Counter:
+    def __init__(self, name: str, documentation: str, labelnames: Sequence[str] = ()):
+        self.name = name
+        self.documentation = documentation
+        self.labelnames = tuple(labelnames)
+        self._values: Dict[LabelValues, float] = {}
+
+    def inc(self, amount: float = 1, **labels):
+        key = tuple(str(labels.get(name, "")) for name in self.labelnames)
+        self._values[key] = self._values.get(key, 0) + amount
+
+    def value(self, **labels) -> float:
+        return self._values.get(tuple(str(labels.get(name, "")) for name in self.labelnames), 0)
+
+    def render(self) -> List[str]:
+        lines = [f"# HELP {self.name} {self.documentation}", f"# TYPE {self.name} counter"]
+        for key, value in sorted(self._values.items()):
+            lines.append(f"{self.name}{_format_labels(self.labelnames, key)} {_format_number(value)}")
+        return lines
+
+
+class Histogram:
+    def __init__(
+        self,
+        name: str,
+        documentation: str,
+        labelnames: Sequence[str] = (),
+        buckets: Sequence[float] = DEFAULT_BUCKETS,
+    ):
+        self.name = name
+        self.documentation = documentation
+        self.labelnames = tuple(labelnames)
+        self.buckets = tuple(sorted(buckets)) + (float("inf"),)
+        # 每组标签: (各桶计数, 总和, 总数)
+        self._values: Dict[LabelValues, Tuple[List[int], float, int]] = {}
+
+    def observe(self, value: float, **labels):
+        key = tuple(str(labels.get(name, "")) for name in self.labelnames)
+        counts, total, count = self._values.get(key, ([0] * len(self.buckets), 0.0, 0))
+        for i, bound in enumerate(self.buckets):
+            if value <= bound:
+                counts[i] += 1
+        self._values[key] = (counts, total + value, count + 1)
+
+    def render(self) -> List[str]:
+        lines = [f"# HELP {self.name} {self.documentation}", f"# TYPE {self.name} histogram"]
+        for key, (counts, total, count) in sorted(self._values.items()):
+            for bound, bucket_count in zip(self.buckets, counts):
+                labels = _format_labels(self.labelnames, key, ("le", _format_number(bound)))
+                lines.append(f"{self.name}_bucket{labels} {bucket_count}")
+            labels = _format_labels(self.labelnames, key)
+            lines.append(f"{self.name}_sum{labels} {_format_number(total)}")
+            lines.append(f"{self.name}_count{labels} {count}")
+        return lines
+
+
+class Gauge:
+    """
+    当前值指标（不带标签）
+
+    可以直接 set()，也可以用 set_function() 提供回调，在每次抓取时读取实时值，避免在各处同步更新
+    """
+
+    def __init__(self, name: str, documentation: str):
+        self.name = name
+        self.documentation = documentation
+        self._value: float = 0
+        self._function: Optional[Callable[[], float]] = None
+
+    def set(self, value: float):
+        self._value = value
+
+    def set_function(self, function: Callable[[], float]):
+        self._function = function
+
+    def value(self) -> float:
+        if self._function is not None:
+            try:
+                return self._function()
+            except Exception as e:
+                logger.warning(f"读取指标 {self.name} 失败: {e}")
+        return self._value
+
+    def render(self) -> List[str]:
+        return [
+            f"# HELP {self.name} {self.documentation}",
+            f"# TYPE {self.name} gauge",
+            f"{self.name} {_format_number(self.value())}",
+        ]
+
+
+class MetricsRegistry:
+    def __init__(self):
+        self._metrics: List = []
+
+    def counter(self, name: str, documentation: str, labelnames: Sequence[str] = ()) -> Counter:
+        metric = Counter(name, documentation, labelnames)
+        self._metrics.append(metric)
+        return metric
+
+    def histogram(self, name: str, documentation: str, labelnames: Sequence[str] = (), **kwargs) -> Histogram:
+        metric = Histogram(name, documentation, labelnames, **kwargs)
+        self._metrics.append(metric)
+        return metric
+
+    def gauge(self, name: str, documentation: str) -> Gauge:
+        metric = Gauge(name, documentation)
+        self._metrics.append(metric)
+        return metric
+
+    def render(self) -> str:
+        lines = []
+        for metric in self._metrics:
+            lines.extend(metric.render())
+        return "\n".join(lines) + "\n"
+
+
+registry = MetricsRegistry()
+
+http_requests_total = registry.counter(
+    "kiro2api_http_requests_total", "HTTP requests by route, method and status code.",
+    ("route", "method", "status"),
+)
+http_request_duration_seconds = registry.histogram(
+    "kiro2api_http_request_duration_seconds", "HTTP request duration in seconds (until the response body is complete).",
+    ("route", "method"),
+)
+upstream_request_duration_seconds = registry.histogram(
+    "kiro2api_upstream_request_duration_seconds", "CodeWhisperer call duration in seconds until response headers.",
+    ("fanout", "status"),
+)
+upstream_errors_total = registry.counter(
+    "kiro2api_upstream_errors_total", "Upstream errors by mapped client error type.",
+    ("type",),
+)
+stream_bytes_total = registry.counter(
+    "kiro2api_stream_bytes_total", "Bytes written to streaming clients.",
+    ("api",),
+)
+stream_end_total = registry.counter(
+    "kiro2api_stream_end_total", "Finished streams by api and end reason (services/stream_outcome.py StreamEndReason).",
+    ("api", "end_reason"),
+)
+requests_total = registry.counter(
+    "kiro2api_requests_total", "Client API requests by api and outcome class (success, client_error, upstream_error, proxy_error).",
+    ("api", "class"),
+)
+unknown_stop_reasons_total = registry.counter(
+    "kiro2api_unknown_stop_reasons_total", "Upstream terminal states that are not a known stop reason, by api (reason is always other; raw values are logged).",
+    ("api", "reason"),
+)
+tokens_total = registry.counter(
+    "kiro2api_tokens_total", "Token usage by model and direction (input/output).",
+    ("model", "direction"),
+)
+accounts_total = registry.gauge("kiro2api_accounts", "Configured upstream accounts.")
+available_accounts = registry.gauge(
+    "kiro2api_available_accounts",
+    "Accounts currently eligible for selection (not exhausted, cooling down, erroring or out of quota).",
+)
+
+
+def _on_accounting_record(record):
+    if isinstance(record, UpstreamCallRecord):
+        status = str(record.status_code) if record.status_code is not None else "error"
+        upstream_request_duration_seconds.observe(record.latency_ms / 1000, fanout=record.fanout, status=status)
+    elif isinstance(record, ClientRequestRecord):
+        requests_total.inc(api=record.api, **{"class": record.outcome_class})
+        tokens_total.inc(record.input_tokens, model=record.model, direction="input")
+        tokens_total.inc(record.output_tokens, model=record.model, direction="output")
+
+
+completion_bus.subscribe(_on_accounting_record)
+
+
+class MetricsMiddleware:
+    """
+    ASGI 中间件：记录每个 HTTP 请求的次数和耗时
+
+    路由标签使用匹配到的路由模板（如 /v1/messages），未匹配的路径统一记为 unmatched，避免标签数量失控；
+    流式响应的耗时计算到响应体写完为止
+    """
+
+    def __init__(self, app):
+        self.app = app
+
+    async def __call__(self, scope, receive, send):
+        if scope["type"] != "http":
+            await self.app(scope, receive, send)
+            return
+
+        started = time.monotonic()
+        status_code = 500
+
+        async def send_wrapper(message):
+            nonlocal status_code
+            if message["type"] == "http.response.start":
+                status_code = message["status"]
+            await send(message)
+
+        try:
+            await self.app(scope, receive, send_wrapper)
+        finally:
+            route = scope.get("route")
+            route_path = getattr(route, "path", None) or "unmatched"
+            method = scope.get("method", "")
+            http_requests_total.inc(route=route_path, method=method, status=status_code)
+            http_request_duration_seconds.observe(time.monotonic() - started, route=route_path, method=method)
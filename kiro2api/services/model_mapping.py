@@ -0,0 +1,97 @@
+"""
+模型映射表
+内置的 MODEL_MAP 作为默认值，启动时合并 MODEL_MAPPING（JSON 字符串或 JSON 文件路径）中的条目，同名条目以 MODEL_MAPPING 为准
+
+键可以是精确的模型名，也可以是带 * 的通配规则（例如 "claude-sonnet-4*"），新的带日期模型名不需要逐个添加；
+精确匹配优先，多条通配规则同时匹配时取最长（最具体）的一条
+
+模型别名（MODEL_ALIASES）在映射之前生效：解析请求时把客户端使用的模型名（例如 gpt-4o）改写为规范的模型名，
+之后的模型校验、上游模型映射、计量和响应中的 model 都只看到规范名称。别名只做精确匹配、只改写一次（不链式解析）
+"""
+
+import os
+import json
+import logging
+from fnmatch import fnmatchcase
+from typing import Dict, List, Optional
+
+from config import MODEL_MAP as DEFAULT_MODEL_MAP, DEFAULT_MODEL, MODEL_MAPPING, MODEL_ALIASES
+
+logger = logging.getLogger(__name__)
+
+
+def load_model_mapping(raw: str, setting: str = "MODEL_MAPPING") -> Dict[str, str]:
+    """解析 MODEL_MAPPING / MODEL_ALIASES：以 { 开头按 JSON 解析，否则视为 JSON 文件路径；格式错误时忽略并记录日志"""
+    raw = (raw or "").strip()
+    if not raw:
+        return {}
+    try:
+        if raw.startswith("{"):
+            data = json.loads(raw)
+        else:
+            with open(os.path.expanduser(raw), "r", encoding="utf-8") as f:
+                data = json.load(f)
+    except (OSError, ValueError) as e:
+        logger.error(f"❌ {setting} 加载失败，已忽略: {e}")
+        return {}
+    if not isinstance(data, dict) or not all(
+        isinstance(k, str) and isinstance(v, str) and k and v for k, v in data.items()
+    ):
+        logger.error(f"❌ {setting} 必须是 {{\"模型名\": \"模型名\"}} 形式的 JSON 对象（值为字符串），已忽略")
+        return {}
+    return data
+
+
+def _is_pattern(name: str) -> bool:
+    return "*" in name
+
+
+MODEL_MAP: Dict[str, str] = {**DEFAULT_MODEL_MAP, **load_model_mapping(MODEL_MAPPING)}
+# 通配规则按长度降序，保证更具体的规则先匹配
+MODEL_PATTERNS = sorted((k for k in MODEL_MAP if _is_pattern(k)), key=len, reverse=True)
+
+if MODEL_MAPPING:
+    logger.info(f"🗺️ 已加载模型映射: {len(MODEL_MAP)} 条（其中通配规则 {len(MODEL_PATTERNS)} 条）")
+
+
+MODEL_ALIAS_MAP: Dict[str, str] = load_model_mapping(MODEL_ALIASES, "MODEL_ALIASES")
+
+
+def canonical_model_name(model: str) -> str:
+    """客户端使用的模型名对应的规范名称；不是别名时原样返回"""
+    return MODEL_ALIAS_MAP.get(model, model)
+
+
+def resolve_model(model: str) -> Optional[str]:
+    """返回模型对应的 CodeWhisperer 模型，未匹配时返回 None"""
+    if model in MODEL_MAP and not _is_pattern(model):
+        return MODEL_MAP[model]
+    for pattern in MODEL_PATTERNS:
+        if fnmatchcase(model, pattern):
+            return MODEL_MAP[pattern]
+    return None
+
+
+def is_valid_model(model: str) -> bool:
+    return resolve_model(model) is not None
+
+
+def listed_models() -> List[str]:
+    """可以直接使用的具体模型名（/v1/models 展示用，不含通配规则）"""
+    return [k for k in MODEL_MAP if not _is_pattern(k)]
+
+
+def accepted_model_names() -> List[str]:
+    """当前接受的模型名和通配规则，用于错误提示"""
+    return listed_models() + MODEL_PATTERNS
+
+
+def default_upstream_model() -> Optional[str]:
+    return resolve_model(DEFAULT_MODEL)
+
+
+for _alias, _target in MODEL_ALIAS_MAP.items():
+    if not is_valid_model(_target):
+        logger.warning(f"⚠️ MODEL_ALIASES: {_alias} -> {_target} 的目标不在模型映射中，使用该别名的请求会返回 400")
+if MODEL_ALIAS_MAP:
+    logger.info(f"🗺️ 已加载模型别名: {len(MODEL_ALIAS_MAP)} 条")
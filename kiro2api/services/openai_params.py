@@ -0,0 +1,106 @@
+"""
+OpenAI 请求参数校验
+上游请求只有对话内容和工具定义，很多 OpenAI 参数无法转发；与其悄悄忽略（例如客户端要 3 个 choice 却只拿到 1 个），
+在处理请求之前逐个检查：
+
+| 参数 | 处理 |
+| --- | --- |
+| n > 1 | 非流式且不超过 OPENAI_MAX_N 时按顺序请求 n 次、合并为 n 个 choice；否则 400（默认上限为 1，流式请求不支持） |
+| logprobs = true | 400：上游不返回 token 概率 |
+| response_format | text 和 json_object 支持（json_object 见 services/json_mode.py）；其他类型（json_schema 等）400：上游没有结构化输出 |
+| presence_penalty / frequency_penalty（非 0） | 默认记录警告后忽略；STRICT_OPENAI_PARAMS=true 时 400 |
+| logit_bias / seed / top_logprobs | 同上 |
+| temperature / top_p | 接受但不生效（上游没有采样参数）；客户端几乎总会发送，不记录警告 |
+| stop / max_tokens / max_completion_tokens / tools / tool_choice / stream_options / user | 支持 |
+
+400 错误使用 OpenAI 的错误格式，type 为 invalid_request_error，param 为参数名，code 为 unsupported_parameter
+"""
+
+import logging
+from typing import Any, Dict, List, Optional
+
+from config import STRICT_OPENAI_PARAMS, OPENAI_MAX_N
+from models.schemas import ChatCompletionRequest
+from services.request_context import add_request_warning
+
+logger = logging.getLogger(__name__)
+
+# 可以安全忽略的参数及忽略后的取值
+IGNORABLE_PARAMS: Dict[str, Any] = {
+    "presence_penalty": 0.0,
+    "frequency_penalty": 0.0,
+    "logit_bias": None,
+    "seed": None,
+    "top_logprobs": None,
+}
+
+
+# 支持的 response_format 类型
+SUPPORTED_RESPONSE_FORMATS = ("text", "json_object")
+
+
+class UnsupportedParameterError(ValueError):
+    """请求中有无法实现的参数（或严格模式下的可忽略参数）"""
+
+    def __init__(self, param: str, reason: str):
+        super().__init__(f"{param}: {reason}")
+        self.param = param
+        self.reason = reason
+
+
+def _n_reason(n: int, stream: bool, max_n: int) -> Optional[str]:
+    if n < 1:
+        return "n must be at least 1"
+    if n == 1:
+        return None
+    if stream:
+        return "only one choice can be streamed per request"
+    if max_n <= 1:
+        return "only one choice can be generated per request"
+    if n > max_n:
+        return f"at most {max_n} choices can be generated per request"
+    return None
+
+
+def _unsupported_reason(request: ChatCompletionRequest, stream: bool, max_n: int) -> Optional[UnsupportedParameterError]:
+    reason = _n_reason(request.n if request.n is not None else 1, stream, max_n)
+    if reason:
+        return UnsupportedParameterError("n", reason)
+    if request.logprobs:
+        return UnsupportedParameterError("logprobs", "the upstream does not return token log probabilities")
+    format_type = (request.response_format or {}).get("type", "text")
+    if format_type not in SUPPORTED_RESPONSE_FORMATS:
+        return UnsupportedParameterError("response_format", f"response_format type '{format_type}' is not supported")
+    return None
+
+
+def validate_openai_params(
+    request: ChatCompletionRequest,
+    strict: bool = STRICT_OPENAI_PARAMS,
+    stream: bool = False,
+    max_n: int = OPENAI_MAX_N,
+) -> List[str]:
+    """
+    校验请求参数，返回被忽略（已重置为默认值）的参数名
+
+    stream 为最终是否使用流式响应（请求体与 Accept 头协商之后）；
+    无法实现的参数，以及严格模式下的可忽略参数，抛出 UnsupportedParameterError
+    """
+    error = _unsupported_reason(request, stream, max_n)
+    if error:
+        raise error
+
+    ignored = []
+    for param, default in IGNORABLE_PARAMS.items():
+        value = getattr(request, param)
+        if value is None or value == default:
+            continue
+        if strict:
+            raise UnsupportedParameterError(param, "the parameter has no effect on this proxy (STRICT_OPENAI_PARAMS is enabled)")
+        setattr(request, param, default)
+        ignored.append(param)
+
+    if ignored:
+        logger.warning(f"⚠️ 忽略上游不支持的参数: {', '.join(ignored)}")
+        add_request_warning(f"ignored unsupported parameters: {', '.join(ignored)}")
+    return ignored
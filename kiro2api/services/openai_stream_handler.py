@@ -0,0 +1,238 @@
+"""
+OpenAI 流式响应转换
+把解析后的 CodeWhisperer 事件转换为 OpenAI chat.completion.chunk（SSE 的 data 行），与 ClaudeStreamHandler 对应：
+
+- 结构化工具调用事件（name + toolUseId）转换为 tool_calls 增量，index 按出现顺序分配，参数按 index 累积，结束时校验
+- 文本中的 bracket 格式工具调用（[Called ... with args: {...}]）从文本中取出，转换为完整的 tool_calls 增量；
+  不完整的部分保留到后续文本到达或流结束
+- 推理内容转换为 reasoning_content 增量
+- 第一个写出的 chunk 带 role=assistant
+- 工具调用超过 STREAM_MAX_TOOL_CALLS 时抛出 BlockLimitError（见 services/block_limits.py）
+
+调用方负责读取上游、解析事件以及输出上限、停止序列和 JSON 代码块等过滤，转换结果原样写出
+"""
+
+import json
+import time
+import uuid
+import logging
+from typing import Any, Dict, Iterator, Optional
+
+from models.schemas import ChatCompletionStreamResponse, StreamChoice, Usage
+from parsers.bracket_parser import parse_single_tool_call, find_matching_bracket
+from services.block_limits import BlockLimits
+from services.request_context import add_request_warning
+from services.tool_utils import ToolNameMap
+
+logger = logging.getLogger(__name__)
+
+
+def is_valid_json_arguments(arguments: str) -> bool:
+    """流式累积的工具参数是否是完整的 JSON（没有参数视为合法）"""
+    if not arguments.strip():
+        return True
+    try:
+        json.loads(arguments)
+        return True
+    except json.JSONDecodeError:
+        return False
+
+
+class OpenAIStreamHandler:
+    """单个 OpenAI 流的转换状态：工具调用 index 的分配、文本缓冲和是否已发出 role"""
+
+    def __init__(self, model: str, tool_names: Optional[ToolNameMap] = None, response_id: Optional[str] = None):
+        self.model = model
+        # 上游返回的是转换后的工具名，发给客户端前还原为原名
+        self.tool_names = tool_names or ToolNameMap()
+        self.response_id = response_id or f"chatcmpl-{uuid.uuid4()}"
+        self.created = int(time.time())
+
+        self.sent_role = False
+        # 正在进行的结构化工具调用及其 id；下一个工具调用使用的 index 和已发出的工具调用数
+        self.is_in_tool_call = False
+        self.current_tool_call_id: Optional[str] = None
+        self.current_tool_call_index = 0
+        self.streamed_tool_calls_count = 0
+        # 每个结构化工具调用（按 index）累积的参数，结束时校验是否完整
+        self.tool_call_arguments: Dict[int, str] = {}
+        # 待发出的文本，以及等待结束 ] 的不完整 bracket 工具调用
+        self.content_buffer = ""
+        self.incomplete_tool_call = ""
+        # 工具调用的数量上限（STREAM_MAX_TOOL_CALLS）；OpenAI chunk 没有内容块
+        self.block_limits = BlockLimits()
+
+    def chunk(self, delta: Dict[str, Any]) -> str:
+        """一个增量 chunk 的 data 行；第一个 chunk 带上 role"""
+        if not self.sent_role:
+            delta["role"] = "assistant"
+            self.sent_role = True
+        response = ChatCompletionStreamResponse(
+            id=self.response_id, model=self.model, created=self.created,
+            choices=[StreamChoice(index=0, delta=delta)]
+        )
+        return f"data: {response.model_dump_json(exclude_none=True)}\n\n"
+
+    def _end_tool_call(self):
+        self.is_in_tool_call = False
+        self.current_tool_call_id = None
+        self.current_tool_call_index += 1
+        self.streamed_tool_calls_count += 1
+
+    def _bracket_tool_call_chunk(self, tool_call_text: str) -> Optional[str]:
+        """完整的 bracket 工具调用转换为 tool_calls 增量；解析失败时返回 None"""
+        parsed_call = parse_single_tool_call(tool_call_text)
+        if not parsed_call:
+            return None
+        self.block_limits.add_tool_call()
+        delta_tool = {
+            "tool_calls": [{
+                "index": self.current_tool_call_index,
+                "id": parsed_call.id,
+                "type": "function",
+                "function": {
+                    "name": self.tool_names.client_name(parsed_call.function["name"]),
+                    "arguments": parsed_call.function["arguments"]
+                }
+            }]
+        }
+        logger.info(f"📤 STREAM: Sending tool call: {parsed_call.function['name']}")
+        data = self.chunk(delta_tool)
+        self.current_tool_call_index += 1
+        self.streamed_tool_calls_count += 1
+        return data
+
+    def handle_event(self, event: Dict[str, Any], reasoning: Optional[Any] = None) -> Iterator[str]:
+        """转换一个上游事件；reasoning 为 extract_reasoning(event) 的结果（已按输出上限截断）"""
+        # --- 结构化工具调用事件 ---
+        if "name" in event and "toolUseId" in event:
+            logger.info(f"🎯 STREAM: Found structured tool call event: {event}")
+            if self.is_in_tool_call and event.get("toolUseId") != self.current_tool_call_id:
+                # 上一个工具调用没有收到 stop 就开始了新的工具调用，视为已结束，参数不再追加到它上面
+                logger.warning(f"⚠️ STREAM: 工具调用 {self.current_tool_call_id} 未收到 stop 就开始了新的工具调用")
+                self._end_tool_call()
+            if not self.is_in_tool_call:
+                self.block_limits.add_tool_call()
+                self.is_in_tool_call = True
+                self.current_tool_call_id = event.get("toolUseId")
+                self.tool_call_arguments[self.current_tool_call_index] = ""
+                yield self.chunk({
+                    "tool_calls": [{
+                        "index": self.current_tool_call_index,
+                        "id": event.get("toolUseId"),
+                        "type": "function",
+                        "function": {"name": self.tool_names.client_name(event.get("name")), "arguments": ""}
+                    }]
+                })
+
+            arguments = event.get("input", "")
+            if arguments:
+                self.tool_call_arguments[self.current_tool_call_index] += arguments
+                yield self.chunk({
+                    "tool_calls": [{
+                        "index": self.current_tool_call_index,
+                        "function": {"arguments": arguments}
+                    }]
+                })
+
+            if event.get("stop"):
+                self._end_tool_call()
+
+        # --- 普通文本事件 ---
+        elif "content" in event and not self.is_in_tool_call:
+            if event.get("content"):
+                yield from self._feed_text(event["content"])
+
+        # --- 推理内容事件 ---
+        elif reasoning and reasoning.text:
+            yield self.chunk({"reasoning_content": reasoning.text})
+
+    def _feed_text(self, text: str) -> Iterator[str]:
+        """追加文本，发出其中的普通文本和完整的 bracket 工具调用"""
+        # 如果有不完整的工具调用，先合并再处理
+        if self.incomplete_tool_call:
+            self.content_buffer = self.incomplete_tool_call + text
+            self.incomplete_tool_call = ""
+        else:
+            self.content_buffer += text
+
+        while True:
+            called_start = self.content_buffer.find("[Called")
+            if called_start == -1:
+                # 没有工具调用，发送所有内容
+                if self.content_buffer:
+                    yield self.chunk({"content": self.content_buffer})
+                    self.content_buffer = ""
+                return
+
+            # 发送 [Called 之前的文本
+            if called_start > 0:
+                text_before = self.content_buffer[:called_start]
+                if text_before.strip():
+                    yield self.chunk({"content": text_before})
+
+            # 查找对应的结束 ]
+            remaining_text = self.content_buffer[called_start:]
+            bracket_end = find_matching_bracket(remaining_text, 0)
+            if bracket_end == -1:
+                # 工具调用不完整，保留等待更多数据
+                self.incomplete_tool_call = remaining_text
+                self.content_buffer = ""
+                return
+
+            data = self._bracket_tool_call_chunk(remaining_text[:bracket_end + 1])
+            if data:
+                yield data
+
+            # 更新缓冲区，继续处理剩余内容
+            self.content_buffer = remaining_text[bracket_end + 1:]
+            self.incomplete_tool_call = ""
+
+    def append_text(self, text: str):
+        """上游结束时从解析器缓冲区恢复的文本，只追加到缓冲区，由 finish() 发出"""
+        self.content_buffer += text
+
+    def finish(self) -> Iterator[str]:
+        """上游结束：发出残留的 bracket 工具调用和文本，收尾未结束的工具调用并校验参数"""
+        if self.incomplete_tool_call:
+            self.content_buffer = self.incomplete_tool_call + self.content_buffer
+            self.incomplete_tool_call = ""
+            if self.content_buffer.find("[Called") == 0:
+                bracket_end = find_matching_bracket(self.content_buffer, 0)
+                if bracket_end != -1:
+                    data = self._bracket_tool_call_chunk(self.content_buffer[:bracket_end + 1])
+                    if data:
+                        yield data
+                        self.content_buffer = self.content_buffer[bracket_end + 1:]
+
+        if self.content_buffer.strip():
+            logger.info(f"📤 Sending remaining content: {len(self.content_buffer)} chars")
+            yield self.chunk({"content": self.content_buffer})
+
+        # 上游在工具调用中途结束（没有 stop 事件）：已发出的工具调用照常计入，以 finish_reason=tool_calls 结束
+        if self.is_in_tool_call:
+            logger.warning(f"⚠️ STREAM: 上游流在工具调用 {self.current_tool_call_id} 结束前终止")
+            add_request_warning(f"upstream stream ended inside tool call {self.current_tool_call_id}")
+            self.is_in_tool_call = False
+            self.current_tool_call_index += 1
+            self.streamed_tool_calls_count += 1
+        for index, arguments in self.tool_call_arguments.items():
+            if not is_valid_json_arguments(arguments):
+                logger.warning(f"⚠️ STREAM: 工具调用 #{index} 的参数不是完整的 JSON（{len(arguments)} 字符），可能被截断")
+                add_request_warning(f"tool call #{index} arguments are not valid JSON")
+
+    def final_chunk(self, finish_reason: str, stop_reason: Optional[str] = None) -> str:
+        """带 finish_reason 的结束 chunk；没有发出过内容时带上 role，部分 SDK 没有 finish_reason 会报错"""
+        end_delta = {} if self.sent_role else {"role": "assistant", "content": ""}
+        response = ChatCompletionStreamResponse(
+            id=self.response_id, model=self.model, created=self.created,
+            choices=[StreamChoice(index=0, delta=end_delta, finish_reason=finish_reason, stop_reason=stop_reason)]
+        )
+        return f"data: {response.model_dump_json(exclude_none=True)}\n\n"
+
+    def usage_chunk(self, usage: Usage) -> str:
+        """stream_options.include_usage：与 OpenAI 一致，最后一个 chunk 的 choices 为空，只带 usage"""
+        response = ChatCompletionStreamResponse(
+            id=self.response_id, model=self.model, created=self.created, choices=[], usage=usage,
+        )
+        return f"data: {response.model_dump_json(exclude_none=True)}\n\n"
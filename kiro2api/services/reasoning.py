@@ -0,0 +1,41 @@
+"""
+推理（extended thinking）内容
+上游的 reasoningContentEvent 事件在解析后只剩 payload，可能是以下几种形式：
+
+- {"reasoningContentEvent": {"text": "...", "signature": "..."}}
+- {"reasoningContent": {"reasoningText": {"text": "...", "signature": "..."}}}（Bedrock Converse 形式）
+- {"text": "...", "signature": "..."}（不含 content / toolUseId 等字段）
+
+Claude 接口以 thinking 内容块原样转发（thinking_delta / signature_delta），OpenAI 接口映射为 reasoning_content
+"""
+
+from dataclasses import dataclass
+from typing import Any, Dict, Optional
+
+
+@dataclass
+class ReasoningDelta:
+    text: str = ""
+    signature: Optional[str] = None
+
+
+def _from_payload(payload: Any) -> Optional[ReasoningDelta]:
+    if not isinstance(payload, dict):
+        return None
+    if isinstance(payload.get("reasoningText"), dict):
+        payload = payload["reasoningText"]
+    text = payload.get("text")
+    signature = payload.get("signature")
+    if not isinstance(text, str) and not isinstance(signature, str):
+        return None
+    return ReasoningDelta(text if isinstance(text, str) else "", signature if isinstance(signature, str) else None)
+
+
+def extract_reasoning(event: Dict[str, Any]) -> Optional[ReasoningDelta]:
+    """事件是推理内容时返回其中的文本和签名，否则返回 None"""
+    for key in ("reasoningContentEvent", "reasoningContent"):
+        if key in event:
+            return _from_payload(event[key])
+    if "content" in event or "toolUseId" in event or "name" in event:
+        return None
+    return _from_payload(event)
@@ -1,21 +1,44 @@
-import re
 import json
 import uuid
 import copy
-import base64
 import logging
-from fastapi import HTTPException
+from typing import Optional, FrozenSet
 
-from config import MODEL_MAP, DEFAULT_MODEL, PROFILE_ARN
+from config import PROFILE_ARN, TOOL_COMPACTION_ENABLED
+from errors import respond_error
 from models.schemas import ChatCompletionRequest
+from services.tool_utils import (
+    compact_tool_specifications, compact_repeated_tools, tool_fingerprint, tool_fingerprints, ToolNameMap, TrailingToolUseError, trailing_tool_use_content,
+    ToolChoiceError, parse_tool_choice, apply_tool_choice,
+)
+from services.request_limits import log_preview
+from services.json_mode import json_mode_requested, with_json_instruction
+from services.image_input import image_url_to_claude_block, ImageInputError
+from services.claude_converter import extract_images_from_claude_content, map_claude_model_to_codewhisperer
 
 logger = logging.getLogger(__name__)
 
 
-def build_codewhisperer_request(request: ChatCompletionRequest):
+def openai_tool_fingerprints(request: ChatCompletionRequest) -> FrozenSet[str]:
+    """请求中工具定义的指纹（与转换为 Claude 请求后的 claude_tool_fingerprints 一致），上游接受请求后记入对话缓存"""
+    return tool_fingerprints(
+        (tool.function.name, tool.function.description, tool.function.parameters) for tool in request.tools or []
+    )
+
+
+def build_codewhisperer_request(
+    request: ChatCompletionRequest,
+    tool_names: Optional[ToolNameMap] = None,
+    conversation_id: Optional[str] = None,
+    declared_tools: FrozenSet[str] = frozenset(),
+):
+    # TOOL_NAME_POLICY=sanitize 时，工具定义和历史中的工具名都使用转换后的名称；
+    # declared_tools 为这个上游对话前几轮已经发送过的工具指纹（见 openai_tool_fingerprints）
+    tool_names = tool_names or ToolNameMap()
     logger.info(f"🔄 request model: {request.model}")
-    codewhisperer_model = MODEL_MAP.get(request.model, MODEL_MAP[DEFAULT_MODEL])
-    conversation_id = str(uuid.uuid4())
+    codewhisperer_model = map_claude_model_to_codewhisperer(request.model)
+    # 沿用客户端对话的上游 conversationId（见 services/conversation_cache.py），没有时开始新对话
+    conversation_id = conversation_id or str(uuid.uuid4())
     
     # Extract system prompt and user messages
     system_prompt = ""
@@ -28,17 +51,7 @@ def build_codewhisperer_request(request: ChatCompletionRequest):
             conversation_messages.append(msg)
     
     if not conversation_messages:
-        raise HTTPException(
-            status_code=400, 
-            detail={
-                "error": {
-                    "message": "No conversation messages found",
-                    "type": "invalid_request_error",
-                    "param": "messages",
-                    "code": "invalid_request"
-                }
-            }
-        )
+        raise respond_error(400, "no_messages", param="messages", api_code="invalid_request")
     
     # Build history - only include user/assistant pairs
     history = []
@@ -63,7 +76,7 @@ def build_codewhisperer_request(request: ChatCompletionRequest):
                     # Build a description of the tool calls
                     tool_descriptions = []
                     for tc in msg.tool_calls:
-                        func_name = tc.function.get("name", "unknown") if isinstance(tc.function, dict) else "unknown"
+                        func_name = tool_names.upstream_name(tc.function.get("name", "unknown")) if isinstance(tc.function, dict) else "unknown"
                         args = tc.function.get("arguments", "{}") if isinstance(tc.function, dict) else "{}"
                         tool_descriptions.append(f"[Called {func_name} with args: {args}]")
                     content = " ".join(tool_descriptions)
@@ -146,46 +159,16 @@ def build_codewhisperer_request(request: ChatCompletionRequest):
     current_message = conversation_messages[-1]
 
     # Handle images in the last message
-    images = []
+    # image_url 先转换为 Anthropic image 块，再按原生 Claude 请求的方式转换为上游格式；不合法的图片返回 400，不再悄悄丢弃
+    image_blocks = []
     if isinstance(current_message.content, list):
         for part in current_message.content:
             if part.type == "image_url" and part.image_url:
                 try:
-                    # 记录原始 URL 的前 50 个字符，用于调试
-                    logger.info(f"🔍 处理图片 URL: {part.image_url.url[:50]}...")
-                    
-                    # 检查 URL 格式是否正确
-                    if not part.image_url.url.startswith("data:image/"):
-                        logger.error(f"❌ 图片 URL 格式不正确，应该以 'data:image/' 开头")
-                        continue
-                    
-                    # Correctly parse the data URI
-                    # format: data:image/jpeg;base64,{base64_string}
-                    header, encoded_data = part.image_url.url.split(",", 1)
-                    
-                    # Correctly parse the image format from the mime type
-                    # "data:image/jpeg;base64" -> "jpeg"
-                    # Use regex to reliably extract image format, e.g., "jpeg" from "data:image/jpeg;base64"
-                    match = re.search(r'image/(\w+)', header)
-                    if match:
-                        image_format = match.group(1)
-                        # 验证 Base64 编码是否有效
-                        try:
-                            base64.b64decode(encoded_data)
-                            logger.info("✅ Base64 编码验证通过")
-                        except Exception as e:
-                            logger.error(f"❌ Base64 编码无效: {e}")
-                            continue
-                            
-                        images.append({
-                            "format": image_format,
-                            "source": {"bytes": encoded_data}
-                        })
-                        logger.info(f"🖼️ 成功处理图片，格式: {image_format}, 大小: {len(encoded_data)} 字符")
-                    else:
-                        logger.warning(f"⚠️ 无法从头部确定图片格式: {header}")
-                except Exception as e:
-                    logger.error(f"❌ 处理图片 URL 失败: {str(e)}")
+                    image_blocks.append(image_url_to_claude_block(part.image_url.url))
+                except ImageInputError as e:
+                    raise respond_error(400, e.code, param="messages", **e.params)
+    images = extract_images_from_claude_content(image_blocks)
 
     current_content = current_message.get_content_text()
     
@@ -203,17 +186,21 @@ def build_codewhisperer_request(request: ChatCompletionRequest):
                 # Find the corresponding tool call
                 for tc in prev_message.tool_calls:
                     if tc.id == tool_call_id:
-                        func_name = tc.function.get("name", "unknown") if isinstance(tc.function, dict) else "unknown"
+                        func_name = tool_names.upstream_name(tc.function.get("name", "unknown")) if isinstance(tc.function, dict) else "unknown"
                         current_content = f"[Completed execution of {func_name}]: {tool_result}"
                         break
     elif current_message.role == "assistant":
         # If last message is from assistant with tool calls, format it appropriately
+        # 按 TRAILING_TOOL_USE_POLICY 处理缺少的 tool 结果
         if hasattr(current_message, 'tool_calls') and current_message.tool_calls:
-            tool_descriptions = []
-            for tc in current_message.tool_calls:
-                func_name = tc.function.get("name", "unknown") if isinstance(tc.function, dict) else "unknown"
-                tool_descriptions.append(f"Continue after calling {func_name}")
-            current_content = "; ".join(tool_descriptions)
+            trailing_calls = [
+                (tc.id, tool_names.upstream_name(tc.function.get("name", "unknown")) if isinstance(tc.function, dict) else "unknown")
+                for tc in current_message.tool_calls
+            ]
+            try:
+                current_content = trailing_tool_use_content(trailing_calls)
+            except TrailingToolUseError as e:
+                raise respond_error(400, "trailing_tool_use", param="messages", ids=", ".join(e.tool_use_ids))
         else:
             current_content = "Continue the conversation"
     
@@ -221,6 +208,10 @@ def build_codewhisperer_request(request: ChatCompletionRequest):
     if not current_content:
         current_content = "Continue"
     
+    # response_format json_object：上游没有 JSON 模式，在 system prompt 中要求只输出 JSON
+    if json_mode_requested(request):
+        system_prompt = with_json_instruction(system_prompt)
+
     # Add system prompt to current message
     if system_prompt:
         current_content = f"{system_prompt}\n\n{current_content}"
@@ -244,16 +235,31 @@ def build_codewhisperer_request(request: ChatCompletionRequest):
     
     # Add context for tools
     user_input_message_context = {}
-    if request.tools:
-        user_input_message_context["tools"] = [
-            {
-                "toolSpecification": {
-                    "name": tool.function.name,
-                    "description": tool.function.description or "",
-                    "inputSchema": {"json": tool.function.parameters or {}}
-                }
-            } for tool in request.tools
-        ]
+    tool_specs = [
+        {
+            "toolSpecification": {
+                "name": tool_names.upstream_name(tool.function.name),
+                "description": tool.function.description or "",
+                "inputSchema": {"json": tool.function.parameters or {}}
+            }
+        } for tool in request.tools or []
+    ]
+    if tool_specs and TOOL_COMPACTION_ENABLED:
+        tool_specs, _ = compact_repeated_tools(
+            tool_specs,
+            [tool_fingerprint(tool.function.name, tool.function.description, tool.function.parameters) for tool in request.tools],
+            declared_tools,
+        )
+        tool_specs, _ = compact_tool_specifications(tool_specs)
+    # 上游不支持 tool_choice，按 apply_tool_choice 的方式近似实现
+    try:
+        tool_specs, tool_instruction = apply_tool_choice(tool_specs, parse_tool_choice(request.tool_choice), tool_names)
+    except ToolChoiceError as e:
+        raise respond_error(400, "invalid_tool_choice", param="tool_choice", reason=e.reason)
+    if tool_specs:
+        user_input_message_context["tools"] = tool_specs
+    if tool_instruction:
+        codewhisperer_request["conversationState"]["currentMessage"]["userInputMessage"]["content"] += f"\n\n{tool_instruction}"
     
     # 根据文档，images 应该是 userInputMessage 的直接子字段，而不是在 userInputMessageContext 中
     if images:
@@ -278,5 +284,5 @@ def build_codewhisperer_request(request: ChatCompletionRequest):
             if "bytes" in img.get("source", {}):
                 img["source"]["bytes"] = img["source"]["bytes"][:20] + "..." # 只记录前20个字符
     
-    logger.info(f"🔄 COMPLETE CODEWHISPERER REQUEST: {json.dumps(log_request, indent=2)}")
+    logger.info(f"🔄 COMPLETE CODEWHISPERER REQUEST: {log_preview(json.dumps(log_request, indent=2))}")
     return codewhisperer_request
@@ -0,0 +1,95 @@
+"""
+请求上下文
+由 AccessLogMiddleware 在每个 HTTP 请求开始时创建并放入 ContextVar，请求处理过程中的计量、日志都可以取到同一个 request_id；
+处理过程中用 annotate_request() 把模型、message_id、上游状态码、token 数和结果类别写回上下文，
+用 add_request_warning() 记录请求级警告，
+请求结束时访问日志从这里读取（流式响应的状态码总是 200，结果类别和 token 数只能由处理器提供）
+"""
+
+import re
+import uuid
+from contextvars import ContextVar
+from dataclasses import dataclass, field
+from typing import Any, Dict, List, Optional
+
+REQUEST_ID_HEADER = "x-request-id"
+# 回显给客户端的上游请求 ID
+UPSTREAM_REQUEST_ID_HEADER = "x-upstream-request-id"
+# 客户端传入的 X-Request-ID 只在格式安全时沿用，避免把任意内容写进日志
+CLIENT_REQUEST_ID_PATTERN = re.compile(r"^[A-Za-z0-9._:-]{1,128}$")
+
+
+@dataclass
+class RequestContext:
+    request_id: str
+    outcome_class: Optional[str] = None
+    model: Optional[str] = None
+    stream: Optional[bool] = None
+    message_id: Optional[str] = None
+    upstream_status: Optional[int] = None
+    # 最后一次上游调用的请求 ID（x-amzn-RequestId / x-amz-request-id），向 AWS 提交工单时使用
+    upstream_request_id: Optional[str] = None
+    # 最后一次上游调用使用的账号（auth.token_manager.SelectedToken），上游响应中途出错时按它计入账号的错误次数
+    upstream_token: Optional[Any] = None
+    input_tokens: Optional[int] = None
+    output_tokens: Optional[int] = None
+    # 请求处理中值得注意但不影响结果的情况（例如上游给出了无法识别的结束原因）
+    warnings: List[str] = field(default_factory=list)
+    # 流式响应按事件类型的统计（个数、平均 / 最大字节数），由 track_stream 在流结束时写入
+    stream_events: Optional[Dict[str, Dict[str, int]]] = None
+    # 上游调用明细（由 RequestAccounting 维护），客户端请求调试信息且有权限时附在错误响应中
+    upstream_attempts: List[Dict[str, Any]] = field(default_factory=list)
+    # 通过认证的 API Key 的标签（default / priority-N），由处理函数写入
+    key_label: Optional[str] = None
+    # Claude 接口请求使用的 anthropic-version 和 anthropic-beta 标记，由 AnthropicHeadersMiddleware 写入
+    anthropic_version: Optional[str] = None
+    anthropic_betas: Optional[List[str]] = None
+    # 本请求求值过的功能开关及结果（见 services/feature_flags.py）
+    feature_flags: Dict[str, bool] = field(default_factory=dict)
+    # 客户端请求的快照（处理前，与处理中的请求模型不共享可变对象，见 services/request_snapshot.py）
+    original_request: Optional[Dict[str, Any]] = None
+    # 演示模式下客户端通过查询参数给出的输出节奏选项（DemoOptions，见 services/demo_upstream.py）
+    demo_options: Optional[Any] = None
+    # 本请求调用上游的时限（秒）及到期的 time.monotonic() 时刻（见 services/stream_timeouts.py），没有时限时为 None
+    upstream_timeout: Optional[float] = None
+    upstream_deadline: Optional[float] = None
+    # 跨轮次工具压缩省略的描述（上游工具名 -> 原描述，见 services/tool_utils.py compact_repeated_tools）
+    compacted_tools: Optional[Dict[str, str]] = None
+
+
+_current: ContextVar[Optional[RequestContext]] = ContextVar("kiro2api_request_context", default=None)
+
+
+def new_request_id() -> str:
+    return f"req_{uuid.uuid4().hex[:24]}"
+
+
+def start_request_context(client_request_id: Optional[str] = None) -> RequestContext:
+    """创建当前请求的上下文，客户端给出合法的 X-Request-ID 时沿用"""
+    if client_request_id and CLIENT_REQUEST_ID_PATTERN.match(client_request_id):
+        request_id = client_request_id
+    else:
+        request_id = new_request_id()
+    context = RequestContext(request_id)
+    _current.set(context)
+    return context
+
+
+def current_request_context() -> Optional[RequestContext]:
+    return _current.get()
+
+
+def annotate_request(**fields):
+    """把请求处理过程中得到的信息写入当前请求上下文（不在请求上下文中时忽略）"""
+    context = _current.get()
+    if context is None:
+        return
+    for name, value in fields.items():
+        setattr(context, name, value)
+
+
+def add_request_warning(message: str):
+    """记录一条请求级警告，随访问日志输出（不在请求上下文中时忽略）"""
+    context = _current.get()
+    if context is not None:
+        context.warnings.append(message)
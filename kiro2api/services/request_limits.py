@@ -0,0 +1,175 @@
+"""
+请求体大小限制与日志预览截断
+超过 MAX_REQUEST_BODY_BYTES 的请求返回 413，避免超大请求（例如巨大的 base64 图片）被完整读入内存并写进日志
+
+部分企业代理会破坏 UTF-8 JSON 请求体，这类客户端可以把请求体整体 base64 编码后发送，
+用 Content-Encoding: base64 或 Content-Type: application/json+base64 标明（非标准，但实用）。
+这里先解码再交给后续处理，校验、哈希、日志看到的都是解码后的 JSON；大小限制按解码后的字节数计算
+"""
+
+import base64
+import binascii
+import logging
+
+from fastapi.responses import JSONResponse
+
+from config import MAX_REQUEST_BODY_BYTES, LOG_BODY_PREVIEW_CHARS
+from errors import respond_error, respond_claude_error
+from services.request_validation import CLAUDE_PATH_PREFIX
+
+logger = logging.getLogger(__name__)
+
+
+def log_preview(text: str, limit: int = LOG_BODY_PREVIEW_CHARS) -> str:
+    """截断写入日志的请求/响应内容（limit <= 0 时不截断）"""
+    if limit <= 0 or len(text) <= limit:
+        return text
+    return f"{text[:limit]}...(已截断，共 {len(text)} 字符)"
+
+
+BASE64_CONTENT_ENCODING = "base64"
+BASE64_CONTENT_TYPE = "application/json+base64"
+
+
+def _too_large_error(limit: int = MAX_REQUEST_BODY_BYTES):
+    return respond_error(413, "request_too_large", limit=limit)
+
+
+def base64_declaration(headers: dict) -> str:
+    """请求体声明的 base64 编码方式（用于错误消息），不是 base64 请求体时返回空字符串"""
+    encoding = headers.get(b"content-encoding", b"").decode("latin-1").strip().lower()
+    if encoding == BASE64_CONTENT_ENCODING:
+        return "Content-Encoding: base64"
+    content_type = headers.get(b"content-type", b"").decode("latin-1").split(";")[0].strip().lower()
+    if content_type == BASE64_CONTENT_TYPE:
+        return f"Content-Type: {BASE64_CONTENT_TYPE}"
+    return ""
+
+
+def decode_base64_body(body: bytes) -> bytes:
+    """解码 base64 请求体（忽略换行等空白字符），无效时抛出 ValueError"""
+    try:
+        return base64.b64decode(b"".join(body.split()), validate=True)
+    except (binascii.Error, ValueError) as e:
+        raise ValueError(str(e)) from e
+
+
+def _decoded_headers(raw_headers, length: int) -> list:
+    """解码后的请求头：去掉 Content-Encoding，Content-Type 改为 application/json，Content-Length 改为解码后的长度"""
+    headers = [
+        (name, value) for name, value in raw_headers
+        if name.lower() not in (b"content-encoding", b"content-length", b"content-type")
+    ]
+    headers.append((b"content-type", b"application/json"))
+    headers.append((b"content-length", str(length).encode()))
+    return headers
+
+
+class MaxBodySizeMiddleware:
+    """
+    ASGI 中间件：限制请求体大小
+
+    - 带 Content-Length 且超过限制时，不读取请求体，直接返回 413
+    - 分块传输等没有 Content-Length 的请求，在读取过程中累计字节数，超过限制时中止读取并返回 413
+    - base64 编码的请求体先完整读取并解码，按解码后的大小判断，再把解码后的 JSON 交给后续处理；无法解码时返回 400
+    所有端点（包括 count_tokens）都受同一限制
+    """
+
+    def __init__(self, app, max_bytes: int = MAX_REQUEST_BODY_BYTES):
+        self.app = app
+        self.max_bytes = max_bytes
+
+    async def __call__(self, scope, receive, send):
+        if scope["type"] != "http":
+            await self.app(scope, receive, send)
+            return
+
+        headers = dict(scope.get("headers") or [])
+        declared = base64_declaration(headers)
+        if declared:
+            await self._handle_base64(scope, receive, send, declared)
+            return
+        if self.max_bytes <= 0:
+            await self.app(scope, receive, send)
+            return
+
+        content_length = headers.get(b"content-length")
+        if content_length is not None:
+            try:
+                too_large = int(content_length) > self.max_bytes
+            except ValueError:
+                too_large = False
+            if too_large:
+                logger.warning(f"⚠️ 请求体过大: Content-Length={content_length.decode(errors='ignore')} > {self.max_bytes}")
+                await self._reject(scope, receive, send, _too_large_error(self.max_bytes))
+                return
+
+        received = 0
+
+        async def limited_receive():
+            nonlocal received
+            message = await receive()
+            if message["type"] == "http.request":
+                received += len(message.get("body", b""))
+                if received > self.max_bytes:
+                    logger.warning(f"⚠️ 请求体过大: 已读取 {received} > {self.max_bytes} 字节，中止读取")
+                    # 在请求体解析阶段抛出 HTTPException，由 FastAPI 转换为 413 响应
+                    raise _too_large_error(self.max_bytes)
+            return message
+
+        await self.app(scope, limited_receive, send)
+
+    def _encoded_limit(self) -> int:
+        """base64 请求体读取时的上限：解码后恰好达到限制的编码长度，另留换行等空白字符的余量（不限制时为 0）"""
+        return (self.max_bytes + 2) // 3 * 4 * 2 if self.max_bytes > 0 else 0
+
+    async def _handle_base64(self, scope, receive, send, declared: str):
+        chunks = []
+        received = 0
+        while True:
+            message = await receive()
+            if message["type"] == "http.disconnect":
+                return
+            body = message.get("body", b"")
+            received += len(body)
+            if 0 < self._encoded_limit() < received:
+                logger.warning(f"⚠️ 请求体过大: base64 请求体已读取 {received} 字节，解码后必然超过 {self.max_bytes}，中止读取")
+                await self._reject(scope, receive, send, _too_large_error(self.max_bytes))
+                return
+            chunks.append(body)
+            if not message.get("more_body", False):
+                break
+
+        try:
+            decoded = decode_base64_body(b"".join(chunks))
+        except ValueError as e:
+            logger.warning(f"⚠️ 无法解码 base64 请求体（{declared}）: {e}")
+            if scope.get("path", "").startswith(CLAUDE_PATH_PREFIX):
+                error = respond_claude_error(400, "invalid_base64_body", "invalid_request_error", declared=declared, reason=e)
+            else:
+                error = respond_error(400, "invalid_base64_body", declared=declared, reason=e)
+            await self._reject(scope, receive, send, error)
+            return
+        if 0 < self.max_bytes < len(decoded):
+            logger.warning(f"⚠️ 请求体过大: base64 解码后 {len(decoded)} > {self.max_bytes} 字节")
+            await self._reject(scope, receive, send, _too_large_error(self.max_bytes))
+            return
+
+        logger.info(f"📦 已解码 base64 请求体（{declared}）: {received} -> {len(decoded)} 字节")
+        scope = dict(scope)
+        scope["headers"] = _decoded_headers(scope.get("headers") or [], len(decoded))
+        replayed = False
+
+        async def decoded_receive():
+            nonlocal replayed
+            if not replayed:
+                replayed = True
+                return {"type": "http.request", "body": decoded, "more_body": False}
+            return await receive()
+
+        await self.app(scope, decoded_receive, send)
+
+    @staticmethod
+    async def _reject(scope, receive, send, error):
+        response = JSONResponse(status_code=error.status_code, content={"detail": error.detail})
+        await response(scope, receive, send)
@@ -0,0 +1,184 @@
+"""
+请求采样
+按 REQUEST_SAMPLE_RATE 抽取一部分真实请求，把脱敏后的客户端请求、上游请求和上游响应事件写成 JSON fixture，
+用于离线回放（例如配合 DEMO_MODE 的假上游）和构建回归用例
+
+每个 fixture 一个文件，文件数达到 REQUEST_SAMPLE_MAX_FIXTURES 后不再写入；未开启时不会缓存任何响应数据
+"""
+
+import os
+import re
+import json
+import time
+import random
+import logging
+from typing import Any, Dict, List, Optional
+
+from config import REQUEST_SAMPLE_RATE, REQUEST_SAMPLE_DIR, REQUEST_SAMPLE_MAX_FIXTURES
+from parsers.stream_parser import CodeWhispererStreamParser
+from services.request_snapshot import original_request
+
+logger = logging.getLogger(__name__)
+
+REDACTED = "[REDACTED]"
+
+# 值整体替换的字段（不区分大小写，忽略 - 和 _）
+SENSITIVE_KEYS = {
+    "authorization", "apikey", "xapikey", "accesstoken", "refreshtoken", "idtoken",
+    "token", "clientsecret", "password", "profilearn", "cookie",
+}
+
+# 文本中需要替换的片段
+SENSITIVE_PATTERNS = [
+    (re.compile(r"Bearer\s+[A-Za-z0-9._~+/=-]+"), "Bearer " + REDACTED),
+    (re.compile(r"\bsk-[A-Za-z0-9_-]{16,}"), REDACTED),
+    (re.compile(r"\b(?:AKIA|ASIA)[A-Z0-9]{16}\b"), REDACTED),
+    (re.compile(r"arn:aws:[a-z0-9-]+:[a-z0-9-]*:\d{12}:[^\s\"']+"), REDACTED),
+    (re.compile(r"[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}"), "[EMAIL]"),
+]
+
+
+def _is_sensitive_key(key: str) -> bool:
+    return key.lower().replace("-", "").replace("_", "") in SENSITIVE_KEYS
+
+
+def redact_text(text: str) -> str:
+    for pattern, replacement in SENSITIVE_PATTERNS:
+        text = pattern.sub(replacement, text)
+    return text
+
+
+def redact(value: Any) -> Any:
+    """递归脱敏：敏感字段整体替换，其余字符串替换其中的凭证、ARN 和邮箱"""
+    if isinstance(value, dict):
+        return {
+            key: REDACTED if _is_sensitive_key(str(key)) else redact(item)
+            for key, item in value.items()
+        }
+    if isinstance(value, list):
+        return [redact(item) for item in value]
+    if isinstance(value, str):
+        return redact_text(value)
+    return value
+
+
+class RequestSampler:
+    """采样决策和 fixture 写入"""
+
+    def __init__(
+        self,
+        rate: float = REQUEST_SAMPLE_RATE,
+        directory: str = REQUEST_SAMPLE_DIR,
+        max_fixtures: int = REQUEST_SAMPLE_MAX_FIXTURES,
+    ):
+        self.rate = rate
+        self.directory = directory
+        self.max_fixtures = max_fixtures
+        self._stored: Optional[int] = None
+
+    @property
+    def enabled(self) -> bool:
+        return self.rate > 0 and self.max_fixtures > 0
+
+    def stored_count(self) -> int:
+        """目录中已有的 fixture 数量（首次调用时统计，之后在内存中累加）"""
+        if self._stored is None:
+            try:
+                self._stored = sum(1 for name in os.listdir(self.directory) if name.endswith(".json"))
+            except FileNotFoundError:
+                self._stored = 0
+        return self._stored
+
+    def should_sample(self) -> bool:
+        if not self.enabled or self.stored_count() >= self.max_fixtures:
+            return False
+        return random.random() < self.rate
+
+    def start(
+        self,
+        request_id: str,
+        api: str,
+        client_request: Dict[str, Any],
+        upstream_request: Dict[str, Any],
+    ) -> Optional["RequestSample"]:
+        """按采样率决定是否采样，未命中时返回 None"""
+        if not self.should_sample():
+            return None
+        return RequestSample(self, request_id, api, client_request, upstream_request)
+
+    def write(self, fixture: Dict[str, Any]) -> Optional[str]:
+        if self.stored_count() >= self.max_fixtures:
+            logger.info(f"📼 fixture 数量已达上限 {self.max_fixtures}，丢弃采样 {fixture['id']}")
+            return None
+        os.makedirs(self.directory, exist_ok=True)
+        path = os.path.join(self.directory, f"{fixture['id']}.json")
+        with open(path, "w", encoding="utf-8") as f:
+            json.dump(fixture, f, ensure_ascii=False, indent=2)
+        self._stored += 1
+        logger.info(f"📼 已写入请求采样 fixture: {path}")
+        return path
+
+
+class RequestSample:
+    """一个被采样的请求，累积上游响应字节，结束时写出 fixture"""
+
+    def __init__(
+        self,
+        sampler: RequestSampler,
+        request_id: str,
+        api: str,
+        client_request: Dict[str, Any],
+        upstream_request: Dict[str, Any],
+    ):
+        self.sampler = sampler
+        self.request_id = request_id
+        self.api = api
+        self.client_request = client_request
+        # 客户端实际发送的请求（处理前的快照）；与 client_request（处理后的请求）不同时 fixture 两者都保留
+        self.original_request = original_request()
+        self.upstream_request = upstream_request
+        self.captured_at = time.time()
+        self.status_code: Optional[int] = None
+        self._body = bytearray()
+        self._finished = False
+
+    def feed(self, chunk: bytes):
+        self._body.extend(chunk)
+
+    def finish(self, status_code: Optional[int] = 200) -> Optional[str]:
+        """写出 fixture（只生效一次），采样失败不影响请求处理"""
+        if self._finished:
+            return None
+        self._finished = True
+        self.status_code = status_code
+        try:
+            return self.sampler.write(self.to_fixture())
+        except Exception as e:
+            logger.warning(f"写入请求采样 fixture 失败: {e}")
+            return None
+
+    def response_events(self) -> List[Dict[str, Any]]:
+        parser = CodeWhispererStreamParser()
+        events = parser.parse(bytes(self._body))
+        if parser.has_remaining_data():
+            events.extend(parser.flush())
+        return events
+
+    def to_fixture(self) -> Dict[str, Any]:
+        fixture = {
+            "id": self.request_id,
+            "api": self.api,
+            "captured_at": self.captured_at,
+            "request": redact(self.original_request or self.client_request),
+            "upstream_request": redact(self.upstream_request),
+            "upstream_response": {
+                "status_code": self.status_code,
+                "events": redact(self.response_events()),
+            },
+        }
+        if self.original_request is not None and self.original_request != self.client_request:
+            fixture["processed_request"] = redact(self.client_request)
+        return fixture
+
+
+request_sampler = RequestSampler()
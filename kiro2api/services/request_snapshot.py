@@ -0,0 +1,52 @@
+"""
+原始请求快照
+有些处理步骤会原地修改请求模型（例如 inline_remote_images 把远程图片改写为 data: URL），
+之后再记录“客户端请求”（审计 transcript、请求采样 fixture）就会看到修改后的内容，而不是客户端实际发送的请求。
+
+处理函数在入口调用 preserve_original：客户端请求的快照（model_dump 后再深拷贝，与模型不共享任何可变对象）
+保存在请求上下文中，返回请求模型的深拷贝交给后续处理，之后对请求的任何修改都不会影响快照。
+记录客户端请求时用 client_request_source 取快照；请求采样的 fixture 同时包含原始请求和处理后的请求（两者不同时）
+"""
+
+from typing import Any, Callable, Dict, Optional, TypeVar
+
+from pydantic import BaseModel
+
+from services.request_context import annotate_request, current_request_context
+
+RequestModel = TypeVar("RequestModel", bound=BaseModel)
+
+
+def clone_json(value: Any) -> Any:
+    """JSON 形式数据（dict / list / 标量）的深拷贝；比 copy.deepcopy 快，不处理循环引用和自定义对象"""
+    if isinstance(value, dict):
+        return {key: clone_json(item) for key, item in value.items()}
+    if isinstance(value, (list, tuple)):
+        return [clone_json(item) for item in value]
+    return value
+
+
+def preserve_original(request: RequestModel) -> RequestModel:
+    """
+    保存客户端请求的快照，返回供后续处理的深拷贝
+
+    同一请求中只有第一次调用保存快照（例如 /v1/completions 保存旧版请求，之后转换出的聊天请求不会覆盖它）
+    """
+    context = current_request_context()
+    if context is not None and context.original_request is None:
+        annotate_request(original_request=clone_json(request.model_dump(exclude_none=True)))
+    return request.model_copy(deep=True)
+
+
+def original_request() -> Optional[Dict[str, Any]]:
+    """当前请求的客户端请求快照，没有时返回 None"""
+    context = current_request_context()
+    return context.original_request if context else None
+
+
+def client_request_source(request: BaseModel) -> Callable[[], Dict[str, Any]]:
+    """记录客户端请求的取值函数：有快照时返回快照，否则在取值时导出 request"""
+    snapshot = original_request()
+    if snapshot is not None:
+        return lambda: snapshot
+    return lambda: request.model_dump(exclude_none=True)
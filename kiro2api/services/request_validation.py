@@ -0,0 +1,56 @@
+"""
+请求体校验错误
+FastAPI 在调用处理函数之前解析和校验请求体，格式错误的请求不会获取 token、也不会访问上游；
+这里把默认的 422 + {"detail": [...]} 改为与其他错误一致的 400 错误格式：
+
+- 请求体不是合法 JSON：code invalid_json
+- 字段缺失或类型不对：code invalid_request_body，param 为第一个出错字段的路径
+
+/v1/messages 系列返回 Claude 格式，其余 /v1/ 接口返回 OpenAI 格式；管理接口（/api/ 等）保持 FastAPI 的默认行为
+"""
+
+import logging
+from typing import Any, Dict, List
+
+from fastapi import Request
+from fastapi.exceptions import RequestValidationError
+from fastapi.exception_handlers import request_validation_exception_handler as default_validation_handler
+
+from errors import respond_error, respond_claude_error
+from services.debug_info import debug_http_exception_handler
+
+logger = logging.getLogger(__name__)
+
+CLAUDE_PATH_PREFIX = "/v1/messages"
+API_PATH_PREFIX = "/v1/"
+
+
+def _field_path(error: Dict[str, Any]) -> str:
+    """错误位置去掉开头的 "body"，例如 messages.0.role"""
+    loc = [str(part) for part in error.get("loc", ())]
+    if loc and loc[0] == "body":
+        loc = loc[1:]
+    return ".".join(loc)
+
+
+def describe_validation_errors(errors: List[Dict[str, Any]]):
+    """返回 (消息代码, 字段路径, 参数)，以第一个错误为准"""
+    first = errors[0] if errors else {}
+    if first.get("type") == "json_invalid":
+        reason = (first.get("ctx") or {}).get("error") or first.get("msg", "")
+        return "invalid_json", None, {"reason": reason}
+    field = _field_path(first) or "body"
+    return "invalid_request_body", field, {"field": field, "reason": first.get("msg", "invalid value")}
+
+
+async def api_validation_exception_handler(request: Request, exc: RequestValidationError):
+    path = request.url.path
+    if not path.startswith(API_PATH_PREFIX):
+        return await default_validation_handler(request, exc)
+    code, field, params = describe_validation_errors(exc.errors())
+    logger.warning(f"⚠️ 请求体校验失败: {path} {code} {params}")
+    if path.startswith(CLAUDE_PATH_PREFIX):
+        error = respond_claude_error(400, code, "invalid_request_error", **params)
+    else:
+        error = respond_error(400, code, param=field, **params)
+    return await debug_http_exception_handler(request, error)
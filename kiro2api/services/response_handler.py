@@ -1,39 +1,66 @@
 import re
 import json
-import time
 import uuid
 import logging
 import httpx
-from fastapi import HTTPException
-from fastapi.responses import StreamingResponse
+from typing import Any, AsyncIterator, Dict, Optional
+from fastapi import HTTPException, Request
+from starlette.background import BackgroundTask
 
-from config import KIRO_BASE_URL
 from models.schemas import (
     ChatCompletionRequest,
     ChatCompletionResponse,
-    ChatCompletionStreamResponse,
     ResponseMessage,
     Choice,
-    StreamChoice,
     Usage,
     ToolCall,
 )
-from auth import token_manager
-from parsers.stream_parser import CodeWhispererStreamParser
+from auth import token_manager, StreamLease
+from parsers.stream_parser import CodeWhispererStreamParser, EventStreamErrorBudgetExhausted
 from parsers.bracket_parser import (
     parse_bracket_tool_calls,
-    parse_single_tool_call,
-    find_matching_bracket,
     deduplicate_tool_calls,
 )
-from services.request_builder import build_codewhisperer_request
+from errors import localize, respond_error
+from services.request_builder import build_codewhisperer_request, openai_tool_fingerprints
+from services.openai_stream_handler import OpenAIStreamHandler
+from services.block_limits import BlockLimits, BlockLimitError
+from services.conversation_cache import conversation_cache
+from services.request_limits import log_preview
+from services.tool_utils import build_tool_name_map, ToolNameError, ToolNameMap
+from services.request_sampler import request_sampler
+from services.error_mapper import retry_after_headers, record_upstream_error, is_client_caused
+from services.request_context import annotate_request, current_request_context
+from services.request_snapshot import client_request_source
+from services.debug_info import with_debug
+from services.accounting import RequestAccounting, OUTCOME_PROXY_ERROR, classify_status
+from services.tokenizer import OutputTokenBudget, count_text_tokens
+from services.reasoning import extract_reasoning
+from services.stop_sequences import StopSequenceFilter
+from services.json_mode import JsonFenceFilter, json_mode_requested, strip_json_fences, check_json_output
+from services.stop_reasons import normalize_stop_reason, resolve_finish_reason, upstream_stop_reason as event_stop_reason
+from services.stream_outcome import StreamOutcome, StreamEndReason, track_stream, release_stream_resources
+from services.sse_writer import SSEResponse, StreamLifecycle
+from services.stream_timeouts import StreamTimeoutError, with_stream_timeouts
+from services.stream_keepalive import keepalive_stream, OPENAI_KEEPALIVE_FRAME, OPENAI_FINAL_MARKER
+from services.upstream import (
+    create_upstream_client,
+    execute_codewhisperer_request,
+    UpstreamStream,
+    iter_response_bytes,
+    UpstreamError,
+    NoTokenAvailableError,
+    TokenInvalidError,
+    RateLimitedError,
+    UpstreamCircuitOpenError,
+)
 
 logger = logging.getLogger(__name__)
 
 
 def estimate_tokens(text: str) -> int:
-    """Rough token estimation"""
-    return max(1, len(text) // 4)
+    """按 TOKENIZER_BACKEND 配置的分词后端计算 token 数量（与 Claude 接口和 count_tokens 使用同一套计数）"""
+    return count_text_tokens(text)
 
 
 def create_usage_stats(prompt_text: str, completion_text: str) -> Usage:
@@ -47,7 +74,26 @@ def create_usage_stats(prompt_text: str, completion_text: str) -> Usage:
     )
 
 
-async def call_kiro_api(request: ChatCompletionRequest):
+def openai_tool_name_map(request: ChatCompletionRequest) -> ToolNameMap:
+    """按 TOOL_NAME_POLICY 校验 OpenAI 请求中的工具名，不合法时返回 400"""
+    try:
+        return build_tool_name_map([tool.function.name for tool in request.tools or []])
+    except ToolNameError as e:
+        raise respond_error(400, "invalid_tool_name", param="tools", name=e.name, rule=e.rule)
+
+
+def upstream_token():
+    """当前请求最后一次上游调用使用的账号（不在请求上下文中时为 None）"""
+    context = current_request_context()
+    return context.upstream_token if context else None
+
+
+async def iter_kiro_events(
+    request: ChatCompletionRequest,
+    accounting: Optional[RequestAccounting] = None,
+    tool_names: Optional[ToolNameMap] = None,
+    conversation_key: Optional[str] = None,
+) -> AsyncIterator[Dict[str, Any]]:
     """
     Make API call to Kiro/CodeWhisperer with multi-account token rotation
     
@@ -55,189 +101,150 @@ async def call_kiro_api(request: ChatCompletionRequest):
     - 多账号轮询支持
     - 自动刷新过期 token
     - 429 错误时自动切换账号
-    - 403 错误时刷新 token 并重试
+    - 403 错误时刷新或切换 token 并重试一次
+
+    上游响应边读边解析，逐个产出事件，不在内存中保留完整的响应体。
+    conversation_key 为客户端对话的缓存键，有时沿用上一轮的上游 conversationId
     """
-    # 使用多账号 token 管理器获取 token
-    token = await token_manager.get_token()
-    if not token:
+    request_data = build_codewhisperer_request(
+        request, tool_names, conversation_cache.lookup(conversation_key), conversation_cache.declared_tools(conversation_key)
+    )
+
+    try:
+        async with create_upstream_client(httpx.Timeout(120.0)) as client:
+            response = await execute_codewhisperer_request(client, request_data, accounting=accounting)
+            conversation_cache.remember(
+                conversation_key, request_data["conversationState"]["conversationId"], openai_tool_fingerprints(request)
+            )
+            sample = request_sampler.start(
+                accounting.request_id if accounting else f"req_{uuid.uuid4().hex[:24]}",
+                "openai", request.model_dump(exclude_none=True), request_data,
+            )
+            parser = CodeWhispererStreamParser()
+            received = 0
+            try:
+                # 非流式不设空闲和总时长上限，只受请求的上游时限约束
+                async for chunk in with_stream_timeouts(iter_response_bytes(response), 0, 0):
+                    received += len(chunk)
+                    if sample:
+                        sample.feed(chunk)
+                    for event in parser.parse(chunk):
+                        yield event
+            finally:
+                await response.aclose()
+            logger.info(f"📤 CodeWhisperer响应体长度: {received} bytes")
+            if sample:
+                sample.finish(response.status_code)
+            
+    except (TokenInvalidError, NoTokenAvailableError) as e:
+        record_upstream_error(e)
         raise HTTPException(
-            status_code=401, 
+            status_code=401,
             detail={
                 "error": {
-                    "message": "No access token available. Please check your KIRO_AUTH_CONFIG configuration.",
+                    "message": e.message,
                     "type": "authentication_error",
                     "param": None,
                     "code": "invalid_api_key"
                 }
             }
         )
-    
-    request_data = build_codewhisperer_request(request)
-    
-    headers = {
-        "Authorization": f"Bearer {token}",
-        "Content-Type": "application/json",
-        "Accept": "text/event-stream" if request.stream else "application/json"
-    }
-
-    # 最大重试次数（用于轮询多个账号）
-    max_retries = 3
-    
-    try:
-        async with httpx.AsyncClient() as client:
-            for attempt in range(max_retries):
-                response = await client.post(
-                    KIRO_BASE_URL,
-                    headers=headers,
-                    json=request_data,
-                    timeout=120
-                )
-                
-                logger.info(f"📤 RESPONSE STATUS: {response.status_code} (attempt {attempt + 1})")
-                
-                if response.status_code == 403:
-                    logger.info("收到403响应，尝试刷新token...")
-                    new_token = await token_manager.refresh_tokens()
-                    if new_token:
-                        headers["Authorization"] = f"Bearer {new_token}"
-                        continue  # 使用新 token 重试
-                    else:
-                        # 刷新失败，尝试切换到下一个账号
-                        token_manager.mark_token_error()
-                        new_token = await token_manager.get_token()
-                        if new_token:
-                            headers["Authorization"] = f"Bearer {new_token}"
-                            continue
-                        raise HTTPException(status_code=401, detail="Token refresh failed and no backup accounts available")
-                
-                if response.status_code == 429:
-                    logger.warning("收到429响应（速率限制），尝试切换账号...")
-                    # 标记当前 token 已耗尽，切换到下一个账号
-                    token_manager.mark_token_exhausted("rate_limit_429")
-                    
-                    # 尝试获取新 token
-                    new_token = await token_manager.get_token()
-                    if new_token and attempt < max_retries - 1:
-                        headers["Authorization"] = f"Bearer {new_token}"
-                        logger.info("已切换到新账号，重试请求...")
-                        continue
-                    
-                    # 所有账号都耗尽
-                    raise HTTPException(
-                        status_code=429,
-                        detail={
-                            "error": {
-                                "message": "All accounts rate limited. Please try again later.",
-                                "type": "rate_limit_error",
-                                "param": None,
-                                "code": "rate_limit_exceeded"
-                            }
-                        }
-                    )
-                
-                response.raise_for_status()
-                return response
-            
-            # 所有重试都失败
-            raise HTTPException(
-                status_code=503,
-                detail={
-                    "error": {
-                        "message": "API call failed after multiple retries",
-                        "type": "api_error",
-                        "param": None,
-                        "code": "api_error"
-                    }
-                }
-            )
-            
-    except httpx.HTTPStatusError as e:
-        logger.error(f"HTTP ERROR: {e.response.status_code} - {e.response.text}")
-        token_manager.mark_token_error()
+    except RateLimitedError as e:
+        record_upstream_error(e)
         raise HTTPException(
-            status_code=503,
+            status_code=429,
             detail={
                 "error": {
-                    "message": f"API call failed: {str(e)}",
-                    "type": "api_error",
+                    "message": e.message,
+                    "type": "rate_limit_error",
                     "param": None,
-                    "code": "api_error"
+                    "code": "rate_limit_exceeded"
                 }
-            }
+            },
+            headers=retry_after_headers(e),
+        )
+    except UpstreamCircuitOpenError as e:
+        # 请求没有发往上游，不计入账号错误
+        record_upstream_error(e)
+        raise HTTPException(
+            status_code=503,
+            detail={"error": {"message": e.message, "type": "api_error", "param": None, "code": "upstream_unavailable"}},
+            headers=retry_after_headers(e),
+        )
+    except StreamTimeoutError as e:
+        # 超过请求的上游时限（UPSTREAM_TIMEOUT / X-Request-Timeout），不计入账号错误
+        logger.error(f"⏱️ 上游超时: {e}")
+        raise respond_error(504, "upstream_timeout", "timeout_error", seconds=e.seconds)
+    except UpstreamError as e:
+        record_upstream_error(e)
+        if not is_client_caused(e):
+            token_manager.mark_token_error(upstream_token())
+        raise respond_error(
+            503, "api_call_failed", "api_error", api_code="api_error",
+            headers=retry_after_headers(e), detail=e.message,
         )
     except HTTPException:
         raise
     except Exception as e:
         logger.error(f"API call failed: {str(e)}")
-        token_manager.mark_token_error()
-        raise HTTPException(
-            status_code=503,
-            detail={
-                "error": {
-                    "message": f"API call failed: {str(e)}",
-                    "type": "api_error",
-                    "param": None,
-                    "code": "api_error"
-                }
-            }
-        )
+        token_manager.mark_token_error(upstream_token())
+        raise respond_error(503, "api_call_failed", "api_error", api_code="api_error", detail=str(e))
 
 
-async def create_non_streaming_response(request: ChatCompletionRequest):
+async def create_non_streaming_response(
+    request: ChatCompletionRequest,
+    conversation_key: Optional[str] = None,
+    accounting: Optional[RequestAccounting] = None,
+):
     """
     Handles non-streaming chat completion requests.
-    It fetches the complete response from CodeWhisperer, parses it using
-    CodeWhispererStreamParser, and constructs a single OpenAI-compatible
-    ChatCompletionResponse. This version correctly handles tool calls by
-    parsing both structured event data and bracket format in text.
+    It feeds the CodeWhisperer response through CodeWhispererStreamParser
+    as it arrives, accumulating only text and tool calls, and constructs a
+    single OpenAI-compatible ChatCompletionResponse. This version correctly
+    handles tool calls by parsing both structured event data and bracket
+    format in text.
+
+    accounting 由 create_multi_choice_response 传入时，上游调用计入同一个客户端请求，
+    成功时由调用方汇总 n 个 choice 后结束计量；失败时整个请求随之失败，这里直接结束
     """
+    owns_accounting = accounting is None
+    if owns_accounting:
+        accounting = RequestAccounting("openai", request.model, stream=False)
+        accounting.request_source = client_request_source(request)
     try:
         logger.info("🚀 开始非流式响应生成...")
-        response = await call_kiro_api(request)
-        
-        # 添加详细的原始响应日志
-        logger.info(f"📤 CodeWhisperer响应状态码: {response.status_code}")
-        logger.info(f"📤 响应头: {dict(response.headers)}")
-        logger.info(f"📤 原始响应体长度: {len(response.content)} bytes")
-        
-        # 获取原始响应文本用于工具调用检测
-        raw_response_text = ""
-        try:
-            raw_response_text = response.content.decode('utf-8', errors='ignore')
-            logger.info(f"🔍 原始响应文本长度: {len(raw_response_text)}")
-            logger.info(f"🔍 原始响应预览(前1000字符): {raw_response_text[:1000]}")
-            
-            # 检查是否包含工具调用标记
-            if "[Called" in raw_response_text:
-                logger.info("✅ 原始响应中发现 [Called 标记")
-                called_positions = [m.start() for m in re.finditer(r'\[Called', raw_response_text)]
-                logger.info(f"🎯 [Called 出现位置: {called_positions}")
-            else:
-                logger.info("❌ 原始响应中未发现 [Called 标记")
-                
-        except Exception as e:
-            logger.error(f"❌ 解码原始响应失败: {e}")
-        
-        # 使用 CodeWhispererStreamParser 一次性解析整个响应体
-        parser = CodeWhispererStreamParser()
-        events = parser.parse(response.content)
-        
+        tool_names = openai_tool_name_map(request)
         full_response_text = ""
+        reasoning_text = ""
+        # 上游事件中带的结束原因（已归一化），没有时为 None
+        upstream_stop_reason = None
         tool_calls = []
         current_tool_call_dict = None
+        event_count = 0
+        output_budget = OutputTokenBudget(request.output_token_limit())
+        # 在代理侧执行请求的 stop，命中后不再读取上游
+        stop_filter = StopSequenceFilter(request.stop)
+        block_limits = BlockLimits()
+
+        # 边接收边处理上游事件，只累积文本和工具调用，不保留原始响应体
+        events = stop_filter.filter_async(iter_kiro_events(request, accounting, tool_names, conversation_key))
+        async for event in events:
+            logger.info(f"📋 事件 {event_count}: {event}")
+            event_count += 1
+            if event.get("content"):
+                event["content"] = output_budget.consume(event["content"])
+            elif isinstance(event.get("input"), str):
+                event["input"] = output_budget.consume(event["input"])
+            stop_reason = event_stop_reason(event)
+            if stop_reason:
+                upstream_stop_reason = normalize_stop_reason(stop_reason, "openai")
 
-        logger.info(f"🔄 解析到 {len(events)} 个事件，开始处理...")
-        
-        # 记录每个事件的详细信息
-        for i, event in enumerate(events):
-            logger.info(f"📋 事件 {i}: {event}")
-
-        for event in events:
             # 优先处理结构化工具调用事件
             if "name" in event and "toolUseId" in event:
                 logger.info(f"🔧 发现结构化工具调用事件: {event}")
                 # 如果是新的工具调用，则初始化
                 if not current_tool_call_dict:
+                    block_limits.add_tool_call()
                     current_tool_call_dict = {
                         "id": event.get("toolUseId"),
                         "type": "function",
@@ -274,6 +281,22 @@ async def create_non_streaming_response(request: ChatCompletionRequest):
                 full_response_text += content
                 logger.info(f"📄 添加文本内容: {content[:100]}...")
 
+            # 推理内容（extended thinking），作为 reasoning_content 返回
+            else:
+                reasoning = extract_reasoning(event)
+                if reasoning:
+                    reasoning_text += output_budget.consume(reasoning.text)
+
+            if output_budget.exhausted:
+                # 达到输出上限：关闭上游连接，已截断的内容以 finish_reason=length 返回
+                await events.aclose()
+                break
+
+        logger.info(f"🔄 共处理 {event_count} 个事件")
+        if stop_filter.matched:
+            logger.info(f"🛑 命中停止序列: {stop_filter.matched!r}")
+            upstream_stop_reason = "stop_sequence"
+
         # 如果流在工具调用中间意外结束，也将其添加
         if current_tool_call_dict:
             logger.warning("⚠️ 响应流在工具调用结束前终止，仍尝试添加。")
@@ -301,19 +324,14 @@ async def create_non_streaming_response(request: ChatCompletionRequest):
             # 清理多余的空白
             full_response_text = re.sub(r'\s+', ' ', full_response_text).strip()
 
-        # 关键修复：检查原始响应中的 bracket 格式工具调用
-        logger.info("🔍 开始检查原始响应中的bracket格式工具调用...")
-        raw_bracket_tool_calls = parse_bracket_tool_calls(raw_response_text)
-        if raw_bracket_tool_calls and isinstance(raw_bracket_tool_calls, list):
-            logger.info(f"✅ 在原始响应中发现 {len(raw_bracket_tool_calls)} 个 bracket 格式工具调用")
-            tool_calls.extend(raw_bracket_tool_calls)
-        else:
-            logger.info("❌ 原始响应中未发现bracket格式工具调用")
-
         # 去重工具调用
         logger.info(f"🔄 去重前工具调用数量: {len(tool_calls)}")
         unique_tool_calls = deduplicate_tool_calls(tool_calls)
         logger.info(f"🔄 去重后工具调用数量: {len(unique_tool_calls)}")
+        # 上游返回的是转换后的工具名，还原为客户端的原名
+        for tc in unique_tool_calls:
+            if isinstance(tc.function, dict) and "name" in tc.function:
+                tc.function["name"] = tool_names.client_name(tc.function["name"])
 
         # 根据是否有工具调用来构建响应
         if unique_tool_calls:
@@ -324,372 +342,342 @@ async def create_non_streaming_response(request: ChatCompletionRequest):
             response_message = ResponseMessage(
                 role="assistant",
                 content=None,  # OpenAI规范：当有tool_calls时，content必须为None
+                reasoning_content=reasoning_text or None,
                 tool_calls=unique_tool_calls
             )
-            finish_reason = "tool_calls"
         else:
             logger.info("📄 构建普通文本响应")
+            if json_mode_requested(request):
+                # response_format json_object：去掉包住 JSON 的代码块并校验
+                full_response_text = strip_json_fences(full_response_text)
+                check_json_output(full_response_text.strip())
             # 如果没有工具调用，使用清理后的文本
             content = full_response_text.strip() if full_response_text.strip() else "I understand."
             logger.info(f"📄 最终文本内容: {content[:200]}...")
             
             response_message = ResponseMessage(
                 role="assistant",
-                content=content
+                content=content,
+                reasoning_content=reasoning_text or None,
             )
-            finish_reason = "stop"
+        finish_reason = resolve_finish_reason(upstream_stop_reason, len(unique_tool_calls))
+        if output_budget.exhausted:
+            finish_reason = "length"
 
         choice = Choice(
             index=0,
             message=response_message,
-            finish_reason=finish_reason
+            finish_reason=finish_reason,
+            stop_reason=stop_filter.matched,
         )
 
         usage = create_usage_stats(
             prompt_text=" ".join([msg.get_content_text() for msg in request.messages]),
-            completion_text=full_response_text if not unique_tool_calls else ""
+            # 有工具调用时计入工具参数（与流式响应的 usage 一致）
+            completion_text="".join(tc.function.get("arguments", "") for tc in unique_tool_calls)
+            if unique_tool_calls else full_response_text,
         )
+        if reasoning_text:
+            # OpenAI 的 completion_tokens 包含推理 token
+            reasoning_tokens = estimate_tokens(reasoning_text)
+            usage.completion_tokens += reasoning_tokens
+            usage.total_tokens += reasoning_tokens
+            usage.completion_tokens_details = {"reasoning_tokens": reasoning_tokens}
 
         chat_response = ChatCompletionResponse(
             model=request.model,
             choices=[choice],
             usage=usage
         )
+        annotate_request(message_id=chat_response.id)
+        accounting.response_source = lambda: reasoning_text + (response_message.content or "") + "".join(
+            call.function.arguments for call in response_message.tool_calls or []
+        )
         
         logger.info(f"📤 最终非流式响应构建完成")
         logger.info(f"📤 响应类型: {'工具调用' if unique_tool_calls else '文本内容'}")
-        logger.info(f"📤 完整响应: {chat_response.model_dump_json(indent=2, exclude_none=True)}")
+        logger.info(f"📤 完整响应: {log_preview(chat_response.model_dump_json(indent=2, exclude_none=True))}")
+        if owns_accounting:
+            accounting.input_tokens = usage.prompt_tokens
+            accounting.output_tokens = usage.completion_tokens
+            accounting.finish("ok")
         return chat_response
         
-    except HTTPException:
+    except HTTPException as e:
+        accounting.finish("error", outcome_class=classify_status(e.status_code))
         raise
+    except BlockLimitError as e:
+        accounting.finish("error", outcome_class=OUTCOME_PROXY_ERROR)
+        raise respond_error(502, "upstream_block_limit", "api_error", limit=e.limit, kind=e.kind)
     except Exception as e:
+        accounting.finish("error", outcome_class=OUTCOME_PROXY_ERROR)
         logger.error(f"❌ 非流式响应处理出错: {e}")
         import traceback
         traceback.print_exc()
-        raise HTTPException(
-            status_code=500,
-            detail={
-                "error": {
-                    "message": f"Internal server error: {str(e)}",
-                    "type": "internal_server_error",
-                    "param": None,
-                    "code": "internal_error"
-                }
-            }
-        )
+        raise respond_error(500, "internal_error", "internal_server_error", detail=str(e))
 
 
-async def create_streaming_response(request: ChatCompletionRequest):
+async def create_multi_choice_response(request: ChatCompletionRequest, n: int) -> ChatCompletionResponse:
+    """
+    n > 1 的非流式请求：上游每次只生成一个补全，按顺序请求 n 次，合并为 n 个 choice
+
+    整个请求只有一条客户端请求级计量，n 次上游请求都记在它的上游调用级明细中；
+    usage 与 OpenAI 一致，prompt_tokens 只计一次，completion_tokens 为所有 choice 之和。
+    任何一次失败时整个请求返回该错误，不返回部分结果
+    """
+    logger.info(f"🔁 n={n}：按顺序请求 {n} 次上游")
+    accounting = RequestAccounting("openai", request.model, stream=False)
+    accounting.request_source = client_request_source(request)
+    responses = []
+    for i in range(n):
+        responses.append(await create_non_streaming_response(request, accounting=accounting))
+        logger.info(f"🔁 已完成第 {i + 1}/{n} 个 choice")
+
+    choices = []
+    for index, response in enumerate(responses):
+        choice = response.choices[0]
+        choice.index = index
+        choices.append(choice)
+    first = responses[0].usage
+    completion_tokens = sum(response.usage.completion_tokens for response in responses)
+    reasoning_tokens = sum(
+        (response.usage.completion_tokens_details or {}).get("reasoning_tokens", 0) for response in responses
+    )
+    usage = Usage(
+        prompt_tokens=first.prompt_tokens,
+        completion_tokens=completion_tokens,
+        total_tokens=first.prompt_tokens + completion_tokens,
+        completion_tokens_details={"reasoning_tokens": reasoning_tokens},
+    )
+    accounting.response_source = lambda: "\n\n".join(
+        (choice.message.reasoning_content or "") + (choice.message.content or "") + "".join(
+            call.function.arguments for call in choice.message.tool_calls or []
+        )
+        for choice in choices
+    )
+    accounting.input_tokens = usage.prompt_tokens
+    accounting.output_tokens = usage.completion_tokens
+    accounting.finish("ok")
+    return ChatCompletionResponse(id=responses[0].id, model=request.model, choices=choices, usage=usage)
+
+
+async def create_streaming_response(
+    request: ChatCompletionRequest,
+    http_request: Optional[Request] = None,
+    lease: Optional[StreamLease] = None,
+    conversation_key: Optional[str] = None,
+):
     """
     Handles streaming chat completion requests.
     真正的流式处理：在同一个上下文中保持 HTTP 连接，边收边推。
+
+    lease 为该流占用的每 Key 并发名额，随流结束释放；conversation_key 为客户端对话的缓存键
     """
     
+    tool_names = openai_tool_name_map(request)
+    accounting = RequestAccounting("openai", request.model, stream=True)
+    accounting.request_source = client_request_source(request)
+    outcome = StreamOutcome("openai", request.model, accounting, lease)
+    # 在返回响应之前复制请求信息，保活和写出只依赖 lifecycle
+    lifecycle = StreamLifecycle()
+    prompt_text = " ".join([msg.get_content_text() for msg in request.messages])
+    # 在返回响应之前构建请求，请求无效时直接返回 4xx；开启 UPSTREAM_PREFETCH 时这里就会发起上游请求
+    request_data = build_codewhisperer_request(
+        request, tool_names, conversation_cache.lookup(conversation_key), conversation_cache.declared_tools(conversation_key)
+    )
+    upstream = UpstreamStream(request_data, accounting=accounting)
+
     async def generate_stream():
-        response_id = f"chatcmpl-{uuid.uuid4()}"
-        created = int(time.time())
+        handler = OpenAIStreamHandler(request.model, tool_names)
+        annotate_request(message_id=handler.response_id)
         parser = CodeWhispererStreamParser()
 
-        # --- 状态变量 ---
-        is_in_tool_call = False
-        sent_role = False
-        current_tool_call_index = 0
-        streamed_tool_calls_count = 0
-        content_buffer = ""
-        incomplete_tool_call = ""
-
-        # 准备请求 - 使用多账号 token 管理器
-        token = await token_manager.get_token()
-        if not token:
-            yield f"data: {json.dumps({'error': {'message': 'No access token available. Please check your KIRO_AUTH_CONFIG configuration.', 'type': 'authentication_error'}})}\n\n"
-            return
-
-        request_data = build_codewhisperer_request(request)
-        headers = {
-            "Authorization": f"Bearer {token}",
-            "Content-Type": "application/json",
-            "Accept": "text/event-stream"
-        }
-
-        # 使用 httpx.Timeout 分离连接超时和读取超时，避免长对话被截断
-        timeout = httpx.Timeout(connect=30.0, read=None, write=30.0, pool=30.0)
+        # 上游事件中带的结束原因（end_turn / max_tokens / tool_use），没有时为 None
+        upstream_stop_reason = None
+        # 从上游解析出的事件数，为 0 时返回错误而不是空的成功响应
+        parsed_event_count = 0
+        # 上游返回的全部文本、推理内容和工具参数，用于结束时统计 output token
+        completion_parts = []
+        reasoning_parts = []
+        # 按 max_completion_tokens / max_tokens 限制输出，达到上限后以 finish_reason=length 结束
+        output_budget = OutputTokenBudget(request.output_token_limit())
+        # 在代理侧执行请求的 stop，命中后以 finish_reason=stop 结束
+        stop_filter = StopSequenceFilter(request.stop)
+        # response_format json_object：去掉包住 JSON 的代码块
+        json_filter = JsonFenceFilter(json_mode_requested(request))
+        accounting.usage_source = lambda: (
+            estimate_tokens(prompt_text),
+            estimate_tokens("".join(completion_parts)) if completion_parts else 0,
+        )
+        accounting.response_source = lambda: "".join(completion_parts)
 
         try:
-            async with httpx.AsyncClient(timeout=timeout) as client:
-                # 支持 403 重试的循环
-                max_retries = 2
-                for attempt in range(max_retries):
-                    async with client.stream("POST", KIRO_BASE_URL, headers=headers, json=request_data) as response:
-                        logger.info(f"📤 STREAM RESPONSE STATUS: {response.status_code} (attempt {attempt + 1})")
-
-                        # 处理 403 - 刷新 token 并重试
-                        if response.status_code == 403 and attempt < max_retries - 1:
-                            logger.info("收到403响应，尝试刷新token...")
-                            new_token = await token_manager.refresh_tokens()
-                            if new_token:
-                                headers["Authorization"] = f"Bearer {new_token}"
-                                continue  # 重试
-                            else:
-                                # 尝试切换到下一个账号
-                                token_manager.mark_token_error()
-                                new_token = await token_manager.get_token()
-                                if new_token:
-                                    headers["Authorization"] = f"Bearer {new_token}"
-                                    continue
-                                yield f"data: {json.dumps({'error': {'message': 'Token refresh failed and no backup accounts available', 'type': 'authentication_error'}})}\n\n"
-                                return
-
-                        if response.status_code == 429:
-                            logger.warning("收到429响应（速率限制），尝试切换账号...")
-                            # 标记当前 token 已耗尽，切换到下一个账号
-                            token_manager.mark_token_exhausted("rate_limit_429")
-                            
-                            if attempt < max_retries - 1:
-                                new_token = await token_manager.get_token()
-                                if new_token:
-                                    headers["Authorization"] = f"Bearer {new_token}"
-                                    logger.info("已切换到新账号，重试请求...")
-                                    continue
-                            
-                            yield f"data: {json.dumps({'error': {'message': 'All accounts rate limited. Please try again later.', 'type': 'rate_limit_error'}})}\n\n"
-                            return
-
-                        if response.status_code != 200:
-                            yield f"data: {json.dumps({'error': {'message': f'API error: {response.status_code}', 'type': 'api_error'}})}\n\n"
-                            return
-
-                        # 真正的流式处理：边收边推
-                        async for chunk in response.aiter_bytes():
-                            events = parser.parse(chunk)
-                            
-                            for event in events:
-                                # --- 处理结构化工具调用事件 ---
-                                if "name" in event and "toolUseId" in event:
-                                    logger.info(f"🎯 STREAM: Found structured tool call event: {event}")
-                                    if not is_in_tool_call:
-                                        is_in_tool_call = True
-                                        
-                                        delta_start = {
-                                            "tool_calls": [{
-                                                "index": current_tool_call_index,
-                                                "id": event.get("toolUseId"),
-                                                "type": "function",
-                                                "function": {"name": event.get("name"), "arguments": ""}
-                                            }]
-                                        }
-                                        if not sent_role:
-                                            delta_start["role"] = "assistant"
-                                            sent_role = True
-
-                                        start_chunk = ChatCompletionStreamResponse(
-                                            id=response_id, model=request.model, created=created,
-                                            choices=[StreamChoice(index=0, delta=delta_start)]
-                                        )
-                                        yield f"data: {start_chunk.model_dump_json(exclude_none=True)}\n\n"
-
-                                    if "input" in event:
-                                        arg_chunk_str = event.get("input", "")
-                                        if arg_chunk_str:
-                                            arg_chunk_delta = {
-                                                "tool_calls": [{
-                                                    "index": current_tool_call_index,
-                                                    "function": {"arguments": arg_chunk_str}
-                                                }]
-                                            }
-                                            arg_chunk_resp = ChatCompletionStreamResponse(
-                                                id=response_id, model=request.model, created=created,
-                                                choices=[StreamChoice(index=0, delta=arg_chunk_delta)]
-                                            )
-                                            yield f"data: {arg_chunk_resp.model_dump_json(exclude_none=True)}\n\n"
-
-                                    if event.get("stop"):
-                                        is_in_tool_call = False
-                                        current_tool_call_index += 1
-                                        streamed_tool_calls_count += 1
-
-                                # --- 处理普通文本内容事件 ---
-                                elif "content" in event and not is_in_tool_call:
-                                    content_text = event.get("content", "")
-                                    if content_text:
-                                        # 如果有不完整的工具调用，先合并再处理
-                                        if incomplete_tool_call:
-                                            content_buffer = incomplete_tool_call + content_text
-                                            incomplete_tool_call = ""
-                                        else:
-                                            content_buffer += content_text
-                                        
-                                        # 处理 bracket 格式的工具调用
-                                        while True:
-                                            called_start = content_buffer.find("[Called")
-                                            
-                                            if called_start == -1:
-                                                # 没有工具调用，发送所有内容
-                                                if content_buffer:
-                                                    delta_content = {"content": content_buffer}
-                                                    if not sent_role:
-                                                        delta_content["role"] = "assistant"
-                                                        sent_role = True
-                                                    
-                                                    content_chunk = ChatCompletionStreamResponse(
-                                                        id=response_id, model=request.model, created=created,
-                                                        choices=[StreamChoice(index=0, delta=delta_content)]
-                                                    )
-                                                    yield f"data: {content_chunk.model_dump_json(exclude_none=True)}\n\n"
-                                                    content_buffer = ""
-                                                break
-                                            
-                                            # 发送 [Called 之前的文本
-                                            if called_start > 0:
-                                                text_before = content_buffer[:called_start]
-                                                if text_before.strip():
-                                                    delta_content = {"content": text_before}
-                                                    if not sent_role:
-                                                        delta_content["role"] = "assistant"
-                                                        sent_role = True
-                                                    
-                                                    content_chunk = ChatCompletionStreamResponse(
-                                                        id=response_id, model=request.model, created=created,
-                                                        choices=[StreamChoice(index=0, delta=delta_content)]
-                                                    )
-                                                    yield f"data: {content_chunk.model_dump_json(exclude_none=True)}\n\n"
-                                            
-                                            # 查找对应的结束 ]
-                                            remaining_text = content_buffer[called_start:]
-                                            bracket_end = find_matching_bracket(remaining_text, 0)
-                                            
-                                            if bracket_end == -1:
-                                                # 工具调用不完整，保留等待更多数据
-                                                incomplete_tool_call = remaining_text
-                                                content_buffer = ""
-                                                break
-                                            
-                                            # 提取完整的工具调用
-                                            tool_call_text = remaining_text[:bracket_end + 1]
-                                            parsed_call = parse_single_tool_call(tool_call_text)
-                                            
-                                            if parsed_call:
-                                                delta_tool = {
-                                                    "tool_calls": [{
-                                                        "index": current_tool_call_index,
-                                                        "id": parsed_call.id,
-                                                        "type": "function",
-                                                        "function": {
-                                                            "name": parsed_call.function["name"],
-                                                            "arguments": parsed_call.function["arguments"]
-                                                        }
-                                                    }]
-                                                }
-                                                if not sent_role:
-                                                    delta_tool["role"] = "assistant"
-                                                    sent_role = True
-                                                
-                                                logger.info(f"📤 STREAM: Sending tool call: {parsed_call.function['name']}")
-                                                tool_chunk = ChatCompletionStreamResponse(
-                                                    id=response_id, model=request.model, created=created,
-                                                    choices=[StreamChoice(index=0, delta=delta_tool)]
-                                                )
-                                                yield f"data: {tool_chunk.model_dump_json(exclude_none=True)}\n\n"
-                                                current_tool_call_index += 1
-                                                streamed_tool_calls_count += 1
-                                            
-                                            # 更新缓冲区，继续处理剩余内容
-                                            content_buffer = remaining_text[bracket_end + 1:]
-                                            incomplete_tool_call = ""
-
-                        # 流结束后处理 parser buffer 中的残留数据
-                        logger.info(f"🔄 Stream ended, parser buffer remaining: {parser.get_remaining_buffer_size()} bytes")
-                        
-                        if parser.has_remaining_data():
-                            flush_events = parser.flush()
-                            logger.info(f"🔄 Flushed {len(flush_events)} events from parser buffer")
-                            
-                            for event in flush_events:
-                                if "content" in event and not is_in_tool_call:
-                                    content_text = event.get("content", "")
-                                    if content_text:
-                                        content_buffer += content_text
-                                        logger.info(f"📝 Recovered content from flush: {len(content_text)} chars")
-                        
-                        # 处理 incomplete_tool_call 中的残留内容
-                        if incomplete_tool_call:
-                            content_buffer = incomplete_tool_call + content_buffer
-                            incomplete_tool_call = ""
-                            
-                            called_start = content_buffer.find("[Called")
-                            if called_start == 0:
-                                bracket_end = find_matching_bracket(content_buffer, 0)
-                                if bracket_end != -1:
-                                    tool_call_text = content_buffer[:bracket_end + 1]
-                                    parsed_call = parse_single_tool_call(tool_call_text)
-                                    
-                                    if parsed_call:
-                                        delta_tool = {
-                                            "tool_calls": [{
-                                                "index": current_tool_call_index,
-                                                "id": parsed_call.id,
-                                                "type": "function",
-                                                "function": {
-                                                    "name": parsed_call.function["name"],
-                                                    "arguments": parsed_call.function["arguments"]
-                                                }
-                                            }]
-                                        }
-                                        if not sent_role:
-                                            delta_tool["role"] = "assistant"
-                                            sent_role = True
-                                        
-                                        tool_chunk = ChatCompletionStreamResponse(
-                                            id=response_id, model=request.model, created=created,
-                                            choices=[StreamChoice(index=0, delta=delta_tool)]
-                                        )
-                                        yield f"data: {tool_chunk.model_dump_json(exclude_none=True)}\n\n"
-                                        current_tool_call_index += 1
-                                        streamed_tool_calls_count += 1
-                                        
-                                        content_buffer = content_buffer[bracket_end + 1:]
-
-                        # 发送任何剩余的内容
-                        if content_buffer.strip():
-                            logger.info(f"📤 Sending remaining content: {len(content_buffer)} chars")
-                            delta_content = {"content": content_buffer}
-                            if not sent_role:
-                                delta_content["role"] = "assistant"
-                                sent_role = True
-                            
-                            content_chunk = ChatCompletionStreamResponse(
-                                id=response_id, model=request.model, created=created,
-                                choices=[StreamChoice(index=0, delta=delta_content)]
-                            )
-                            yield f"data: {content_chunk.model_dump_json(exclude_none=True)}\n\n"
-
-                        # --- 流结束 ---
-                        finish_reason = "tool_calls" if streamed_tool_calls_count > 0 else "stop"
-                        logger.info(f"🏁 STREAM: Completed with {streamed_tool_calls_count} tool calls, finish_reason={finish_reason}")
-                        end_chunk = ChatCompletionStreamResponse(
-                            id=response_id, model=request.model, created=created,
-                            choices=[StreamChoice(index=0, delta={}, finish_reason=finish_reason)]
-                        )
-                        yield f"data: {end_chunk.model_dump_json(exclude_none=True)}\n\n"
-                        
-                        yield "data: [DONE]\n\n"
-                        return  # 成功完成，退出重试循环
+            # 403 刷新重试和 429 切换账号都在这里完成，此时尚未向客户端写出任何数据
+            try:
+                response = await upstream.open()
+            except UpstreamError as e:
+                record_upstream_error(e)
+                reason = StreamEndReason.INVALID_REQUEST if is_client_caused(e) else StreamEndReason.UPSTREAM_ERROR
+                outcome.end(reason, f"status={e.status_code}")
+                yield f"data: {json.dumps(with_debug({'error': {'message': e.message, 'type': e.error_type}}, http_request))}\n\n"
+                yield "data: [DONE]\n\n"
+                return
+            conversation_cache.remember(
+                conversation_key, request_data["conversationState"]["conversationId"], openai_tool_fingerprints(request)
+            )
 
+            # 真正的流式处理：边收边推
+            sample = request_sampler.start(
+                accounting.request_id, "openai", request.model_dump(exclude_none=True), request_data
+            )
+            async for chunk in with_stream_timeouts(iter_response_bytes(response)):
+                if sample:
+                    sample.feed(chunk)
+                for event in json_filter.filter(stop_filter.filter(parser.parse(chunk))):
+                    parsed_event_count += 1
+                    if output_budget.exhausted:
+                        break
+                    if event.get("content"):
+                        event["content"] = output_budget.consume(event["content"])
+                    elif isinstance(event.get("input"), str):
+                        event["input"] = output_budget.consume(event["input"])
+                    if event.get("content"):
+                        completion_parts.append(event["content"])
+                    elif isinstance(event.get("input"), str):
+                        completion_parts.append(event["input"])
+                    stop_reason = event_stop_reason(event)
+                    if stop_reason:
+                        upstream_stop_reason = normalize_stop_reason(stop_reason, "openai")
+                    # 推理内容（extended thinking）以 reasoning_content 增量发出
+                    reasoning = extract_reasoning(event)
+                    if reasoning:
+                        reasoning.text = output_budget.consume(reasoning.text)
+                        if reasoning.text:
+                            completion_parts.append(reasoning.text)
+                            reasoning_parts.append(reasoning.text)
+                    for data in handler.handle_event(event, reasoning):
+                        yield data
+
+                if output_budget.exhausted:
+                    # 达到输出上限：不再读取上游，剩余缓冲内容照常发出后以 length 结束
+                    upstream_stop_reason = "max_tokens"
+                    outcome.end(StreamEndReason.MAX_TOKENS_ENFORCED, f"max_tokens={output_budget.limit}")
+                    break
+                if stop_filter.matched:
+                    # 命中停止序列：不再读取上游，以 finish_reason=stop 结束
+                    upstream_stop_reason = "stop_sequence"
+                    outcome.end(StreamEndReason.STOP_SEQUENCE, f"stop_sequence={stop_filter.matched!r}")
+                    break
+
+            # 只有完整读完上游响应的请求才写出 fixture
+            if sample and not output_budget.exhausted and not stop_filter.matched:
+                sample.finish(response.status_code)
+
+            # 流结束后处理 parser buffer 中的残留数据
+            logger.info(f"🔄 Stream ended, parser buffer remaining: {parser.get_remaining_buffer_size()} bytes")
+                    
+            if not output_budget.exhausted and not stop_filter.matched:
+                flush_events = list(stop_filter.filter(parser.flush())) if parser.has_remaining_data() else []
+                logger.info(f"🔄 Flushed {len(flush_events)} events from parser buffer")
+                if stop_filter.matched:
+                    upstream_stop_reason = "stop_sequence"
+                    outcome.end(StreamEndReason.STOP_SEQUENCE, f"stop_sequence={stop_filter.matched!r}")
+                # 停止序列和 JSON 代码块过滤暂时保留的文本在最后放出
+                flush_events += stop_filter.flush()
+                flush_events = list(json_filter.filter(flush_events)) + json_filter.flush()
+                        
+                parsed_event_count += len(flush_events)
+                for event in flush_events:
+                    if "content" in event and not handler.is_in_tool_call:
+                        content_text = output_budget.consume(event.get("content", ""))
+                        if content_text:
+                            completion_parts.append(content_text)
+                            handler.append_text(content_text)
+                            logger.info(f"📝 Recovered content from flush: {len(content_text)} chars")
+                if output_budget.exhausted:
+                    upstream_stop_reason = "max_tokens"
+                    outcome.end(StreamEndReason.MAX_TOKENS_ENFORCED, f"max_tokens={output_budget.limit}")
+
+            # 残留的 bracket 工具调用和文本，以及未结束的工具调用
+            for data in handler.finish():
+                yield data
+            if json_filter.enabled and parsed_event_count and not handler.streamed_tool_calls_count:
+                check_json_output("".join(completion_parts).strip())
+
+            # 上游返回 200 但没有任何事件：返回错误，而不是只有 [DONE] 的空响应
+            if parsed_event_count == 0 and not handler.sent_role:
+                logger.error("❌ STREAM: 上游流没有返回任何事件")
+                outcome.end(StreamEndReason.UPSTREAM_ERROR, "empty upstream stream")
+                yield f"data: {json.dumps(with_debug({'error': {'message': localize('upstream_empty_stream'), 'type': 'api_error'}}, http_request))}\n\n"
+                yield "data: [DONE]\n\n"
+                return
+
+            # --- 流结束 ---
+            # 每个流恰好发出一个结束 chunk
+            finish_reason = resolve_finish_reason(upstream_stop_reason, handler.streamed_tool_calls_count)
+            logger.info(
+                f"🏁 STREAM: Completed with {handler.streamed_tool_calls_count} tool calls, "
+                f"upstream_stop_reason={upstream_stop_reason}, finish_reason={finish_reason}"
+            )
+            yield handler.final_chunk(finish_reason, stop_filter.matched)
+
+            if request.include_stream_usage():
+                prompt_tokens, completion_tokens = accounting.usage_source()
+                yield handler.usage_chunk(Usage(
+                    prompt_tokens=prompt_tokens,
+                    completion_tokens=completion_tokens,
+                    total_tokens=prompt_tokens + completion_tokens,
+                    completion_tokens_details={
+                        "reasoning_tokens": estimate_tokens("".join(reasoning_parts)) if reasoning_parts else 0
+                    },
+                ))
+                    
+            yield "data: [DONE]\n\n"
+
+        except StreamTimeoutError as e:
+            # 上游卡住：报告错误后仍然发出 [DONE]，客户端不会一直等待结束标记
+            logger.error(f"⏱️ STREAM: {e}")
+            outcome.end(e.end_reason, str(e))
+            yield f"data: {json.dumps(with_debug({'error': {'message': str(e), 'type': 'timeout_error'}}, http_request))}\n\n"
+            yield "data: [DONE]\n\n"
+        except BlockLimitError as e:
+            # 上游发出过多的工具调用：与超时一样在流内报错并发出 [DONE]
+            outcome.end(StreamEndReason.BLOCK_LIMIT, f"{e} (tool_calls={e.tool_calls})")
+            yield f"data: {json.dumps(with_debug({'error': {'message': str(e), 'type': 'api_error'}}, http_request))}\n\n"
+            yield "data: [DONE]\n\n"
+        except EventStreamErrorBudgetExhausted as e:
+            # 上游数据连续无法解析：不再读取上游，在流内报错并发出 [DONE]
+            logger.error(f"❌ STREAM: {e}")
+            outcome.end(StreamEndReason.ERROR_BUDGET_EXHAUSTED, str(e))
+            yield f"data: {json.dumps(with_debug({'error': {'message': str(e), 'type': 'api_error'}}, http_request))}\n\n"
+            yield "data: [DONE]\n\n"
         except httpx.HTTPStatusError as e:
             logger.error(f"HTTP ERROR in stream: {e}")
+            outcome.end(StreamEndReason.UPSTREAM_ERROR, str(e))
             yield f"data: {json.dumps({'error': {'message': str(e), 'type': 'api_error'}})}\n\n"
+            yield "data: [DONE]\n\n"
         except Exception as e:
             logger.error(f"Stream error: {e}")
             import traceback
             traceback.print_exc()
+            outcome.end(StreamEndReason.UPSTREAM_ERROR, str(e))
             yield f"data: {json.dumps({'error': {'message': str(e), 'type': 'internal_error'}})}\n\n"
-
-    return StreamingResponse(
-        generate_stream(),
+            yield "data: [DONE]\n\n"
+        finally:
+            await upstream.aclose()
+
+    return SSEResponse(
+        track_stream(
+            keepalive_stream(generate_stream(), OPENAI_KEEPALIVE_FRAME, OPENAI_FINAL_MARKER, lifecycle=lifecycle),
+            outcome, http_request,
+        ),
+        outcome=outcome,
+        lifecycle=lifecycle,
         media_type="text/event-stream",
         headers={
             "Cache-Control": "no-cache",
             "Connection": "keep-alive",
             "Content-Type": "text/event-stream"
-        }
+        },
+        background=BackgroundTask(release_stream_resources, outcome, upstream),
     )
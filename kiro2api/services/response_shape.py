@@ -0,0 +1,48 @@
+"""
+非流式响应字段裁剪
+默认返回完整响应；客户端通过 X-Response-Shape: lean（或 RESPONSE_SHAPE=lean）选择精简形态时，
+省略 LEAN_RESPONSE_OMIT_FIELDS 中的顶层字段（usage、system_fingerprint 等）以及值为 null 的可选字段
+"""
+
+import logging
+from typing import Any, Dict, Iterable, Optional
+
+from config import RESPONSE_SHAPE, LEAN_RESPONSE_OMIT_FIELDS
+
+logger = logging.getLogger(__name__)
+
+RESPONSE_SHAPE_HEADER = "x-response-shape"
+SHAPE_FULL = "full"
+SHAPE_LEAN = "lean"
+
+# 客户端解析响应必需的字段，即使配置在 LEAN_RESPONSE_OMIT_FIELDS 中也不会省略
+REQUIRED_FIELDS = {"id", "object", "type", "role", "model", "choices", "content"}
+
+
+def resolve_response_shape(header_value: Optional[str]) -> str:
+    """请求头优先，其次 RESPONSE_SHAPE；无法识别的值按 full 处理"""
+    shape = (header_value or RESPONSE_SHAPE or SHAPE_FULL).strip().lower()
+    if shape not in (SHAPE_FULL, SHAPE_LEAN):
+        logger.warning(f"无法识别的响应形态 {shape!r}，使用完整响应")
+        return SHAPE_FULL
+    return shape
+
+
+def _drop_none(value: Any) -> Any:
+    if isinstance(value, dict):
+        return {key: _drop_none(item) for key, item in value.items() if item is not None}
+    if isinstance(value, list):
+        return [_drop_none(item) for item in value]
+    return value
+
+
+def project_response(
+    body: Dict[str, Any],
+    shape: str,
+    omit_fields: Iterable[str] = LEAN_RESPONSE_OMIT_FIELDS,
+) -> Dict[str, Any]:
+    """按响应形态裁剪响应体，full 时原样返回"""
+    if shape != SHAPE_LEAN:
+        return body
+    omitted = set(omit_fields) - REQUIRED_FIELDS
+    return _drop_none({key: value for key, value in body.items() if key not in omitted})
@@ -0,0 +1,92 @@
+"""
+优雅关闭
+收到 SIGINT / SIGTERM 后进入排空状态：
+
+- 新请求直接返回 503（code: shutting_down，带 Connection: close，客户端重连后会被负载均衡分配到其他实例），/health 返回 down
+- 已经开始的流式响应继续输出，直到发出 message_stop / [DONE] 正常结束，最多等待 SHUTDOWN_DRAIN_TIMEOUT_SECONDS
+- 排空结束（或超时）后再交给 uvicorn 关闭连接；超时仍未结束的流会被中断
+
+进行中的流由 track_stream 计数，两条流式路径共用；再次发送信号会跳过等待立即退出
+"""
+
+import time
+import asyncio
+import logging
+from typing import Callable, Optional
+
+from fastapi.responses import JSONResponse
+
+from config import SHUTDOWN_DRAIN_TIMEOUT_SECONDS
+from errors import respond_error
+
+logger = logging.getLogger(__name__)
+
+# 排空期间仍然放行的路径（负载均衡需要看到 down 状态）
+DRAIN_EXEMPT_PATHS = ("/health",)
+
+
+class ShutdownCoordinator:
+    def __init__(self):
+        self.draining = False
+        self.in_flight_streams = 0
+
+    def begin_drain(self):
+        if not self.draining:
+            self.draining = True
+            logger.warning(f"🛑 开始优雅关闭：拒绝新请求，等待 {self.in_flight_streams} 个进行中的流结束")
+
+    def stream_started(self):
+        self.in_flight_streams += 1
+
+    def stream_finished(self):
+        self.in_flight_streams -= 1
+
+    async def wait_for_streams(self, timeout: float, should_abort: Optional[Callable[[], bool]] = None) -> bool:
+        """等待进行中的流全部结束，全部结束时返回 True，超时或 should_abort() 为真时返回 False"""
+        deadline = time.monotonic() + timeout
+        while self.in_flight_streams > 0:
+            if time.monotonic() >= deadline or (should_abort and should_abort()):
+                logger.warning(f"⚠️ 优雅关闭等待结束，仍有 {self.in_flight_streams} 个流未完成，将被中断")
+                return False
+            await asyncio.sleep(0.1)
+        logger.info("✅ 进行中的流已全部结束")
+        return True
+
+
+# 全局单例
+shutdown_coordinator = ShutdownCoordinator()
+
+
+class ShutdownGuardMiddleware:
+    """ASGI 中间件：排空期间拒绝新请求（503 shutting_down）"""
+
+    def __init__(self, app, coordinator: ShutdownCoordinator = shutdown_coordinator):
+        self.app = app
+        self.coordinator = coordinator
+
+    async def __call__(self, scope, receive, send):
+        if scope["type"] != "http" or not self.coordinator.draining or scope.get("path") in DRAIN_EXEMPT_PATHS:
+            await self.app(scope, receive, send)
+            return
+        error = respond_error(503, "shutting_down", "api_error", api_code="shutting_down")
+        response = JSONResponse(
+            status_code=error.status_code, content={"detail": error.detail}, headers={"Connection": "close"}
+        )
+        await response(scope, receive, send)
+
+
+def run_server(app, host: str, port: int):
+    """启动 uvicorn，收到退出信号时先排空进行中的流再关闭"""
+    import uvicorn
+
+    class GracefulServer(uvicorn.Server):
+        def handle_exit(self, sig, frame):
+            shutdown_coordinator.begin_drain()
+            super().handle_exit(sig, frame)
+
+        async def shutdown(self, sockets=None):
+            # 此时监听套接字尚未关闭，排空期间到达的新请求会收到 503
+            await shutdown_coordinator.wait_for_streams(SHUTDOWN_DRAIN_TIMEOUT_SECONDS, lambda: self.force_exit)
+            await super().shutdown(sockets=sockets)
+
+    GracefulServer(uvicorn.Config(app, host=host, port=port, timeout_graceful_shutdown=1)).run()
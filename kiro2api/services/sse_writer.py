@@ -0,0 +1,114 @@
+"""
+SSE 响应写出
+StreamingResponse 写出失败（客户端已断开、连接被重置）时只是把异常抛给服务器，流生成器不会被关闭：
+上游连接和并发名额要等生成器被垃圾回收才释放，background 清理任务也不会执行。
+
+SSEResponse 检查每一次写出：写出失败时转换为 ClientGone，随即关闭流生成器（track_stream 记录 client_disconnect，
+内部生成器在 finally 中关闭上游连接），再照常执行 background 清理，不再继续读取上游和格式化事件。
+写出之前的断开检测仍由 track_stream 完成（服务器在连接断开后可能静默丢弃写出，而不是报错）
+
+流的生命周期由 StreamLifecycle 表示：在返回响应之前创建，复制后台逻辑需要的请求信息（request_id），
+之后不再依赖 Request 对象。所有写出（事件、保活帧、错误事件）都经过 StreamLifecycle.send，
+流结束（正常结束、写出失败、异常）时关闭；关闭之后的写出是程序错误：默认记录错误日志并丢弃，
+STREAM_LIFECYCLE_STRICT=true（调试用）时抛出 StreamClosedError，便于在测试中发现
+"""
+
+import asyncio
+import logging
+from typing import Any, Optional
+
+from fastapi.responses import StreamingResponse
+
+from config import STREAM_LIFECYCLE_STRICT
+from services.request_context import current_request_context
+from services.stream_outcome import StreamEndReason
+
+logger = logging.getLogger(__name__)
+
+
+class ClientGone(Exception):
+    """写出 SSE 事件失败：客户端已经断开"""
+
+
+class StreamClosedError(RuntimeError):
+    """流的生命周期已经结束后仍尝试写出"""
+
+
+class StreamLifecycle:
+    """单个 SSE 流的生命周期；在返回响应之前创建，保活等后台逻辑只依赖它而不依赖 Request"""
+
+    def __init__(self, request_id: Optional[str] = None, strict: bool = STREAM_LIFECYCLE_STRICT):
+        context = current_request_context()
+        self.request_id = request_id or (context.request_id if context else None)
+        self.strict = strict
+        self.closed = False
+        self.close_reason: Optional[str] = None
+        # 关闭之后被拒绝的写出次数
+        self.rejected_writes = 0
+        self.done = asyncio.Event()
+
+    def close(self, reason: str = "finished"):
+        """结束生命周期，只有第一次调用生效"""
+        if self.closed:
+            return
+        self.closed = True
+        self.close_reason = reason
+        self.done.set()
+
+    async def send(self, send, message):
+        """写出一条 ASGI 消息；已关闭时拒绝写出，写出失败时抛出 ClientGone"""
+        if self.closed:
+            self.rejected_writes += 1
+            error = StreamClosedError(
+                f"write after stream closed (request_id={self.request_id}, reason={self.close_reason})"
+            )
+            if self.strict:
+                raise error
+            logger.error(f"❌ {error}")
+            return
+        try:
+            await send(message)
+        except Exception as e:
+            raise ClientGone(str(e) or type(e).__name__) from e
+
+
+class SSEResponse(StreamingResponse):
+    """写出失败时立即停止流的 StreamingResponse；传入 outcome 时把写出错误记为 client_disconnect 的详情"""
+
+    def __init__(
+        self,
+        content,
+        *args,
+        outcome: Optional[Any] = None,
+        lifecycle: Optional[StreamLifecycle] = None,
+        **kwargs,
+    ):
+        super().__init__(content, *args, **kwargs)
+        self.outcome = outcome
+        self.lifecycle = lifecycle or StreamLifecycle()
+        self.client_gone = False
+
+    async def _write(self, send, message):
+        await self.lifecycle.send(send, message)
+
+    async def stream_response(self, send) -> None:
+        try:
+            await self._write(send, {"type": "http.response.start", "status": self.status_code, "headers": self.raw_headers})
+            async for chunk in self.body_iterator:
+                if not isinstance(chunk, (bytes, memoryview)):
+                    chunk = chunk.encode(self.charset)
+                await self._write(send, {"type": "http.response.body", "body": chunk, "more_body": True})
+            await self._write(send, {"type": "http.response.body", "body": b"", "more_body": False})
+            self.lifecycle.close()
+        except ClientGone as e:
+            self.client_gone = True
+            self.lifecycle.close("client_gone")
+            logger.info(f"🔌 写出 SSE 事件失败，客户端已断开 (request_id={self.lifecycle.request_id}): {e}")
+            if self.outcome is not None:
+                self.outcome.end(StreamEndReason.CLIENT_DISCONNECT, f"write failed: {e}")
+            aclose = getattr(self.body_iterator, "aclose", None)
+            if aclose is not None:
+                await aclose()
+        finally:
+            # 异常或任务取消（客户端断开时服务器取消响应任务）同样结束生命周期
+            self.lifecycle.close("aborted")
@@ -0,0 +1,89 @@
+"""
+结束原因映射
+上游（Claude 语义）的结束原因统一在这里归一化，再映射为各接口的结束原因：
+
+- 已知的结束原因（end_turn / max_tokens / stop_sequence / tool_use）原样使用
+- 无法识别的结束状态（例如将来的 pause_turn 或其他等待中的状态）不会被悄悄吞掉：
+  对客户端使用 UNKNOWN_STOP_REASON_FALLBACK（默认 end_turn），同时记录警告日志、请求级警告（随访问日志输出）
+  和 kiro2api_unknown_stop_reasons_total 指标，便于及时发现上游的新行为。
+  指标只用固定的 reason="other" 标签（原始值来自上游，不可控，不能作为标签），原始值见日志
+"""
+
+import logging
+from typing import Any, Optional
+
+from config import UNKNOWN_STOP_REASON_FALLBACK
+from services.metrics import unknown_stop_reasons_total
+from services.request_context import add_request_warning
+
+logger = logging.getLogger(__name__)
+
+KNOWN_STOP_REASONS = ("end_turn", "max_tokens", "stop_sequence", "tool_use")
+DEFAULT_STOP_REASON = "end_turn"
+# 指标中所有无法识别的结束原因共用的标签值
+OTHER_STOP_REASON_LABEL = "other"
+
+# 上游（Claude 语义）的结束原因到 OpenAI finish_reason 的映射
+OPENAI_FINISH_REASONS = {
+    "end_turn": "stop",
+    "stop_sequence": "stop",
+    "max_tokens": "length",
+    "tool_use": "tool_calls",
+}
+
+
+def _fallback_stop_reason() -> str:
+    if UNKNOWN_STOP_REASON_FALLBACK in KNOWN_STOP_REASONS:
+        return UNKNOWN_STOP_REASON_FALLBACK
+    logger.warning(f"⚠️ 未知的 UNKNOWN_STOP_REASON_FALLBACK={UNKNOWN_STOP_REASON_FALLBACK}，使用 {DEFAULT_STOP_REASON}")
+    return DEFAULT_STOP_REASON
+
+
+UNKNOWN_STOP_REASON = _fallback_stop_reason()
+
+
+def upstream_stop_reason(event: Any) -> Optional[str]:
+    """
+    事件中带的结束原因（stopReason / stop_reason），没有时返回 None
+
+    message_delta 形式的事件把结束原因放在 delta 中：{"type": "message_delta", "delta": {"stop_reason": ...}}
+    """
+    if not isinstance(event, dict):
+        return None
+    stop_reason = event.get("stopReason") or event.get("stop_reason")
+    delta = event.get("delta")
+    if not stop_reason and isinstance(delta, dict):
+        stop_reason = delta.get("stopReason") or delta.get("stop_reason")
+    return stop_reason if isinstance(stop_reason, str) and stop_reason else None
+
+
+def normalize_stop_reason(raw: Optional[str], api: str) -> Optional[str]:
+    """
+    把上游给出的结束原因归一化为已知的 Claude 结束原因；raw 为空时返回 None（由调用方决定默认值）
+
+    无法识别的结束状态按 UNKNOWN_STOP_REASON 处理，并记录日志、请求级警告和指标
+    """
+    if not raw:
+        return None
+    reason = raw.strip().lower()
+    if reason in KNOWN_STOP_REASONS:
+        return reason
+    logger.warning(f"⚠️ 上游返回了无法识别的结束原因: {raw!r}（{api}），按 {UNKNOWN_STOP_REASON} 处理")
+    add_request_warning(f"unknown upstream stop reason {raw!r} mapped to {UNKNOWN_STOP_REASON}")
+    unknown_stop_reasons_total.inc(api=api, reason=OTHER_STOP_REASON_LABEL)
+    return UNKNOWN_STOP_REASON
+
+
+def resolve_finish_reason(upstream_stop_reason: Optional[str], tool_calls_count: int) -> str:
+    """
+    决定流式响应最后一个 chunk 的 finish_reason（upstream_stop_reason 应已经过 normalize_stop_reason）
+
+    上游明确给出 max_tokens 时返回 length；否则只要发出过工具调用就是 tool_calls；
+    其余情况使用上游的结束原因，上游没有给出时为 stop
+    """
+    mapped = OPENAI_FINISH_REASONS.get(upstream_stop_reason or "")
+    if mapped == "length":
+        return mapped
+    if tool_calls_count > 0:
+        return "tool_calls"
+    return mapped or "stop"
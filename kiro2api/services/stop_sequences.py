@@ -0,0 +1,109 @@
+"""
+停止序列（Anthropic stop_sequences / OpenAI stop）
+上游请求不支持停止序列，由代理在上游文本事件上执行：
+
+- 文本事件经过 StopSequenceFilter 后才交给各接口的转换逻辑，流式和非流式路径共用
+- 命中时文本截断在匹配位置之前（停止序列本身不输出），filter 停止产出事件，调用方据此停止读取上游，
+  Claude 接口返回 stop_reason=stop_sequence 和命中的 stop_sequence，OpenAI 接口返回 finish_reason=stop
+- 停止序列可能跨越两个文本事件：文本末尾可能是某个停止序列开头的部分会暂时保留，与下一段文本合并后再判断；
+  遇到非文本事件（工具调用、推理内容等）或上游结束时原样放出
+"""
+
+from typing import Any, AsyncIterator, Dict, Iterable, Iterator, List, Optional, Union
+
+
+def normalize_stop_sequences(value: Optional[Union[str, List[str]]]) -> List[str]:
+    """OpenAI 的 stop 可以是字符串或数组；忽略空字符串和重复项"""
+    if value is None:
+        return []
+    if isinstance(value, str):
+        value = [value]
+    sequences: List[str] = []
+    for item in value:
+        if isinstance(item, str) and item and item not in sequences:
+            sequences.append(item)
+    return sequences
+
+
+class StopSequenceFilter:
+    """在上游事件流上执行停止序列（没有停止序列时原样透传）"""
+
+    def __init__(self, sequences: Optional[Union[str, List[str]]] = None):
+        self.sequences = normalize_stop_sequences(sequences)
+        self._max_len = max((len(s) for s in self.sequences), default=0)
+        # 暂时保留的文本（可能是某个停止序列的开头）
+        self._held = ""
+        # 命中的停止序列
+        self.matched: Optional[str] = None
+
+    def _held_suffix_len(self, text: str) -> int:
+        """text 末尾最长的、是某个停止序列真前缀的部分的长度"""
+        for size in range(min(self._max_len - 1, len(text)), 0, -1):
+            suffix = text[-size:]
+            if any(s.startswith(suffix) for s in self.sequences):
+                return size
+        return 0
+
+    def feed_text(self, text: str) -> str:
+        """输入一段文本，返回现在可以输出的部分；命中时返回匹配位置之前的文本并设置 matched"""
+        if self.matched:
+            return ""
+        if not self.sequences:
+            return text
+        buffer = self._held + text
+        first: Optional[int] = None
+        for sequence in self.sequences:
+            index = buffer.find(sequence)
+            if index != -1 and (first is None or index < first):
+                first, self.matched = index, sequence
+        if first is not None:
+            self._held = ""
+            return buffer[:first]
+        hold = self._held_suffix_len(buffer)
+        self._held = buffer[len(buffer) - hold:] if hold else ""
+        return buffer[:len(buffer) - hold]
+
+    def take_held(self) -> str:
+        held, self._held = self._held, ""
+        return held
+
+    def filter(self, events: Iterable[Dict[str, Any]]) -> Iterator[Dict[str, Any]]:
+        """过滤一批上游事件；命中停止序列后不再产出任何事件"""
+        for event in events:
+            if self.matched:
+                return
+            content = event.get("content")
+            if not self.sequences:
+                yield event
+            elif isinstance(content, str):
+                text = self.feed_text(content)
+                # 全部被暂时保留的文本事件不产出，避免提前打开空的文本块
+                if text or not content:
+                    yield dict(event, content=text)
+            else:
+                held = self.take_held()
+                if held:
+                    yield {"content": held}
+                yield event
+
+    def flush(self) -> List[Dict[str, Any]]:
+        """上游结束（且没有命中）时放出保留的文本"""
+        held = "" if self.matched else self.take_held()
+        return [{"content": held}] if held else []
+
+    async def filter_async(self, events: AsyncIterator[Dict[str, Any]]) -> AsyncIterator[Dict[str, Any]]:
+        """
+        过滤异步事件流，上游结束时放出保留的文本；命中停止序列后关闭上游事件流，不再读取
+
+        调用方提前关闭本生成器时也会关闭上游事件流
+        """
+        try:
+            async for event in events:
+                for filtered in self.filter([event]):
+                    yield filtered
+                if self.matched:
+                    return
+            for filtered in self.flush():
+                yield filtered
+        finally:
+            await events.aclose()
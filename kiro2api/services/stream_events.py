@@ -0,0 +1,89 @@
+"""
+流式响应的事件类型统计
+在 track_stream 中对每个写出的 SSE 帧分类计数，记录每类事件的个数和字节数（平均 / 最大），
+用于判断"回答一次性整块出现"之类的问题是上游只发了少量大增量，还是代理合并造成的。
+
+只按帧开头和少量子串分类，不解析 JSON；字节数为整个 SSE 帧的长度（包括 "data: " 前缀等固定开销）
+"""
+
+from typing import Dict, Optional
+
+
+def classify_claude_frame(frame: str) -> str:
+    """Claude 帧按 event 名称分类，content_block_delta 再按增量类型细分"""
+    if frame.startswith(":"):
+        return "comment"
+    if not frame.startswith("event: "):
+        return "other"
+    event = frame[len("event: "):frame.find("\n")] if "\n" in frame else frame[len("event: "):]
+    if event == "content_block_delta":
+        for delta_type in ("text_delta", "input_json_delta", "thinking_delta", "signature_delta"):
+            if f'"{delta_type}"' in frame:
+                return "tool_delta" if delta_type == "input_json_delta" else delta_type
+    return event.strip()
+
+
+def classify_openai_frame(frame: str) -> str:
+    """OpenAI chunk 按 delta 中的字段分类"""
+    if frame.startswith(": keepalive"):
+        return "ping"
+    if frame.startswith(":"):
+        return "comment"
+    if frame.startswith("data: [DONE]"):
+        return "done"
+    if frame.startswith('data: {"error"'):
+        return "error"
+    if '"tool_calls"' in frame:
+        return "tool_delta"
+    if '"reasoning_content"' in frame:
+        return "reasoning_delta"
+    if '"content"' in frame:
+        return "text_delta"
+    if '"finish_reason"' in frame:
+        return "finish"
+    if '"usage"' in frame:
+        return "usage"
+    return "other"
+
+
+FRAME_CLASSIFIERS = {
+    "claude": classify_claude_frame,
+    "openai": classify_openai_frame,
+}
+
+
+class StreamEventStats:
+    """单个流按事件类型统计的个数、总字节数和最大字节数"""
+
+    def __init__(self, api: str):
+        self._classify = FRAME_CLASSIFIERS.get(api, classify_openai_frame)
+        # 事件类型 -> [个数, 总字节数, 最大字节数]
+        self.types: Dict[str, list] = {}
+
+    def record(self, frame: str):
+        size = len(frame)
+        event_type = self._classify(frame)
+        entry = self.types.get(event_type)
+        if entry is None:
+            self.types[event_type] = [1, size, size]
+            return
+        entry[0] += 1
+        entry[1] += size
+        if size > entry[2]:
+            entry[2] = size
+
+    def summary(self) -> Dict[str, Dict[str, int]]:
+        """{事件类型: {"count", "avg_bytes", "max_bytes"}}，用于访问日志"""
+        return {
+            event_type: {"count": count, "avg_bytes": total // count, "max_bytes": largest}
+            for event_type, (count, total, largest) in sorted(self.types.items())
+        }
+
+    def compact(self) -> Optional[str]:
+        """单行形式（text_delta:12/85/240 表示 个数/平均字节/最大字节），用于结束摘要日志和 stats 注释"""
+        if not self.types:
+            return None
+        return ",".join(
+            f"{event_type}:{stats['count']}/{stats['avg_bytes']}/{stats['max_bytes']}"
+            for event_type, stats in self.summary().items()
+        )
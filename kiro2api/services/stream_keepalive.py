@@ -0,0 +1,78 @@
+"""
+流式响应保活
+上游在大上下文请求中可能 20-30 秒才返回第一个 token，期间连接上没有任何数据，部分客户端和中间代理会把空闲的 SSE 连接断开。
+超过 STREAM_KEEPALIVE_SECONDS 没有发出真实事件时补发一个保活帧：
+
+- Claude 接口：与官方 API 一致的 ping 事件
+- OpenAI 接口：没有对应事件，发送 SSE 注释行 ": keepalive"（标准客户端会忽略）
+
+发出最后一个事件（message_stop / [DONE]）之后不再发送保活帧。等待中的读取任务在每条退出路径
+（正常结束、异常、客户端断开导致的取消）上都会被取消并关闭内部生成器，不会在请求结束后残留；
+传入流的 StreamLifecycle 时，生命周期结束后立即停止，不再产出保活帧
+"""
+
+import asyncio
+import logging
+from typing import Any, AsyncIterator, Optional
+
+from config import STREAM_KEEPALIVE_SECONDS
+from services.claude_stream_handler import build_claude_ping_event
+
+logger = logging.getLogger(__name__)
+
+OPENAI_KEEPALIVE_FRAME = ": keepalive\n\n"
+OPENAI_FINAL_MARKER = "data: [DONE]"
+CLAUDE_FINAL_MARKER = "event: message_stop"
+
+
+def claude_keepalive_frame() -> str:
+    return build_claude_ping_event()
+
+
+async def keepalive_stream(
+    stream: AsyncIterator[str],
+    frame: str,
+    final_marker: Optional[str] = None,
+    interval: float = STREAM_KEEPALIVE_SECONDS,
+    lifecycle: Optional[Any] = None,
+) -> AsyncIterator[str]:
+    """
+    包装流式生成器，interval 秒内没有产出时补发 frame；interval <= 0 时原样透传
+
+    产出包含 final_marker 的帧之后不再补发保活帧；lifecycle（StreamLifecycle）已结束时停止
+    """
+    if interval <= 0:
+        async for item in stream:
+            yield item
+        return
+
+    finished = False
+    pending: Optional[asyncio.Task] = None
+    try:
+        while True:
+            if pending is None:
+                pending = asyncio.ensure_future(stream.__anext__())
+            done, _ = await asyncio.wait({pending}, timeout=None if finished else interval)
+            if not done:
+                if lifecycle is not None and lifecycle.closed:
+                    return
+                yield frame
+                continue
+            task, pending = pending, None
+            try:
+                item = task.result()
+            except StopAsyncIteration:
+                return
+            if final_marker and final_marker in item:
+                finished = True
+            yield item
+    finally:
+        if pending is not None and not pending.done():
+            pending.cancel()
+            try:
+                await pending
+            except (asyncio.CancelledError, StopAsyncIteration):
+                pass
+            except Exception as e:
+                logger.warning(f"取消流读取任务时出错: {e}")
+        await stream.aclose()
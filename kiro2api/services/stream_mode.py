@@ -0,0 +1,52 @@
+"""
+流式 / 非流式模式协商
+请求体的 stream 字段与 Accept 头冲突时，按 STREAM_MODE_RESOLUTION 决定以哪一方为准
+"""
+
+import logging
+from typing import Optional
+
+from config import STREAM_MODE_RESOLUTION
+
+logger = logging.getLogger(__name__)
+
+SSE_MEDIA_TYPE = "text/event-stream"
+JSON_MEDIA_TYPE = "application/json"
+
+
+def accept_preference(accept: Optional[str]) -> Optional[bool]:
+    """
+    解析 Accept 头表达的偏好
+
+    返回 True 表示只接受 SSE，False 表示只接受 JSON，None 表示没有明确偏好（缺省、*/* 或两者都接受）
+    """
+    if not accept:
+        return None
+    media_types = {part.split(";", 1)[0].strip().lower() for part in accept.split(",")}
+    wants_sse = SSE_MEDIA_TYPE in media_types
+    wants_json = JSON_MEDIA_TYPE in media_types
+    if wants_sse and not wants_json:
+        return True
+    if wants_json and not wants_sse:
+        return False
+    return None
+
+
+def resolve_stream_mode(body_stream: bool, accept: Optional[str]) -> bool:
+    """
+    决定最终是否使用流式响应
+
+    - body（默认）: 以请求体 stream 字段为准
+    - accept: 以 Accept 头为准，Accept 没有明确偏好时仍使用请求体
+    两者冲突时都会记录一条警告日志
+    """
+    preference = accept_preference(accept)
+    if preference is None or preference == body_stream:
+        return body_stream
+
+    if STREAM_MODE_RESOLUTION == "accept":
+        logger.warning(f"⚠️ stream={body_stream} 与 Accept: {accept} 冲突，按 Accept 头使用 stream={preference}")
+        return preference
+
+    logger.warning(f"⚠️ stream={body_stream} 与 Accept: {accept} 冲突，按请求体使用 stream={body_stream}")
+    return body_stream
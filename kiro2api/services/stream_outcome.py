@@ -0,0 +1,210 @@
+"""
+流式响应结束原因
+OpenAI 与 Claude 两条流式路径共用：记录每个流为什么结束和按事件类型的统计（个数、平均 / 最大字节数），
+写入结束摘要日志和访问日志，并可选地以 SSE 注释发给客户端
+"""
+
+import time
+import asyncio
+import logging
+from enum import Enum
+from typing import AsyncIterator, Optional
+
+from fastapi import Request
+
+from config import STREAM_STATS_COMMENT
+from services.accounting import (
+    RequestAccounting, OUTCOME_SUCCESS, OUTCOME_CLIENT_ERROR, OUTCOME_UPSTREAM_ERROR, OUTCOME_PROXY_ERROR,
+)
+from services.metrics import stream_bytes_total, stream_end_total
+from services.request_context import annotate_request
+from services.stream_events import StreamEventStats
+from services.shutdown import shutdown_coordinator
+from services.load_shed import load_shedder, overloaded_frame
+from auth.stream_limits import StreamLease
+
+logger = logging.getLogger(__name__)
+
+
+class StreamEndReason(str, Enum):
+    """流结束原因（取值固定，可直接用作监控标签）"""
+    UPSTREAM_EOF = "upstream_eof"
+    UPSTREAM_ERROR = "upstream_error"
+    INVALID_REQUEST = "invalid_request"
+    IDLE_TIMEOUT = "idle_timeout"
+    DURATION_CAP = "duration_cap"
+    CLIENT_DISCONNECT = "client_disconnect"
+    MAX_TOKENS_ENFORCED = "max_tokens_enforced"
+    STOP_SEQUENCE = "stop_sequence"
+    ERROR_BUDGET_EXHAUSTED = "error_budget_exhausted"
+    LOAD_SHED = "load_shed"
+    BLOCK_LIMIT = "block_limit"
+
+
+# 视为正常完成的结束原因
+COMPLETED_REASONS = (
+    StreamEndReason.UPSTREAM_EOF,
+    StreamEndReason.STOP_SEQUENCE,
+    StreamEndReason.MAX_TOKENS_ENFORCED,
+)
+
+
+def outcome_class_for(reason: Optional[StreamEndReason]) -> str:
+    """流结束原因对应的请求结果类别：客户端断开和上游拒绝请求本身记为 client_error，其余提前结束记为 upstream_error"""
+    if reason in COMPLETED_REASONS:
+        return OUTCOME_SUCCESS
+    if reason in (StreamEndReason.CLIENT_DISCONNECT, StreamEndReason.INVALID_REQUEST):
+        return OUTCOME_CLIENT_ERROR
+    if reason in (StreamEndReason.LOAD_SHED, StreamEndReason.BLOCK_LIMIT):
+        return OUTCOME_PROXY_ERROR
+    return OUTCOME_UPSTREAM_ERROR
+
+
+class StreamOutcome:
+    """
+    单个流的结束记录
+
+    结束原因只在第一次调用 end() 时生效，之后的调用被忽略，
+    这样内部逻辑先设置的具体原因不会被外层的兜底原因覆盖
+    """
+
+    def __init__(
+        self,
+        api: str,
+        model: str,
+        accounting: Optional[RequestAccounting] = None,
+        lease: Optional[StreamLease] = None,
+    ):
+        self.api = api
+        self.model = model
+        self.accounting = accounting
+        # 该流占用的每 Key 并发名额，流结束时释放
+        self.lease = lease
+        self.started_at = time.monotonic()
+        self.ended_at: Optional[float] = None
+        self.reason: Optional[StreamEndReason] = None
+        self.detail: str = ""
+        self.events = 0
+        self.bytes = 0
+        self.event_stats = StreamEventStats(api)
+        # 过载保护要求中断该流（下一次写出之前以错误事件结束）
+        self.shed = False
+
+    def release_lease(self):
+        if self.lease:
+            self.lease.release()
+
+    def end(self, reason: StreamEndReason, detail: str = "") -> bool:
+        """设置结束原因，已经设置过时返回 False"""
+        if self.reason is not None:
+            return False
+        self.reason = reason
+        self.detail = detail
+        self.ended_at = time.monotonic()
+        return True
+
+    @property
+    def duration_ms(self) -> int:
+        end = self.ended_at if self.ended_at is not None else time.monotonic()
+        return int((end - self.started_at) * 1000)
+
+    def summary(self) -> str:
+        reason = self.reason.value if self.reason else "unknown"
+        text = (
+            f"api={self.api} model={self.model} end_reason={reason} "
+            f"events={self.events} bytes={self.bytes} duration_ms={self.duration_ms}"
+        )
+        event_types = self.event_stats.compact()
+        if event_types:
+            text += f" event_types={event_types}"
+        if self.detail:
+            text += f" detail={self.detail}"
+        return text
+
+    def stats_comment(self) -> str:
+        """SSE 注释行，标准客户端会忽略，便于排查时查看流为何结束"""
+        reason = self.reason.value if self.reason else "unknown"
+        text = f": stats end_reason={reason} events={self.events} bytes={self.bytes} duration_ms={self.duration_ms}"
+        event_types = self.event_stats.compact()
+        if event_types:
+            text += f" event_types={event_types}"
+        return text + "\n\n"
+
+
+async def track_stream(
+    stream: AsyncIterator[str],
+    outcome: StreamOutcome,
+    request: Optional[Request] = None,
+) -> AsyncIterator[str]:
+    """
+    包装流式生成器，保证每条退出路径都恰好记录一次结束原因
+
+    - 正常迭代结束：upstream_eof（内部未设置更具体的原因时）
+    - 客户端断开（任务取消、生成器被关闭，或写出前检测到连接已断开）：client_disconnect
+    - 未捕获的异常：upstream_error
+
+    结束原因在 finally 中计入 kiro2api_stream_end_total{api,end_reason}，每个流恰好一次
+
+    传入 request 时，每次写出之前都检查客户端是否已断开，断开后立即停止读取上游；
+    无论从哪条路径退出，都会关闭内部生成器，让它在 finally 中及时释放上游连接
+
+    进行中的流计入 shutdown_coordinator，优雅关闭时等待它们正常结束；同时登记到过载保护，
+    被选中中断时在下一次写出之前发出 overloaded 错误事件并结束（load_shed）
+    """
+    shutdown_coordinator.stream_started()
+    load_shedder.stream_started(outcome)
+    try:
+        async for frame in stream:
+            if request is not None and await request.is_disconnected():
+                outcome.end(StreamEndReason.CLIENT_DISCONNECT, "detected before write")
+                return
+            if outcome.shed:
+                outcome.end(StreamEndReason.LOAD_SHED, "aborted by load shedding")
+                yield overloaded_frame(outcome.api)
+                return
+            outcome.events += 1
+            outcome.bytes += len(frame)
+            outcome.event_stats.record(frame)
+            yield frame
+        outcome.end(StreamEndReason.UPSTREAM_EOF)
+        if STREAM_STATS_COMMENT:
+            yield outcome.stats_comment()
+    except (asyncio.CancelledError, GeneratorExit):
+        outcome.end(StreamEndReason.CLIENT_DISCONNECT)
+        raise
+    except Exception as e:
+        outcome.end(StreamEndReason.UPSTREAM_ERROR, str(e))
+        raise
+    finally:
+        shutdown_coordinator.stream_finished()
+        load_shedder.stream_finished(outcome)
+        outcome.release_lease()
+        try:
+            await stream.aclose()
+        except Exception as e:
+            logger.warning(f"关闭内部流失败: {e}")
+        stream_bytes_total.inc(outcome.bytes, api=outcome.api)
+        stream_end_total.inc(api=outcome.api, end_reason=outcome.reason.value if outcome.reason else "unknown")
+        annotate_request(stream_events=outcome.event_stats.summary() or None)
+        completed = outcome.reason in COMPLETED_REASONS
+        if completed:
+            logger.info(f"🏁 流结束: {outcome.summary()}")
+        else:
+            logger.warning(f"⚠️ 流提前结束: {outcome.summary()}")
+        if outcome.accounting:
+            outcome.accounting.finish(
+                "ok" if completed else "error",
+                outcome.reason.value if outcome.reason else None,
+                outcome_class_for(outcome.reason),
+            )
+
+
+async def release_stream_resources(outcome: StreamOutcome, upstream):
+    """
+    响应结束后的兜底清理（作为 StreamingResponse 的 background 执行）
+
+    客户端在响应开始之前就断开时，流生成器可能从未开始迭代，track_stream 的 finally 不会执行，
+    这里保证并发名额和上游连接仍然会被释放
+    """
+    outcome.release_lease()
+    await upstream.aclose()
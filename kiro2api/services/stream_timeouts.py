@@ -0,0 +1,151 @@
+"""
+上游读取超时：流式响应的空闲超时和总时长上限，以及请求级的上游时限
+上游客户端没有读取超时（长对话的首 token 可能很慢），上游卡住时读取会一直等待，流永远不结束。
+流式路径读取上游时经过 with_stream_timeouts：
+
+- 空闲超时：STREAM_IDLE_TIMEOUT_SECONDS 秒没有收到任何上游数据
+- 总时长上限：从开始读取起超过 STREAM_TOTAL_TIMEOUT_SECONDS 秒
+
+每次读取都以两者中较早到期的时间为期限，超时后取消读取并抛出 StreamTimeoutError，由各接口在流内收尾：
+OpenAI 接口发出错误 chunk 后仍然发出 [DONE]，Claude 接口发出 error 事件；结束原因记为 idle_timeout / duration_cap。
+两个值为 0 时分别关闭
+
+另外每个请求调用上游有总时限：默认 UPSTREAM_TIMEOUT 秒，客户端可以用 X-Request-Timeout 请求头（秒）缩短，不能延长。
+处理函数用 start_request_deadline 把到期时刻写入请求上下文，之后发起上游请求（含重试，within_deadline）
+和读取响应（with_stream_timeouts，流式和非流式都经过）都以它为期限，到期时抛出 DeadlineExceededError：
+还没有向客户端写出数据时返回 504 upstream_timeout，流已经开始时与上面的超时一样在流内报错结束（结束原因 duration_cap）
+"""
+
+import math
+import time
+import asyncio
+from typing import AsyncIterator, Awaitable, Optional, Tuple, TypeVar
+
+from config import STREAM_IDLE_TIMEOUT_SECONDS, STREAM_TOTAL_TIMEOUT_SECONDS, UPSTREAM_TIMEOUT
+from services.request_context import annotate_request, current_request_context
+from services.stream_outcome import StreamEndReason
+
+T = TypeVar("T")
+
+TIMEOUT_IDLE = "idle"
+TIMEOUT_TOTAL = "total"
+TIMEOUT_DEADLINE = "deadline"
+
+REQUEST_TIMEOUT_HEADER = "x-request-timeout"
+
+
+class StreamTimeoutError(Exception):
+    """读取上游流超时（kind 为 idle、total 或 deadline）"""
+
+    def __init__(self, kind: str, seconds: float):
+        if kind == TIMEOUT_IDLE:
+            message = f"upstream sent no data for {seconds:g} seconds"
+        elif kind == TIMEOUT_DEADLINE:
+            message = f"upstream request exceeded the timeout of {seconds:g} seconds"
+        else:
+            message = f"stream exceeded the maximum duration of {seconds:g} seconds"
+        super().__init__(message)
+        self.kind = kind
+        self.seconds = seconds
+
+    @property
+    def end_reason(self) -> StreamEndReason:
+        return StreamEndReason.IDLE_TIMEOUT if self.kind == TIMEOUT_IDLE else StreamEndReason.DURATION_CAP
+
+
+class DeadlineExceededError(StreamTimeoutError):
+    """超过本请求调用上游的时限（UPSTREAM_TIMEOUT / X-Request-Timeout）"""
+
+    def __init__(self, seconds: float):
+        super().__init__(TIMEOUT_DEADLINE, seconds)
+
+
+def parse_request_timeout(value: Optional[str], limit: float = UPSTREAM_TIMEOUT) -> float:
+    """
+    本请求的上游时限（秒，0 表示不限）
+
+    没有 X-Request-Timeout 时为 limit；请求头的值超过 limit（limit 为 0 时不限）时按 limit 处理；
+    不是正数时抛出 ValueError
+    """
+    if value is None or not value.strip():
+        return limit
+    try:
+        seconds = float(value)
+    except ValueError:
+        raise ValueError("must be a number of seconds")
+    if not math.isfinite(seconds) or seconds <= 0:
+        raise ValueError("must be a positive number of seconds")
+    return min(seconds, limit) if limit > 0 else seconds
+
+
+def start_request_deadline(header_value: Optional[str], clock=time.monotonic) -> float:
+    """按 X-Request-Timeout 和 UPSTREAM_TIMEOUT 设置本请求的上游时限，返回时限秒数；请求头不合法时抛出 ValueError"""
+    timeout = parse_request_timeout(header_value)
+    if timeout > 0:
+        annotate_request(upstream_timeout=timeout, upstream_deadline=clock() + timeout)
+    return timeout
+
+
+def request_deadline() -> Optional[Tuple[float, float]]:
+    """当前请求的 (到期时刻, 时限秒数)，没有时限时返回 None"""
+    context = current_request_context()
+    if context is None or context.upstream_deadline is None:
+        return None
+    return context.upstream_deadline, context.upstream_timeout
+
+
+async def within_deadline(awaitable: Awaitable[T], clock=time.monotonic) -> T:
+    """在当前请求的上游时限内等待 awaitable，到期时取消并抛出 DeadlineExceededError"""
+    deadline = request_deadline()
+    if deadline is None:
+        return await awaitable
+    expires_at, seconds = deadline
+    try:
+        return await asyncio.wait_for(awaitable, max(expires_at - clock(), 0))
+    except asyncio.TimeoutError:
+        raise DeadlineExceededError(seconds)
+
+
+async def with_stream_timeouts(
+    chunks: AsyncIterator[bytes],
+    idle_timeout: float = STREAM_IDLE_TIMEOUT_SECONDS,
+    total_timeout: float = STREAM_TOTAL_TIMEOUT_SECONDS,
+    clock=time.monotonic,
+) -> AsyncIterator[bytes]:
+    """
+    逐块读取 chunks，空闲或总时长超时时抛出 StreamTimeoutError，超过请求的上游时限时抛出 DeadlineExceededError；
+    超时或提前退出时关闭 chunks。两个值都为 0 时只受请求的上游时限约束（非流式路径）
+    """
+    deadline: Optional[float] = clock() + total_timeout if total_timeout > 0 else None
+    request = request_deadline()
+    iterator = chunks.__aiter__()
+    try:
+        while True:
+            timeout, kind = None, None
+            if idle_timeout > 0:
+                timeout, kind = idle_timeout, TIMEOUT_IDLE
+            if deadline is not None:
+                remaining = deadline - clock()
+                if remaining <= 0:
+                    raise StreamTimeoutError(TIMEOUT_TOTAL, total_timeout)
+                if timeout is None or remaining < timeout:
+                    timeout, kind = remaining, TIMEOUT_TOTAL
+            if request is not None:
+                remaining = request[0] - clock()
+                if remaining <= 0:
+                    raise DeadlineExceededError(request[1])
+                if timeout is None or remaining < timeout:
+                    timeout, kind = remaining, TIMEOUT_DEADLINE
+            try:
+                chunk = await asyncio.wait_for(iterator.__anext__(), timeout)
+            except StopAsyncIteration:
+                return
+            except asyncio.TimeoutError:
+                if kind == TIMEOUT_DEADLINE:
+                    raise DeadlineExceededError(request[1])
+                raise StreamTimeoutError(kind, idle_timeout if kind == TIMEOUT_IDLE else total_timeout)
+            yield chunk
+    finally:
+        aclose = getattr(iterator, "aclose", None)
+        if aclose is not None:
+            await aclose()
@@ -0,0 +1,120 @@
+"""
+粗略 token 估算的校准
+用一批已知 token 数的样本评估当前估算误差，并按字符类别拟合新的每 token 字符数
+"""
+
+import logging
+from typing import Dict, List, Optional
+
+from services.tokenizer import (
+    EstimatorMultipliers,
+    classify_chars,
+    estimate_tokens_rough,
+)
+
+logger = logging.getLogger(__name__)
+
+CHAR_CLASSES = ("latin", "cjk", "code")
+# 拟合结果的合理范围（每 token 字符数），避免少量样本拟合出极端值
+MIN_CHARS_PER_TOKEN = 0.25
+MAX_CHARS_PER_TOKEN = 20.0
+
+
+def _mape(estimated: List[int], expected: List[int]) -> float:
+    """平均绝对百分比误差（expected 为 0 的样本不计入）"""
+    errors = [abs(e - x) / x for e, x in zip(estimated, expected) if x > 0]
+    return sum(errors) / len(errors) if errors else 0.0
+
+
+def _solve(matrix: List[List[float]], vector: List[float]) -> Optional[List[float]]:
+    """高斯消元求解线性方程组，矩阵奇异时返回 None"""
+    n = len(vector)
+    a = [row[:] + [vector[i]] for i, row in enumerate(matrix)]
+    for col in range(n):
+        pivot = max(range(col, n), key=lambda r: abs(a[r][col]))
+        if abs(a[pivot][col]) < 1e-9:
+            return None
+        a[col], a[pivot] = a[pivot], a[col]
+        for r in range(n):
+            if r != col:
+                factor = a[r][col] / a[col][col]
+                for c in range(col, n + 1):
+                    a[r][c] -= factor * a[col][c]
+    return [a[i][n] / a[i][i] for i in range(n)]
+
+
+def suggest_multipliers(
+    counts: List[Dict[str, int]],
+    expected: List[int],
+    current: EstimatorMultipliers,
+) -> EstimatorMultipliers:
+    """
+    最小二乘拟合 expected ≈ Σ 字符数 / 每 token 字符数
+
+    只拟合样本中出现过的字符类别；方程奇异或拟合出非正值时，
+    退化为按总 token 数等比例缩放当前参数
+    """
+    classes = [c for c in CHAR_CLASSES if any(item[c] for item in counts)]
+    suggested = EstimatorMultipliers(**{c: getattr(current, c) for c in CHAR_CLASSES})
+    if not classes:
+        return suggested
+
+    # 正规方程 (XᵀX) w = Xᵀy，w 为每个字符对应的 token 数
+    xtx = [[sum(item[a] * item[b] for item in counts) for b in classes] for a in classes]
+    xty = [sum(item[a] * y for item, y in zip(counts, expected)) for a in classes]
+    weights = _solve(xtx, xty)
+
+    if weights and all(w > 0 for w in weights):
+        for cls, w in zip(classes, weights):
+            setattr(suggested, cls, min(MAX_CHARS_PER_TOKEN, max(MIN_CHARS_PER_TOKEN, 1 / w)))
+        return suggested
+
+    estimated_total = sum(
+        sum(item[c] / getattr(current, c) for c in CHAR_CLASSES) for item in counts
+    )
+    expected_total = sum(expected)
+    if estimated_total > 0 and expected_total > 0:
+        scale = estimated_total / expected_total
+        for cls in classes:
+            value = getattr(current, cls) * scale
+            setattr(suggested, cls, min(MAX_CHARS_PER_TOKEN, max(MIN_CHARS_PER_TOKEN, value)))
+    return suggested
+
+
+def calibrate(samples: List[Dict], current: EstimatorMultipliers) -> Dict:
+    """
+    评估当前估算参数并给出建议参数
+
+    samples: [{"text": str, "expected_tokens": int}, ...]
+    """
+    texts = [item["text"] for item in samples]
+    expected = [item["expected_tokens"] for item in samples]
+    counts = [classify_chars(text) for text in texts]
+
+    estimated = [estimate_tokens_rough(text, current) for text in texts]
+    suggested = suggest_multipliers(counts, expected, current)
+    suggested_estimated = [estimate_tokens_rough(text, suggested) for text in texts]
+
+    items = []
+    for i, (est, exp) in enumerate(zip(estimated, expected)):
+        items.append({
+            "index": i,
+            "expected_tokens": exp,
+            "estimated_tokens": est,
+            "error": est - exp,
+            "error_pct": round((est - exp) / exp * 100, 2) if exp > 0 else None,
+            "char_classes": counts[i],
+        })
+
+    current_mape = _mape(estimated, expected)
+    suggested_mape = _mape(suggested_estimated, expected)
+    logger.info(f"🔢 token 估算校准: {len(samples)} 个样本, MAPE {current_mape:.4f} -> {suggested_mape:.4f}")
+
+    return {
+        "items": items,
+        "mape": round(current_mape, 4),
+        "current_multipliers": vars(current).copy(),
+        "suggested_multipliers": {k: round(v, 4) for k, v in vars(suggested).items()},
+        "suggested_mape": round(suggested_mape, 4),
+        "suggested": suggested,
+    }
@@ -0,0 +1,208 @@
+"""
+Token 计数
+默认使用按字符数的粗略估算；TOKENIZER_BACKEND 设为 BPE 编码名（cl100k_base / o200k_base）时改用 tiktoken 精确分词，
+tiktoken 未安装或编码加载失败时自动回退到粗略估算
+"""
+
+import logging
+from dataclasses import dataclass
+from typing import Dict, Optional
+
+from config import TOKENIZER_BACKEND, ENFORCE_MAX_TOKENS
+
+logger = logging.getLogger(__name__)
+
+ESTIMATE_BACKEND = "estimate"
+BPE_ENCODINGS = ("cl100k_base", "o200k_base")
+
+if TOKENIZER_BACKEND not in (ESTIMATE_BACKEND,) + BPE_ENCODINGS:
+    logger.warning(f"⚠️ 未知的 TOKENIZER_BACKEND={TOKENIZER_BACKEND}，使用粗略估算")
+
+# 已加载的 tiktoken 编码；False 表示加载失败，不再重试
+_encoding = None
+
+
+def _get_encoding():
+    """按需加载 BPE 编码（首次使用时可能需要下载编码文件）"""
+    global _encoding
+    if _encoding is None:
+        try:
+            import tiktoken
+            _encoding = tiktoken.get_encoding(TOKENIZER_BACKEND)
+            logger.info(f"🔢 已加载 BPE 分词器: {TOKENIZER_BACKEND}")
+        except Exception as e:
+            logger.warning(f"⚠️ 加载 BPE 分词器 {TOKENIZER_BACKEND} 失败，回退到粗略估算: {e}")
+            _encoding = False
+    return _encoding or None
+
+
+@dataclass
+class EstimatorMultipliers:
+    """
+    粗略估算的参数：每类字符平均多少个字符对应 1 个 token
+
+    默认三类都是 4.0，与原先的 len // 4 完全一致；可通过校准接口按实际语料调整
+    """
+    latin: float = 4.0
+    cjk: float = 4.0
+    code: float = 4.0
+
+
+# 运行时生效的估算参数（校准接口可以替换）
+estimator_multipliers = EstimatorMultipliers()
+
+# 代码中常见、通常会被单独切分的符号
+CODE_CHARS = set("{}[]()<>;:=+-*/\\|&^%$#@!~`\"'_,.?")
+
+
+def _is_cjk(ch: str) -> bool:
+    code = ord(ch)
+    return (
+        0x4E00 <= code <= 0x9FFF      # CJK 统一汉字
+        or 0x3400 <= code <= 0x4DBF   # CJK 扩展 A
+        or 0x3040 <= code <= 0x30FF   # 平假名 / 片假名
+        or 0xAC00 <= code <= 0xD7AF   # 韩文音节
+        or 0x3000 <= code <= 0x303F   # CJK 标点
+        or 0xFF00 <= code <= 0xFFEF   # 全角字符
+    )
+
+
+def classify_chars(text: str) -> Dict[str, int]:
+    """按 latin / cjk / code 三类统计字符数"""
+    counts = {"latin": 0, "cjk": 0, "code": 0}
+    for ch in text:
+        if _is_cjk(ch):
+            counts["cjk"] += 1
+        elif ch in CODE_CHARS:
+            counts["code"] += 1
+        else:
+            counts["latin"] += 1
+    return counts
+
+
+def estimate_tokens_rough(text: str, multipliers: Optional[EstimatorMultipliers] = None) -> int:
+    """粗略估算：按字符类别分别除以对应的每 token 字符数"""
+    if not text:
+        return 0
+    m = multipliers or estimator_multipliers
+    counts = classify_chars(text)
+    tokens = counts["latin"] / m.latin + counts["cjk"] / m.cjk + counts["code"] / m.code
+    return max(1, int(tokens))
+
+
+def estimate_tokens_exact(text: str) -> Optional[int]:
+    """使用 BPE 分词器精确计数，分词器不可用时返回 None"""
+    encoding = _get_encoding()
+    if encoding is None:
+        return None
+    if not text:
+        return 0
+    return len(encoding.encode(text, disallowed_special=()))
+
+
+def exact_enabled() -> bool:
+    """是否配置了 BPE 分词后端"""
+    return TOKENIZER_BACKEND in BPE_ENCODINGS
+
+
+def count_text_tokens(text: str) -> int:
+    """按 TOKENIZER_BACKEND 选择的后端计算 token 数量"""
+    if exact_enabled():
+        exact = estimate_tokens_exact(text)
+        if exact is not None:
+            return exact
+    return estimate_tokens_rough(text)
+
+
+
+class IncrementalTokenCounter:
+    """
+    流式输出的增量 token 计数，避免每收到一段就对全文重新计数
+
+    粗略估算累计各类字符数后统一换算（与对全文一次性估算的结果相同）；BPE 后端对每段分别分词后求和
+    """
+
+    def __init__(self):
+        self.char_counts = {"latin": 0, "cjk": 0, "code": 0}
+        self.exact_tokens = 0
+
+    def _exact(self, text: str) -> Optional[int]:
+        return estimate_tokens_exact(text) if exact_enabled() else None
+
+    def tokens_with(self, text: str = "") -> int:
+        """追加 text 之后的总 token 数（不修改计数）"""
+        exact_tokens = self.exact_tokens
+        char_counts = dict(self.char_counts)
+        if text:
+            exact = self._exact(text)
+            if exact is not None:
+                exact_tokens += exact
+            else:
+                for kind, count in classify_chars(text).items():
+                    char_counts[kind] += count
+        m = estimator_multipliers
+        rough = char_counts["latin"] / m.latin + char_counts["cjk"] / m.cjk + char_counts["code"] / m.code
+        return exact_tokens + int(rough)
+
+    @property
+    def tokens(self) -> int:
+        return self.tokens_with()
+
+    def add(self, text: str):
+        if not text:
+            return
+        exact = self._exact(text)
+        if exact is not None:
+            self.exact_tokens += exact
+            return
+        for kind, count in classify_chars(text).items():
+            self.char_counts[kind] += count
+
+    def fit(self, text: str, max_tokens: int) -> str:
+        """text 的最长前缀，使追加后的总 token 数不超过 max_tokens（BPE 后端按分词边界截断）"""
+        encoding = _get_encoding() if exact_enabled() else None
+        if encoding is not None:
+            remaining = max_tokens - self.tokens
+            if remaining <= 0:
+                return ""
+            tokens = encoding.encode(text, disallowed_special=())
+            # 截断处可能落在多字节字符中间，去掉解码出的替换字符
+            return text if len(tokens) <= remaining else encoding.decode(tokens[:remaining]).rstrip("\ufffd")
+        low, high = 0, len(text)
+        while low < high:
+            mid = (low + high + 1) // 2
+            if self.tokens_with(text[:mid]) <= max_tokens:
+                low = mid
+            else:
+                high = mid - 1
+        return text[:low]
+
+
+class OutputTokenBudget:
+    """
+    按客户端的 max_tokens 限制输出
+
+    CodeWhisperer 的请求不支持设置最大输出长度，只能在代理侧计数：每段输出经 consume() 截断到剩余额度内，
+    额度用完后 exhausted 为 True，调用方停止读取上游并以 max_tokens / length 结束响应。
+    未设置 max_tokens 或关闭 ENFORCE_MAX_TOKENS 时不做限制
+    """
+
+    def __init__(self, max_tokens: Optional[int]):
+        self.limit = max_tokens if ENFORCE_MAX_TOKENS and max_tokens and max_tokens > 0 else None
+        self.counter = IncrementalTokenCounter()
+        self.exhausted = False
+
+    def consume(self, text: str) -> str:
+        """返回 text 中仍在额度内的部分"""
+        if self.limit is None or not text:
+            return text
+        if self.exhausted:
+            return ""
+        if self.counter.tokens_with(text) < self.limit:
+            self.counter.add(text)
+            return text
+        self.exhausted = True
+        logger.info(f"✂️ 输出达到 max_tokens={self.limit}，截断并结束响应")
+        kept = self.counter.fit(text, self.limit)
+        self.counter.add(kept)
+        return kept
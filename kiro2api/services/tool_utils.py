@@ -0,0 +1,454 @@
+"""
+工具定义相关的通用处理
+OpenAI (request_builder.py) 与 Claude (claude_converter.py) 两条转换路径共用
+"""
+
+import re
+import json
+import hashlib
+import logging
+import uuid
+import threading
+import unicodedata
+from collections import OrderedDict
+from typing import List, Dict, Any, Optional, Tuple, FrozenSet, Iterable
+
+from config import TOOL_NAME_POLICY, TOOL_RESULT_SPLIT_BYTES, TRAILING_TOOL_USE_POLICY
+from services.request_context import annotate_request, current_request_context
+
+logger = logging.getLogger(__name__)
+
+
+def tool_fingerprint(name: str, description: Optional[str], schema: Optional[Dict[str, Any]]) -> str:
+    """计算工具定义的指纹，名称、描述和 schema 完全相同的工具指纹一致"""
+    raw = json.dumps(
+        {"name": name, "description": description or "", "schema": schema or {}},
+        sort_keys=True,
+        ensure_ascii=False,
+    )
+    return hashlib.sha256(raw.encode("utf-8")).hexdigest()
+
+
+def compact_tool_specifications(tool_specs: List[Dict[str, Any]]) -> Tuple[List[Dict[str, Any]], int]:
+    """
+    去掉同一个请求中重复的工具定义
+
+    客户端有时会在一个请求的 tools 中重复声明同一个工具（例如合并多个工具来源时）；
+    完全相同的定义只保留第一次出现的那个，顺序不变。只处理单个请求，
+    跨轮次重复的工具见 compact_repeated_tools
+
+    Returns:
+        (压缩后的 toolSpecification 列表, 被移除的重复定义数量)
+    """
+    seen = set()
+    seen_names = set()
+    compacted = []
+
+    for spec in tool_specs:
+        tool = spec.get("toolSpecification", {})
+        name = tool.get("name", "")
+        fingerprint = tool_fingerprint(name, tool.get("description"), tool.get("inputSchema", {}).get("json"))
+        if fingerprint in seen:
+            continue
+        if name in seen_names:
+            logger.warning(f"⚠️ 工具 {name} 存在多个不同的定义，保留全部")
+        seen.add(fingerprint)
+        seen_names.add(name)
+        compacted.append(spec)
+
+    removed = len(tool_specs) - len(compacted)
+    if removed:
+        logger.info(f"🧹 工具定义压缩: 移除 {removed} 个重复定义，剩余 {len(compacted)} 个")
+    return compacted, removed
+
+
+# Anthropic 文档中的工具名规则，上游同样只接受这种名称
+TOOL_NAME_PATTERN = re.compile(r"^[a-zA-Z0-9_-]{1,64}$")
+TOOL_NAME_MAX_LENGTH = 64
+
+
+def tool_fingerprints(tools: Iterable[Tuple[str, Optional[str], Optional[Dict[str, Any]]]]) -> FrozenSet[str]:
+    """一组工具（客户端名称、描述、schema）的指纹，记入对话缓存，供后续轮次判断工具是否已经声明过"""
+    return frozenset(tool_fingerprint(name, description, schema) for name, description, schema in tools)
+
+
+def compact_repeated_tools(
+    tool_specs: List[Dict[str, Any]],
+    fingerprints: List[str],
+    declared: FrozenSet[str],
+) -> Tuple[List[Dict[str, Any]], int]:
+    """
+    跨轮次压缩：本对话前几轮已经发送过、完全相同的工具只保留名称和 inputSchema
+
+    客户端每一轮都会重新发送全部工具定义；上游没有引用已声明工具的方式，沿用同一个 conversationId 时
+    仍需在请求中给出工具，但描述（通常占定义的大部分）已经在这个上游对话中发送过，省略后模型仍能按 schema 调用。
+    fingerprints 与 tool_specs 一一对应（按客户端名称计算，见 tool_fingerprints），declared 为对话缓存中记录的指纹。
+    被省略的描述记入请求上下文，上游拒绝沿用的 conversationId、换新对话重试时由 restore_compacted_tools 恢复
+
+    Returns:
+        (压缩后的 toolSpecification 列表, 省略了描述的工具数量)
+    """
+    if not declared:
+        return tool_specs, 0
+
+    compacted = []
+    originals = {}
+    for spec, fingerprint in zip(tool_specs, fingerprints):
+        tool = spec.get("toolSpecification", {})
+        if fingerprint in declared and tool.get("description"):
+            originals[tool.get("name", "")] = tool["description"]
+            spec = {"toolSpecification": {**tool, "description": ""}}
+        compacted.append(spec)
+
+    if originals:
+        annotate_request(compacted_tools=originals)
+        logger.info(f"🧹 工具定义压缩: {len(originals)} 个工具已在本对话前几轮声明过，省略描述")
+    return compacted, len(originals)
+
+
+def restore_compacted_tools(conversation_state: Dict[str, Any]) -> int:
+    """把 compact_repeated_tools 省略的描述写回请求（换新的上游对话时使用），返回恢复的工具数量"""
+    context = current_request_context()
+    originals = context.compacted_tools if context else None
+    if not originals:
+        return 0
+    user_input = conversation_state.get("currentMessage", {}).get("userInputMessage", {})
+    restored = 0
+    for spec in user_input.get("userInputMessageContext", {}).get("tools", []):
+        tool = spec.get("toolSpecification", {})
+        if not tool.get("description") and tool.get("name") in originals:
+            tool["description"] = originals[tool["name"]]
+            restored += 1
+    annotate_request(compacted_tools=None)
+    return restored
+
+
+class ToolNameError(ValueError):
+    """工具名不符合命名规则"""
+
+    def __init__(self, name: str, rule: str):
+        super().__init__(f"Invalid tool name '{name}': {rule}")
+        self.name = name
+        self.rule = rule
+
+
+def tool_name_violation(name: str) -> Optional[str]:
+    """返回工具名违反的规则描述，合法时返回 None"""
+    if not name:
+        return "name must not be empty"
+    if len(name) > TOOL_NAME_MAX_LENGTH:
+        return f"name must be at most {TOOL_NAME_MAX_LENGTH} characters"
+    if not TOOL_NAME_PATTERN.match(name):
+        return "name may only contain letters, digits, underscores and hyphens (^[a-zA-Z0-9_-]{1,64}$)"
+    return None
+
+
+def sanitize_tool_name(name: str, taken: set) -> str:
+    """
+    将工具名转换为合法名称
+
+    先把 unicode 字符转写为 ASCII，非法字符替换为下划线，再截断到 64 个字符；
+    与已有名称冲突或发生截断时追加短哈希，保证不同原名映射到不同的名称
+    """
+    ascii_name = unicodedata.normalize("NFKD", name).encode("ascii", "ignore").decode("ascii")
+    candidate = re.sub(r"[^a-zA-Z0-9_-]", "_", ascii_name).strip("_") or "tool"
+    if len(candidate) > TOOL_NAME_MAX_LENGTH or candidate in taken:
+        suffix = hashlib.sha256(name.encode("utf-8")).hexdigest()[:8]
+        candidate = f"{candidate[:TOOL_NAME_MAX_LENGTH - len(suffix) - 1]}_{suffix}"
+    return candidate
+
+
+class ToolNameMap:
+    """
+    单个请求内的工具名映射
+
+    只有开启 TOOL_NAME_POLICY=sanitize 且存在非法工具名时才会有条目；
+    发往上游时使用 upstream_name，返回给客户端的 tool_use / tool_calls 使用 client_name 还原原名
+    """
+
+    def __init__(self):
+        self.to_upstream: Dict[str, str] = {}
+        self.to_client: Dict[str, str] = {}
+
+    def add(self, client_name: str, upstream_name: str):
+        self.to_upstream[client_name] = upstream_name
+        self.to_client[upstream_name] = client_name
+
+    def upstream_name(self, name: str) -> str:
+        return self.to_upstream.get(name, name)
+
+    def client_name(self, name: Optional[str]) -> Optional[str]:
+        return self.to_client.get(name, name) if name else name
+
+
+def build_tool_name_map(names: List[str], policy: Optional[str] = None) -> ToolNameMap:
+    """
+    校验请求中的工具名（policy 默认取 TOOL_NAME_POLICY）
+
+    - reject（默认）: 遇到非法名称抛出 ToolNameError
+    - sanitize: 把非法名称转换为合法名称，并记录可逆映射
+    """
+    policy = policy or TOOL_NAME_POLICY
+    tool_names = ToolNameMap()
+    taken = {name for name in names if tool_name_violation(name) is None}
+    for name in names:
+        rule = tool_name_violation(name)
+        if rule is None or name in tool_names.to_upstream:
+            continue
+        if policy != "sanitize":
+            raise ToolNameError(name, rule)
+        sanitized = sanitize_tool_name(name, taken)
+        taken.add(sanitized)
+        tool_names.add(name, sanitized)
+        logger.warning(f"⚠️ 工具名 '{name}' 不合法（{rule}），已转换为 '{sanitized}'")
+    return tool_names
+
+
+# Claude 接口的 tool_use id 格式：toolu_ 前缀，只包含字母、数字、下划线和连字符（Anthropic SDK 按此校验）
+CLAUDE_TOOL_USE_ID_PREFIX = "toolu_"
+# 上游 id 常见的前缀，转换时去掉，避免出现 toolu_tooluse_xxx
+UPSTREAM_TOOL_USE_ID_PREFIX = "tooluse_"
+# 进程内最多记住多少个返回给客户端的 id 与上游 id 的对应关系，超出后淘汰最早的
+TOOL_USE_ID_REGISTRY_SIZE = 10000
+
+
+def normalize_tool_use_id(upstream_id: Optional[str]) -> str:
+    """把上游的 toolUseId 转换为 Claude 格式的 id；上游没有给出 id 时生成一个"""
+    if not upstream_id:
+        return f"{CLAUDE_TOOL_USE_ID_PREFIX}{uuid.uuid4().hex[:24]}"
+    if upstream_id.startswith(CLAUDE_TOOL_USE_ID_PREFIX) and not re.search(r"[^A-Za-z0-9_-]", upstream_id):
+        return upstream_id
+    body = upstream_id[len(UPSTREAM_TOOL_USE_ID_PREFIX):] if upstream_id.startswith(UPSTREAM_TOOL_USE_ID_PREFIX) else upstream_id
+    body = re.sub(r"[^A-Za-z0-9_-]", "_", body)
+    return f"{CLAUDE_TOOL_USE_ID_PREFIX}{body}" if body else normalize_tool_use_id(None)
+
+
+class ToolUseIdRegistry:
+    """
+    返回给客户端的 tool_use id 到上游原始 id 的映射（进程内，按插入顺序淘汰）
+
+    客户端下一轮在 tool_use / tool_result 中带回的是转换后的 id，发往上游前用 upstream_id 还原；
+    不认识的 id（客户端自己生成的，或映射已被淘汰 / 进程重启）原样使用
+    """
+
+    def __init__(self, max_size: int = TOOL_USE_ID_REGISTRY_SIZE):
+        self.max_size = max_size
+        self._ids: "OrderedDict[str, str]" = OrderedDict()
+        self._lock = threading.Lock()
+
+    def remember(self, client_id: str, upstream_id: str):
+        if client_id == upstream_id:
+            return
+        with self._lock:
+            self._ids[client_id] = upstream_id
+            self._ids.move_to_end(client_id)
+            while len(self._ids) > self.max_size:
+                self._ids.popitem(last=False)
+
+    def upstream_id(self, client_id: str) -> str:
+        with self._lock:
+            return self._ids.get(client_id, client_id)
+
+
+tool_use_ids = ToolUseIdRegistry()
+
+
+class ToolUseIdMap:
+    """
+    单条消息内的 tool_use id 分配
+
+    每个 tool_use 块开始时调用 assign 分配一次 id，之后的 input 增量和非流式输出都沿用这个 id；
+    上游在同一条消息里重复使用同一个 id 时，后面的块加 _2、_3 ... 后缀保证唯一
+    """
+
+    def __init__(self, registry: ToolUseIdRegistry = tool_use_ids):
+        self.registry = registry
+        self.assigned: Dict[str, str] = {}
+
+    def assign(self, upstream_id: Optional[str]) -> str:
+        base = normalize_tool_use_id(upstream_id)
+        client_id = base
+        suffix = 2
+        while client_id in self.assigned:
+            client_id = f"{base}_{suffix}"
+            suffix += 1
+        if client_id != upstream_id:
+            logger.debug(f"tool_use id 转换: {upstream_id} -> {client_id}")
+        self.assigned[client_id] = upstream_id or client_id
+        if upstream_id:
+            self.registry.remember(client_id, upstream_id)
+        return client_id
+
+
+def split_tool_result_text(text: str, max_bytes: Optional[int] = None) -> List[str]:
+    """
+    把超长的 tool_result 文本按 UTF-8 字节数拆分为多段（max_bytes 默认取 TOOL_RESULT_SPLIT_BYTES）
+
+    优先在换行处断开（换行留在前一段末尾），一段内没有换行时按字符断开，不会截断多字节字符；
+    max_bytes <= 0 或文本不超过限制时原样返回一段
+    """
+    if max_bytes is None:
+        max_bytes = TOOL_RESULT_SPLIT_BYTES
+    if max_bytes <= 0 or len(text.encode("utf-8")) <= max_bytes:
+        return [text]
+
+    parts = []
+    start = 0
+    while start < len(text):
+        # 在字节预算内能放下的最长前缀
+        end = start
+        size = 0
+        while end < len(text):
+            char_size = len(text[end].encode("utf-8"))
+            if size + char_size > max_bytes:
+                break
+            size += char_size
+            end += 1
+        if end == start:
+            # 单个字符就超过预算（max_bytes 小于 4 时），至少放一个字符
+            end = start + 1
+        elif end < len(text):
+            newline = text.rfind("\n", start, end)
+            if newline != -1:
+                end = newline + 1
+        parts.append(text[start:end])
+        start = end
+    return parts
+
+
+def format_tool_result(label: str, tool_use_id: str, text: str, max_bytes: Optional[int] = None) -> List[str]:
+    """
+    生成发往上游的 tool_result 文本，例如 "[Tool result for toolu_x]: ..."
+
+    开启 TOOL_RESULT_SPLIT_BYTES 且内容超长时拆成多段，每段都带 tool_use_id 和 (part i/n) 标记
+    """
+    if max_bytes is None:
+        max_bytes = TOOL_RESULT_SPLIT_BYTES
+    parts = split_tool_result_text(text, max_bytes)
+    if len(parts) == 1:
+        return [f"[{label} {tool_use_id}]: {text}"]
+    logger.info(f"✂️ tool_result {tool_use_id} 超过 {max_bytes} 字节，拆分为 {len(parts)} 段")
+    return [
+        f"[{label} {tool_use_id} (part {index}/{len(parts)})]: {part}"
+        for index, part in enumerate(parts, 1)
+    ]
+
+
+# 对话以 assistant 的 tool_use 结尾、后面没有 tool_result 时的处理方式
+TRAILING_TOOL_USE_REJECT = "reject"
+TRAILING_TOOL_USE_COMPLETE = "complete"
+TRAILING_TOOL_USE_CONTINUE = "continue"
+
+
+class TrailingToolUseError(ValueError):
+    """对话以 tool_use 结尾且缺少 tool_result（TRAILING_TOOL_USE_POLICY=reject）"""
+
+    def __init__(self, tool_use_ids: List[str]):
+        self.tool_use_ids = tool_use_ids
+        super().__init__(f"Conversation ends with tool_use {', '.join(tool_use_ids)} without tool_result")
+
+
+def trailing_tool_use_content(
+    calls: List[Tuple[str, str]],
+    policy: str = TRAILING_TOOL_USE_POLICY,
+) -> str:
+    """
+    为结尾的 tool_use 生成发往上游的当前消息，calls 为 (tool_use_id, 上游工具名)
+
+    - reject: 抛出 TrailingToolUseError，由调用方返回 400
+    - complete: 视为工具已执行完毕但没有返回结果，让模型据此继续
+    - continue: 提示模型在调用工具之后继续输出
+    """
+    if policy == TRAILING_TOOL_USE_COMPLETE:
+        return "\n".join(f"[Tool execution completed for {tool_use_id}]: (no result returned)" for tool_use_id, _ in calls)
+    if policy == TRAILING_TOOL_USE_CONTINUE:
+        return "; ".join(f"Continue after calling {name}" for _, name in calls)
+    if policy != TRAILING_TOOL_USE_REJECT:
+        logger.warning(f"⚠️ 未知的 TRAILING_TOOL_USE_POLICY={policy}，按 reject 处理")
+    raise TrailingToolUseError([tool_use_id for tool_use_id, _ in calls])
+
+
+# tool_choice：上游请求没有对应字段，由代理尽量实现
+# - none: 不向上游发送工具定义，模型无法调用工具
+# - any（OpenAI 的 required）: 保留全部工具，并在当前消息末尾要求模型至少调用一个工具
+# - tool（OpenAI 的指定 function）: 只向上游发送该工具，并要求模型调用它
+# 后两种依赖模型遵循指令，不能保证一定产生工具调用
+TOOL_CHOICE_AUTO = "auto"
+TOOL_CHOICE_NONE = "none"
+TOOL_CHOICE_ANY = "any"
+TOOL_CHOICE_TOOL = "tool"
+
+
+class ToolChoiceError(ValueError):
+    """tool_choice 格式不合法，或指定的工具不在 tools 中"""
+
+    def __init__(self, reason: str):
+        self.reason = reason
+        super().__init__(f"Invalid tool_choice: {reason}")
+
+
+class ToolChoice:
+    def __init__(self, mode: str = TOOL_CHOICE_AUTO, name: Optional[str] = None):
+        self.mode = mode
+        self.name = name
+
+
+def parse_tool_choice(value: Any) -> ToolChoice:
+    """
+    解析 OpenAI 或 Anthropic 格式的 tool_choice
+
+    OpenAI: "auto" / "none" / "required" / {"type": "function", "function": {"name": ...}}
+    Anthropic: {"type": "auto" | "any" | "none"} / {"type": "tool", "name": ...}
+    """
+    if value is None:
+        return ToolChoice()
+    if isinstance(value, str):
+        mode = {"auto": TOOL_CHOICE_AUTO, "none": TOOL_CHOICE_NONE, "required": TOOL_CHOICE_ANY, "any": TOOL_CHOICE_ANY}.get(value)
+        if mode is None:
+            raise ToolChoiceError(f"unknown value '{value}'")
+        return ToolChoice(mode)
+    if not isinstance(value, dict):
+        raise ToolChoiceError("must be a string or an object")
+
+    choice_type = value.get("type")
+    if choice_type == "function":
+        name = (value.get("function") or {}).get("name")
+    elif choice_type == "tool":
+        name = value.get("name")
+    elif choice_type in (TOOL_CHOICE_AUTO, TOOL_CHOICE_NONE, TOOL_CHOICE_ANY):
+        return ToolChoice(choice_type)
+    else:
+        raise ToolChoiceError(f"unknown type '{choice_type}'")
+    if not isinstance(name, str) or not name:
+        raise ToolChoiceError("a tool name is required")
+    return ToolChoice(TOOL_CHOICE_TOOL, name)
+
+
+def apply_tool_choice(
+    tool_specs: List[Dict[str, Any]],
+    choice: ToolChoice,
+    tool_names: ToolNameMap,
+) -> Tuple[List[Dict[str, Any]], Optional[str]]:
+    """
+    按 tool_choice 调整发往上游的工具定义
+
+    Returns:
+        (toolSpecification 列表, 需要追加到当前消息末尾的指令；没有时为 None)
+    """
+    if choice.mode == TOOL_CHOICE_AUTO:
+        return tool_specs, None
+    if choice.mode == TOOL_CHOICE_NONE:
+        if tool_specs:
+            logger.info(f"🔧 tool_choice=none: 不向上游发送 {len(tool_specs)} 个工具定义")
+        return [], None
+    if not tool_specs:
+        raise ToolChoiceError("tools must be provided when tool_choice requires a tool call")
+    if choice.mode == TOOL_CHOICE_ANY:
+        return tool_specs, "You must call at least one of the available tools in your response."
+
+    upstream_name = tool_names.upstream_name(choice.name)
+    selected = [spec for spec in tool_specs if spec.get("toolSpecification", {}).get("name") == upstream_name]
+    if not selected:
+        raise ToolChoiceError(f"tool '{choice.name}' is not in tools")
+    logger.info(f"🔧 tool_choice 指定工具 {upstream_name}，只向上游发送该工具定义")
+    return selected, f"You must call the tool `{upstream_name}` in your response."
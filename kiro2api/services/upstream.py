@@ -0,0 +1,502 @@
+"""
+CodeWhisperer 上游请求执行
+OpenAI 与 Claude 两条路径共用：获取 token、403 刷新重试、429 切换账号
+
+执行函数只在拿到 200 响应后才返回，所有重试都发生在调用方向客户端写出任何字节之前，
+因此流式请求的重试不会破坏已经开始的 SSE 流。
+"""
+
+import json
+import time
+import random
+import asyncio
+import logging
+from typing import Any, AsyncIterator, Dict, Optional
+
+import httpx
+
+from config import (
+    KIRO_BASE_URL,
+    DEMO_MODE,
+    UPSTREAM_PREFETCH,
+    UPSTREAM_RETRY_MAX_ATTEMPTS,
+    UPSTREAM_RETRY_BASE_DELAY,
+    STREAM_READ_CHUNK_BYTES,
+)
+from errors import localize
+from auth import token_manager
+from auth.token_manager import SelectedToken, create_token_preview
+from services.demo_upstream import demo_upstream_handler
+from services.upstream_network import upstream_transport
+from services.circuit_breaker import upstream_breaker, CircuitOpenError
+from services.error_body import describe_error_body
+from services.conversation_cache import conversation_cache, is_stale_conversation_error
+from services.tool_utils import restore_compacted_tools
+from services.feature_flags import feature_flags, FLAG_UPSTREAM_PREFETCH
+from services.request_context import annotate_request, current_request_context
+from services.stream_timeouts import within_deadline
+from services.accounting import (
+    RequestAccounting,
+    FANOUT_PRIMARY,
+    FANOUT_RETRY_FORBIDDEN,
+    FANOUT_RETRY_RATE_LIMITED,
+    FANOUT_RETRY_TRANSIENT,
+    FANOUT_RETRY_CONVERSATION,
+    DECISION_ACCEPT,
+    DECISION_RETRY,
+    DECISION_FALLBACK,
+    DECISION_ABORT,
+)
+
+logger = logging.getLogger(__name__)
+
+# 429 时最多切换账号重试的次数
+MAX_RATE_LIMIT_ATTEMPTS = 3
+
+# 视为暂时性故障、可以退避重试的上游状态码
+TRANSIENT_STATUS_CODES = (500, 502, 503, 504)
+
+# 上游响应中的请求 ID 头（按优先级），向 AWS 提交工单时需要
+UPSTREAM_REQUEST_ID_HEADERS = ("x-amzn-requestid", "x-amz-request-id")
+
+
+def upstream_request_id(headers) -> Optional[str]:
+    """上游响应的请求 ID，没有时返回 None"""
+    lowered = {key.lower(): value for key, value in (headers or {}).items()}
+    for name in UPSTREAM_REQUEST_ID_HEADERS:
+        value = (lowered.get(name) or "").strip()
+        if value:
+            return value
+    return None
+
+
+class UpstreamError(Exception):
+    """上游请求失败，携带应返回给客户端的状态码和错误类型"""
+
+    def __init__(
+        self,
+        status_code: int,
+        message: str,
+        error_type: str = "api_error",
+        body: bytes = b"",
+        headers: Optional[Dict[str, str]] = None,
+    ):
+        super().__init__(message)
+        self.status_code = status_code
+        self.message = message
+        self.error_type = error_type
+        self.body = body
+        self.headers = headers or {}
+
+
+class NoTokenAvailableError(UpstreamError):
+    """没有可用的 access token"""
+
+    def __init__(self):
+        super().__init__(
+            401,
+            localize("no_token_available"),
+            "authentication_error",
+        )
+
+
+class TokenInvalidError(UpstreamError):
+    """token 失效（403），刷新或切换 token 并重试一次后仍然失败"""
+
+    def __init__(self, body: bytes = b""):
+        super().__init__(401, localize("token_invalid"), "authentication_error", body)
+
+
+class RateLimitedError(UpstreamError):
+    """所有账号都被限流（429）"""
+
+    def __init__(self, body: bytes = b"", headers: Optional[Dict[str, str]] = None):
+        super().__init__(429, localize("rate_limited"), "rate_limit_error", body, headers)
+
+
+class QuotaDepletedError(RateLimitedError):
+    """所有账号配置的请求额度（quota）都已用尽"""
+
+    def __init__(self):
+        UpstreamError.__init__(self, 429, localize("quota_depleted"), "rate_limit_error")
+
+
+class UpstreamCircuitOpenError(UpstreamError):
+    """上游熔断器打开，请求没有发往上游"""
+
+    def __init__(self, retry_after: int):
+        super().__init__(
+            503, localize("upstream_circuit_open", retry_after=retry_after), "api_error",
+            headers={"Retry-After": str(retry_after)},
+        )
+
+
+def no_token_error() -> UpstreamError:
+    """取不到 token 时应抛出的错误：额度全部用尽时为 429，否则为 401"""
+    if token_manager.all_quota_depleted():
+        return QuotaDepletedError()
+    return NoTokenAvailableError()
+
+
+def is_throttling_error(body: bytes, content_type: Optional[str] = None) -> bool:
+    """
+    识别 CodeWhisperer 的限流错误
+
+    限流不一定以 429 返回，也可能是其他状态码加上 __type / reason 为 ThrottlingException / THROTTLING 的错误体
+    （JSON 或 event-stream 异常帧），或者直接是包含 ThrottlingException 的纯文本错误体
+    """
+    return describe_error_body(body, content_type).is_throttling()
+
+
+def upstream_model_id(request_data: Dict[str, Any]) -> Optional[str]:
+    """CodeWhisperer 请求中的模型 ID"""
+    current = request_data.get("conversationState", {}).get("currentMessage", {})
+    return current.get("userInputMessage", {}).get("modelId")
+
+
+def retry_delay(attempt: int, base_delay: float = UPSTREAM_RETRY_BASE_DELAY) -> float:
+    """第 attempt 次重试前的等待时间：指数退避加 0~50% 的随机抖动"""
+    delay = base_delay * (2 ** (attempt - 1))
+    return delay + random.uniform(0, delay / 2)
+
+
+async def iter_response_bytes(
+    response: httpx.Response,
+    max_chunk_bytes: int = STREAM_READ_CHUNK_BYTES,
+) -> AsyncIterator[bytes]:
+    """
+    读取上游响应体，OpenAI / Claude 的流式和非流式路径共用
+
+    超过 max_chunk_bytes 的块拆分后依次产出；已经收到的数据立即产出，不会为凑满一个块而等待后续数据，
+    因此不会增加流式响应的延迟。max_chunk_bytes <= 0 时按收到的块原样产出
+    """
+    async for chunk in response.aiter_bytes():
+        if max_chunk_bytes <= 0 or len(chunk) <= max_chunk_bytes:
+            yield chunk
+            continue
+        for offset in range(0, len(chunk), max_chunk_bytes):
+            yield chunk[offset:offset + max_chunk_bytes]
+
+
+async def deep_probe_upstream(timeout: float) -> Dict[str, Any]:
+    """
+    /health?deep=true 的认证探测：取一个可用 token（可能触发刷新）后用它探测上游（演示模式下由模拟上游响应）
+
+    取 token 和探测共用 timeout，整个检查不会超过该时间太多；取不到 token 时只检查可达性
+    """
+    started = time.monotonic()
+    try:
+        if DEMO_MODE:
+            token = "demo"
+        else:
+            selected = await asyncio.wait_for(token_manager.get_token(), timeout)
+            token = selected.access_token if selected else None
+    except asyncio.TimeoutError:
+        logger.warning(f"健康检查获取 token 超时（{timeout} 秒）")
+        token = None
+    except Exception as e:
+        logger.warning(f"健康检查获取 token 失败: {e}")
+        token = None
+    remaining = max(0.5, timeout - (time.monotonic() - started))
+    result = await probe_upstream(remaining, token)
+    result["token_available"] = bool(token)
+    result["latency_ms"] = int((time.monotonic() - started) * 1000)
+    return result
+
+
+def create_upstream_client(timeout: Optional[httpx.Timeout] = None) -> httpx.AsyncClient:
+    """创建访问 CodeWhisperer 的 HTTP 客户端"""
+    if timeout is None:
+        # 分离连接超时和读取超时，避免长对话被截断
+        timeout = httpx.Timeout(connect=30.0, read=None, write=30.0, pool=30.0)
+    if DEMO_MODE:
+        return httpx.AsyncClient(timeout=timeout, transport=httpx.MockTransport(demo_upstream_handler))
+    return httpx.AsyncClient(timeout=timeout, transport=upstream_transport())
+
+
+async def execute_codewhisperer_request(
+    client: httpx.AsyncClient,
+    request_data: Dict[str, Any],
+    token: Optional[SelectedToken] = None,
+    accounting: Optional[RequestAccounting] = None,
+) -> httpx.Response:
+    """
+    发送 CodeWhisperer 请求，返回状态码为 200 的流式响应（调用方负责 aclose）
+
+    受当前请求的上游时限（UPSTREAM_TIMEOUT / X-Request-Timeout）约束：到期时取消正在进行的调用或重试等待，
+    抛出 DeadlineExceededError；重试策略见 send_with_retries
+    """
+    return await within_deadline(send_with_retries(client, request_data, token, accounting))
+
+
+async def send_with_retries(
+    client: httpx.AsyncClient,
+    request_data: Dict[str, Any],
+    token: Optional[SelectedToken] = None,
+    accounting: Optional[RequestAccounting] = None,
+) -> httpx.Response:
+    """
+    发送 CodeWhisperer 请求并按状态码重试，返回状态码为 200 的流式响应
+
+    - 403: 刷新当前 token 或隔离（冷却 TOKEN_UNHEALTHY_COOLDOWN_SECONDS 秒）后切换到下一个健康 token 重试；
+      刷新后仍然 403 时隔离该账号并换账号再试一次，换账号后仍然 403 则放弃
+    - 429: 标记账号耗尽并切换账号重试
+    - 500/502/503/504 和网络错误: 指数退避后重试，最多 UPSTREAM_RETRY_MAX_ATTEMPTS 次
+    - 400/404 且错误信息提到 conversation、请求沿用了客户端对话的 conversationId: 换新的 conversationId 重试一次
+    - 其他非 200: 抛出 UpstreamError，由调用方决定如何返回给客户端
+    - 上游熔断器打开时不发出请求，抛出 UpstreamCircuitOpenError（503）；网络错误和 5xx 计入熔断器的连续失败次数
+
+    所有重试都在返回 200 响应之前完成，此时还没有向客户端写出任何字节，因此流式请求同样可以安全重试
+
+    传入 accounting 时，每一次实际发出的上游调用都会记录一条上游调用级计量和调用之后的决定
+
+    token 为调用方已经取得的 token（没有时在这里获取）；每次调用使用的账号保存在 selected 中，
+    计量和 403 / 429 的处理都针对该账号，不受并发请求切换 current_index 的影响
+    """
+    selected = token or await token_manager.get_token()
+    if not selected:
+        raise no_token_error()
+
+    forbidden_refreshed = False
+    forbidden_switched = False
+    rate_limit_attempts = 0
+    transient_attempts = 0
+    conversation_reset = False
+    fanout = FANOUT_PRIMARY
+    model = upstream_model_id(request_data)
+
+    def record_call(
+        status_code: Optional[int], started: float, error: Optional[str] = None, request_id: Optional[str] = None
+    ):
+        if accounting:
+            accounting.record_upstream_call(
+                status_code, int((time.monotonic() - started) * 1000), fanout,
+                selected.name, error, model, create_token_preview(selected.access_token), request_id,
+            )
+
+    def decide(decision: str, reason: Optional[str] = None):
+        if accounting:
+            accounting.record_decision(decision, reason)
+
+    while True:
+        # 上游响应中途出错时，按这次调用的账号计入错误次数（见 response_handler.iter_kiro_events）
+        annotate_request(upstream_token=selected)
+        headers = {
+            "Authorization": f"Bearer {selected.access_token}",
+            "Content-Type": "application/json",
+            "Accept": "text/event-stream",
+        }
+        try:
+            upstream_breaker.before_call()
+        except CircuitOpenError as e:
+            decide(DECISION_ABORT, "circuit_open")
+            raise UpstreamCircuitOpenError(e.retry_after)
+        upstream_request = client.build_request("POST", KIRO_BASE_URL, headers=headers, json=request_data)
+        started = time.monotonic()
+        try:
+            response = await client.send(upstream_request, stream=True)
+        except Exception as e:
+            record_call(None, started, str(e) or type(e).__name__)
+            if isinstance(e, httpx.TransportError):
+                upstream_breaker.record_failure(repr(e))
+            transient_attempts += 1
+            if isinstance(e, httpx.TransportError) and transient_attempts < UPSTREAM_RETRY_MAX_ATTEMPTS:
+                delay = retry_delay(transient_attempts)
+                logger.warning(f"上游网络错误: {e!r}，{delay:.2f} 秒后重试（第 {transient_attempts} 次）")
+                decide(DECISION_RETRY)
+                await asyncio.sleep(delay)
+                fanout = FANOUT_RETRY_TRANSIENT
+                continue
+            decide(DECISION_ABORT)
+            raise
+        upstream_id = upstream_request_id(response.headers)
+        context = current_request_context()
+        logger.info(
+            f"📤 UPSTREAM RESPONSE STATUS: {response.status_code}"
+            f" (request_id={context.request_id if context else None}, upstream_request_id={upstream_id})"
+        )
+        annotate_request(upstream_request_id=upstream_id)
+        record_call(response.status_code, started, request_id=upstream_id)
+        if response.status_code in TRANSIENT_STATUS_CODES:
+            upstream_breaker.record_failure(f"HTTP {response.status_code}")
+        else:
+            upstream_breaker.record_success()
+
+        if response.status_code == 200:
+            decide(DECISION_ACCEPT)
+            return response
+
+        body = await response.aread()
+        await response.aclose()
+        error_body = describe_error_body(body, response.headers.get("content-type"))
+        reason = error_body.summary() or None
+
+        if response.status_code == 403:
+            if forbidden_switched:
+                logger.error("切换 token 后重试仍然返回 403")
+                token_manager.mark_token_unhealthy(selected, "403 after switching account")
+                decide(DECISION_ABORT, reason)
+                raise TokenInvalidError(body)
+            if forbidden_refreshed:
+                # 同一账号刷新后仍然 403：隔离该账号，换下一个健康账号再试；
+                # 没有其他可用账号时（不会隔离）仍然选中同一账号，不再重试
+                logger.info("刷新 token 后仍然返回 403，隔离该账号并切换...")
+                token_manager.mark_token_unhealthy(selected, "403 after refresh")
+                next_token = await token_manager.get_token()
+                if next_token and next_token.name == selected.name:
+                    next_token = None
+            else:
+                logger.info("收到403响应，尝试刷新或切换token后重试...")
+                next_token = await token_manager.handle_forbidden(selected)
+            if not next_token:
+                decide(DECISION_ABORT, reason)
+                raise TokenInvalidError(body)
+            forbidden_refreshed = True
+            forbidden_switched = next_token.name != selected.name
+            selected = next_token
+            decide(DECISION_FALLBACK if forbidden_switched else DECISION_RETRY, reason)
+            fanout = FANOUT_RETRY_FORBIDDEN
+            continue
+
+        if response.status_code == 429 or error_body.is_throttling():
+            logger.warning(f"收到{response.status_code}响应（速率限制），尝试切换账号...")
+            token_manager.mark_token_exhausted(selected, "rate_limit_429")
+            rate_limit_attempts += 1
+            if rate_limit_attempts < MAX_RATE_LIMIT_ATTEMPTS:
+                next_token = await token_manager.get_token()
+                if next_token:
+                    selected = next_token
+                    logger.info("已切换到新账号，重试请求...")
+                    decide(DECISION_FALLBACK, reason)
+                    fanout = FANOUT_RETRY_RATE_LIMITED
+                    continue
+            decide(DECISION_ABORT, reason)
+            raise RateLimitedError(body, dict(response.headers))
+
+        if response.status_code in TRANSIENT_STATUS_CODES:
+            transient_attempts += 1
+            if transient_attempts < UPSTREAM_RETRY_MAX_ATTEMPTS:
+                delay = retry_delay(transient_attempts)
+                logger.warning(f"上游暂时性错误 {response.status_code}，{delay:.2f} 秒后重试（第 {transient_attempts} 次）")
+                decide(DECISION_RETRY, reason)
+                await asyncio.sleep(delay)
+                fanout = FANOUT_RETRY_TRANSIENT
+                continue
+
+        conversation_state = request_data.get("conversationState") or {}
+        conversation_id = conversation_state.get("conversationId")
+        if (
+            not conversation_reset
+            and is_stale_conversation_error(response.status_code, reason)
+            and conversation_cache.is_reused(conversation_id)
+        ):
+            # 沿用的 conversationId 已失效：换新对话重试，request_data 随之更新，调用方记录的是新的 id；
+            # 新对话中上游没有见过前几轮的工具，跨轮次压缩省略的工具描述要写回去
+            conversation_state["conversationId"] = conversation_cache.reset(conversation_id)
+            restore_compacted_tools(conversation_state)
+            conversation_reset = True
+            decide(DECISION_RETRY, reason)
+            fanout = FANOUT_RETRY_CONVERSATION
+            continue
+
+        logger.error(f"API 错误: {response.status_code} - [{error_body.format}] {error_body.summary()}")
+        decide(DECISION_ABORT, reason)
+        summary = error_body.summary()
+        raise UpstreamError(
+            response.status_code,
+            localize("upstream_error_detail", status=response.status_code, detail=summary)
+            if summary else localize("upstream_error", status=response.status_code),
+            "api_error",
+            body,
+            dict(response.headers),
+        )
+
+
+class UpstreamStream:
+    """
+    流式请求的上游调用
+
+    开启 UPSTREAM_PREFETCH（或对当前请求开启了 upstream_prefetch 功能开关）时，构造时（处理函数返回 StreamingResponse 之前）就在后台发起上游请求，
+    与下游 SSE 响应头的发送重叠，缩短首 token 延迟；否则在 open() 时才发起。
+    两种方式下游看到的事件顺序完全相同：open() 拿到 200 响应之前不会产生任何下游事件。
+
+    aclose() 可重复调用；客户端在流开始前断开时，由 StreamingResponse 的 background 任务负责清理
+    """
+
+    def __init__(
+        self,
+        request_data: Dict[str, Any],
+        token: Optional[SelectedToken] = None,
+        accounting: Optional[RequestAccounting] = None,
+        prefetch: Optional[bool] = None,
+    ):
+        self.request_data = request_data
+        self.token = token
+        self.accounting = accounting
+        self._client: Optional[httpx.AsyncClient] = None
+        self._task: Optional[asyncio.Task] = None
+        self._closed = False
+        if prefetch is None:
+            prefetch = UPSTREAM_PREFETCH or feature_flags.enabled(FLAG_UPSTREAM_PREFETCH)
+        if prefetch:
+            self._start()
+
+    def _start(self):
+        self._client = create_upstream_client()
+        self._task = asyncio.ensure_future(
+            execute_codewhisperer_request(self._client, self.request_data, self.token, self.accounting)
+        )
+
+    async def open(self) -> httpx.Response:
+        """等待上游返回 200 响应，失败时抛出 UpstreamError"""
+        if self._task is None:
+            self._start()
+        return await self._task
+
+    async def aclose(self):
+        if self._closed:
+            return
+        self._closed = True
+        if self._task is not None:
+            if not self._task.done():
+                self._task.cancel()
+            await asyncio.wait([self._task])
+            # 失败或被取消的请求没有需要关闭的响应
+            if not self._task.cancelled() and self._task.exception() is None:
+                await self._task.result().aclose()
+        if self._client is not None:
+            await self._client.aclose()
+
+
+async def probe_upstream(timeout: float, token: Optional[str] = None) -> Dict[str, Any]:
+    """
+    轻量的上游检查
+
+    只要在超时内收到任意 HTTP 响应（包括 4xx）就视为可达。不带 token 时发送 HEAD；
+    带 token 时发送一个空的请求体，上游会以参数错误拒绝、不会生成回复，但会先校验 token，
+    返回 401 / 403 说明 token 不可用
+    """
+    started = time.monotonic()
+    try:
+        async with create_upstream_client(httpx.Timeout(timeout)) as client:
+            if token:
+                response = await client.post(
+                    KIRO_BASE_URL, json={}, headers={"Authorization": f"Bearer {token}", "Content-Type": "application/json"},
+                )
+            else:
+                response = await client.head(KIRO_BASE_URL)
+        result = {
+            "reachable": True,
+            "status_code": response.status_code,
+            "latency_ms": int((time.monotonic() - started) * 1000),
+        }
+        if token:
+            result["token_usable"] = response.status_code not in (401, 403)
+        return result
+    except Exception as e:
+        logger.warning(f"上游可达性检查失败: {e}")
+        return {
+            "reachable": False,
+            "error": str(e) or type(e).__name__,
+            "latency_ms": int((time.monotonic() - started) * 1000),
+        }
@@ -0,0 +1,124 @@
+"""
+上游连接的网络设置
+上游地址由 KIRO_UPSTREAM_URL / KIRO_REGION 决定，Host 头由 URL 推导（httpx 按请求 URL 设置）。
+用于隔离网络和分离 DNS（split-DNS）环境：
+
+- UPSTREAM_HOST_MAP：静态的主机名 → IP 映射（类似 /etc/hosts），连接时直接使用映射的 IP，
+  Host 头、TLS SNI 和证书校验仍使用原主机名
+- UPSTREAM_TLS_SERVER_NAME：覆盖 TLS SNI 和证书校验使用的名称，与 URL 中的主机名分开设置，
+  例如经由内部 TLS 网关转发、网关证书签发给另一个名称时
+
+只对访问 CodeWhisperer 的客户端生效；映射中出现我们不会访问的主机时启动失败，避免配置拼写错误被悄悄忽略
+"""
+
+import logging
+import ipaddress
+from functools import lru_cache
+from typing import Dict, Iterable, Optional
+from urllib.parse import urlparse
+
+import httpx
+
+from config import KIRO_BASE_URL, KIRO_REGION, PROFILE_ARN, UPSTREAM_HOST_MAP, UPSTREAM_TLS_SERVER_NAME
+
+logger = logging.getLogger(__name__)
+
+
+class UpstreamNetworkConfigError(ValueError):
+    """UPSTREAM_HOST_MAP / UPSTREAM_TLS_SERVER_NAME 配置不合法"""
+
+
+def validate_upstream_url(url: str) -> str:
+    """校验上游地址（必须是带主机名的 http(s) URL），返回其中的主机名"""
+    parsed = urlparse(url)
+    if parsed.scheme not in ("http", "https") or not parsed.hostname:
+        raise UpstreamNetworkConfigError(f"KIRO_UPSTREAM_URL 必须是带主机名的 http(s) URL: {url!r}")
+    return parsed.hostname
+
+
+def upstream_hosts() -> set:
+    """上游客户端会访问的主机名"""
+    return {urlparse(KIRO_BASE_URL).hostname}
+
+
+def parse_host_map(raw: str, allowed_hosts: Iterable[str]) -> Dict[str, str]:
+    """解析 "host=ip,host2=ip2" 形式的映射；格式错误、IP 不合法或主机不在 allowed_hosts 中时抛出异常"""
+    allowed = {host.lower() for host in allowed_hosts if host}
+    mapping: Dict[str, str] = {}
+    for item in raw.split(","):
+        item = item.strip()
+        if not item:
+            continue
+        host, sep, address = item.partition("=")
+        host, address = host.strip().lower(), address.strip()
+        if not sep or not host or not address:
+            raise UpstreamNetworkConfigError(f"UPSTREAM_HOST_MAP 条目格式应为 host=ip: {item!r}")
+        try:
+            ipaddress.ip_address(address)
+        except ValueError:
+            raise UpstreamNetworkConfigError(f"UPSTREAM_HOST_MAP 中 {host} 的地址不是合法的 IP: {address!r}")
+        if host not in allowed:
+            raise UpstreamNetworkConfigError(
+                f"UPSTREAM_HOST_MAP 包含不会访问的主机 {host}（可映射的主机: {', '.join(sorted(allowed))}）"
+            )
+        mapping[host] = address
+    return mapping
+
+
+class StaticHostTransport(httpx.AsyncBaseTransport):
+    """
+    按静态映射改写连接地址的 transport
+
+    请求 URL 中的主机名替换为映射的 IP 后交给内部 transport；Host 头在构造请求时已经按原主机名设置，
+    TLS SNI 和证书校验通过 sni_hostname 扩展使用 server_name（没有设置时为原主机名）
+    """
+
+    def __init__(
+        self,
+        transport: httpx.AsyncBaseTransport,
+        host_map: Dict[str, str],
+        server_name: Optional[str] = None,
+    ):
+        self.transport = transport
+        self.host_map = host_map
+        self.server_name = server_name
+
+    async def handle_async_request(self, request: httpx.Request) -> httpx.Response:
+        host = request.url.host
+        address = self.host_map.get(host.lower())
+        if address is not None or self.server_name:
+            if request.url.scheme == "https":
+                request.extensions = dict(request.extensions, sni_hostname=self.server_name or host)
+            if address is not None:
+                request.url = request.url.copy_with(host=address)
+        return await self.transport.handle_async_request(request)
+
+    async def aclose(self):
+        await self.transport.aclose()
+
+
+@lru_cache(maxsize=1)
+def configured_host_map() -> Dict[str, str]:
+    return parse_host_map(UPSTREAM_HOST_MAP, upstream_hosts())
+
+
+def load_upstream_network() -> Dict[str, str]:
+    """解析并校验上游地址和网络配置（启动时调用，配置错误时抛出 UpstreamNetworkConfigError），输出生效的设置"""
+    validate_upstream_url(KIRO_BASE_URL)
+    logger.info(f"🌐 上游地址: {KIRO_BASE_URL}（Host: {urlparse(KIRO_BASE_URL).netloc}）")
+    if KIRO_REGION not in PROFILE_ARN.split(":"):
+        logger.warning(f"⚠️ KIRO_PROFILE_ARN 不属于区域 {KIRO_REGION}，上游可能拒绝请求: {PROFILE_ARN}")
+    host_map = configured_host_map()
+    for host, address in host_map.items():
+        logger.info(f"🌐 上游静态地址映射: {host} -> {address}")
+    if UPSTREAM_TLS_SERVER_NAME:
+        logger.info(f"🔐 上游 TLS SNI / 证书校验名称: {UPSTREAM_TLS_SERVER_NAME}")
+    return host_map
+
+
+def upstream_transport() -> Optional[httpx.AsyncBaseTransport]:
+    """没有配置映射和 SNI 覆盖时返回 None，使用 httpx 默认的 transport"""
+    host_map = configured_host_map()
+    if not host_map and not UPSTREAM_TLS_SERVER_NAME:
+        return None
+    return StaticHostTransport(httpx.AsyncHTTPTransport(), host_map, UPSTREAM_TLS_SERVER_NAME or None)
@@ -0,0 +1,334 @@
+"""
+用量统计（GET /admin/usage）
+订阅 completion_bus 上的客户端请求级记录，按 UTC 小时、API Key 标签、模型累计请求数和 input / output token，
+查询时再按请求的时区汇总为每日桶，接口形式参照 Anthropic 管理 API 的用量报表，现成的计费看板可以直接对接：
+
+- 查询区间 [starting_at, ending_at) 以日期表示，在 tz 时区（IANA 名称，默认 UTC）中解释；每天一个桶，没有用量的日期也返回空桶
+- 按天分页：limit 为每页天数，next_page 是下一页第一天的日期，原样作为 page 参数传回
+- 费用按 USAGE_PRICING（合并内置价格）估算，token 数本身也是代理侧估算值；找不到单价的模型费用为 null
+- 用量按小时存储，UTC 偏移不是整小时的时区（如 +05:30）按小时对齐，日边界会有半小时的误差
+
+设置 USAGE_STORE_PATH 时用 SnapshotFile 持久化（原子写入、校验和、滚动备份），每 USAGE_FLUSH_SECONDS 秒写入一次，
+关闭时再写入一次；超过 USAGE_RETENTION_DAYS 的小时桶在写入时删除
+"""
+
+import io
+import csv
+import os
+import json
+import asyncio
+import logging
+import threading
+from datetime import date, datetime, timedelta, timezone, tzinfo
+from fnmatch import fnmatchcase
+from typing import Any, Dict, List, Optional, Tuple
+from zoneinfo import ZoneInfo, ZoneInfoNotFoundError
+
+from config import USAGE_STORE_PATH, USAGE_FLUSH_SECONDS, USAGE_RETENTION_DAYS, USAGE_PRICING
+from services.accounting import completion_bus, ClientRequestRecord
+from storage.snapshot_file import SnapshotFile, SnapshotCorruptError
+
+logger = logging.getLogger(__name__)
+
+HOUR_SECONDS = 3600
+# 没有 Key 标签的请求（例如演示模式）归入该标签
+UNKNOWN_KEY_LABEL = "unknown"
+
+DEFAULT_PAGE_DAYS = 7
+MAX_PAGE_DAYS = 31
+# 单次查询的最大区间，避免一次请求生成过多的空桶
+MAX_RANGE_DAYS = 366
+
+CSV_COLUMNS = ["date", "starting_at", "ending_at", "api_key", "model", "requests", "input_tokens", "output_tokens", "estimated_cost_usd"]
+
+# 内置单价（美元 / 百万 token），按 Anthropic 公开价格填写
+DEFAULT_PRICING: Dict[str, Dict[str, float]] = {
+    "*opus-4-5*": {"input": 5.0, "output": 25.0},
+    "*opus-4.5*": {"input": 5.0, "output": 25.0},
+    "*opus*": {"input": 15.0, "output": 75.0},
+    "*sonnet*": {"input": 3.0, "output": 15.0},
+    "*haiku*": {"input": 1.0, "output": 5.0},
+}
+
+
+class UsageQueryError(ValueError):
+    """查询参数不合法"""
+
+    def __init__(self, param: str, reason: str):
+        super().__init__(f"{param}: {reason}")
+        self.param = param
+        self.reason = reason
+
+
+def load_pricing(raw: str) -> Dict[str, Dict[str, float]]:
+    """解析 USAGE_PRICING：以 { 开头按 JSON 解析，否则视为 JSON 文件路径；格式错误时忽略并记录日志"""
+    raw = (raw or "").strip()
+    if not raw:
+        return {}
+    try:
+        if raw.startswith("{"):
+            data = json.loads(raw)
+        else:
+            with open(os.path.expanduser(raw), "r", encoding="utf-8") as f:
+                data = json.load(f)
+    except (OSError, ValueError) as e:
+        logger.error(f"❌ USAGE_PRICING 加载失败，仅使用内置价格: {e}")
+        return {}
+    if not isinstance(data, dict) or not all(
+        isinstance(price, dict) and all(isinstance(price.get(k), (int, float)) for k in ("input", "output"))
+        for price in data.values()
+    ):
+        logger.error("❌ USAGE_PRICING 必须是 {\"模型名或通配规则\": {\"input\": 单价, \"output\": 单价}} 形式的 JSON 对象，已忽略")
+        return {}
+    return data
+
+
+PRICING: Dict[str, Dict[str, float]] = {**DEFAULT_PRICING, **load_pricing(USAGE_PRICING)}
+
+
+def model_price(model: str, pricing: Dict[str, Dict[str, float]] = PRICING) -> Optional[Dict[str, float]]:
+    if model in pricing and "*" not in model:
+        return pricing[model]
+    for pattern in sorted((k for k in pricing if "*" in k), key=len, reverse=True):
+        if fnmatchcase(model, pattern):
+            return pricing[pattern]
+    return None
+
+
+def estimate_cost(model: str, input_tokens: int, output_tokens: int, pricing=PRICING) -> Optional[float]:
+    price = model_price(model, pricing)
+    if price is None:
+        return None
+    return round((input_tokens * price["input"] + output_tokens * price["output"]) / 1_000_000, 6)
+
+
+def parse_timezone(value: Optional[str]) -> tzinfo:
+    """IANA 时区名（如 Asia/Shanghai）或 UTC；为空时使用 UTC"""
+    if not value or value.upper() == "UTC":
+        return timezone.utc
+    try:
+        return ZoneInfo(value)
+    except (ZoneInfoNotFoundError, ValueError):
+        raise UsageQueryError("tz", f"unknown time zone '{value}'")
+
+
+def parse_day(value: str, param: str, tz: tzinfo) -> date:
+    """YYYY-MM-DD，或 RFC 3339 时间（换算到 tz 后取日期）"""
+    try:
+        if len(value) == 10:
+            return date.fromisoformat(value)
+        moment = datetime.fromisoformat(value.replace("Z", "+00:00"))
+    except ValueError:
+        raise UsageQueryError(param, f"'{value}' is not a date (YYYY-MM-DD) or RFC 3339 timestamp")
+    if moment.tzinfo is None:
+        return moment.date()
+    return moment.astimezone(tz).date()
+
+
+def day_bounds(day: date, tz: tzinfo) -> Tuple[datetime, datetime]:
+    """tz 中某一天的起止时间（UTC）；夏令时切换日的长度不是 24 小时"""
+    start = datetime(day.year, day.month, day.day, tzinfo=tz)
+    following = day + timedelta(days=1)
+    end = datetime(following.year, following.month, following.day, tzinfo=tz)
+    return start.astimezone(timezone.utc), end.astimezone(timezone.utc)
+
+
+class UsageStore:
+    def __init__(
+        self,
+        path: str = USAGE_STORE_PATH,
+        retention_days: int = USAGE_RETENTION_DAYS,
+        pricing: Dict[str, Dict[str, float]] = PRICING,
+    ):
+        self.snapshot = SnapshotFile(path) if path else None
+        self.retention_days = retention_days
+        self.pricing = pricing
+        # (UTC 小时起点的时间戳, Key 标签, 模型) -> [请求数, input token, output token]
+        self.buckets: Dict[Tuple[int, str, str], List[int]] = {}
+        self._lock = threading.Lock()
+        self._dirty = False
+        self._task: Optional[asyncio.Task] = None
+
+    def add(self, timestamp: float, key_label: Optional[str], model: str, input_tokens: int, output_tokens: int, requests: int = 1):
+        hour = int(timestamp) // HOUR_SECONDS * HOUR_SECONDS
+        key = (hour, key_label or UNKNOWN_KEY_LABEL, model)
+        with self._lock:
+            counts = self.buckets.setdefault(key, [0, 0, 0])
+            counts[0] += requests
+            counts[1] += input_tokens or 0
+            counts[2] += output_tokens or 0
+            self._dirty = True
+
+    def on_record(self, record):
+        """completion_bus 订阅者：累计每个客户端请求的用量"""
+        if isinstance(record, ClientRequestRecord):
+            self.add(record.timestamp, record.key_label, record.model, record.input_tokens, record.output_tokens)
+
+    # ------------------------------------------------------------------
+    # 查询
+    # ------------------------------------------------------------------
+
+    def _day_results(self, start: datetime, end: datetime) -> List[Dict[str, Any]]:
+        start_ts, end_ts = int(start.timestamp()), int(end.timestamp())
+        totals: Dict[Tuple[str, str], List[int]] = {}
+        with self._lock:
+            for (hour, key_label, model), counts in self.buckets.items():
+                if start_ts <= hour < end_ts:
+                    total = totals.setdefault((key_label, model), [0, 0, 0])
+                    for i in range(3):
+                        total[i] += counts[i]
+        return [
+            {
+                "api_key": key_label,
+                "model": model,
+                "requests": requests,
+                "input_tokens": input_tokens,
+                "output_tokens": output_tokens,
+                "estimated_cost_usd": estimate_cost(model, input_tokens, output_tokens, self.pricing),
+            }
+            for (key_label, model), (requests, input_tokens, output_tokens) in sorted(totals.items())
+        ]
+
+    def daily_report(
+        self,
+        starting_at: str,
+        ending_at: Optional[str] = None,
+        tz: Optional[str] = None,
+        limit: int = DEFAULT_PAGE_DAYS,
+        page: Optional[str] = None,
+    ) -> Dict[str, Any]:
+        """
+        [starting_at, ending_at) 之间每天按 Key 和模型汇总的用量
+
+        ending_at 默认为 tz 中的明天（包含今天）；starting_at 等于 ending_at 时返回空列表
+        """
+        zone = parse_timezone(tz)
+        first = parse_day(starting_at, "starting_at", zone)
+        if ending_at:
+            last = parse_day(ending_at, "ending_at", zone)
+        else:
+            last = datetime.now(zone).date() + timedelta(days=1)
+        if last < first:
+            raise UsageQueryError("ending_at", "ending_at must not be earlier than starting_at")
+        if (last - first).days > MAX_RANGE_DAYS:
+            raise UsageQueryError("ending_at", f"the range must not exceed {MAX_RANGE_DAYS} days")
+        if not 1 <= limit <= MAX_PAGE_DAYS:
+            raise UsageQueryError("limit", f"limit must be between 1 and {MAX_PAGE_DAYS}")
+        if page:
+            cursor = parse_day(page, "page", zone) if len(page) == 10 else None
+            if cursor is None or not first <= cursor < last:
+                raise UsageQueryError("page", f"'{page}' is not a page of this range")
+            first = cursor
+
+        page_end = min(last, first + timedelta(days=limit))
+        data = []
+        day = first
+        while day < page_end:
+            start, end = day_bounds(day, zone)
+            data.append({
+                "date": day.isoformat(),
+                "starting_at": start.astimezone(zone).isoformat(),
+                "ending_at": end.astimezone(zone).isoformat(),
+                "results": self._day_results(start, end),
+            })
+            day += timedelta(days=1)
+        has_more = page_end < last
+        return {
+            "object": "usage_report",
+            "bucket_width": "1d",
+            "timezone": tz or "UTC",
+            "data": data,
+            "has_more": has_more,
+            "next_page": page_end.isoformat() if has_more else None,
+        }
+
+    # ------------------------------------------------------------------
+    # 持久化
+    # ------------------------------------------------------------------
+
+    def load(self):
+        if self.snapshot is None:
+            return
+        try:
+            data = self.snapshot.load()
+        except SnapshotCorruptError as e:
+            logger.error(f"❌ 用量快照无法恢复，从空数据开始统计（损坏的文件已保留）: {e}")
+            return
+        if not data:
+            return
+        with self._lock:
+            for hour, key_label, model, requests, input_tokens, output_tokens in data.get("buckets", []):
+                self.buckets[(hour, key_label, model)] = [requests, input_tokens, output_tokens]
+        logger.info(f"📊 已加载用量快照: {len(self.buckets)} 个小时桶（{self.snapshot.loaded_from}）")
+
+    def prune(self, now: float):
+        if self.retention_days <= 0:
+            return
+        cutoff = int(now) - self.retention_days * 86400
+        with self._lock:
+            expired = [key for key in self.buckets if key[0] < cutoff]
+            for key in expired:
+                del self.buckets[key]
+            if expired:
+                self._dirty = True
+
+    def flush(self, now: Optional[float] = None) -> bool:
+        """有新用量时写入快照，返回是否写入"""
+        if self.snapshot is None:
+            return False
+        self.prune(now if now is not None else datetime.now(timezone.utc).timestamp())
+        with self._lock:
+            if not self._dirty:
+                return False
+            rows = [[hour, key_label, model, *counts] for (hour, key_label, model), counts in sorted(self.buckets.items())]
+            self._dirty = False
+        try:
+            self.snapshot.save({"buckets": rows})
+        except OSError as e:
+            with self._lock:
+                self._dirty = True
+            logger.error(f"❌ 写入用量快照失败: {e}")
+            return False
+        return True
+
+    async def _run(self, interval: float):
+        while True:
+            await asyncio.sleep(interval)
+            await asyncio.to_thread(self.flush)
+
+    def start(self, interval: float = USAGE_FLUSH_SECONDS):
+        if self.snapshot is not None and self._task is None:
+            self.load()
+            logger.info(f"📊 用量统计持久化已启用: path={self.snapshot.path} interval={interval:g}s")
+            self._task = asyncio.create_task(self._run(interval))
+
+    async def stop(self):
+        if self._task is not None:
+            self._task.cancel()
+            try:
+                await self._task
+            except asyncio.CancelledError:
+                pass
+            self._task = None
+        await asyncio.to_thread(self.flush)
+
+
+def report_to_csv(report: Dict[str, Any]) -> str:
+    """每个（日期, Key, 模型）一行；没有用量的日期不输出行"""
+    output = io.StringIO()
+    writer = csv.writer(output, lineterminator="\n")
+    writer.writerow(CSV_COLUMNS)
+    for bucket in report["data"]:
+        for result in bucket["results"]:
+            cost = result["estimated_cost_usd"]
+            writer.writerow([
+                bucket["date"], bucket["starting_at"], bucket["ending_at"], result["api_key"], result["model"],
+                result["requests"], result["input_tokens"], result["output_tokens"],
+                "" if cost is None else f"{cost:.6f}",
+            ])
+    return output.getvalue()
+
+
+# 全局单例
+usage_store = UsageStore()
+completion_bus.subscribe(usage_store.on_record)
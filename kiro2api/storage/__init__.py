@@ -2,5 +2,6 @@
 from .models import Account, Base
 from .database import get_db, init_db, close_db
 from .account_store import AccountStore
+from .snapshot_file import SnapshotFile, SnapshotCorruptError
 
-__all__ = ["Account", "Base", "get_db", "init_db", "close_db", "AccountStore"]
+__all__ = ["Account", "Base", "get_db", "init_db", "close_db", "AccountStore", "SnapshotFile", "SnapshotCorruptError"]
@@ -0,0 +1,172 @@
+"""
+JSON 快照文件
+用于把用量 / 预算等运行时状态持久化到本地（或共享）文件系统，保证进程崩溃后不会留下损坏的文件，
+文件损坏时也不会把已有数据当成空数据覆盖：
+
+- 原子写入：写入同目录下的临时文件，fsync 后 rename 覆盖目标文件，再 fsync 目录
+- 校验和：文件内容为 {"version": 1, "checksum": "sha256:...", "data": ...}，checksum 覆盖 data 的规范化 JSON，
+  可以发现截断或部分写入后仍然是合法 JSON 的情况
+- 滚动备份：每次写入前，把当前（校验通过的）主文件复制为 <path>.bak，之前的备份依次后移为 <path>.bak.2 ...
+- 恢复：主文件损坏时把它改名为 <path>.corrupt 保留现场，按顺序从备份中加载最近一份完好的快照并记录警告；
+  所有备份都损坏时抛出 SnapshotCorruptError，由调用方决定如何处理，而不是返回空数据
+"""
+
+import os
+import json
+import hashlib
+import logging
+import tempfile
+from typing import Any, List, Optional
+
+logger = logging.getLogger(__name__)
+
+SNAPSHOT_FORMAT_VERSION = 1
+DEFAULT_BACKUP_COUNT = 2
+
+
+class SnapshotCorruptError(ValueError):
+    """快照文件无法解析或校验和不匹配"""
+
+    def __init__(self, path: str, reason: str):
+        super().__init__(f"{path}: {reason}")
+        self.path = path
+        self.reason = reason
+
+
+def snapshot_checksum(data: Any) -> str:
+    canonical = json.dumps(data, ensure_ascii=False, sort_keys=True, separators=(",", ":"))
+    return "sha256:" + hashlib.sha256(canonical.encode("utf-8")).hexdigest()
+
+
+def encode_snapshot(data: Any) -> bytes:
+    document = {"version": SNAPSHOT_FORMAT_VERSION, "checksum": snapshot_checksum(data), "data": data}
+    return json.dumps(document, ensure_ascii=False, indent=2).encode("utf-8")
+
+
+def decode_snapshot(raw: bytes, path: str = "<snapshot>") -> Any:
+    """解析并校验快照内容，返回其中的 data"""
+    try:
+        document = json.loads(raw.decode("utf-8"))
+    except (UnicodeDecodeError, json.JSONDecodeError) as e:
+        raise SnapshotCorruptError(path, f"invalid JSON ({e})")
+    if not isinstance(document, dict) or "data" not in document or "checksum" not in document:
+        raise SnapshotCorruptError(path, "missing checksum or data field")
+    if document.get("version") != SNAPSHOT_FORMAT_VERSION:
+        raise SnapshotCorruptError(path, f"unsupported version {document.get('version')!r}")
+    if snapshot_checksum(document["data"]) != document["checksum"]:
+        raise SnapshotCorruptError(path, "checksum mismatch (partial write?)")
+    return document["data"]
+
+
+def _fsync_directory(directory: str):
+    """rename 之后 fsync 所在目录，保证目录项落盘（不支持的平台上忽略）"""
+    try:
+        fd = os.open(directory, os.O_RDONLY)
+    except OSError:
+        return
+    try:
+        os.fsync(fd)
+    except OSError:
+        pass
+    finally:
+        os.close(fd)
+
+
+def atomic_write(path: str, payload: bytes):
+    """写入临时文件并 fsync，再 rename 覆盖 path；任何一步失败时 path 保持原样"""
+    directory = os.path.dirname(os.path.abspath(path))
+    fd, tmp_path = tempfile.mkstemp(dir=directory, prefix=f".{os.path.basename(path)}.", suffix=".tmp")
+    try:
+        with os.fdopen(fd, "wb") as f:
+            f.write(payload)
+            f.flush()
+            os.fsync(f.fileno())
+        os.replace(tmp_path, path)
+    except BaseException:
+        try:
+            os.unlink(tmp_path)
+        except OSError:
+            pass
+        raise
+    _fsync_directory(directory)
+
+
+class SnapshotFile:
+    """一个带校验和、滚动备份和损坏恢复的 JSON 快照文件"""
+
+    def __init__(self, path: str, backup_count: int = DEFAULT_BACKUP_COUNT):
+        self.path = path
+        self.backup_count = max(0, backup_count)
+        # 最近一次 load() 实际读取的文件（从备份恢复时为备份路径），没有文件时为 None
+        self.loaded_from: Optional[str] = None
+
+    def backup_path(self, n: int = 1) -> str:
+        return f"{self.path}.bak" if n == 1 else f"{self.path}.bak.{n}"
+
+    @property
+    def corrupt_path(self) -> str:
+        return f"{self.path}.corrupt"
+
+    def _backup_paths(self) -> List[str]:
+        return [self.backup_path(n) for n in range(1, self.backup_count + 1)]
+
+    def _read(self, path: str) -> Any:
+        with open(path, "rb") as f:
+            return decode_snapshot(f.read(), path)
+
+    def _rotate_backups(self):
+        """把当前主文件复制为最新的备份；主文件不存在或已损坏时不轮转，避免覆盖完好的备份"""
+        if self.backup_count == 0 or not os.path.exists(self.path):
+            return
+        with open(self.path, "rb") as f:
+            raw = f.read()
+        try:
+            decode_snapshot(raw, self.path)
+        except SnapshotCorruptError as e:
+            logger.warning(f"⚠️ 快照主文件已损坏，跳过备份轮转: {e}")
+            return
+        backups = self._backup_paths()
+        for older, newer in zip(reversed(backups[1:]), reversed(backups[:-1])):
+            if os.path.exists(newer):
+                os.replace(newer, older)
+        atomic_write(backups[0], raw)
+
+    def save(self, data: Any):
+        payload = encode_snapshot(data)
+        self._rotate_backups()
+        atomic_write(self.path, payload)
+
+    def load(self) -> Optional[Any]:
+        """
+        读取快照；主文件和备份都不存在时返回 None
+
+        主文件损坏时改名为 <path>.corrupt，从最近的完好备份恢复；全部损坏时抛出 SnapshotCorruptError
+        """
+        self.loaded_from = None
+        errors: List[SnapshotCorruptError] = []
+        if os.path.exists(self.path):
+            try:
+                data = self._read(self.path)
+                self.loaded_from = self.path
+                return data
+            except SnapshotCorruptError as e:
+                errors.append(e)
+                logger.error(f"❌ 快照文件已损坏: {e}，保留为 {self.corrupt_path}，尝试从备份恢复")
+                os.replace(self.path, self.corrupt_path)
+
+        for backup in self._backup_paths():
+            if not os.path.exists(backup):
+                continue
+            try:
+                data = self._read(backup)
+            except SnapshotCorruptError as e:
+                errors.append(e)
+                logger.warning(f"⚠️ 快照备份也已损坏: {e}")
+                continue
+            logger.warning(f"⚠️ 已从备份恢复快照: {backup}（之后的更改已丢失）")
+            self.loaded_from = backup
+            return data
+
+        if errors:
+            raise SnapshotCorruptError(self.path, "snapshot and all backups are corrupt: " + "; ".join(e.reason for e in errors))
+        return None
@@ -0,0 +1,56 @@
+"""
+测试公共配置
+在导入应用之前设置环境变量：演示模式（内置假上游，不需要 Kiro 凭证和数据库）、固定的 API Key，
+避免读取本地 .env 中的部署配置影响测试结果
+"""
+
+import os
+
+os.environ.update({
+    "DEMO_MODE": "true",
+    "API_KEY": "test-api-key",
+    "ADMIN_API_KEY": "test-admin-key",
+    "ERROR_LOCALE": "en",
+    # 允许 n > 1，覆盖多 choice 的合并和计量
+    "OPENAI_MAX_N": "3",
+    # 一个指向已知模型的别名和一个目标不在模型映射中的别名
+    "MODEL_ALIASES": '{"gpt-4o": "claude-sonnet-4-5-20250929", "gpt-broken": "no-such-model"}',
+})
+
+import pytest
+from fastapi.testclient import TestClient
+
+API_KEY = os.environ["API_KEY"]
+ADMIN_API_KEY = os.environ["ADMIN_API_KEY"]
+
+
+@pytest.fixture(scope="session")
+def app():
+    from app import app as application
+    return application
+
+
+@pytest.fixture(scope="session")
+def client(app):
+    # 进入上下文时执行 lifespan（演示模式下不初始化数据库和账号）
+    with TestClient(app) as test_client:
+        yield test_client
+
+
+@pytest.fixture
+def auth_headers():
+    return {"Authorization": f"Bearer {API_KEY}"}
+
+
+@pytest.fixture
+def admin_headers():
+    return {"Authorization": f"Bearer {ADMIN_API_KEY}"}
+
+
+@pytest.fixture
+def records(monkeypatch):
+    """测试期间发布到 completion_bus 的计量记录"""
+    from services.accounting import completion_bus
+    collected = []
+    monkeypatch.setattr(completion_bus, "_subscribers", completion_bus._subscribers + [collected.append])
+    return collected
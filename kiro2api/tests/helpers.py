@@ -0,0 +1,113 @@
+"""测试用的 SSE 解析工具、多账号 token 管理器和假上游"""
+
+import json
+import asyncio
+import importlib
+from typing import Any, Dict, List, Optional, Tuple
+
+from auth.config import AuthConfig
+from auth.token_manager import MultiAccountTokenManager
+
+# auth 包导出的 token_manager 是全局实例，模块本身从 importlib 取
+token_manager_module = importlib.import_module("auth.token_manager")
+
+
+def openai_chunks(body: str) -> Tuple[List[Dict[str, Any]], bool]:
+    """OpenAI 流的 data 行解析为 chunk 列表，同时返回是否以 [DONE] 结束"""
+    chunks = []
+    done = False
+    for line in body.splitlines():
+        if not line.startswith("data: "):
+            continue
+        data = line[len("data: "):]
+        if data == "[DONE]":
+            done = True
+            continue
+        chunks.append(json.loads(data))
+    return chunks, done
+
+
+def claude_events(body: str) -> List[Tuple[str, Dict[str, Any]]]:
+    """Claude 流解析为 (event, data) 列表，忽略保活的 ping"""
+    events = []
+    for block in body.split("\n\n"):
+        event_type, data = None, None
+        for line in block.splitlines():
+            if line.startswith("event: "):
+                event_type = line[len("event: "):]
+            elif line.startswith("data: "):
+                data = json.loads(line[len("data: "):])
+        if event_type and event_type != "ping":
+            events.append((event_type, data))
+    return events
+
+
+def openai_text(chunks: List[Dict[str, Any]]) -> str:
+    return "".join(
+        choice["delta"].get("content") or ""
+        for chunk in chunks for choice in chunk.get("choices", [])
+    )
+
+
+def claude_text(events: List[Tuple[str, Dict[str, Any]]]) -> str:
+    return "".join(
+        data["delta"].get("text", "")
+        for event_type, data in events
+        if event_type == "content_block_delta" and data["delta"].get("type") == "text_delta"
+    )
+
+
+def make_manager(monkeypatch, *names) -> MultiAccountTokenManager:
+    """按账号名创建已初始化的 token 管理器（sequential 策略），刷新得到 <账号名>-token-<刷新次数>"""
+    monkeypatch.setattr(token_manager_module, "DEMO_MODE", False)
+    manager = MultiAccountTokenManager()
+    manager.strategy = "sequential"
+    manager.configs = [AuthConfig(refresh_token=f"refresh-{name}", name=name) for name in names]
+    manager._initialized = True
+    manager.refresh_count = 0
+
+    async def fake_refresh(config):
+        manager.refresh_count += 1
+        return f"{config.name}-token-{manager.refresh_count}"
+
+    monkeypatch.setattr(manager, "_refresh_single_token", fake_refresh)
+    return manager
+
+
+class FakeUpstreamResponse:
+    def __init__(self, status_code: int, body: bytes = b""):
+        self.status_code = status_code
+        self.body = body
+        self.headers = {"content-type": "application/json"}
+        self.closed = False
+
+    async def aread(self) -> bytes:
+        return self.body
+
+    async def aclose(self):
+        self.closed = True
+
+
+class FakeUpstreamClient:
+    """
+    按 access token 所属账号返回预设状态码的上游客户端（实现 send_with_retries 用到的 build_request / send）
+
+    statuses 为 账号名 -> 状态码列表，每次调用依次取出一个，取完后返回 200；calls 记录每次调用使用的账号
+    """
+
+    def __init__(self, statuses: Optional[Dict[str, List[int]]] = None):
+        self.statuses = {name: list(codes) for name, codes in (statuses or {}).items()}
+        self.calls: List[str] = []
+
+    def build_request(self, method, url, headers=None, json=None):
+        return {"method": method, "url": url, "headers": headers, "json": json}
+
+    async def send(self, request, stream=False):
+        token = request["headers"]["Authorization"][len("Bearer "):]
+        account = token.split("-token-")[0]
+        self.calls.append(account)
+        # 让出事件循环，并发的请求在这里交错
+        await asyncio.sleep(0)
+        codes = self.statuses.get(account) or []
+        status_code = codes.pop(0) if codes else 200
+        return FakeUpstreamResponse(status_code, b'{"message": "upstream test error"}' if status_code != 200 else b"")
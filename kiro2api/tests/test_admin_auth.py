@@ -0,0 +1,51 @@
+"""管理端点只接受 ADMIN_API_KEY；API_KEY 不能访问管理端点，ADMIN_API_KEY 也不能访问普通 API"""
+
+import importlib
+
+import pytest
+
+# auth 包导出的 verify_api_key 等是函数，模块本身从 importlib 取
+api_key_module = importlib.import_module("auth.api_key")
+
+USAGE_PATH = "/admin/usage?starting_at=2026-03-01&ending_at=2026-03-02"
+ADMIN_ROUTES = [("get", USAGE_PATH), ("post", "/admin/refresh-token"), ("post", "/admin/tokenizer/calibrate")]
+
+
+def test_usage_with_admin_key(client, admin_headers):
+    response = client.get(USAGE_PATH, headers=admin_headers)
+    assert response.status_code == 200
+    assert response.json()["object"] == "usage_report"
+
+
+@pytest.mark.parametrize("method, path", ADMIN_ROUTES)
+def test_api_key_rejected_on_admin_routes(client, auth_headers, method, path):
+    response = getattr(client, method)(path, headers=auth_headers)
+    assert response.status_code == 401
+    assert response.json()["detail"]["error"]["code"] == "invalid_api_key"
+    assert "ADMIN_API_KEY" in response.json()["detail"]["error"]["message"]
+
+
+@pytest.mark.parametrize("method, path", ADMIN_ROUTES)
+def test_missing_key_rejected_on_admin_routes(client, method, path):
+    response = getattr(client, method)(path)
+    assert response.status_code == 401
+
+
+def test_admin_key_rejected_on_api_routes(client, admin_headers):
+    response = client.get("/v1/models", headers=admin_headers)
+    assert response.status_code == 401
+
+
+def test_admin_routes_disabled_without_admin_key(client, admin_headers, monkeypatch):
+    monkeypatch.setattr(api_key_module, "ADMIN_API_KEY", "")
+    response = client.get(USAGE_PATH, headers=admin_headers)
+    assert response.status_code == 403
+    assert response.json()["detail"]["error"]["code"] == "admin_api_key_not_configured"
+
+
+def test_calibrate_with_admin_key(client, admin_headers):
+    body = {"samples": [{"text": "hello world, this is a calibration sample", "expected_tokens": 9}]}
+    response = client.post("/admin/tokenizer/calibrate", json=body, headers=admin_headers)
+    assert response.status_code == 200
+    assert response.json()["applied"] is False
+    assert "suggested_multipliers" in response.json()
@@ -0,0 +1,87 @@
+"""
+base64 编码的请求体（Content-Encoding: base64 或 Content-Type: application/json+base64）：
+先解码再交给路由；无法解码时返回 400，解码后超过 MAX_REQUEST_BODY_BYTES 时返回 413，两个接口行为一致
+"""
+
+import base64
+import json
+
+import pytest
+from fastapi.testclient import TestClient
+
+from services.request_limits import MaxBodySizeMiddleware, base64_declaration, decode_base64_body
+
+MODEL = "claude-sonnet-4-5-20250929"
+ROUTES = {
+    "/v1/messages": {"model": MODEL, "max_tokens": 64, "stream": False, "messages": [{"role": "user", "content": "hello"}]},
+    "/v1/chat/completions": {"model": MODEL, "stream": False, "messages": [{"role": "user", "content": "hello"}]},
+}
+DECLARATIONS = [
+    {"Content-Encoding": "base64", "Content-Type": "application/json"},
+    {"Content-Type": "application/json+base64"},
+]
+
+
+def encoded(body, wrap=False):
+    data = base64.b64encode(json.dumps(body).encode())
+    # 部分客户端按 76 字符换行
+    return b"\n".join(data[i:i + 76] for i in range(0, len(data), 76)) if wrap else data
+
+
+def test_declaration():
+    assert base64_declaration({b"content-encoding": b"base64"}) == "Content-Encoding: base64"
+    assert base64_declaration({b"content-type": b"application/json+base64; charset=utf-8"}) == (
+        "Content-Type: application/json+base64"
+    )
+    assert base64_declaration({b"content-type": b"application/json"}) == ""
+
+
+def test_decode():
+    body = {"text": "你好"}
+    assert json.loads(decode_base64_body(encoded(body, wrap=True))) == body
+    with pytest.raises(ValueError):
+        decode_base64_body(b"not*base64!")
+
+
+@pytest.mark.parametrize("path", ROUTES)
+@pytest.mark.parametrize("declaration", DECLARATIONS)
+def test_valid_body(client, auth_headers, path, declaration):
+    response = client.post(path, content=encoded(ROUTES[path], wrap=True), headers={**auth_headers, **declaration})
+    assert response.status_code == 200
+
+
+def test_invalid_body_claude(client, auth_headers):
+    response = client.post("/v1/messages", content=b"not*base64!", headers={**auth_headers, **DECLARATIONS[0]})
+    assert response.status_code == 400
+    error = response.json()["detail"]
+    assert error["type"] == "error"
+    assert error["error"]["type"] == "invalid_request_error"
+
+
+def test_invalid_body_openai(client, auth_headers):
+    response = client.post("/v1/chat/completions", content=b"not*base64!", headers={**auth_headers, **DECLARATIONS[1]})
+    assert response.status_code == 400
+    assert response.json()["detail"]["error"]["code"] == "invalid_base64_body"
+
+
+@pytest.fixture
+def small_limit_client(app, client):
+    """在应用外面再套一层限制为 1024 字节的中间件（应用自己的中间件在定义时已按配置创建）"""
+    return TestClient(MaxBodySizeMiddleware(app, max_bytes=1024))
+
+
+@pytest.mark.parametrize("path", ROUTES)
+def test_oversized_after_decode(small_limit_client, auth_headers, path):
+    body = {**ROUTES[path], "messages": [{"role": "user", "content": "x" * 1500}]}
+    data = encoded(body)
+    # 编码后的长度在读取上限以内，解码后才超过限制
+    assert len(data) < 1024 * 2 * 4 // 3
+    response = small_limit_client.post(path, content=data, headers={**auth_headers, **DECLARATIONS[0]})
+    assert response.status_code == 413
+    assert response.json()["detail"]["error"]["code"] == "request_too_large"
+
+
+@pytest.mark.parametrize("path", ROUTES)
+def test_within_limit_after_decode(small_limit_client, auth_headers, path):
+    response = small_limit_client.post(path, content=encoded(ROUTES[path]), headers={**auth_headers, **DECLARATIONS[1]})
+    assert response.status_code == 200
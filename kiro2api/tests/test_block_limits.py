@@ -0,0 +1,124 @@
+"""
+内容块和工具调用数量上限（STREAM_MAX_CONTENT_BLOCKS / STREAM_MAX_TOOL_CALLS）
+假上游替换为一次返回多个工具调用，两个接口的流式和非流式响应都应以 block_limit 错误结束
+"""
+
+import json
+
+import pytest
+
+from services import block_limits, demo_upstream
+from services.demo_upstream import encode_event_stream_message
+from tests.helpers import openai_chunks, claude_events
+
+MODEL = "claude-sonnet-4-5-20250929"
+TOOL_CALLS = 3
+
+
+def build_many_tool_calls(request_data, options=None):
+    """一段文本后跟 TOOL_CALLS 个工具调用"""
+    frames = [
+        encode_event_stream_message("messageMetadataEvent", {"conversationId": "demo-block-limit"}),
+        encode_event_stream_message("assistantResponseEvent", {"content": "calling tools"}),
+    ]
+    for i in range(TOOL_CALLS):
+        tool_use_id = f"tooluse_limit_{i}"
+        frames.append(encode_event_stream_message(
+            "toolUseEvent", {"name": "get_weather", "toolUseId": tool_use_id, "input": json.dumps({"i": i})}
+        ))
+        frames.append(encode_event_stream_message(
+            "toolUseEvent", {"name": "get_weather", "toolUseId": tool_use_id, "stop": True}
+        ))
+    return [(frame, 0.0) for frame in frames]
+
+
+@pytest.fixture
+def many_tool_calls(monkeypatch):
+    monkeypatch.setattr(demo_upstream, "build_demo_events", build_many_tool_calls)
+
+
+def limit_tool_calls(monkeypatch, limit):
+    monkeypatch.setattr(block_limits, "STREAM_MAX_TOOL_CALLS", limit)
+
+
+def limit_content_blocks(monkeypatch, limit):
+    monkeypatch.setattr(block_limits, "STREAM_MAX_CONTENT_BLOCKS", limit)
+
+
+def chat_request(**overrides):
+    return {"model": MODEL, "messages": [{"role": "user", "content": "weather"}], **overrides}
+
+
+def message_request(**overrides):
+    return {"model": MODEL, "max_tokens": 256, "messages": [{"role": "user", "content": "weather"}], **overrides}
+
+
+def test_within_limits_succeeds(client, auth_headers, many_tool_calls):
+    response = client.post("/v1/chat/completions", json=chat_request(), headers=auth_headers)
+    assert response.status_code == 200
+    assert len(response.json()["choices"][0]["message"]["tool_calls"]) == TOOL_CALLS
+
+
+def test_chat_tool_call_limit(client, auth_headers, many_tool_calls, monkeypatch):
+    limit_tool_calls(monkeypatch, 2)
+    response = client.post("/v1/chat/completions", json=chat_request(), headers=auth_headers)
+    assert response.status_code == 502
+    assert response.json()["detail"]["error"]["code"] == "upstream_block_limit"
+
+
+def test_chat_stream_tool_call_limit(client, auth_headers, many_tool_calls, monkeypatch):
+    limit_tool_calls(monkeypatch, 2)
+    response = client.post("/v1/chat/completions", json=chat_request(stream=True), headers=auth_headers)
+    assert response.status_code == 200
+    chunks, done = openai_chunks(response.text)
+    assert done
+    tool_starts = [
+        delta for chunk in chunks for choice in chunk.get("choices", [])
+        for delta in choice["delta"].get("tool_calls") or [] if delta.get("id")
+    ]
+    assert len(tool_starts) == 2
+    assert chunks[-1]["error"]["type"] == "api_error"
+
+
+def test_chat_ignores_content_block_limit(client, auth_headers, many_tool_calls, monkeypatch):
+    # OpenAI 响应没有内容块，只受工具调用上限约束
+    limit_content_blocks(monkeypatch, 1)
+    response = client.post("/v1/chat/completions", json=chat_request(), headers=auth_headers)
+    assert response.status_code == 200
+
+
+def test_message_tool_call_limit(client, auth_headers, many_tool_calls, monkeypatch):
+    limit_tool_calls(monkeypatch, 2)
+    response = client.post("/v1/messages", json=message_request(), headers=auth_headers)
+    assert response.status_code == 502
+    body = response.json()["detail"]
+    assert body["type"] == "error"
+    assert body["error"]["type"] == "api_error"
+
+
+def test_message_content_block_limit(client, auth_headers, many_tool_calls, monkeypatch):
+    # 文本块和第一个工具调用之后，第二个工具调用需要第三个内容块
+    limit_content_blocks(monkeypatch, 2)
+    response = client.post("/v1/messages", json=message_request(), headers=auth_headers)
+    assert response.status_code == 502
+    assert response.json()["detail"]["error"]["type"] == "api_error"
+
+
+@pytest.mark.parametrize("limit_kind", ["tool_calls", "content_blocks"])
+def test_message_stream_limit(client, auth_headers, many_tool_calls, monkeypatch, limit_kind):
+    if limit_kind == "tool_calls":
+        limit_tool_calls(monkeypatch, 2)
+    else:
+        limit_content_blocks(monkeypatch, 2)
+    response = client.post("/v1/messages", json=message_request(stream=True), headers=auth_headers)
+    assert response.status_code == 200
+    events = claude_events(response.text)
+    types = [event_type for event_type, _ in events]
+    assert types[0] == "message_start"
+    assert types[-1] == "error"
+    assert "message_stop" not in types
+    tool_starts = [
+        data for event_type, data in events
+        if event_type == "content_block_start" and data["content_block"]["type"] == "tool_use"
+    ]
+    assert len(tool_starts) == (2 if limit_kind == "tool_calls" else 1)
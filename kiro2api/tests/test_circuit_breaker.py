@@ -0,0 +1,114 @@
+"""上游熔断器的状态转换：closed -> open -> half_open -> closed / open"""
+
+import pytest
+
+from services.circuit_breaker import (
+    CircuitBreaker,
+    CircuitOpenError,
+    STATE_CLOSED,
+    STATE_OPEN,
+    STATE_HALF_OPEN,
+)
+
+
+class FakeClock:
+    def __init__(self):
+        self.now = 1000.0
+
+    def __call__(self) -> float:
+        return self.now
+
+    def advance(self, seconds: float):
+        self.now += seconds
+
+
+@pytest.fixture
+def clock():
+    return FakeClock()
+
+
+@pytest.fixture
+def breaker(clock):
+    return CircuitBreaker(failure_threshold=3, open_seconds=10, clock=clock)
+
+
+def fail(breaker, times):
+    for _ in range(times):
+        breaker.before_call()
+        breaker.record_failure("HTTP 503")
+
+
+def test_opens_after_consecutive_failures(breaker):
+    fail(breaker, 2)
+    assert breaker.state == STATE_CLOSED
+    fail(breaker, 1)
+    assert breaker.state == STATE_OPEN
+    assert breaker.open_count == 1
+    with pytest.raises(CircuitOpenError) as exc_info:
+        breaker.before_call()
+    assert exc_info.value.retry_after == 10
+
+
+def test_success_resets_failure_count(breaker):
+    fail(breaker, 2)
+    breaker.record_success()
+    fail(breaker, 2)
+    assert breaker.state == STATE_CLOSED
+    assert breaker.consecutive_failures == 2
+
+
+def test_retry_after_counts_down(breaker, clock):
+    fail(breaker, 3)
+    clock.advance(4)
+    with pytest.raises(CircuitOpenError) as exc_info:
+        breaker.before_call()
+    assert exc_info.value.retry_after == 6
+    assert breaker.status()["retry_after_seconds"] == 6
+
+
+def test_half_open_allows_single_probe(breaker, clock):
+    fail(breaker, 3)
+    clock.advance(10)
+    breaker.before_call()
+    assert breaker.state == STATE_HALF_OPEN
+    # 探测请求进行期间，其他请求照常拒绝
+    with pytest.raises(CircuitOpenError):
+        breaker.before_call()
+
+
+def test_half_open_success_closes(breaker, clock):
+    fail(breaker, 3)
+    clock.advance(10)
+    breaker.before_call()
+    breaker.record_success()
+    assert breaker.state == STATE_CLOSED
+    assert breaker.consecutive_failures == 0
+    breaker.before_call()
+
+
+def test_half_open_failure_reopens(breaker, clock):
+    fail(breaker, 3)
+    clock.advance(10)
+    breaker.before_call()
+    breaker.record_failure("timeout")
+    assert breaker.state == STATE_OPEN
+    assert breaker.open_count == 2
+    with pytest.raises(CircuitOpenError):
+        breaker.before_call()
+
+
+def test_abandoned_probe_allows_next_probe(breaker, clock):
+    fail(breaker, 3)
+    clock.advance(10)
+    breaker.before_call()
+    # 探测请求被取消、没有报告结果：超过 open_seconds 后放行下一个探测
+    clock.advance(10)
+    breaker.before_call()
+    assert breaker.state == STATE_HALF_OPEN
+
+
+def test_disabled_never_opens(clock):
+    breaker = CircuitBreaker(failure_threshold=0, open_seconds=10, clock=clock)
+    fail(breaker, 100)
+    assert breaker.state == STATE_CLOSED
+    breaker.before_call()
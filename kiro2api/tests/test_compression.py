@@ -0,0 +1,175 @@
+"""
+响应压缩：客户端接受 gzip/deflate 时，不小于 RESPONSE_COMPRESSION_MIN_BYTES 的非流式 JSON 响应被压缩；
+SSE 流式响应无论大小永远原样透传
+"""
+
+import asyncio
+import gzip
+import json
+import zlib
+
+import pytest
+
+from services import demo_upstream
+from services.compression import ResponseCompressionMiddleware, negotiate_encoding, is_compressible
+from services.demo_upstream import encode_event_stream_message
+from tests.helpers import openai_chunks, openai_text, claude_events, claude_text
+
+MODEL = "claude-sonnet-4-5-20250929"
+LARGE_TEXT = "compressible text " * 500
+
+
+@pytest.mark.parametrize("accept_encoding, expected", [
+    ("gzip, deflate", "gzip"),
+    ("deflate", "deflate"),
+    ("gzip;q=0, deflate", "deflate"),
+    ("*", "gzip"),
+    ("br", None),
+    ("gzip;q=0", None),
+    ("", None),
+])
+def test_negotiate_encoding(accept_encoding, expected):
+    assert negotiate_encoding(accept_encoding) == expected
+
+
+def test_is_compressible():
+    assert is_compressible("application/json")
+    assert is_compressible("application/problem+json; charset=utf-8")
+    assert not is_compressible("text/event-stream; charset=utf-8")
+    assert not is_compressible("text/plain")
+
+
+def json_app(body):
+    async def app(scope, receive, send):
+        await send({"type": "http.response.start", "status": 200, "headers": [
+            (b"content-type", b"application/json"), (b"content-length", str(len(body)).encode()),
+        ]})
+        await send({"type": "http.response.body", "body": body})
+    return app
+
+
+def sse_app(events):
+    async def app(scope, receive, send):
+        await send({"type": "http.response.start", "status": 200, "headers": [(b"content-type", b"text/event-stream")]})
+        for event in events:
+            await send({"type": "http.response.body", "body": event, "more_body": True})
+        await send({"type": "http.response.body", "body": b""})
+    return app
+
+
+def call(middleware, accept_encoding="gzip"):
+    """调用中间件，返回 (发出的消息列表, 响应头)"""
+    messages = []
+
+    async def receive():
+        return {"type": "http.request", "body": b"", "more_body": False}
+
+    async def send(message):
+        messages.append(message)
+
+    scope = {"type": "http", "method": "POST", "path": "/v1/messages", "headers": [(b"accept-encoding", accept_encoding.encode())]}
+    asyncio.run(middleware(scope, receive, send))
+    headers = {k.decode().lower(): v.decode() for k, v in messages[0].get("headers", [])}
+    return messages, headers
+
+
+def test_large_json_is_compressed():
+    body = json.dumps({"text": LARGE_TEXT}).encode()
+    messages, headers = call(ResponseCompressionMiddleware(json_app(body), enabled=True, min_bytes=1024))
+    assert headers["content-encoding"] == "gzip"
+    assert headers["vary"] == "Accept-Encoding"
+    compressed = messages[1]["body"]
+    assert int(headers["content-length"]) == len(compressed) < len(body)
+    assert gzip.decompress(compressed) == body
+
+
+def test_deflate():
+    body = json.dumps({"text": LARGE_TEXT}).encode()
+    messages, headers = call(ResponseCompressionMiddleware(json_app(body), enabled=True, min_bytes=1024), "deflate")
+    assert headers["content-encoding"] == "deflate"
+    assert zlib.decompress(messages[1]["body"]) == body
+
+
+def test_small_json_passes_through():
+    body = b'{"ok": true}'
+    messages, headers = call(ResponseCompressionMiddleware(json_app(body), enabled=True, min_bytes=1024))
+    assert "content-encoding" not in headers
+    assert messages[1]["body"] == body
+
+
+def test_without_accept_encoding_passes_through():
+    body = json.dumps({"text": LARGE_TEXT}).encode()
+    messages, headers = call(ResponseCompressionMiddleware(json_app(body), enabled=True, min_bytes=1024), "identity")
+    assert "content-encoding" not in headers
+    assert messages[1]["body"] == body
+
+
+def test_sse_is_never_compressed():
+    events = [f"data: {LARGE_TEXT}\n\n".encode()] * 3
+    messages, headers = call(ResponseCompressionMiddleware(sse_app(events), enabled=True, min_bytes=1))
+    assert "content-encoding" not in headers
+    # 每个事件一到就放行，不被缓冲合并
+    assert [m["body"] for m in messages[1:4]] == events
+
+
+# ---------------------------------------------------------------------------
+# 路由：应用按默认配置（下限 1024 字节）挂载中间件
+# ---------------------------------------------------------------------------
+
+@pytest.fixture
+def large_upstream(monkeypatch):
+    frames = [
+        (encode_event_stream_message("messageMetadataEvent", {"conversationId": "demo-compression"}), 0.0),
+        (encode_event_stream_message("assistantResponseEvent", {"content": LARGE_TEXT}), 0.0),
+    ]
+    monkeypatch.setattr(demo_upstream, "build_demo_events", lambda request_data, options=None: list(frames))
+
+
+def claude_body(stream):
+    return {"model": MODEL, "max_tokens": 4096, "stream": stream, "messages": [{"role": "user", "content": "hello"}]}
+
+
+def openai_body(stream):
+    return {"model": MODEL, "stream": stream, "messages": [{"role": "user", "content": "hello"}]}
+
+
+def post(client, auth_headers, path, body):
+    response = client.post(path, json=body, headers={**auth_headers, "Accept-Encoding": "gzip"})
+    assert response.status_code == 200
+    return response
+
+
+def test_claude_non_stream_is_compressed(client, auth_headers, large_upstream):
+    response = post(client, auth_headers, "/v1/messages", claude_body(False))
+    assert response.headers["content-encoding"] == "gzip"
+    # 测试客户端自动解压
+    assert response.json()["content"][0]["text"] == LARGE_TEXT
+
+
+def test_openai_non_stream_is_compressed(client, auth_headers, large_upstream):
+    response = post(client, auth_headers, "/v1/chat/completions", openai_body(False))
+    assert response.headers["content-encoding"] == "gzip"
+    assert response.json()["choices"][0]["message"]["content"] == LARGE_TEXT
+
+
+def test_claude_stream_is_not_compressed(client, auth_headers, large_upstream):
+    response = post(client, auth_headers, "/v1/messages", claude_body(True))
+    assert response.headers["content-type"].startswith("text/event-stream")
+    assert "content-encoding" not in response.headers
+    assert claude_text(claude_events(response.text)) == LARGE_TEXT
+
+
+def test_openai_stream_is_not_compressed(client, auth_headers, large_upstream):
+    response = post(client, auth_headers, "/v1/chat/completions", openai_body(True))
+    assert response.headers["content-type"].startswith("text/event-stream")
+    assert "content-encoding" not in response.headers
+    chunks, done = openai_chunks(response.text)
+    assert openai_text(chunks) == LARGE_TEXT
+    assert done
+
+
+def test_small_json_is_not_compressed(client, auth_headers):
+    response = client.get("/health", headers={"Accept-Encoding": "gzip"})
+    assert response.status_code == 200
+    assert len(response.content) < 1024
+    assert "content-encoding" not in response.headers
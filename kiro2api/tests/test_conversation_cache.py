@@ -0,0 +1,167 @@
+"""
+对话连续性：同一客户端对话标识（X-Conversation-Id / metadata.user_id）的后续请求沿用上一轮的上游 conversationId；
+映射按最近使用淘汰（CONVERSATION_CACHE_SIZE）、超时过期（CONVERSATION_TTL_SECONDS），
+上游拒绝沿用的 id 时换新对话重试一次
+"""
+
+import json
+
+import httpx
+import pytest
+
+from services import demo_upstream, upstream
+from services.accounting import UpstreamCallRecord, FANOUT_RETRY_CONVERSATION
+from services.circuit_breaker import CircuitBreaker
+from services.conversation_cache import ConversationCache, conversation_key, is_stale_conversation_error
+from services.demo_upstream import demo_upstream_handler
+
+MODEL = "claude-sonnet-4-5-20250929"
+
+
+def test_conversation_key():
+    assert conversation_key("default", "chat-1") == "default:chat-1"
+    assert conversation_key(None, "chat-1") == "-:chat-1"
+    # 不同 Key 的相同标识互不影响
+    assert conversation_key("priority-1", "chat-1") != conversation_key("default", "chat-1")
+    for client_id in (None, "", "has space", "x" * 257, 42):
+        assert conversation_key("default", client_id) is None
+
+
+def test_remember_and_lookup():
+    cache = ConversationCache(max_size=10, ttl_seconds=0)
+    assert cache.lookup("k") is None
+    cache.remember("k", "conv-1")
+    assert cache.lookup("k") == "conv-1"
+    assert cache.is_reused("conv-1")
+    assert cache.lookup(None) is None
+
+
+def test_cap_evicts_least_recently_used():
+    cache = ConversationCache(max_size=2, ttl_seconds=0)
+    cache.remember("a", "conv-a")
+    cache.remember("b", "conv-b")
+    # 使用 a 之后，最久未使用的是 b
+    assert cache.lookup("a") == "conv-a"
+    cache.remember("c", "conv-c")
+    assert len(cache) == 2
+    assert cache.lookup("b") is None
+    assert not cache.is_reused("conv-b")
+    assert cache.lookup("a") == "conv-a"
+    assert cache.lookup("c") == "conv-c"
+
+
+def test_ttl_expires_unused_entries():
+    now = [0.0]
+    cache = ConversationCache(max_size=10, ttl_seconds=60, clock=lambda: now[0])
+    cache.remember("k", "conv-1")
+    now[0] = 50
+    # 使用会刷新时间
+    assert cache.lookup("k") == "conv-1"
+    now[0] = 100
+    assert cache.lookup("k") == "conv-1"
+    now[0] = 161
+    assert cache.lookup("k") is None
+    assert len(cache) == 0
+
+
+def test_disabled_cache():
+    cache = ConversationCache(max_size=0, ttl_seconds=0)
+    cache.remember("k", "conv-1")
+    assert cache.lookup("k") is None
+    assert not cache.enabled
+
+
+def test_reset_drops_mapping():
+    cache = ConversationCache(max_size=10, ttl_seconds=0)
+    cache.remember("k", "conv-1")
+    new_id = cache.reset("conv-1")
+    assert new_id != "conv-1"
+    assert cache.lookup("k") is None
+    assert not cache.is_reused("conv-1")
+
+
+def test_stale_conversation_error():
+    assert is_stale_conversation_error(400, "Invalid conversationId")
+    assert is_stale_conversation_error(404, "Conversation not found")
+    assert not is_stale_conversation_error(400, "Improperly formed request")
+    assert not is_stale_conversation_error(500, "conversation store unavailable")
+
+
+# ---------------------------------------------------------------------------
+# 路由
+# ---------------------------------------------------------------------------
+
+@pytest.fixture
+def sent_conversation_ids(monkeypatch):
+    """假上游收到的每个请求的 conversationId"""
+    received = []
+    build = demo_upstream.build_demo_events
+
+    def recording(request_data, options=None):
+        received.append(request_data["conversationState"]["conversationId"])
+        return build(request_data, options)
+
+    monkeypatch.setattr(demo_upstream, "build_demo_events", recording)
+    return received
+
+
+def claude_turn(client, auth_headers, conversation=None, **overrides):
+    headers = {**auth_headers, **({"X-Conversation-Id": conversation} if conversation else {})}
+    body = {"model": MODEL, "max_tokens": 64, "stream": False, "messages": [{"role": "user", "content": "hello"}], **overrides}
+    response = client.post("/v1/messages", json=body, headers=headers)
+    assert response.status_code == 200
+    return response
+
+
+def openai_turn(client, auth_headers, conversation, stream=False):
+    body = {"model": MODEL, "stream": stream, "messages": [{"role": "user", "content": "hello"}]}
+    response = client.post("/v1/chat/completions", json=body, headers={**auth_headers, "X-Conversation-Id": conversation})
+    assert response.status_code == 200
+    return response
+
+
+def test_same_conversation_reuses_upstream_id(client, auth_headers, sent_conversation_ids):
+    claude_turn(client, auth_headers, "continuity-claude")
+    claude_turn(client, auth_headers, "continuity-claude", stream=True)
+    openai_turn(client, auth_headers, "continuity-openai")
+    openai_turn(client, auth_headers, "continuity-openai", stream=True)
+    first, second, third, fourth = sent_conversation_ids
+    assert first == second
+    assert third == fourth
+    assert first != third
+
+
+def test_without_identifier_every_request_is_new(client, auth_headers, sent_conversation_ids):
+    claude_turn(client, auth_headers)
+    claude_turn(client, auth_headers)
+    assert len(set(sent_conversation_ids)) == 2
+
+
+def test_metadata_user_id(client, auth_headers, sent_conversation_ids):
+    for _ in range(2):
+        claude_turn(client, auth_headers, metadata={"user_id": "continuity-metadata"})
+    assert sent_conversation_ids[0] == sent_conversation_ids[1]
+
+
+def test_stale_conversation_falls_back_to_new_one(client, auth_headers, records, sent_conversation_ids, monkeypatch):
+    claude_turn(client, auth_headers, "continuity-stale")
+    [stale_id] = sent_conversation_ids
+
+    def rejecting(request):
+        if json.loads(request.content)["conversationState"]["conversationId"] == stale_id:
+            return httpx.Response(400, json={"message": "Invalid conversationId: conversation not found"})
+        return demo_upstream_handler(request)
+
+    monkeypatch.setattr(upstream, "upstream_breaker", CircuitBreaker(failure_threshold=0))
+    monkeypatch.setattr(upstream, "demo_upstream_handler", rejecting)
+
+    # 客户端无感知：上游拒绝后换新对话重试，请求照常成功
+    claude_turn(client, auth_headers, "continuity-stale")
+    fanouts = [r.fanout for r in records if isinstance(r, UpstreamCallRecord)]
+    assert FANOUT_RETRY_CONVERSATION in fanouts
+    [_, new_id] = sent_conversation_ids
+    assert new_id != stale_id
+
+    # 之后沿用新的 id
+    claude_turn(client, auth_headers, "continuity-stale")
+    assert sent_conversation_ids[-1] == new_id
@@ -0,0 +1,195 @@
+"""
+演示模式下的端到端测试：完整的路由、中间件和转换流程，上游为内置假上游（services/demo_upstream.py），
+不需要任何账号凭证
+"""
+
+from tests.helpers import openai_chunks, claude_events, openai_text, claude_text
+
+MODEL = "claude-sonnet-4-5-20250929"
+
+WEATHER_TOOL_OPENAI = {
+    "type": "function",
+    "function": {
+        "name": "get_weather",
+        "description": "Get the weather for a city",
+        "parameters": {"type": "object", "properties": {"city": {"type": "string"}}},
+    },
+}
+
+WEATHER_TOOL_CLAUDE = {
+    "name": "get_weather",
+    "description": "Get the weather for a city",
+    "input_schema": {"type": "object", "properties": {"city": {"type": "string"}}},
+}
+
+
+def chat_request(**overrides):
+    return {"model": MODEL, "messages": [{"role": "user", "content": "hello demo"}], **overrides}
+
+
+def message_request(**overrides):
+    return {"model": MODEL, "max_tokens": 256, "messages": [{"role": "user", "content": "hello demo"}], **overrides}
+
+
+def test_health_reports_demo_mode(client):
+    response = client.get("/health")
+    assert response.status_code == 200
+    assert response.headers["X-Kiro-Demo"] == "true"
+
+
+def test_models_requires_api_key(client):
+    assert client.get("/v1/models").status_code == 401
+
+
+def test_models_lists_default_model(client, auth_headers):
+    response = client.get("/v1/models", headers=auth_headers)
+    assert response.status_code == 200
+    assert MODEL in [model["id"] for model in response.json()["data"]]
+
+
+def test_chat_completion_echoes_last_message(client, auth_headers):
+    response = client.post("/v1/chat/completions", json=chat_request(), headers=auth_headers)
+    assert response.status_code == 200
+    body = response.json()
+    assert body["object"] == "chat.completion"
+    assert body["model"] == MODEL
+    message = body["choices"][0]["message"]
+    assert message["content"].startswith("[demo]")
+    assert "hello demo" in message["content"]
+    assert body["choices"][0]["finish_reason"] == "stop"
+    assert body["usage"]["prompt_tokens"] > 0
+    assert body["usage"]["completion_tokens"] > 0
+
+
+def test_chat_completion_stream(client, auth_headers):
+    response = client.post("/v1/chat/completions", json=chat_request(stream=True), headers=auth_headers)
+    assert response.status_code == 200
+    assert response.headers["content-type"].startswith("text/event-stream")
+    chunks, done = openai_chunks(response.text)
+    assert done
+    assert chunks[0]["choices"][0]["delta"]["role"] == "assistant"
+    assert "hello demo" in openai_text(chunks)
+    assert chunks[-1]["choices"][0]["finish_reason"] == "stop"
+
+
+def test_chat_completion_stream_include_usage(client, auth_headers):
+    response = client.post(
+        "/v1/chat/completions",
+        json=chat_request(stream=True, stream_options={"include_usage": True}),
+        headers=auth_headers,
+    )
+    chunks, done = openai_chunks(response.text)
+    assert done
+    assert chunks[-1]["choices"] == []
+    assert chunks[-1]["usage"]["completion_tokens"] > 0
+
+
+def test_chat_completion_tools_echo_tool_call(client, auth_headers):
+    response = client.post("/v1/chat/completions", json=chat_request(tools=[WEATHER_TOOL_OPENAI]), headers=auth_headers)
+    assert response.status_code == 200
+    choice = response.json()["choices"][0]
+    assert choice["finish_reason"] == "tool_calls"
+    tool_call = choice["message"]["tool_calls"][0]
+    assert tool_call["function"]["name"] == "get_weather"
+    assert tool_call["function"]["arguments"] == '{"demo": true}'
+
+
+def test_chat_completion_stream_tools(client, auth_headers):
+    response = client.post(
+        "/v1/chat/completions", json=chat_request(stream=True, tools=[WEATHER_TOOL_OPENAI]), headers=auth_headers
+    )
+    chunks, done = openai_chunks(response.text)
+    assert done
+    tool_deltas = [
+        delta for chunk in chunks for choice in chunk["choices"]
+        for delta in choice["delta"].get("tool_calls") or []
+    ]
+    assert tool_deltas[0]["function"]["name"] == "get_weather"
+    assert "".join(delta["function"].get("arguments", "") for delta in tool_deltas) == '{"demo": true}'
+    assert chunks[-1]["choices"][0]["finish_reason"] == "tool_calls"
+
+
+def test_legacy_completion(client, auth_headers):
+    response = client.post(
+        "/v1/completions", json={"model": MODEL, "prompt": "hello demo"}, headers=auth_headers
+    )
+    assert response.status_code == 200
+    body = response.json()
+    assert body["object"] == "text_completion"
+    assert "hello demo" in body["choices"][0]["text"]
+
+
+def test_message_echoes_last_message(client, auth_headers):
+    response = client.post("/v1/messages", json=message_request(), headers=auth_headers)
+    assert response.status_code == 200
+    body = response.json()
+    assert body["type"] == "message"
+    assert body["role"] == "assistant"
+    assert body["model"] == MODEL
+    assert body["content"][0]["type"] == "text"
+    assert "hello demo" in body["content"][0]["text"]
+    assert body["stop_reason"] == "end_turn"
+    assert body["usage"]["output_tokens"] > 0
+
+
+def test_message_stream(client, auth_headers):
+    response = client.post("/v1/messages", json=message_request(stream=True), headers=auth_headers)
+    assert response.status_code == 200
+    events = claude_events(response.text)
+    types = [event_type for event_type, _ in events]
+    assert types[0] == "message_start"
+    assert types[-1] == "message_stop"
+    assert "hello demo" in claude_text(events)
+    message_delta = [data for event_type, data in events if event_type == "message_delta"][-1]
+    assert message_delta["delta"]["stop_reason"] == "end_turn"
+
+
+def test_message_tools_echo_tool_use(client, auth_headers):
+    response = client.post("/v1/messages", json=message_request(tools=[WEATHER_TOOL_CLAUDE]), headers=auth_headers)
+    assert response.status_code == 200
+    body = response.json()
+    tool_use = [block for block in body["content"] if block["type"] == "tool_use"][0]
+    assert tool_use["name"] == "get_weather"
+    assert tool_use["input"] == {"demo": True}
+    assert body["stop_reason"] == "tool_use"
+
+
+def test_message_stream_tools(client, auth_headers):
+    response = client.post(
+        "/v1/messages", json=message_request(stream=True, tools=[WEATHER_TOOL_CLAUDE]), headers=auth_headers
+    )
+    events = claude_events(response.text)
+    starts = [data for event_type, data in events if event_type == "content_block_start"]
+    assert starts[-1]["content_block"]["type"] == "tool_use"
+    assert starts[-1]["content_block"]["name"] == "get_weather"
+    message_delta = [data for event_type, data in events if event_type == "message_delta"][-1]
+    assert message_delta["delta"]["stop_reason"] == "tool_use"
+
+
+def test_message_count_tokens(client, auth_headers):
+    response = client.post("/v1/messages/count_tokens", json=message_request(), headers=auth_headers)
+    assert response.status_code == 200
+    assert response.json()["input_tokens"] > 0
+
+
+def test_chat_count_tokens(client, auth_headers):
+    response = client.post("/v1/chat/completions/count_tokens", json=chat_request(), headers=auth_headers)
+    assert response.status_code == 200
+    body = response.json()
+    assert body["object"] == "token_count"
+    assert body["input_tokens"] > 0
+
+
+def test_demo_query_options_are_validated(client, auth_headers):
+    response = client.post("/v1/chat/completions?tps=-1", json=chat_request(), headers=auth_headers)
+    assert response.status_code == 400
+
+
+def test_demo_seed_is_reproducible(client, auth_headers):
+    bodies = [
+        client.post(
+            "/v1/chat/completions?seed=7&chunk=2-5", json=chat_request(stream=True), headers=auth_headers
+        ).text
+        for _ in range(2)
+    ]
+    assert openai_text(openai_chunks(bodies[0])[0]) == openai_text(openai_chunks(bodies[1])[0])
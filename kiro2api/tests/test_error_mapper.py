@@ -0,0 +1,117 @@
+"""
+上游错误映射：ERROR_STRATEGIES 按顺序决定下游的状态码和错误类型，
+限流（429 或 ThrottlingException 错误体）映射为 Claude rate_limit_error 429，并以 Retry-After 透传重试提示
+"""
+
+import json
+
+import httpx
+import pytest
+
+from services import upstream
+from services.circuit_breaker import CircuitBreaker
+from services.error_mapper import (
+    throttling_strategy,
+    authentication_strategy,
+    client_error_strategy,
+    circuit_open_strategy,
+    map_upstream_error,
+    retry_after_header,
+    claude_error_from_upstream,
+)
+from services.upstream import UpstreamError, UpstreamCircuitOpenError, RateLimitedError, TokenInvalidError
+
+MODEL = "claude-sonnet-4-5-20250929"
+THROTTLING_JSON = json.dumps({"__type": "com.amazon.coral.availability#ThrottlingException", "message": "slow down"}).encode()
+
+
+def error(status_code, body=b"", error_type="api_error", headers=None):
+    return UpstreamError(status_code, "upstream error", error_type, body, headers)
+
+
+@pytest.mark.parametrize("e", [
+    error(429),
+    error(400, THROTTLING_JSON, headers={"content-type": "application/json"}),
+    error(400, json.dumps({"message": "busy", "reason": "THROTTLING"}).encode()),
+    error(500, b"ThrottlingException: rate exceeded", headers={"Content-Type": "text/plain"}),
+    RateLimitedError(),
+])
+def test_throttling_strategy_matches(e):
+    assert throttling_strategy(e) == (429, "rate_limit_error")
+    assert map_upstream_error(e) == (429, "rate_limit_error")
+
+
+@pytest.mark.parametrize("e", [
+    error(400, b'{"message": "Improperly formed request"}'),
+    error(500, b"internal failure"),
+])
+def test_throttling_strategy_ignores_other_errors(e):
+    assert throttling_strategy(e) is None
+
+
+def test_authentication_strategy():
+    assert authentication_strategy(TokenInvalidError()) == (401, "authentication_error")
+    assert authentication_strategy(error(400)) is None
+
+
+def test_client_error_strategy():
+    assert client_error_strategy(error(404)) == (400, "invalid_request_error")
+    assert client_error_strategy(error(503)) is None
+
+
+def test_circuit_open_strategy():
+    assert circuit_open_strategy(UpstreamCircuitOpenError(12)) == (503, "api_error")
+    assert circuit_open_strategy(error(429)) is None
+
+
+def test_strategy_order():
+    # 4xx 的限流错误体按限流处理，而不是普通的 400
+    assert map_upstream_error(error(400, THROTTLING_JSON)) == (429, "rate_limit_error")
+    # 没有策略匹配时为 502
+    assert map_upstream_error(error(500)) == (502, "api_error")
+
+
+@pytest.mark.parametrize("headers, expected", [
+    ({"Retry-After": "7"}, "7"),
+    ({"x-amzn-Retry-After": "3"}, "3"),
+    ({"retry-after-ms": "1500"}, "2"),
+    ({"x-amz-retry-after-ms": "10"}, "1"),
+    ({"retry-after": "9", "x-amzn-retry-after": "3"}, "9"),
+    ({}, None),
+])
+def test_retry_after_header(headers, expected):
+    assert retry_after_header(headers) == expected
+
+
+def test_claude_error_from_throttling():
+    e = RateLimitedError(THROTTLING_JSON, {"x-amzn-Retry-After": "5"})
+    exc = claude_error_from_upstream(e)
+    assert exc.status_code == 429
+    assert exc.detail == {"type": "error", "error": {"type": "rate_limit_error", "message": e.message}}
+    assert exc.headers == {"Retry-After": "5"}
+
+
+def test_claude_error_without_retry_hint():
+    exc = claude_error_from_upstream(error(429))
+    assert exc.status_code == 429
+    assert exc.headers is None
+
+
+@pytest.fixture
+def throttled_upstream(monkeypatch):
+    """假上游以 400 + ThrottlingException 错误体拒绝所有请求，并给出 Retry-After"""
+    monkeypatch.setattr(upstream, "upstream_breaker", CircuitBreaker(failure_threshold=0))
+    monkeypatch.setattr(upstream, "demo_upstream_handler", lambda request: httpx.Response(
+        400, content=THROTTLING_JSON, headers={"content-type": "application/json", "Retry-After": "7"},
+    ))
+
+
+@pytest.mark.parametrize("stream", [False, True])
+def test_messages_route_maps_throttling_to_429(client, auth_headers, throttled_upstream, stream):
+    body = {"model": MODEL, "max_tokens": 64, "stream": stream, "messages": [{"role": "user", "content": "hi"}]}
+    response = client.post("/v1/messages", json=body, headers=auth_headers)
+    assert response.status_code == 429
+    assert response.headers["Retry-After"] == "7"
+    payload = response.json()["detail"]
+    assert payload["type"] == "error"
+    assert payload["error"]["type"] == "rate_limit_error"
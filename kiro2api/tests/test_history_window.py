@@ -0,0 +1,103 @@
+"""对话历史窗口（HISTORY_WINDOW_TURNS）：按轮裁剪历史，tool_use / tool_result 不会被窗口边界拆散"""
+
+from models.claude_schemas import ClaudeMessage, ClaudeRequest
+from services import claude_converter
+from services.claude_converter import apply_history_window
+from services.request_context import start_request_context
+
+
+def user(text):
+    return ClaudeMessage(role="user", content=text)
+
+
+def assistant(text):
+    return ClaudeMessage(role="assistant", content=text)
+
+
+def tool_use(tool_id):
+    return ClaudeMessage(role="assistant", content=[
+        {"type": "text", "text": "checking"},
+        {"type": "tool_use", "id": tool_id, "name": "get_weather", "input": {"city": "Paris"}},
+    ])
+
+
+def tool_result(tool_id):
+    return ClaudeMessage(role="user", content=[
+        {"type": "tool_result", "tool_use_id": tool_id, "content": "sunny"},
+    ])
+
+
+def plain_history():
+    """三轮历史加当前消息"""
+    return [
+        user("q1"), assistant("a1"),
+        user("q2"), assistant("a2"),
+        user("q3"), assistant("a3"),
+        user("current"),
+    ]
+
+
+def test_window_one_keeps_last_turn():
+    messages = plain_history()
+    windowed, omitted = apply_history_window(messages, 1)
+    assert omitted == 2
+    assert [m.content for m in windowed] == ["q3", "a3", "current"]
+
+
+def test_window_larger_than_history_keeps_everything():
+    messages = plain_history()
+    windowed, omitted = apply_history_window(messages, 10)
+    assert omitted == 0
+    assert windowed == messages
+
+
+def test_window_equal_to_history_keeps_everything():
+    messages = plain_history()
+    windowed, omitted = apply_history_window(messages, 3)
+    assert omitted == 0
+    assert windowed == messages
+
+
+def test_window_disabled():
+    messages = plain_history()
+    assert apply_history_window(messages, 0) == (messages, 0)
+
+
+def test_window_keeps_tool_pairs_together():
+    # 第二轮包含一次工具调用：tool_result 只是上一轮的结果，不是新的一轮，窗口从 q2 开始
+    messages = [
+        user("q1"), assistant("a1"),
+        user("q2"), tool_use("toolu_1"), tool_result("toolu_1"), assistant("a2"),
+        user("current"),
+    ]
+    windowed, omitted = apply_history_window(messages, 1)
+    assert omitted == 1
+    assert windowed == messages[2:]
+    assert windowed[0].content == "q2"
+
+
+def test_window_boundary_inside_tool_loop():
+    # 当前消息是 tool_result：保留发起该工具调用的整轮，而不是只保留孤立的 tool_result
+    messages = [
+        user("q1"), assistant("a1"),
+        user("q2"), tool_use("toolu_1"), tool_result("toolu_1"), tool_use("toolu_2"),
+        tool_result("toolu_2"),
+    ]
+    windowed, omitted = apply_history_window(messages, 1)
+    assert omitted == 1
+    assert windowed == messages[2:]
+
+
+def test_converter_reports_omitted_turns(monkeypatch):
+    monkeypatch.setattr(claude_converter, "HISTORY_WINDOW_TURNS", 1)
+    context = start_request_context()
+    request = ClaudeRequest(
+        model="claude-sonnet-4-5-20250929",
+        max_tokens=100,
+        messages=plain_history(),
+    )
+    converted = claude_converter.convert_claude_to_codewhisperer_request(request)
+    history = converted["conversationState"]["history"]
+    # 只剩 q3 / a3 一轮历史
+    assert len(history) == 2
+    assert any("omitted 2 turns" in warning for warning in context.warnings)
@@ -0,0 +1,122 @@
+"""count_tokens 中的图片块：base64 图片按文件头中的尺寸计算 (宽 × 高) / 750，URL 图片无法得知尺寸，按上限计算"""
+
+import base64
+import struct
+
+from models.claude_schemas import ClaudeMessage, ClaudeRequest
+from services.claude_stream_handler import estimate_input_token_breakdown
+from services.image_tokens import estimate_image_tokens, image_dimensions, IMAGE_MAX_TOKENS
+
+MODEL = "claude-sonnet-4-5-20250929"
+
+
+def png(width, height):
+    """只有文件签名和 IHDR 的 PNG，足够解析尺寸"""
+    ihdr = struct.pack(">II", width, height) + b"\x08\x02\x00\x00\x00"
+    return b"\x89PNG\r\n\x1a\n" + struct.pack(">I", len(ihdr)) + b"IHDR" + ihdr + b"\x00\x00\x00\x00"
+
+
+def jpeg(width, height):
+    """SOI + APP0 (JFIF) + SOF0 的 JPEG 文件头"""
+    app0 = b"JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00"
+    sof0 = struct.pack(">BHHB", 8, height, width, 3) + b"\x01\x22\x00\x02\x11\x01\x03\x11\x01"
+    return (
+        b"\xff\xd8"
+        + b"\xff\xe0" + struct.pack(">H", len(app0) + 2) + app0
+        + b"\xff\xc0" + struct.pack(">H", len(sof0) + 2) + sof0
+    )
+
+
+def base64_source(media_type, data):
+    return {"type": "base64", "media_type": media_type, "data": base64.b64encode(data).decode()}
+
+
+def image_block(source):
+    return {"type": "image", "source": source}
+
+
+def message_with(*blocks):
+    return ClaudeRequest(
+        model=MODEL, max_tokens=256, messages=[ClaudeMessage(role="user", content=list(blocks))]
+    )
+
+
+def image_only_tokens(source):
+    """请求中图片块贡献的 token 数（带图片与不带图片的计数之差）"""
+    text = {"type": "text", "text": "describe this"}
+    with_image = estimate_input_token_breakdown(message_with(text, image_block(source))).input_tokens
+    without_image = estimate_input_token_breakdown(message_with(text)).input_tokens
+    return with_image - without_image
+
+
+def test_dimensions_from_headers():
+    assert image_dimensions(png(200, 150)) == (200, 150)
+    assert image_dimensions(jpeg(300, 250)) == (300, 250)
+    assert image_dimensions(b"not an image") is None
+
+
+def test_base64_png():
+    # 200 × 150 / 750 = 40
+    assert estimate_image_tokens(base64_source("image/png", png(200, 150))) == 40
+    assert image_only_tokens(base64_source("image/png", png(200, 150))) == 40
+
+
+def test_base64_jpeg():
+    # 300 × 250 / 750 = 100
+    assert estimate_image_tokens(base64_source("image/jpeg", jpeg(300, 250))) == 100
+    assert image_only_tokens(base64_source("image/jpeg", jpeg(300, 250))) == 100
+
+
+def test_large_image_is_capped():
+    assert estimate_image_tokens(base64_source("image/png", png(4000, 3000))) == IMAGE_MAX_TOKENS
+
+
+def test_explicit_dimensions_take_precedence():
+    source = {**base64_source("image/png", png(200, 150)), "width": 75, "height": 10}
+    assert estimate_image_tokens(source) == 1
+
+
+def test_url_image_counts_as_maximum():
+    source = {"type": "url", "url": "https://example.com/cat.png"}
+    assert estimate_image_tokens(source) == IMAGE_MAX_TOKENS
+    assert image_only_tokens(source) == IMAGE_MAX_TOKENS
+
+
+def test_undecodable_base64_counts_as_maximum():
+    assert estimate_image_tokens({"type": "base64", "media_type": "image/png", "data": "!!!"}) == IMAGE_MAX_TOKENS
+
+
+def test_images_inside_tool_results():
+    request = ClaudeRequest(model=MODEL, max_tokens=256, messages=[
+        ClaudeMessage(role="user", content="take a screenshot"),
+        ClaudeMessage(role="assistant", content=[
+            {"type": "tool_use", "id": "toolu_1", "name": "screenshot", "input": {}},
+        ]),
+        ClaudeMessage(role="user", content=[{
+            "type": "tool_result", "tool_use_id": "toolu_1",
+            "content": [image_block(base64_source("image/png", png(200, 150)))],
+        }]),
+    ])
+    without_image = ClaudeRequest(model=MODEL, max_tokens=256, messages=[
+        *request.messages[:2],
+        ClaudeMessage(role="user", content=[{"type": "tool_result", "tool_use_id": "toolu_1", "content": []}]),
+    ])
+    difference = (
+        estimate_input_token_breakdown(request).input_tokens
+        - estimate_input_token_breakdown(without_image).input_tokens
+    )
+    assert difference == 40
+
+
+def test_count_tokens_route(client, auth_headers):
+    def count(*blocks):
+        body = {"model": MODEL, "max_tokens": 256, "messages": [{"role": "user", "content": list(blocks)}]}
+        response = client.post("/v1/messages/count_tokens", json=body, headers=auth_headers)
+        assert response.status_code == 200
+        return response.json()["input_tokens"]
+
+    text = {"type": "text", "text": "describe these"}
+    base = count(text)
+    assert count(text, image_block(base64_source("image/png", png(200, 150)))) == base + 40
+    assert count(text, image_block(base64_source("image/jpeg", jpeg(300, 250)))) == base + 100
+    assert count(text, image_block({"type": "url", "url": "https://example.com/cat.png"})) == base + IMAGE_MAX_TOKENS
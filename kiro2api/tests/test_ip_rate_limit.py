@@ -0,0 +1,111 @@
+"""按客户端 IP 的令牌桶限流：突发容量、补充速率、令牌桶清理，以及中间件返回的 429"""
+
+import asyncio
+import json
+
+from auth.rate_limits import TokenBucketLimiter, CLEANUP_INTERVAL_SECONDS
+from services.ip_rate_limit import IpRateLimitMiddleware
+
+
+class FakeClock:
+    def __init__(self):
+        self.now = 1000.0
+
+    def __call__(self) -> float:
+        return self.now
+
+
+def test_burst_then_rejected():
+    clock = FakeClock()
+    limiter = TokenBucketLimiter(60, burst=3, clock=clock)
+    assert [limiter.take("10.0.0.1") for _ in range(3)] == [None, None, None]
+    # 每分钟 60 个，下一个令牌 1 秒后到达
+    assert limiter.take("10.0.0.1") == 1
+    # 其他 IP 不受影响
+    assert limiter.take("10.0.0.2") is None
+
+
+def test_refills_over_time():
+    clock = FakeClock()
+    limiter = TokenBucketLimiter(6, burst=1, clock=clock)
+    assert limiter.take("ip") is None
+    assert limiter.take("ip") == 10
+    clock.now += 10
+    assert limiter.take("ip") is None
+
+
+def test_disabled_never_limits():
+    limiter = TokenBucketLimiter(0)
+    assert not limiter.enabled
+    assert all(limiter.take("ip") is None for _ in range(1000))
+
+
+def test_idle_buckets_are_cleaned_up():
+    clock = FakeClock()
+    limiter = TokenBucketLimiter(60, burst=2, clock=clock)
+    for i in range(100):
+        limiter.take(f"10.0.{i}.1")
+    assert len(limiter.buckets) == 100
+    clock.now += CLEANUP_INTERVAL_SECONDS
+    limiter.take("10.1.0.1")
+    assert list(limiter.buckets) == ["10.1.0.1"]
+
+
+def test_concurrent_requests_share_the_burst():
+    clock = FakeClock()
+    limiter = TokenBucketLimiter(60, burst=5, clock=clock)
+
+    async def take():
+        await asyncio.sleep(0)
+        return limiter.take("ip")
+
+    async def run():
+        return await asyncio.gather(*(take() for _ in range(50)))
+
+    results = asyncio.run(run())
+    assert results.count(None) == 5
+
+
+async def ok_app(scope, receive, send):
+    await send({"type": "http.response.start", "status": 200, "headers": []})
+    await send({"type": "http.response.body", "body": b"ok"})
+
+
+def call(middleware, path, ip="10.0.0.1"):
+    """以指定客户端 IP 调用中间件，返回 (状态码, 响应头, 响应体)"""
+    messages = []
+
+    async def receive():
+        return {"type": "http.request", "body": b"", "more_body": False}
+
+    async def send(message):
+        messages.append(message)
+
+    scope = {"type": "http", "method": "POST", "path": path, "headers": [], "client": (ip, 1234), "query_string": b""}
+    asyncio.run(middleware(scope, receive, send))
+    start = messages[0]
+    body = b"".join(m.get("body", b"") for m in messages[1:])
+    headers = {k.decode().lower(): v.decode() for k, v in start.get("headers", [])}
+    return start["status"], headers, body
+
+
+def test_middleware_returns_429_past_burst():
+    middleware = IpRateLimitMiddleware(ok_app, TokenBucketLimiter(60, burst=2, clock=FakeClock()), trust_forwarded=False)
+    assert [call(middleware, "/v1/chat/completions")[0] for _ in range(2)] == [200, 200]
+    status, headers, body = call(middleware, "/v1/chat/completions")
+    assert status == 429
+    assert headers["retry-after"] == "1"
+    assert json.loads(body)["detail"]["error"]["code"] == "rate_limited"
+
+
+def test_middleware_claude_error_shape():
+    middleware = IpRateLimitMiddleware(ok_app, TokenBucketLimiter(60, burst=1, clock=FakeClock()), trust_forwarded=False)
+    call(middleware, "/v1/messages")
+    status, _, body = call(middleware, "/v1/messages")
+    assert status == 429
+    assert json.loads(body)["detail"]["error"]["type"] == "rate_limit_error"
+
+
+def test_middleware_exempts_health():
+    middleware = IpRateLimitMiddleware(ok_app, TokenBucketLimiter(60, burst=1, clock=FakeClock()), trust_forwarded=False)
+    assert [call(middleware, "/health")[0] for _ in range(5)] == [200] * 5
@@ -0,0 +1,75 @@
+"""不在模型映射中的模型名：所有接收模型的接口都返回 400，错误格式与接口一致"""
+
+import pytest
+
+UNKNOWN_MODEL = "no-such-model"
+MESSAGES = [{"role": "user", "content": "hello"}]
+
+
+@pytest.mark.parametrize("path, body", [
+    ("/v1/chat/completions", {"model": UNKNOWN_MODEL, "messages": MESSAGES}),
+    ("/v1/chat/completions", {"model": UNKNOWN_MODEL, "messages": MESSAGES, "stream": True}),
+    ("/v1/completions", {"model": UNKNOWN_MODEL, "prompt": "hello"}),
+    ("/v1/chat/completions/count_tokens", {"model": UNKNOWN_MODEL, "messages": MESSAGES}),
+])
+def test_openai_routes_reject_unknown_model(client, auth_headers, path, body):
+    response = client.post(path, json=body, headers=auth_headers)
+    assert response.status_code == 400
+    error = response.json()["detail"]["error"]
+    assert error["code"] == "model_not_found"
+    assert error["param"] == "model"
+    assert UNKNOWN_MODEL in error["message"]
+
+
+@pytest.mark.parametrize("path, body", [
+    ("/v1/messages", {"model": UNKNOWN_MODEL, "max_tokens": 64, "messages": MESSAGES}),
+    ("/v1/messages", {"model": UNKNOWN_MODEL, "max_tokens": 64, "messages": MESSAGES, "stream": True}),
+    ("/v1/messages/count_tokens", {"model": UNKNOWN_MODEL, "messages": MESSAGES}),
+])
+def test_claude_routes_reject_unknown_model(client, auth_headers, path, body):
+    response = client.post(path, json=body, headers=auth_headers)
+    assert response.status_code == 400
+    detail = response.json()["detail"]
+    assert detail["type"] == "error"
+    assert detail["error"]["type"] == "invalid_request_error"
+    assert UNKNOWN_MODEL in detail["error"]["message"]
+
+
+ALIAS = "gpt-4o"
+CANONICAL_MODEL = "claude-sonnet-4-5-20250929"
+BROKEN_ALIAS = "gpt-broken"
+
+
+def route_requests(model):
+    return [
+        ("/v1/chat/completions", {"model": model, "messages": MESSAGES, "stream": False}),
+        ("/v1/completions", {"model": model, "prompt": "hello"}),
+        ("/v1/chat/completions/count_tokens", {"model": model, "messages": MESSAGES}),
+        ("/v1/messages", {"model": model, "max_tokens": 64, "messages": MESSAGES, "stream": False}),
+        ("/v1/messages/count_tokens", {"model": model, "messages": MESSAGES}),
+    ]
+
+
+@pytest.mark.parametrize("path, body", route_requests(ALIAS))
+def test_alias_is_validated_as_canonical_model(client, auth_headers, path, body):
+    response = client.post(path, json=body, headers=auth_headers)
+    assert response.status_code == 200
+    if "model" in response.json():
+        # 响应中的 model 是别名改写后的规范名称（Claude count_tokens 响应不带 model）
+        assert response.json()["model"] == CANONICAL_MODEL
+
+
+@pytest.mark.parametrize("path, body", route_requests(CANONICAL_MODEL))
+def test_non_alias_passes_through(client, auth_headers, path, body):
+    response = client.post(path, json=body, headers=auth_headers)
+    assert response.status_code == 200
+    if "model" in response.json():
+        assert response.json()["model"] == CANONICAL_MODEL
+
+
+@pytest.mark.parametrize("path, body", route_requests(BROKEN_ALIAS))
+def test_alias_to_unmapped_model_rejected(client, auth_headers, path, body):
+    # 校验在别名改写之后进行：错误信息中是改写后的目标模型名
+    response = client.post(path, json=body, headers=auth_headers)
+    assert response.status_code == 400
+    assert "no-such-model" in response.json()["detail"]["error"]["message"]
@@ -0,0 +1,57 @@
+"""n > 1：不超过 OPENAI_MAX_N（测试中为 3）时请求 n 次上游合并为 n 个 choice，只记一条客户端请求级计量"""
+
+import pytest
+
+from services import stream_mode
+from services.accounting import ClientRequestRecord, UpstreamCallRecord
+
+MODEL = "claude-sonnet-4-5-20250929"
+
+
+def chat_request(**overrides):
+    return {"model": MODEL, "messages": [{"role": "user", "content": "hello"}], **overrides}
+
+
+@pytest.mark.parametrize("n", [2, 3])
+def test_fans_out_to_n_choices(client, auth_headers, records, n):
+    response = client.post("/v1/chat/completions", json=chat_request(n=n), headers=auth_headers)
+    assert response.status_code == 200
+    body = response.json()
+    assert [choice["index"] for choice in body["choices"]] == list(range(n))
+    assert all(choice["message"]["content"] for choice in body["choices"])
+
+    client_records = [r for r in records if isinstance(r, ClientRequestRecord)]
+    upstream_records = [r for r in records if isinstance(r, UpstreamCallRecord)]
+    assert len(client_records) == 1
+    record = client_records[0]
+    assert record.status == "ok"
+    assert record.upstream_calls == n
+    assert record.input_tokens == body["usage"]["prompt_tokens"]
+    assert record.output_tokens == body["usage"]["completion_tokens"]
+    assert [r.attempt for r in upstream_records] == list(range(1, n + 1))
+    assert {r.request_id for r in upstream_records} == {record.request_id}
+
+
+def test_n_above_cap_rejected(client, auth_headers, records):
+    response = client.post("/v1/chat/completions", json=chat_request(n=4), headers=auth_headers)
+    assert response.status_code == 400
+    error = response.json()["detail"]["error"]
+    assert error["code"] == "unsupported_parameter"
+    assert error["param"] == "n"
+    assert not [r for r in records if isinstance(r, UpstreamCallRecord)]
+
+
+def test_stream_with_n_rejected(client, auth_headers, records):
+    response = client.post("/v1/chat/completions", json=chat_request(n=2, stream=True), headers=auth_headers)
+    assert response.status_code == 400
+    assert response.json()["detail"]["error"]["param"] == "n"
+    assert not [r for r in records if isinstance(r, UpstreamCallRecord)]
+
+
+def test_accept_header_stream_with_n_rejected(client, auth_headers, monkeypatch):
+    # STREAM_MODE_RESOLUTION=accept 时按 Accept 头协商出流式，同样不支持多个 choice
+    monkeypatch.setattr(stream_mode, "STREAM_MODE_RESOLUTION", "accept")
+    headers = {**auth_headers, "Accept": "text/event-stream"}
+    response = client.post("/v1/chat/completions", json=chat_request(n=2), headers=headers)
+    assert response.status_code == 400
+    assert response.json()["detail"]["error"]["param"] == "n"
@@ -0,0 +1,44 @@
+"""OpenAI 接口的 usage 使用 TOKENIZER_BACKEND 配置的分词后端计数（这里替换为按空白分词，便于核对）"""
+
+import pytest
+
+from services import response_handler
+from tests.helpers import openai_chunks, openai_text
+
+MODEL = "claude-sonnet-4-5-20250929"
+PROMPT = "what is the weather like today"
+
+
+def count_words(text):
+    return len(text.split())
+
+
+@pytest.fixture
+def word_tokenizer(monkeypatch):
+    monkeypatch.setattr(response_handler, "count_text_tokens", count_words)
+
+
+def chat_request(**overrides):
+    return {"model": MODEL, "messages": [{"role": "user", "content": PROMPT}], **overrides}
+
+
+def test_non_stream_usage(client, auth_headers, word_tokenizer):
+    response = client.post("/v1/chat/completions", json=chat_request(), headers=auth_headers)
+    body = response.json()
+    usage = body["usage"]
+    assert usage["prompt_tokens"] == count_words(PROMPT)
+    assert usage["completion_tokens"] == count_words(body["choices"][0]["message"]["content"])
+    assert usage["total_tokens"] == usage["prompt_tokens"] + usage["completion_tokens"]
+
+
+def test_stream_usage(client, auth_headers, word_tokenizer):
+    response = client.post(
+        "/v1/chat/completions",
+        json=chat_request(stream=True, stream_options={"include_usage": True}),
+        headers=auth_headers,
+    )
+    chunks, done = openai_chunks(response.text)
+    assert done
+    usage = chunks[-1]["usage"]
+    assert usage["prompt_tokens"] == count_words(PROMPT)
+    assert usage["completion_tokens"] == count_words(openai_text(chunks))
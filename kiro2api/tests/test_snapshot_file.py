@@ -0,0 +1,89 @@
+"""JSON 快照文件：原子写入、校验和、备份轮转，以及截断 / 部分写入后的恢复"""
+
+import json
+
+import pytest
+
+from storage.snapshot_file import SnapshotFile, SnapshotCorruptError, encode_snapshot, decode_snapshot
+
+
+@pytest.fixture
+def snapshot(tmp_path):
+    return SnapshotFile(str(tmp_path / "usage.json"), backup_count=2)
+
+
+def truncate(path, keep_ratio=0.5):
+    with open(path, "rb") as f:
+        raw = f.read()
+    with open(path, "wb") as f:
+        f.write(raw[:int(len(raw) * keep_ratio)])
+
+
+def test_round_trip(snapshot):
+    snapshot.save({"budget": 10})
+    assert snapshot.load() == {"budget": 10}
+    assert snapshot.loaded_from == snapshot.path
+
+
+def test_missing_file_loads_none(snapshot):
+    assert snapshot.load() is None
+    assert snapshot.loaded_from is None
+
+
+def test_no_temp_files_left_behind(snapshot, tmp_path):
+    snapshot.save({"budget": 1})
+    snapshot.save({"budget": 2})
+    assert not [p for p in tmp_path.iterdir() if p.name.endswith(".tmp")]
+
+
+def test_checksum_detects_partial_write():
+    # 部分写入后仍然是合法 JSON：只有校验和能发现
+    document = json.loads(encode_snapshot({"a": 1, "b": 2}))
+    del document["data"]["b"]
+    with pytest.raises(SnapshotCorruptError, match="checksum mismatch"):
+        decode_snapshot(json.dumps(document).encode("utf-8"))
+
+
+def test_backups_rotate(snapshot):
+    for budget in (1, 2, 3):
+        snapshot.save({"budget": budget})
+    assert decode_snapshot(open(snapshot.backup_path(1), "rb").read()) == {"budget": 2}
+    assert decode_snapshot(open(snapshot.backup_path(2), "rb").read()) == {"budget": 1}
+
+
+def test_truncated_primary_recovers_from_backup(snapshot, tmp_path):
+    snapshot.save({"budget": 1})
+    snapshot.save({"budget": 2})
+    truncate(snapshot.path)
+    assert snapshot.load() == {"budget": 1}
+    assert snapshot.loaded_from == snapshot.backup_path(1)
+    # 损坏的主文件保留现场，而不是被删除或当成空数据覆盖
+    assert (tmp_path / "usage.json.corrupt").exists()
+
+
+def test_recovers_from_older_backup(snapshot):
+    for budget in (1, 2, 3):
+        snapshot.save({"budget": budget})
+    truncate(snapshot.path)
+    truncate(snapshot.backup_path(1))
+    assert snapshot.load() == {"budget": 1}
+    assert snapshot.loaded_from == snapshot.backup_path(2)
+
+
+def test_all_corrupt_raises(snapshot):
+    snapshot.save({"budget": 1})
+    snapshot.save({"budget": 2})
+    truncate(snapshot.path)
+    truncate(snapshot.backup_path(1))
+    with pytest.raises(SnapshotCorruptError):
+        snapshot.load()
+
+
+def test_corrupt_primary_does_not_overwrite_backup(snapshot):
+    snapshot.save({"budget": 1})
+    snapshot.save({"budget": 2})
+    truncate(snapshot.path)
+    # 主文件损坏时保存不轮转备份，完好的备份不会被损坏的内容覆盖
+    snapshot.save({"budget": 3})
+    assert decode_snapshot(open(snapshot.backup_path(1), "rb").read()) == {"budget": 1}
+    assert snapshot.load() == {"budget": 3}
@@ -0,0 +1,26 @@
+"""无法识别的上游结束原因：按 UNKNOWN_STOP_REASON 处理，指标只用固定的 other 标签"""
+
+from services.metrics import unknown_stop_reasons_total
+from services.stop_reasons import normalize_stop_reason, upstream_stop_reason, UNKNOWN_STOP_REASON
+
+
+def test_known_reason_is_kept():
+    assert normalize_stop_reason("Max_Tokens", "openai") == "max_tokens"
+    assert normalize_stop_reason(None, "openai") is None
+
+
+def test_stop_reason_from_event():
+    assert upstream_stop_reason({"stopReason": "end_turn"}) == "end_turn"
+    assert upstream_stop_reason({"type": "message_delta", "delta": {"stop_reason": "max_tokens"}}) == "max_tokens"
+    assert upstream_stop_reason({"content": "hi"}) is None
+    assert upstream_stop_reason("not an event") is None
+
+
+def test_unknown_reasons_share_the_other_label():
+    before = unknown_stop_reasons_total.value(api="claude", reason="other")
+    assert normalize_stop_reason("pause_turn", "claude") == UNKNOWN_STOP_REASON
+    assert normalize_stop_reason("x" * 500, "claude") == UNKNOWN_STOP_REASON
+    assert unknown_stop_reasons_total.value(api="claude", reason="other") == before + 2
+    rendered = "\n".join(unknown_stop_reasons_total.render())
+    assert "pause_turn" not in rendered
+    assert "xxxx" not in rendered
@@ -0,0 +1,145 @@
+"""
+停止序列（Claude stop_sequences / OpenAI stop）：代理在上游文本上执行，命中后截断在匹配位置之前并停止读取上游；
+跨越两个文本增量的停止序列同样能命中，两个接口的流式和非流式响应都返回对应的结束原因
+"""
+
+import asyncio
+
+import pytest
+
+from services import demo_upstream
+from services.demo_upstream import encode_event_stream_message
+from services.stop_sequences import StopSequenceFilter, normalize_stop_sequences
+from tests.helpers import openai_chunks, openai_text, claude_events, claude_text
+
+MODEL = "claude-sonnet-4-5-20250929"
+
+
+def test_normalize():
+    assert normalize_stop_sequences(None) == []
+    assert normalize_stop_sequences("END") == ["END"]
+    assert normalize_stop_sequences(["END", "", "END", "STOP"]) == ["END", "STOP"]
+
+
+def test_match_within_one_delta():
+    stop_filter = StopSequenceFilter(["STOP"])
+    assert stop_filter.feed_text("one STOP two") == "one "
+    assert stop_filter.matched == "STOP"
+    assert stop_filter.feed_text("more") == ""
+
+
+def test_match_straddling_deltas():
+    stop_filter = StopSequenceFilter(["STOP"])
+    assert stop_filter.feed_text("one ST") == "one "
+    assert stop_filter.matched is None
+    assert stop_filter.feed_text("OP two") == ""
+    assert stop_filter.matched == "STOP"
+
+
+def test_held_prefix_is_released_when_it_does_not_match():
+    stop_filter = StopSequenceFilter(["STOP"])
+    assert stop_filter.feed_text("one ST") == "one "
+    assert stop_filter.feed_text("ART") == "START"
+    assert stop_filter.feed_text("ends with S") == "ends with "
+    assert stop_filter.flush() == [{"content": "S"}]
+    assert stop_filter.matched is None
+
+
+def test_earliest_sequence_wins():
+    stop_filter = StopSequenceFilter(["two", "one"])
+    assert stop_filter.feed_text("zero one two") == "zero "
+    assert stop_filter.matched == "one"
+
+
+def test_filter_events():
+    stop_filter = StopSequenceFilter(["STOP"])
+    events = [
+        {"content": "one ST"},
+        {"name": "get_time", "toolUseId": "tooluse_1", "input": "{}"},
+        {"content": "ST"},
+        {"content": "OP"},
+        {"content": "never sent"},
+    ]
+    assert list(stop_filter.filter(events)) == [
+        {"content": "one "},
+        # 非文本事件之前放出保留的文本
+        {"content": "ST"},
+        {"name": "get_time", "toolUseId": "tooluse_1", "input": "{}"},
+    ]
+    assert stop_filter.matched == "STOP"
+    assert stop_filter.flush() == []
+
+
+def test_without_sequences_events_pass_through():
+    events = [{"content": "STOP"}, {"content": ""}]
+    assert list(StopSequenceFilter(None).filter(events)) == events
+
+
+def test_filter_async_stops_reading_upstream():
+    read = []
+
+    async def upstream_events():
+        for text in ["one ST", "OP", "never read"]:
+            read.append(text)
+            yield {"content": text}
+
+    async def run():
+        stop_filter = StopSequenceFilter(["STOP"])
+        return [event async for event in stop_filter.filter_async(upstream_events())]
+
+    assert asyncio.run(run()) == [{"content": "one "}]
+    assert read == ["one ST", "OP"]
+
+
+# ---------------------------------------------------------------------------
+# 路由：停止序列跨越上游的两个文本增量
+# ---------------------------------------------------------------------------
+
+@pytest.fixture
+def straddling_upstream(monkeypatch):
+    frames = [
+        (encode_event_stream_message("messageMetadataEvent", {"conversationId": "demo-stop-sequences"}), 0.0),
+        (encode_event_stream_message("assistantResponseEvent", {"content": "one two ST"}), 0.0),
+        (encode_event_stream_message("assistantResponseEvent", {"content": "OP three"}), 0.0),
+    ]
+    monkeypatch.setattr(demo_upstream, "build_demo_events", lambda request_data, options=None: list(frames))
+
+
+def claude_body(stream):
+    return {
+        "model": MODEL, "max_tokens": 256, "stream": stream, "stop_sequences": ["STOP"],
+        "messages": [{"role": "user", "content": "count"}],
+    }
+
+
+def openai_body(stream):
+    return {"model": MODEL, "stream": stream, "stop": "STOP", "messages": [{"role": "user", "content": "count"}]}
+
+
+def test_claude_non_stream(client, auth_headers, straddling_upstream):
+    message = client.post("/v1/messages", json=claude_body(False), headers=auth_headers).json()
+    assert "".join(block["text"] for block in message["content"] if block["type"] == "text") == "one two "
+    assert message["stop_reason"] == "stop_sequence"
+    assert message["stop_sequence"] == "STOP"
+
+
+def test_claude_stream(client, auth_headers, straddling_upstream):
+    events = claude_events(client.post("/v1/messages", json=claude_body(True), headers=auth_headers).text)
+    assert claude_text(events) == "one two "
+    [delta] = [data for event, data in events if event == "message_delta"]
+    assert delta["delta"] == {"stop_reason": "stop_sequence", "stop_sequence": "STOP"}
+    assert events[-1][0] == "message_stop"
+
+
+def test_openai_non_stream(client, auth_headers, straddling_upstream):
+    [choice] = client.post("/v1/chat/completions", json=openai_body(False), headers=auth_headers).json()["choices"]
+    assert choice["message"]["content"] == "one two "
+    assert choice["finish_reason"] == "stop"
+
+
+def test_openai_stream(client, auth_headers, straddling_upstream):
+    chunks, done = openai_chunks(client.post("/v1/chat/completions", json=openai_body(True), headers=auth_headers).text)
+    assert openai_text(chunks) == "one two "
+    finish_reasons = [choice["finish_reason"] for chunk in chunks for choice in chunk["choices"] if choice.get("finish_reason")]
+    assert finish_reasons == ["stop"]
+    assert done
@@ -0,0 +1,227 @@
+"""
+流结束原因：每条退出路径恰好记录一次结束原因，并计入 kiro2api_stream_end_total{api,end_reason}
+track_stream 层面的路径用脚本化的内部流和请求驱动；处理函数内部的路径（超时、max_tokens、stop、解析错误预算）
+把假上游替换为脚本化的事件帧，超时用脚本化的时钟或很短的空闲超时
+"""
+
+import asyncio
+import importlib
+from functools import partial
+
+import pytest
+
+from services import demo_upstream, response_handler
+from services.accounting import ClientRequestRecord
+from services.demo_upstream import encode_event_stream_message
+from services.metrics import stream_end_total
+from services.stream_outcome import StreamOutcome, StreamEndReason, track_stream
+from services.stream_timeouts import with_stream_timeouts
+from tests.helpers import openai_chunks, claude_events
+
+MODEL = "claude-sonnet-4-5-20250929"
+
+
+class ScriptedRequest:
+    """is_disconnected 依次返回脚本中的值，取完后保持最后一个"""
+
+    def __init__(self, *disconnected):
+        self.script = list(disconnected)
+
+    async def is_disconnected(self):
+        return self.script.pop(0) if len(self.script) > 1 else self.script[0]
+
+
+class ScriptedClock:
+    """依次返回脚本中的时刻，取完后保持最后一个"""
+
+    def __init__(self, *times):
+        self.times = list(times)
+
+    def __call__(self):
+        return self.times.pop(0) if len(self.times) > 1 else self.times[0]
+
+
+async def frames(*items):
+    for item in items:
+        yield item
+
+
+async def failing():
+    yield "data: one\n\n"
+    raise RuntimeError("upstream connection reset")
+
+
+def ended(api, reason):
+    return stream_end_total.value(api=api, end_reason=reason.value)
+
+
+def drain(outcome, stream, request=None, close_after=None):
+    """迭代 track_stream；close_after 为写出这么多帧后关闭生成器（模拟客户端断开时 ASGI 服务器的做法）"""
+    async def run():
+        written = []
+        tracked = track_stream(stream, outcome, request)
+        async for frame in tracked:
+            written.append(frame)
+            if close_after is not None and len(written) >= close_after:
+                await tracked.aclose()
+                break
+        return written
+    return asyncio.run(run())
+
+
+def test_upstream_eof():
+    outcome = StreamOutcome("openai", MODEL)
+    before = ended("openai", StreamEndReason.UPSTREAM_EOF)
+    assert drain(outcome, frames("data: one\n\n", "data: two\n\n")) == ["data: one\n\n", "data: two\n\n"]
+    assert outcome.reason is StreamEndReason.UPSTREAM_EOF
+    assert ended("openai", StreamEndReason.UPSTREAM_EOF) == before + 1
+
+
+def test_upstream_error():
+    outcome = StreamOutcome("claude", MODEL)
+    before = ended("claude", StreamEndReason.UPSTREAM_ERROR)
+    with pytest.raises(RuntimeError):
+        drain(outcome, failing())
+    assert outcome.reason is StreamEndReason.UPSTREAM_ERROR
+    assert ended("claude", StreamEndReason.UPSTREAM_ERROR) == before + 1
+
+
+def test_client_disconnect_detected_before_write():
+    outcome = StreamOutcome("openai", MODEL)
+    before = ended("openai", StreamEndReason.CLIENT_DISCONNECT)
+    written = drain(outcome, frames("data: one\n\n", "data: two\n\n"), ScriptedRequest(False, True))
+    assert written == ["data: one\n\n"]
+    assert outcome.reason is StreamEndReason.CLIENT_DISCONNECT
+    assert ended("openai", StreamEndReason.CLIENT_DISCONNECT) == before + 1
+
+
+def test_client_disconnect_closes_generator():
+    outcome = StreamOutcome("claude", MODEL)
+    before = ended("claude", StreamEndReason.CLIENT_DISCONNECT)
+    drain(outcome, frames("a", "b", "c"), close_after=1)
+    assert outcome.reason is StreamEndReason.CLIENT_DISCONNECT
+    assert ended("claude", StreamEndReason.CLIENT_DISCONNECT) == before + 1
+
+
+def test_inner_reason_is_not_overridden():
+    """内部先设置的具体原因保留，外层的兜底原因不覆盖，只计数一次"""
+    outcome = StreamOutcome("openai", MODEL)
+
+    async def stopped():
+        yield "data: one\n\n"
+        outcome.end(StreamEndReason.STOP_SEQUENCE, "stop_sequence='x'")
+
+    stop_before = ended("openai", StreamEndReason.STOP_SEQUENCE)
+    eof_before = ended("openai", StreamEndReason.UPSTREAM_EOF)
+    drain(outcome, stopped())
+    assert outcome.reason is StreamEndReason.STOP_SEQUENCE
+    assert ended("openai", StreamEndReason.STOP_SEQUENCE) == stop_before + 1
+    assert ended("openai", StreamEndReason.UPSTREAM_EOF) == eof_before
+
+
+# ---------------------------------------------------------------------------
+# 处理函数内部的退出路径（两个接口的流式响应）
+# ---------------------------------------------------------------------------
+
+def text_frame(text):
+    return encode_event_stream_message("assistantResponseEvent", {"content": text})
+
+
+def metadata_frame():
+    return encode_event_stream_message("messageMetadataEvent", {"conversationId": "demo-stream-end"})
+
+
+def corrupt(frame):
+    """改动载荷中的一个字节，消息 CRC 不再匹配"""
+    index = len(frame) - 6
+    return frame[:index] + bytes([frame[index] ^ 0x01]) + frame[index + 1:]
+
+
+def script_upstream(monkeypatch, *frames_with_waits):
+    monkeypatch.setattr(demo_upstream, "build_demo_events", lambda request_data, options=None: list(frames_with_waits))
+
+
+def use_stream_timeouts(monkeypatch, app, **options):
+    """两条流式路径读取上游时使用的超时参数（默认值在定义时绑定，这里替换函数本身）"""
+    timed = partial(with_stream_timeouts, **options)
+    monkeypatch.setattr(response_handler, "with_stream_timeouts", timed)
+    monkeypatch.setattr(importlib.import_module("app"), "with_stream_timeouts", timed)
+
+
+def openai_stream(client, auth_headers, **overrides):
+    body = {"model": MODEL, "stream": True, "messages": [{"role": "user", "content": "hello"}], **overrides}
+    return client.post("/v1/chat/completions", json=body, headers=auth_headers)
+
+
+def claude_stream(client, auth_headers, **overrides):
+    body = {"model": MODEL, "max_tokens": 256, "stream": True, "messages": [{"role": "user", "content": "hello"}], **overrides}
+    return client.post("/v1/messages", json=body, headers=auth_headers)
+
+
+def client_record(records):
+    [record] = [r for r in records if isinstance(r, ClientRequestRecord)]
+    return record
+
+
+def assert_ended(records, api, reason, before):
+    assert client_record(records).end_reason == reason.value
+    assert ended(api, reason) == before + 1
+
+
+def test_openai_idle_timeout(client, auth_headers, records, monkeypatch, app):
+    script_upstream(monkeypatch, (metadata_frame(), 0.0), (text_frame("one"), 0.0), (text_frame("two"), 5.0))
+    use_stream_timeouts(monkeypatch, app, idle_timeout=0.05, total_timeout=0)
+    before = ended("openai", StreamEndReason.IDLE_TIMEOUT)
+    chunks, done = openai_chunks(openai_stream(client, auth_headers).text)
+    assert chunks[-1]["error"]["type"] == "timeout_error"
+    assert done
+    assert_ended(records, "openai", StreamEndReason.IDLE_TIMEOUT, before)
+
+
+def test_claude_duration_cap(client, auth_headers, records, monkeypatch, app):
+    script_upstream(monkeypatch, (metadata_frame(), 0.0), (text_frame("one"), 0.0), (text_frame("two"), 0.0))
+    # 开始读取时为 0，读到第一块之后时钟跳过了总时长上限
+    use_stream_timeouts(monkeypatch, app, idle_timeout=0, total_timeout=10, clock=ScriptedClock(0, 0, 100))
+    before = ended("claude", StreamEndReason.DURATION_CAP)
+    events = claude_events(claude_stream(client, auth_headers).text)
+    assert events[-1][0] == "error"
+    assert_ended(records, "claude", StreamEndReason.DURATION_CAP, before)
+
+
+@pytest.mark.parametrize("api", ["openai", "claude"])
+def test_max_tokens_enforced(client, auth_headers, records, monkeypatch, api):
+    script_upstream(monkeypatch, (metadata_frame(), 0.0), *[(text_frame(f"word{i} " * 20), 0.0) for i in range(5)])
+    before = ended(api, StreamEndReason.MAX_TOKENS_ENFORCED)
+    if api == "openai":
+        chunks, done = openai_chunks(openai_stream(client, auth_headers, max_tokens=3).text)
+        assert [c["choices"][0]["finish_reason"] for c in chunks if c.get("choices")][-1] == "length"
+    else:
+        events = claude_events(claude_stream(client, auth_headers, max_tokens=3).text)
+        assert [data for event, data in events if event == "message_delta"][-1]["delta"]["stop_reason"] == "max_tokens"
+    assert_ended(records, api, StreamEndReason.MAX_TOKENS_ENFORCED, before)
+
+
+@pytest.mark.parametrize("api", ["openai", "claude"])
+def test_stop_sequence(client, auth_headers, records, monkeypatch, api):
+    script_upstream(monkeypatch, (metadata_frame(), 0.0), (text_frame("one two "), 0.0), (text_frame("STOP three"), 0.0))
+    before = ended(api, StreamEndReason.STOP_SEQUENCE)
+    if api == "openai":
+        openai_stream(client, auth_headers, stop=["STOP"])
+    else:
+        claude_stream(client, auth_headers, stop_sequences=["STOP"])
+    assert_ended(records, api, StreamEndReason.STOP_SEQUENCE, before)
+
+
+@pytest.mark.parametrize("api", ["openai", "claude"])
+def test_error_budget_exhausted(client, auth_headers, records, monkeypatch, api):
+    # 一个正常的帧之后全是损坏的帧：lenient 模式逐个丢弃，连续超过上限后中止
+    script_upstream(monkeypatch, (metadata_frame(), 0.0), *[(corrupt(text_frame(f"bad {i}")), 0.0) for i in range(10)])
+    before = ended(api, StreamEndReason.ERROR_BUDGET_EXHAUSTED)
+    if api == "openai":
+        chunks, done = openai_chunks(openai_stream(client, auth_headers).text)
+        assert chunks[-1]["error"]["type"] == "api_error"
+        assert done
+    else:
+        events = claude_events(claude_stream(client, auth_headers).text)
+        assert events[-1][0] == "error"
+    assert_ended(records, api, StreamEndReason.ERROR_BUDGET_EXHAUSTED, before)
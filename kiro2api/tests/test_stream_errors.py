@@ -0,0 +1,70 @@
+"""OpenAI 流式响应处理中途出错：发出错误 chunk 后仍以 [DONE] 结束，客户端不会一直等待结束标记"""
+
+import httpx
+import pytest
+
+from services import demo_upstream, response_handler, upstream
+from services.circuit_breaker import CircuitBreaker
+from tests.helpers import openai_chunks
+
+MODEL = "claude-sonnet-4-5-20250929"
+
+
+def stream_request(client, auth_headers):
+    return client.post(
+        "/v1/chat/completions",
+        json={"model": MODEL, "messages": [{"role": "user", "content": "hello"}], "stream": True},
+        headers=auth_headers,
+    )
+
+
+def failing(error):
+    def extract_reasoning(event):
+        raise error
+    return extract_reasoning
+
+
+@pytest.mark.parametrize("error, error_type", [
+    (RuntimeError("handler failed"), "internal_error"),
+    (
+        httpx.HTTPStatusError(
+            "upstream failed",
+            request=httpx.Request("POST", "https://upstream.test"),
+            response=httpx.Response(500),
+        ),
+        "api_error",
+    ),
+])
+def test_stream_error_ends_with_done(client, auth_headers, monkeypatch, error, error_type):
+    monkeypatch.setattr(response_handler, "extract_reasoning", failing(error))
+    response = stream_request(client, auth_headers)
+    assert response.status_code == 200
+    chunks, done = openai_chunks(response.text)
+    assert done
+    assert chunks[-1]["error"]["type"] == error_type
+
+
+def test_empty_upstream_stream_ends_with_done(client, auth_headers, monkeypatch):
+    monkeypatch.setattr(demo_upstream, "build_demo_events", lambda request_data, options=None: [])
+    response = stream_request(client, auth_headers)
+    assert response.status_code == 200
+    chunks, done = openai_chunks(response.text)
+    assert done
+    assert len(chunks) == 1
+    assert chunks[0]["error"]["type"] == "api_error"
+
+
+@pytest.mark.parametrize("status_code", [400, 500])
+def test_upstream_error_on_open_ends_with_done(client, auth_headers, monkeypatch, status_code):
+    monkeypatch.setattr(upstream, "upstream_breaker", CircuitBreaker(failure_threshold=0))
+    monkeypatch.setattr(upstream, "retry_delay", lambda attempt: 0)
+    monkeypatch.setattr(
+        upstream, "demo_upstream_handler",
+        lambda request: httpx.Response(status_code, json={"message": "upstream test error"}),
+    )
+    response = stream_request(client, auth_headers)
+    assert response.status_code == 200
+    chunks, done = openai_chunks(response.text)
+    assert done
+    assert len(chunks) == 1
+    assert "error" in chunks[0]
@@ -0,0 +1,130 @@
+"""
+录制的上游事件流（tests/fixtures/streams/*.json，与 REQUEST_SAMPLE_RATE 采样写出的 fixture 格式相同）
+分别经 OpenAIStreamHandler 和 ClaudeStreamHandler 转换，与同名的 *.expected.json 比对
+
+采样得到的 fixture 复制到该目录即可成为新的用例；转换逻辑有意改变时用 UPDATE_GOLDEN=1 重新生成 expected 文件，
+提交前检查其中的差异
+"""
+
+import glob
+import json
+import os
+import re
+
+import pytest
+
+from models.claude_schemas import ClaudeMessage, ClaudeRequest, ClaudeTool
+from parsers.stream_parser import CodeWhispererStreamParser
+from services.claude_stream_handler import ClaudeStreamHandler
+from services.demo_upstream import encode_event_stream_message
+from services.openai_stream_handler import OpenAIStreamHandler
+from services.reasoning import extract_reasoning
+from services.stop_reasons import normalize_stop_reason, resolve_finish_reason, upstream_stop_reason
+from tests.helpers import openai_chunks, claude_events
+
+FIXTURE_DIR = os.path.join(os.path.dirname(__file__), "fixtures", "streams")
+FIXTURES = sorted(
+    os.path.basename(path)[:-len(".json")]
+    for path in glob.glob(os.path.join(FIXTURE_DIR, "*.json"))
+    if not path.endswith(".expected.json")
+)
+UPDATE_GOLDEN = os.getenv("UPDATE_GOLDEN", "").lower() in ("true", "1", "yes")
+
+# 每次生成都不同的值，比对前替换为固定值
+RESPONSE_ID = "chatcmpl-golden"
+MESSAGE_ID = "msg_golden"
+BRACKET_CALL_ID = re.compile(r"call_[0-9a-f]{8}")
+
+
+def load_fixture(name):
+    with open(os.path.join(FIXTURE_DIR, f"{name}.json"), encoding="utf-8") as f:
+        return json.load(f)
+
+
+def event_type(event):
+    """fixture 只保存解析后的事件，重新编码时按事件内容选择类型（解析器不区分事件类型）"""
+    if "toolUseId" in event:
+        return "toolUseEvent"
+    if "content" in event:
+        return "assistantResponseEvent"
+    if "conversationId" in event:
+        return "messageMetadataEvent"
+    if extract_reasoning(event):
+        return "reasoningContentEvent"
+    return "metadataEvent"
+
+
+def upstream_frames(fixture):
+    return [encode_event_stream_message(event_type(event), event) for event in fixture["upstream_response"]["events"]]
+
+
+def claude_request(fixture):
+    request = fixture["request"]
+    return ClaudeRequest(
+        model=request["model"], max_tokens=request["max_tokens"], stream=True,
+        messages=[ClaudeMessage(**message) for message in request["messages"]],
+        tools=[ClaudeTool(**tool) for tool in request["tools"]] if request.get("tools") else None,
+    )
+
+
+def normalize(value):
+    return json.loads(BRACKET_CALL_ID.sub("call_golden", json.dumps(value, ensure_ascii=False)))
+
+
+def openai_output(fixture, chunks):
+    """与 create_streaming_response 相同的调用顺序：逐个事件转换，上游结束后 finish()，最后一个 finish_reason chunk"""
+    handler = OpenAIStreamHandler(fixture["request"]["model"], response_id=RESPONSE_ID)
+    handler.created = 0
+    parser = CodeWhispererStreamParser()
+    stop_reason = None
+    output = []
+    for chunk in chunks:
+        for event in parser.parse(chunk):
+            reason = upstream_stop_reason(event)
+            if reason:
+                stop_reason = normalize_stop_reason(reason, "openai")
+            output.extend(handler.handle_event(event, extract_reasoning(event)))
+    output.extend(handler.finish())
+    output.append(handler.final_chunk(resolve_finish_reason(stop_reason, handler.streamed_tool_calls_count)))
+    return normalize(openai_chunks("".join(output))[0])
+
+
+def claude_output(fixture, chunks):
+    handler = ClaudeStreamHandler(fixture["request"]["model"], claude_request(fixture))
+    handler.message_id = MESSAGE_ID
+    output = []
+    for chunk in chunks:
+        output.extend(handler.handle_chunk(chunk))
+    output.extend(handler.finalize())
+    return normalize([[event, data] for event, data in claude_events("".join(output))])
+
+
+def outputs(name, chunks=None):
+    fixture = load_fixture(name)
+    chunks = chunks if chunks is not None else upstream_frames(fixture)
+    return {"openai": openai_output(fixture, chunks), "claude": claude_output(fixture, chunks)}
+
+
+@pytest.mark.parametrize("name", FIXTURES)
+def test_golden(name):
+    actual = outputs(name)
+    path = os.path.join(FIXTURE_DIR, f"{name}.expected.json")
+    if UPDATE_GOLDEN or not os.path.exists(path):
+        with open(path, "w", encoding="utf-8") as f:
+            json.dump(actual, f, ensure_ascii=False, indent=2)
+            f.write("\n")
+        if not UPDATE_GOLDEN:
+            pytest.fail(f"已生成 {path}，检查后提交")
+    with open(path, encoding="utf-8") as f:
+        expected = json.load(f)
+    assert actual["openai"] == expected["openai"]
+    assert actual["claude"] == expected["claude"]
+
+
+@pytest.mark.parametrize("name", FIXTURES)
+def test_output_does_not_depend_on_chunking(name):
+    """整个响应体一次到达、或逐字节到达时，输出与逐帧到达相同"""
+    body = b"".join(upstream_frames(load_fixture(name)))
+    expected = outputs(name)
+    assert outputs(name, [body]) == expected
+    assert outputs(name, [body[i:i + 1] for i in range(len(body))]) == expected
@@ -0,0 +1,164 @@
+"""
+每个 API Key 的并发流数限制（MAX_CONCURRENT_STREAMS_PER_KEY）：超过上限返回 429，
+流从任何路径结束（正常结束、上游出错、客户端断开、响应开始前失败）后名额都会释放，计数回到 0
+"""
+
+import asyncio
+
+import httpx
+import pytest
+
+from auth import stream_limiter, token_manager, StreamLimitError
+from auth import stream_limits
+from auth.stream_limits import StreamConcurrencyLimiter
+from services import upstream
+from services.circuit_breaker import CircuitBreaker
+from services.stream_outcome import StreamOutcome, track_stream
+
+MODEL = "claude-sonnet-4-5-20250929"
+API_KEY = "test-api-key"
+
+
+def test_limit_per_key(monkeypatch):
+    # 直接用 Key 本身作为标签，两个 Key 分别计数
+    monkeypatch.setattr(stream_limits, "api_key_label", lambda api_key: api_key)
+    limiter = StreamConcurrencyLimiter(limit=2)
+    first = limiter.acquire(API_KEY)
+    limiter.acquire(API_KEY)
+    with pytest.raises(StreamLimitError) as e:
+        limiter.acquire(API_KEY)
+    assert (e.value.active, e.value.limit) == (2, 2)
+    # 其他 Key 不受影响
+    limiter.acquire("another-key")
+    first.release()
+    limiter.acquire(API_KEY)
+    assert limiter.active_streams(API_KEY) == 2
+
+
+def test_release_is_idempotent():
+    limiter = StreamConcurrencyLimiter(limit=2)
+    lease = limiter.acquire(API_KEY)
+    limiter.acquire(API_KEY)
+    lease.release()
+    lease.release()
+    assert limiter.active_streams(API_KEY) == 1
+
+
+def test_zero_limit_is_unlimited():
+    limiter = StreamConcurrencyLimiter(limit=0)
+    for _ in range(100):
+        limiter.acquire(API_KEY)
+    assert limiter.active_streams(API_KEY) == 0
+
+
+async def frames(*items):
+    for item in items:
+        yield item
+
+
+async def failing():
+    yield "data: one\n\n"
+    raise RuntimeError("upstream connection reset")
+
+
+def drain(stream, close_after=None):
+    async def run():
+        tracked = stream
+        written = 0
+        async for _ in tracked:
+            written += 1
+            if close_after is not None and written >= close_after:
+                await tracked.aclose()
+                break
+    asyncio.run(run())
+
+
+@pytest.mark.parametrize("make_stream, close_after, raises", [
+    (lambda: frames("a", "b"), None, None),
+    (failing, None, RuntimeError),
+    (lambda: frames("a", "b", "c"), 1, None),
+])
+def test_track_stream_releases_lease(make_stream, close_after, raises):
+    limiter = StreamConcurrencyLimiter(limit=1)
+    outcome = StreamOutcome("openai", MODEL, lease=limiter.acquire(API_KEY))
+    tracked = track_stream(make_stream(), outcome)
+    if raises:
+        with pytest.raises(raises):
+            drain(tracked)
+    else:
+        drain(tracked, close_after)
+    assert limiter.active_streams(API_KEY) == 0
+
+
+# ---------------------------------------------------------------------------
+# 路由
+# ---------------------------------------------------------------------------
+
+@pytest.fixture
+def limit_one(monkeypatch):
+    monkeypatch.setattr(stream_limiter, "limit", 1)
+    yield
+    assert stream_limiter.active_streams(API_KEY) == 0
+
+
+def openai_body(stream=True):
+    return {"model": MODEL, "stream": stream, "messages": [{"role": "user", "content": "hello"}]}
+
+
+def claude_body(stream=True, **overrides):
+    return {"model": MODEL, "max_tokens": 64, "stream": stream, "messages": [{"role": "user", "content": "hello"}], **overrides}
+
+
+def test_openai_stream_over_limit(client, auth_headers, limit_one):
+    held = stream_limiter.acquire(API_KEY)
+    try:
+        response = client.post("/v1/chat/completions", json=openai_body(), headers=auth_headers)
+        assert response.status_code == 429
+        assert response.headers["Retry-After"]
+        error = response.json()["detail"]["error"]
+        assert error["type"] == "rate_limit_error"
+        assert error["code"] == "concurrent_stream_limit"
+        # 非流式请求不受限制
+        assert client.post("/v1/chat/completions", json=openai_body(stream=False), headers=auth_headers).status_code == 200
+    finally:
+        held.release()
+
+
+def test_claude_stream_over_limit(client, auth_headers, limit_one):
+    held = stream_limiter.acquire(API_KEY)
+    try:
+        response = client.post("/v1/messages", json=claude_body(), headers=auth_headers)
+        assert response.status_code == 429
+        assert response.json()["detail"]["error"]["type"] == "rate_limit_error"
+        assert client.post("/v1/messages", json=claude_body(stream=False), headers=auth_headers).status_code == 200
+    finally:
+        held.release()
+
+
+def test_completed_streams_release(client, auth_headers, limit_one):
+    # 上限为 1 时连续的流都能成功，说明每个流结束后都释放了名额
+    for _ in range(3):
+        assert client.post("/v1/chat/completions", json=openai_body(), headers=auth_headers).status_code == 200
+        assert client.post("/v1/messages", json=claude_body(), headers=auth_headers).status_code == 200
+
+
+def test_upstream_error_releases(client, auth_headers, limit_one, monkeypatch):
+    monkeypatch.setattr(upstream, "upstream_breaker", CircuitBreaker(failure_threshold=0))
+    monkeypatch.setattr(upstream, "demo_upstream_handler", lambda request: httpx.Response(500, content=b"boom"))
+    client.post("/v1/chat/completions", json=openai_body(), headers=auth_headers)
+    client.post("/v1/messages", json=claude_body(), headers=auth_headers)
+
+
+def test_openai_invalid_request_releases(client, auth_headers, limit_one):
+    # 获取名额之后、返回响应之前校验失败（非法工具名）
+    body = {**openai_body(), "tools": [{"type": "function", "function": {"name": "get time!", "parameters": {}}}]}
+    assert client.post("/v1/chat/completions", json=body, headers=auth_headers).status_code == 400
+
+
+def test_claude_no_token_releases(client, auth_headers, limit_one, monkeypatch):
+    async def no_token():
+        return None
+
+    # 获取名额之后没有可用的账号
+    monkeypatch.setattr(token_manager, "get_token", no_token)
+    assert client.post("/v1/messages", json=claude_body(), headers=auth_headers).status_code >= 400
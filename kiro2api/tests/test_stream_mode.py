@@ -0,0 +1,126 @@
+"""
+/v1/messages 的请求体 stream 与 Accept 头冲突时按 STREAM_MODE_RESOLUTION 决定响应方式，计量记录的 stream 与实际响应一致；
+/v1/chat/completions 的流式响应恰好发出一个带 finish_reason 的结束 chunk，并使用上游给出的结束原因
+"""
+
+import pytest
+
+from services import demo_upstream, stream_mode
+from services.accounting import ClientRequestRecord
+from services.demo_upstream import encode_event_stream_message
+from tests.helpers import claude_events, openai_chunks
+
+MODEL = "claude-sonnet-4-5-20250929"
+
+
+def message_request(**overrides):
+    return {"model": MODEL, "max_tokens": 256, "messages": [{"role": "user", "content": "hello"}], **overrides}
+
+
+def client_record(records):
+    [record] = [r for r in records if isinstance(r, ClientRequestRecord)]
+    return record
+
+
+@pytest.mark.parametrize("body_stream, accept, expect_stream", [
+    (True, "application/json", False),
+    (False, "text/event-stream", True),
+    (True, "*/*", True),
+    (False, None, False),
+])
+def test_accept_resolution(client, auth_headers, records, monkeypatch, body_stream, accept, expect_stream):
+    monkeypatch.setattr(stream_mode, "STREAM_MODE_RESOLUTION", "accept")
+    headers = {**auth_headers, **({"Accept": accept} if accept else {})}
+    response = client.post("/v1/messages", json=message_request(stream=body_stream), headers=headers)
+    assert response.status_code == 200
+    if expect_stream:
+        assert response.headers["content-type"].startswith("text/event-stream")
+        assert claude_events(response.text)[-1][0] == "message_stop"
+    else:
+        assert response.json()["type"] == "message"
+    assert client_record(records).stream is expect_stream
+
+
+@pytest.mark.parametrize("body_stream, accept", [
+    (True, "application/json"),
+    (False, "text/event-stream"),
+])
+def test_body_resolution(client, auth_headers, records, monkeypatch, body_stream, accept):
+    monkeypatch.setattr(stream_mode, "STREAM_MODE_RESOLUTION", "body")
+    headers = {**auth_headers, "Accept": accept}
+    response = client.post("/v1/messages", json=message_request(stream=body_stream), headers=headers)
+    assert response.status_code == 200
+    assert response.headers["content-type"].startswith("text/event-stream") is body_stream
+    assert client_record(records).stream is body_stream
+
+
+# ---------------------------------------------------------------------------
+# OpenAI 流的结束 chunk
+# ---------------------------------------------------------------------------
+
+WEATHER_TOOL = {"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object"}}}
+
+
+def frame(event_type, payload):
+    return encode_event_stream_message(event_type, payload), 0.0
+
+
+def metadata_frame():
+    return frame("messageMetadataEvent", {"conversationId": "demo-finish-chunk"})
+
+
+def message_delta_frame(stop_reason):
+    return frame("messageDeltaEvent", {"type": "message_delta", "delta": {"stop_reason": stop_reason}})
+
+
+def script_upstream(monkeypatch, *frames):
+    monkeypatch.setattr(demo_upstream, "build_demo_events", lambda request_data, options=None: list(frames))
+
+
+def openai_stream(client, auth_headers, **overrides):
+    body = {"model": MODEL, "stream": True, "messages": [{"role": "user", "content": "hello"}], **overrides}
+    return client.post("/v1/chat/completions", json=body, headers=auth_headers)
+
+
+def finish_chunks(chunks):
+    return [chunk for chunk in chunks for choice in chunk.get("choices", []) if choice.get("finish_reason")]
+
+
+def test_empty_stream_has_one_finish_chunk(client, auth_headers, monkeypatch):
+    # 上游只返回元数据事件，没有任何内容
+    script_upstream(monkeypatch, metadata_frame())
+    chunks, done = openai_chunks(openai_stream(client, auth_headers).text)
+    [final] = finish_chunks(chunks)
+    assert final["choices"][0]["finish_reason"] == "stop"
+    assert final["choices"][0]["delta"]["role"] == "assistant"
+    assert done
+
+
+@pytest.mark.parametrize("stop_reason, finish_reason", [("end_turn", "stop"), ("max_tokens", "length")])
+def test_message_delta_stop_reason_is_honored(client, auth_headers, monkeypatch, stop_reason, finish_reason):
+    script_upstream(
+        monkeypatch, metadata_frame(), frame("assistantResponseEvent", {"content": "hi"}), message_delta_frame(stop_reason)
+    )
+    chunks, done = openai_chunks(openai_stream(client, auth_headers).text)
+    [final] = finish_chunks(chunks)
+    assert final["choices"][0]["finish_reason"] == finish_reason
+    assert chunks[-1] is final
+    assert done
+
+
+def test_tool_stream_has_no_duplicate_finish_chunk(client, auth_headers, monkeypatch):
+    tool_use = {"name": "get_weather", "toolUseId": "tooluse_1"}
+    script_upstream(
+        monkeypatch,
+        metadata_frame(),
+        frame("toolUseEvent", {**tool_use, "input": '{"city": "Paris"}'}),
+        frame("toolUseEvent", {**tool_use, "stop": True}),
+        message_delta_frame("tool_use"),
+    )
+    chunks, done = openai_chunks(openai_stream(client, auth_headers, tools=[WEATHER_TOOL]).text)
+    [final] = finish_chunks(chunks)
+    assert final["choices"][0]["finish_reason"] == "tool_calls"
+    # 结束 chunk 在所有工具调用增量之后
+    assert chunks.index(final) == len(chunks) - 1
+    assert any(choice["delta"].get("tool_calls") for chunk in chunks for choice in chunk["choices"])
+    assert done
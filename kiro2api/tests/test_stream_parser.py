@@ -0,0 +1,126 @@
+"""event-stream 解析器：跨数据块的帧拼接，以及 strict / lenient / off 三种 CRC 校验模式"""
+
+import json
+
+import pytest
+
+from parsers.stream_parser import (
+    CodeWhispererStreamParser,
+    EventStreamCorruptionError,
+    EventStreamErrorBudgetExhausted,
+    CRC_MODE_STRICT,
+    CRC_MODE_LENIENT,
+    CRC_MODE_OFF,
+)
+from services.demo_upstream import encode_event_stream_message
+
+
+def frame(text: str) -> bytes:
+    return encode_event_stream_message("assistantResponseEvent", {"content": text})
+
+
+def corrupt_payload(data: bytes) -> bytes:
+    """改动载荷中的一个字节，消息 CRC 不再匹配（prelude 不受影响）"""
+    index = len(data) - 6
+    return data[:index] + bytes([data[index] ^ 0x01]) + data[index + 1:]
+
+
+def corrupt_prelude(data: bytes) -> bytes:
+    """改动 total_len 的最低位，prelude CRC 不再匹配，帧长度也不可信"""
+    return data[:3] + bytes([data[3] ^ 0x01]) + data[4:]
+
+
+def contents(events):
+    return [event["content"] for event in events]
+
+
+def test_frames_split_at_every_byte():
+    data = frame("one") + frame("two")
+    parser = CodeWhispererStreamParser(CRC_MODE_STRICT)
+    events = []
+    for i in range(len(data)):
+        events.extend(parser.parse(data[i:i + 1]))
+    assert contents(events) == ["one", "two"]
+    assert not parser.has_remaining_data()
+
+
+def test_event_appears_only_after_its_last_byte():
+    """逐字节喂入一个带多字节字符的工具调用帧：最后一个字节到达前没有事件，之后得到完整的事件"""
+    payload = {"name": "搜索", "toolUseId": "tooluse_1", "input": json.dumps({"query": "天气 ☀"}, ensure_ascii=False)}
+    data = encode_event_stream_message("toolUseEvent", payload)
+    parser = CodeWhispererStreamParser(CRC_MODE_STRICT)
+    for i in range(len(data) - 1):
+        assert parser.parse(data[i:i + 1]) == []
+        assert parser.has_remaining_data()
+    assert parser.parse(data[-1:]) == [payload]
+    assert not parser.has_remaining_data()
+
+
+def test_short_prelude_is_skipped_without_spinning():
+    # total_len 小于最小帧长的 prelude 不消耗任何字节，需要逐字节跳过重新对齐
+    parser = CodeWhispererStreamParser(CRC_MODE_OFF)
+    assert contents(parser.parse(b"\x00\x00\x00" + frame("two"))) == ["two"]
+    assert not parser.has_remaining_data()
+
+
+def test_lenient_drops_frame_with_bad_message_crc():
+    parser = CodeWhispererStreamParser(CRC_MODE_LENIENT)
+    events = parser.parse(frame("one") + corrupt_payload(frame("two")) + frame("three"))
+    assert contents(events) == ["one", "three"]
+    assert parser.crc_errors == 1
+
+
+def test_strict_raises_on_bad_message_crc():
+    parser = CodeWhispererStreamParser(CRC_MODE_STRICT)
+    assert contents(parser.parse(frame("one"))) == ["one"]
+    with pytest.raises(EventStreamCorruptionError):
+        parser.parse(corrupt_payload(frame("two")))
+    assert parser.crc_errors == 1
+
+
+def test_strict_raises_on_bad_prelude_crc():
+    parser = CodeWhispererStreamParser(CRC_MODE_STRICT)
+    with pytest.raises(EventStreamCorruptionError):
+        parser.parse(corrupt_prelude(frame("one")) + frame("two"))
+
+
+def test_off_ignores_crc():
+    data = frame("one")
+    bad_crc = data[:-4] + b"\x00\x00\x00\x00"
+    parser = CodeWhispererStreamParser(CRC_MODE_OFF)
+    assert contents(parser.parse(bad_crc)) == ["one"]
+    assert parser.crc_errors == 0
+
+
+def test_lenient_resyncs_after_bad_prelude():
+    parser = CodeWhispererStreamParser(CRC_MODE_LENIENT)
+    events = parser.parse(corrupt_prelude(frame("one")) + frame("two") + frame("three"))
+    assert contents(events) == ["two", "three"]
+    assert parser.crc_errors == 1
+
+
+def test_lenient_resync_spans_chunks():
+    data = corrupt_prelude(frame("one")) + frame("two") + frame("three")
+    parser = CodeWhispererStreamParser(CRC_MODE_LENIENT)
+    # 第一次只收到损坏的帧和下一帧的前几个字节，找不到有效的帧起点时等待更多数据
+    split = len(frame("one")) + 5
+    events = parser.parse(data[:split])
+    events += parser.parse(data[split:])
+    assert contents(events) == ["two", "three"]
+
+
+def test_lenient_error_budget():
+    parser = CodeWhispererStreamParser(CRC_MODE_LENIENT)
+    assert contents(parser.parse(frame("one"))) == ["one"]
+    for i in range(parser.max_errors):
+        assert parser.parse(corrupt_payload(frame(f"bad {i}"))) == []
+    with pytest.raises(EventStreamErrorBudgetExhausted):
+        parser.parse(corrupt_payload(frame("one too many")))
+
+
+def test_parsed_event_resets_error_budget():
+    parser = CodeWhispererStreamParser(CRC_MODE_LENIENT)
+    for _ in range(3):
+        for i in range(parser.max_errors):
+            parser.parse(corrupt_payload(frame(f"bad {i}")))
+        assert contents(parser.parse(frame("good"))) == ["good"]
@@ -0,0 +1,76 @@
+"""
+Claude 请求的 system：字符串、text 块数组、空字符串和 null 在模型校验时统一为 text 块列表，
+发往上游和 count_tokens 使用同样的文本；非 text 类型的块返回 400
+"""
+
+import pytest
+from pydantic import ValidationError
+
+from models.claude_schemas import ClaudeRequest
+from services.claude_converter import convert_claude_to_codewhisperer_request
+from services.claude_stream_handler import estimate_input_token_breakdown
+
+MODEL = "claude-sonnet-4-5-20250929"
+SYSTEM_TEXT = "You are a helpful assistant."
+
+
+def claude_request(system):
+    return ClaudeRequest(model=MODEL, max_tokens=256, system=system, messages=[{"role": "user", "content": "hello"}])
+
+
+def sent_content(request):
+    return convert_claude_to_codewhisperer_request(request)["conversationState"]["currentMessage"]["userInputMessage"]["content"]
+
+
+def test_string_becomes_one_text_block():
+    request = claude_request(SYSTEM_TEXT)
+    assert [block.model_dump() for block in request.system] == [{"type": "text", "text": SYSTEM_TEXT}]
+    assert request.system_text() == SYSTEM_TEXT
+
+
+def test_array_of_text_blocks():
+    request = claude_request([{"type": "text", "text": "You are"}, {"type": "text", "text": "helpful."}])
+    assert request.system_text() == "You are\nhelpful."
+
+
+@pytest.mark.parametrize("system", ["", None, []])
+def test_empty_system(system):
+    request = claude_request(system)
+    assert request.system_text() == ""
+    assert sent_content(request) == "hello"
+
+
+@pytest.mark.parametrize("system", [
+    [{"type": "text", "text": "ok"}, {"type": "image", "source": {"type": "url", "url": "https://example.com/a.png"}}],
+    [{"type": "text", "text": "ok"}, "plain string"],
+    [{"type": "text"}],
+    42,
+])
+def test_invalid_system_is_rejected(system):
+    with pytest.raises(ValidationError):
+        claude_request(system)
+
+
+def test_string_and_array_are_sent_and_counted_the_same():
+    as_string = claude_request(SYSTEM_TEXT)
+    as_array = claude_request([{"type": "text", "text": SYSTEM_TEXT}])
+    assert sent_content(as_string) == sent_content(as_array) == f"{SYSTEM_TEXT}\n\nhello"
+    assert estimate_input_token_breakdown(as_string).input_tokens == estimate_input_token_breakdown(as_array).input_tokens
+    assert estimate_input_token_breakdown(as_string).input_tokens > estimate_input_token_breakdown(claude_request("")).input_tokens
+
+
+def message_body(system):
+    return {"model": MODEL, "max_tokens": 64, "stream": False, "system": system, "messages": [{"role": "user", "content": "hello"}]}
+
+
+@pytest.mark.parametrize("system", [SYSTEM_TEXT, [{"type": "text", "text": SYSTEM_TEXT}], "", None])
+def test_messages_route_accepts(client, auth_headers, system):
+    response = client.post("/v1/messages", json=message_body(system), headers=auth_headers)
+    assert response.status_code == 200
+
+
+def test_messages_route_rejects_mixed_types(client, auth_headers):
+    system = [{"type": "text", "text": "ok"}, {"type": "image", "source": {"type": "url", "url": "https://example.com/a.png"}}]
+    response = client.post("/v1/messages", json=message_body(system), headers=auth_headers)
+    assert response.status_code == 400
+    assert response.json()["detail"]["error"]["type"] == "invalid_request_error"
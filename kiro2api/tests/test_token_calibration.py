@@ -0,0 +1,65 @@
+"""粗略估算校准：用按已知每 token 字符数生成的语料拟合参数，应用建议参数后误差下降"""
+
+from services.token_calibration import calibrate
+from services.tokenizer import EstimatorMultipliers, classify_chars, estimate_tokens_rough
+
+# 生成语料时假设的“真实”每 token 字符数
+TRUE_LATIN, TRUE_CJK, TRUE_CODE = 5.0, 1.25, 2.0
+
+LATIN = "the quick brown fox jumps over the lazy dog "
+CJK = "敏捷的棕色狐狸跳过了懒狗"
+CODE = "{}[]();=+-*/"
+
+
+def synthetic_corpus():
+    samples = []
+    for latin, cjk, code in [(1, 0, 0), (0, 2, 0), (0, 0, 3), (2, 1, 1), (3, 2, 0), (1, 1, 4), (4, 0, 2), (0, 3, 1)]:
+        text = LATIN * latin + CJK * cjk + CODE * code
+        counts = classify_chars(text)
+        expected = counts["latin"] / TRUE_LATIN + counts["cjk"] / TRUE_CJK + counts["code"] / TRUE_CODE
+        samples.append({"text": text, "expected_tokens": round(expected)})
+    return samples
+
+
+def mape(samples, multipliers):
+    errors = [
+        abs(estimate_tokens_rough(s["text"], multipliers) - s["expected_tokens"]) / s["expected_tokens"]
+        for s in samples
+    ]
+    return sum(errors) / len(errors)
+
+
+def test_suggested_multipliers_reduce_error():
+    samples = synthetic_corpus()
+    current = EstimatorMultipliers()
+    result = calibrate(samples, current)
+
+    assert result["mape"] > 0.2
+    # 估算结果取整，误差不会完全为 0
+    assert result["suggested_mape"] < 0.05
+    assert result["suggested_mape"] < result["mape"] / 5
+    # 应用建议参数后重新估算，误差同样下降
+    assert mape(samples, result["suggested"]) < mape(samples, current) / 5
+
+
+def test_suggested_multipliers_move_toward_true_values():
+    result = calibrate(synthetic_corpus(), EstimatorMultipliers())
+    suggested = result["suggested_multipliers"]
+    assert abs(suggested["latin"] - TRUE_LATIN) < 0.25
+    assert abs(suggested["cjk"] - TRUE_CJK) < 0.1
+    assert abs(suggested["code"] - TRUE_CODE) < 0.1
+
+
+def test_per_item_errors():
+    samples = synthetic_corpus()
+    result = calibrate(samples, EstimatorMultipliers())
+    assert [item["index"] for item in result["items"]] == list(range(len(samples)))
+    for item, sample in zip(result["items"], samples):
+        assert item["expected_tokens"] == sample["expected_tokens"]
+        assert item["error"] == item["estimated_tokens"] - sample["expected_tokens"]
+
+
+def test_calibrate_does_not_change_current_multipliers():
+    current = EstimatorMultipliers()
+    calibrate(synthetic_corpus(), current)
+    assert vars(current) == vars(EstimatorMultipliers())
@@ -0,0 +1,128 @@
+"""
+多账号 token 管理：403 / 429 / 出错的处理针对调用方传入的账号（而不是最近一次被选中的账号），
+以及只剩一个可用账号时 403 不进入冷却
+"""
+
+import asyncio
+from datetime import timedelta
+
+import pytest
+
+from auth.token_manager import MultiAccountTokenManager, SelectedToken
+from tests.helpers import make_manager, token_manager_module
+
+
+@pytest.fixture
+def manager(monkeypatch):
+    return make_manager(monkeypatch, "a", "b")
+
+
+def select(manager):
+    return asyncio.run(manager.get_token())
+
+
+def age_cache(manager, name, seconds=3600):
+    """让账号缓存的 token 看起来是很久之前刷新的（不算“刚刷新过”）"""
+    manager.cached_tokens[name].cached_at -= timedelta(seconds=seconds)
+    manager.cached_tokens[name].expires_at = manager.cached_tokens[name].cached_at + timedelta(hours=2)
+
+
+def test_get_token_returns_account(manager):
+    selected = select(manager)
+    assert isinstance(selected, SelectedToken)
+    assert selected.name == "a"
+    assert selected.access_token == "a-token-1"
+
+
+def test_demo_mode_token_has_no_account(monkeypatch):
+    monkeypatch.setattr(token_manager_module, "DEMO_MODE", True)
+    selected = asyncio.run(MultiAccountTokenManager().get_token())
+    assert selected.name is None
+    assert selected.access_token
+
+
+def test_exhausted_marks_given_account_not_current(manager):
+    a = select(manager)
+    # 并发的另一个请求之后选中了 b
+    manager.current_index = 1
+    manager.mark_token_exhausted(a, "rate_limit_429")
+    assert manager.cached_tokens["a"].is_exhausted
+    assert manager.current_index == 1
+    assert select(manager).name == "b"
+
+
+def test_unhealthy_quarantines_given_account(manager):
+    a = select(manager)
+    manager.current_index = 1
+    manager.mark_token_unhealthy(a, "403")
+    assert manager.cached_tokens["a"].is_cooling_down()
+    manager.current_index = 0
+    assert select(manager).name == "b"
+
+
+def test_unhealthy_single_account_is_not_quarantined(monkeypatch):
+    manager = make_manager(monkeypatch, "only")
+    only = select(manager)
+    manager.mark_token_unhealthy(only, "403 after refresh")
+    assert not manager.cached_tokens["only"].is_cooling_down()
+    assert select(manager).name == "only"
+
+
+def test_unhealthy_last_available_account_is_not_quarantined(manager):
+    a = select(manager)
+    manager.current_index = 1
+    b = select(manager)
+    manager.mark_token_exhausted(b, "rate_limit_429")
+    manager.mark_token_unhealthy(a, "403")
+    assert not manager.cached_tokens["a"].is_cooling_down()
+
+
+def test_handle_forbidden_refreshes_given_account(manager):
+    a = select(manager)
+    age_cache(manager, "a")
+    manager.current_index = 1
+    b = select(manager)
+    refreshed = asyncio.run(manager.handle_forbidden(a))
+    assert refreshed.name == "a"
+    assert refreshed.access_token != a.access_token
+    assert manager.cached_tokens["b"].access_token == b.access_token
+
+
+def test_handle_forbidden_reuses_token_refreshed_by_other_request(manager):
+    a = select(manager)
+    age_cache(manager, "a")
+    first = asyncio.run(manager.handle_forbidden(a))
+    refresh_count = manager.refresh_count
+    # 另一个请求拿着同一个旧 token 也收到了 403：直接使用已刷新的 token，不再刷新、也不隔离
+    second = asyncio.run(manager.handle_forbidden(a))
+    assert second.access_token == first.access_token
+    assert manager.refresh_count == refresh_count
+    assert not manager.cached_tokens["a"].is_cooling_down()
+
+
+def test_handle_forbidden_after_recent_refresh_switches_account(manager):
+    a = select(manager)
+    # a 的 token 刚刚刷新过仍然 403：隔离 a，切换到 b
+    switched = asyncio.run(manager.handle_forbidden(a))
+    assert manager.cached_tokens["a"].is_cooling_down()
+    assert switched.name == "b"
+
+
+def test_mark_token_error_counts_given_account(manager):
+    a = select(manager)
+    manager.current_index = 1
+    b = select(manager)
+    for _ in range(3):
+        manager.mark_token_error(a)
+    assert manager.cached_tokens["a"].error_count == 3
+    assert manager.cached_tokens["b"].error_count == 0
+    assert manager.available_count() == 1
+    assert b.name == "b"
+
+
+def test_mark_without_account_is_ignored(manager):
+    select(manager)
+    manager.mark_token_error(None)
+    manager.mark_token_exhausted(SelectedToken("demo"), "rate_limit_429")
+    manager.mark_token_unhealthy(SelectedToken("demo"), "403")
+    assert manager.available_count() == 2
@@ -0,0 +1,148 @@
+"""
+工具定义压缩（TOOL_COMPACTION_ENABLED）：同一请求内的重复定义只保留一份，
+同一对话前几轮已经发送过的相同工具只发送名称和 schema，count_tokens 按压缩后的定义计数
+"""
+
+import pytest
+
+from models.claude_schemas import ClaudeMessage, ClaudeRequest, ClaudeTool
+from services import claude_converter, claude_stream_handler
+from services.claude_converter import claude_tool_fingerprints, convert_claude_to_codewhisperer_request
+from services.claude_stream_handler import estimate_input_token_breakdown
+from services.conversation_cache import ConversationCache
+from services.request_context import start_request_context
+from services.tool_utils import restore_compacted_tools
+
+MODEL = "claude-sonnet-4-5-20250929"
+WEATHER = ClaudeTool(
+    name="get_weather",
+    description="Get the current weather for a city. " * 20,
+    input_schema={"type": "object", "properties": {"city": {"type": "string"}}},
+)
+CLOCK = ClaudeTool(
+    name="get_time",
+    description="Get the current time in a time zone. " * 20,
+    input_schema={"type": "object", "properties": {"zone": {"type": "string"}}},
+)
+
+
+@pytest.fixture
+def compaction(monkeypatch):
+    monkeypatch.setattr(claude_converter, "TOOL_COMPACTION_ENABLED", True)
+    monkeypatch.setattr(claude_stream_handler, "TOOL_COMPACTION_ENABLED", True)
+
+
+def claude_request(*tools):
+    return ClaudeRequest(
+        model=MODEL, max_tokens=256, messages=[ClaudeMessage(role="user", content="weather?")], tools=list(tools)
+    )
+
+
+def sent_tools(codewhisperer_request):
+    user_input = codewhisperer_request["conversationState"]["currentMessage"]["userInputMessage"]
+    return {
+        spec["toolSpecification"]["name"]: spec["toolSpecification"]
+        for spec in user_input.get("userInputMessageContext", {}).get("tools", [])
+    }
+
+
+def test_cache_accumulates_tools_for_the_same_conversation():
+    cache = ConversationCache(max_size=10, ttl_seconds=0)
+    cache.remember("k", "conv-1", {"a"})
+    cache.remember("k", "conv-1", {"b"})
+    assert cache.declared_tools("k") == {"a", "b"}
+    # 换了上游对话：之前的工具上游没有见过
+    cache.remember("k", "conv-2", {"c"})
+    assert cache.declared_tools("k") == {"c"}
+    cache.reset("conv-2")
+    assert cache.declared_tools("k") == frozenset()
+
+
+def test_cache_declared_tools_expire_with_the_entry():
+    now = [0.0]
+    cache = ConversationCache(max_size=10, ttl_seconds=60, clock=lambda: now[0])
+    cache.remember("k", "conv-1", {"a"})
+    now[0] = 61
+    assert cache.declared_tools("k") == frozenset()
+    assert cache.declared_tools(None) == frozenset()
+
+
+def test_repeated_tools_are_sent_without_description(compaction):
+    start_request_context()
+    declared = claude_tool_fingerprints(claude_request(WEATHER))
+    tools = sent_tools(convert_claude_to_codewhisperer_request(claude_request(WEATHER, CLOCK), None, "conv-1", declared))
+    assert tools["get_weather"]["description"] == ""
+    assert tools["get_weather"]["inputSchema"] == {"json": WEATHER.input_schema}
+    assert tools["get_time"]["description"] == CLOCK.description
+
+
+def test_changed_tool_is_sent_in_full(compaction):
+    start_request_context()
+    declared = claude_tool_fingerprints(claude_request(WEATHER))
+    changed = ClaudeTool(name=WEATHER.name, description="Weather, now with forecasts.", input_schema=WEATHER.input_schema)
+    tools = sent_tools(convert_claude_to_codewhisperer_request(claude_request(changed), None, "conv-1", declared))
+    assert tools["get_weather"]["description"] == "Weather, now with forecasts."
+
+
+def test_disabled_sends_full_definitions(monkeypatch):
+    monkeypatch.setattr(claude_converter, "TOOL_COMPACTION_ENABLED", False)
+    declared = claude_tool_fingerprints(claude_request(WEATHER))
+    tools = sent_tools(convert_claude_to_codewhisperer_request(claude_request(WEATHER), None, "conv-1", declared))
+    assert tools["get_weather"]["description"] == WEATHER.description
+
+
+def test_restore_after_conversation_reset(compaction):
+    start_request_context()
+    declared = claude_tool_fingerprints(claude_request(WEATHER))
+    request_data = convert_claude_to_codewhisperer_request(claude_request(WEATHER, CLOCK), None, "conv-1", declared)
+    assert restore_compacted_tools(request_data["conversationState"]) == 1
+    assert sent_tools(request_data)["get_weather"]["description"] == WEATHER.description
+    # 只恢复一次
+    assert restore_compacted_tools(request_data["conversationState"]) == 0
+
+
+def test_count_tokens_skips_descriptions_of_declared_tools(compaction):
+    request = claude_request(WEATHER, CLOCK)
+    declared = claude_tool_fingerprints(claude_request(WEATHER))
+    full = estimate_input_token_breakdown(request).input_tokens
+    compacted = estimate_input_token_breakdown(request, declared).input_tokens
+    without_weather_description = estimate_input_token_breakdown(claude_request(
+        ClaudeTool(name=WEATHER.name, description="", input_schema=WEATHER.input_schema), CLOCK
+    )).input_tokens
+    assert compacted < full
+    assert compacted == without_weather_description
+
+
+def test_count_tokens_counts_duplicates_once(compaction):
+    once = estimate_input_token_breakdown(claude_request(WEATHER)).input_tokens
+    assert estimate_input_token_breakdown(claude_request(WEATHER, WEATHER)).input_tokens == once
+
+
+def test_count_tokens_ignores_declared_tools_when_disabled(monkeypatch):
+    monkeypatch.setattr(claude_stream_handler, "TOOL_COMPACTION_ENABLED", False)
+    request = claude_request(WEATHER, CLOCK)
+    declared = claude_tool_fingerprints(claude_request(WEATHER))
+    assert estimate_input_token_breakdown(request, declared).input_tokens == estimate_input_token_breakdown(request).input_tokens
+
+
+def tool_message_body(tools):
+    return {
+        "model": MODEL,
+        "max_tokens": 256,
+        "messages": [{"role": "user", "content": "weather?"}],
+        "tools": [tool.model_dump() for tool in tools],
+    }
+
+
+def test_count_tokens_route_after_a_turn(client, auth_headers, compaction):
+    headers = {**auth_headers, "X-Conversation-Id": "tool-compaction-route"}
+    body = tool_message_body([WEATHER, CLOCK])
+    before = client.post("/v1/messages/count_tokens", json=body, headers=headers).json()["input_tokens"]
+
+    # 第一轮把两个工具发往上游，之后同一对话的计数不再包含它们的描述
+    assert client.post("/v1/messages", json=body, headers=headers).status_code == 200
+    after = client.post("/v1/messages/count_tokens", json=body, headers=headers).json()["input_tokens"]
+    assert after < before
+
+    # 没有对话标识时按完整定义计数
+    assert client.post("/v1/messages/count_tokens", json=body, headers=auth_headers).json()["input_tokens"] == before
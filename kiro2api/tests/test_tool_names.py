@@ -0,0 +1,172 @@
+"""
+工具名校验（TOOL_NAME_POLICY）：reject 时非法名称返回 400；sanitize 时转换为合法名称发往上游，
+响应中的 tool_use / tool_calls 还原为客户端的原名（两个接口的流式和非流式响应）
+"""
+
+import json
+
+import pytest
+
+from models.claude_schemas import ClaudeMessage, ClaudeRequest, ClaudeTool
+from services import tool_utils
+from services.claude_converter import convert_claude_to_codewhisperer_request
+from services.tool_utils import build_tool_name_map, sanitize_tool_name, tool_name_violation, ToolNameError
+from tests.helpers import openai_chunks, claude_events
+
+MODEL = "claude-sonnet-4-5-20250929"
+INVALID_NAME = "get weather!"
+SCHEMA = {"type": "object", "properties": {"city": {"type": "string"}}}
+
+
+@pytest.fixture
+def sanitize(monkeypatch):
+    monkeypatch.setattr(tool_utils, "TOOL_NAME_POLICY", "sanitize")
+
+
+@pytest.mark.parametrize("name", ["get_weather", "a", "tool-1", "x" * 64])
+def test_valid_names(name):
+    assert tool_name_violation(name) is None
+
+
+@pytest.mark.parametrize("name", ["", "x" * 65, INVALID_NAME, "天气", "a.b"])
+def test_invalid_names(name):
+    assert tool_name_violation(name)
+
+
+def test_reject_policy_raises():
+    with pytest.raises(ToolNameError) as e:
+        build_tool_name_map(["get_time", INVALID_NAME], policy="reject")
+    assert e.value.name == INVALID_NAME
+
+
+def test_valid_names_need_no_mapping():
+    tool_names = build_tool_name_map(["get_time", "get_weather"], policy="reject")
+    assert tool_names.to_upstream == {}
+    assert tool_names.upstream_name("get_time") == "get_time"
+    assert tool_names.client_name("get_time") == "get_time"
+
+
+def test_sanitized_names_are_valid_and_reversible():
+    names = [INVALID_NAME, "天气查询", "y" * 80, "search.docs"]
+    tool_names = build_tool_name_map(names, policy="sanitize")
+    upstream_names = [tool_names.upstream_name(name) for name in names]
+    assert upstream_names[0] == "get_weather"
+    assert upstream_names[3] == "search_docs"
+    for name, upstream_name in zip(names, upstream_names):
+        assert tool_name_violation(upstream_name) is None
+        assert tool_names.client_name(upstream_name) == name
+    assert len(set(upstream_names)) == len(names)
+
+
+def test_sanitized_name_does_not_collide_with_valid_name():
+    tool_names = build_tool_name_map(["get_weather", INVALID_NAME], policy="sanitize")
+    sanitized = tool_names.upstream_name(INVALID_NAME)
+    assert sanitized != "get_weather"
+    assert sanitized.startswith("get_weather_")
+    assert tool_names.client_name("get_weather") == "get_weather"
+
+
+def test_truncation_adds_hash():
+    first = sanitize_tool_name("a" * 70 + "1", set())
+    second = sanitize_tool_name("a" * 70 + "2", set())
+    assert len(first) <= 64 and len(second) <= 64
+    assert first != second
+
+
+def test_policy_defaults_to_config(sanitize):
+    assert build_tool_name_map([INVALID_NAME]).upstream_name(INVALID_NAME) == "get_weather"
+
+
+def test_converter_uses_sanitized_names_in_tools_and_history():
+    tool_names = build_tool_name_map([INVALID_NAME], policy="sanitize")
+    request = ClaudeRequest(
+        model=MODEL,
+        max_tokens=256,
+        tools=[ClaudeTool(name=INVALID_NAME, description="weather", input_schema=SCHEMA)],
+        messages=[
+            ClaudeMessage(role="user", content="weather?"),
+            ClaudeMessage(role="assistant", content=[
+                {"type": "tool_use", "id": "toolu_1", "name": INVALID_NAME, "input": {"city": "Paris"}},
+            ]),
+            ClaudeMessage(role="user", content=[{"type": "tool_result", "tool_use_id": "toolu_1", "content": "sunny"}]),
+        ],
+    )
+    converted = convert_claude_to_codewhisperer_request(request, tool_names)
+    text = json.dumps(converted, ensure_ascii=False)
+    assert INVALID_NAME not in text
+    user_input = converted["conversationState"]["currentMessage"]["userInputMessage"]
+    assert user_input["userInputMessageContext"]["tools"][0]["toolSpecification"]["name"] == "get_weather"
+    assert "[Called get_weather with args" in text
+
+
+# ---------------------------------------------------------------------------
+# 路由：假上游对请求中的第一个工具发出一次工具调用（使用收到的、转换后的名称）
+# ---------------------------------------------------------------------------
+
+def claude_body(stream):
+    return {
+        "model": MODEL,
+        "max_tokens": 256,
+        "stream": stream,
+        "messages": [{"role": "user", "content": "weather in Paris?"}],
+        "tools": [{"name": INVALID_NAME, "description": "weather", "input_schema": SCHEMA}],
+    }
+
+
+def openai_body(stream):
+    return {
+        "model": MODEL,
+        "stream": stream,
+        "messages": [{"role": "user", "content": "weather in Paris?"}],
+        "tools": [{"type": "function", "function": {"name": INVALID_NAME, "description": "weather", "parameters": SCHEMA}}],
+    }
+
+
+def test_claude_route_rejects_invalid_name(client, auth_headers):
+    response = client.post("/v1/messages", json=claude_body(False), headers=auth_headers)
+    assert response.status_code == 400
+    assert response.json()["detail"]["error"]["type"] == "invalid_request_error"
+
+
+def test_openai_route_rejects_invalid_name(client, auth_headers):
+    response = client.post("/v1/chat/completions", json=openai_body(False), headers=auth_headers)
+    assert response.status_code == 400
+    error = response.json()["detail"]["error"]
+    assert error["code"] == "invalid_tool_name"
+    assert error["param"] == "tools"
+
+
+def test_claude_non_stream_restores_name(client, auth_headers, sanitize):
+    response = client.post("/v1/messages", json=claude_body(False), headers=auth_headers)
+    assert response.status_code == 200
+    [tool_use] = [block for block in response.json()["content"] if block["type"] == "tool_use"]
+    assert tool_use["name"] == INVALID_NAME
+
+
+def test_claude_stream_restores_name(client, auth_headers, sanitize):
+    response = client.post("/v1/messages", json=claude_body(True), headers=auth_headers)
+    starts = [
+        data["content_block"] for event, data in claude_events(response.text)
+        if event == "content_block_start" and data["content_block"]["type"] == "tool_use"
+    ]
+    assert [block["name"] for block in starts] == [INVALID_NAME]
+
+
+def test_openai_non_stream_restores_name(client, auth_headers, sanitize):
+    response = client.post("/v1/chat/completions", json=openai_body(False), headers=auth_headers)
+    assert response.status_code == 200
+    [tool_call] = response.json()["choices"][0]["message"]["tool_calls"]
+    assert tool_call["function"]["name"] == INVALID_NAME
+
+
+def test_openai_stream_restores_name(client, auth_headers, sanitize):
+    response = client.post("/v1/chat/completions", json=openai_body(True), headers=auth_headers)
+    chunks, done = openai_chunks(response.text)
+    names = [
+        call["function"]["name"]
+        for chunk in chunks for choice in chunk.get("choices", [])
+        for call in choice["delta"].get("tool_calls") or []
+        if call.get("function", {}).get("name")
+    ]
+    assert names == [INVALID_NAME]
+    assert done
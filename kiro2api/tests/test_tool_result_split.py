@@ -0,0 +1,101 @@
+"""
+超长 tool_result 拆分（TOOL_RESULT_SPLIT_BYTES）：每段不超过字节上限、优先在换行处断开、
+每段都带 tool_use_id 和 (part i/n) 标记，count_tokens 按拆分后的多段计数
+"""
+
+import re
+
+import pytest
+
+from models.claude_schemas import ClaudeMessage, ClaudeRequest
+from services import tool_utils
+from services.claude_converter import convert_claude_to_codewhisperer_request
+from services.claude_stream_handler import estimate_input_token_breakdown
+from services.tool_utils import format_tool_result, split_tool_result_text
+
+MODEL = "claude-sonnet-4-5-20250929"
+SPLIT_BYTES = 200
+LINES = "\n".join(f"line {i}: " + "x" * 30 for i in range(40))
+
+
+@pytest.fixture
+def splitting(monkeypatch):
+    monkeypatch.setattr(tool_utils, "TOOL_RESULT_SPLIT_BYTES", SPLIT_BYTES)
+
+
+def test_short_or_disabled_is_not_split():
+    assert split_tool_result_text("short", 100) == ["short"]
+    assert split_tool_result_text(LINES, 0) == [LINES]
+
+
+def test_parts_fit_and_break_at_newlines():
+    parts = split_tool_result_text(LINES, SPLIT_BYTES)
+    assert len(parts) > 1
+    assert "".join(parts) == LINES
+    assert all(len(part.encode("utf-8")) <= SPLIT_BYTES for part in parts)
+    assert all(part.endswith("\n") for part in parts[:-1])
+
+
+def test_multibyte_characters_are_not_cut():
+    text = "工具结果" * 50
+    parts = split_tool_result_text(text, 10)
+    assert "".join(parts) == text
+    # 每个汉字 3 字节，10 字节的预算每段放 3 个
+    assert all(len(part) == 3 for part in parts[:-1])
+
+
+def test_parts_are_labeled_with_tool_use_id():
+    results = format_tool_result("Tool result for", "toolu_big", LINES, SPLIT_BYTES)
+    count = len(results)
+    assert count > 1
+    for index, result in enumerate(results, 1):
+        assert result.startswith(f"[Tool result for toolu_big (part {index}/{count})]: ")
+    assert format_tool_result("Tool result for", "toolu_small", "ok", SPLIT_BYTES) == ["[Tool result for toolu_small]: ok"]
+
+
+def tool_result_request(result_content):
+    return ClaudeRequest(model=MODEL, max_tokens=256, messages=[
+        ClaudeMessage(role="user", content="read the log"),
+        ClaudeMessage(role="assistant", content=[
+            {"type": "tool_use", "id": "toolu_big", "name": "read_log", "input": {}},
+        ]),
+        ClaudeMessage(role="user", content=[
+            {"type": "tool_result", "tool_use_id": "toolu_big", "content": result_content},
+        ]),
+    ])
+
+
+@pytest.mark.parametrize("result_content", [LINES, [{"type": "text", "text": LINES}]])
+def test_converter_sends_correlated_parts(splitting, result_content):
+    converted = convert_claude_to_codewhisperer_request(tool_result_request(result_content))
+    content = converted["conversationState"]["currentMessage"]["userInputMessage"]["content"]
+    markers = re.findall(r"\[Tool execution completed for toolu_big \(part (\d+)/(\d+)\)\]: ", content)
+    expected = len(split_tool_result_text(LINES, SPLIT_BYTES))
+    assert [int(index) for index, _ in markers] == list(range(1, expected + 1))
+    assert {int(total) for _, total in markers} == {expected}
+
+
+def test_count_tokens_counts_the_parts(monkeypatch):
+    request = tool_result_request(LINES)
+    whole = estimate_input_token_breakdown(request).input_tokens
+    monkeypatch.setattr(tool_utils, "TOOL_RESULT_SPLIT_BYTES", SPLIT_BYTES)
+    split = estimate_input_token_breakdown(request).input_tokens
+    # 每段多出一个带 tool_use_id 的前缀
+    assert split > whole
+
+
+def test_count_tokens_route(client, auth_headers, monkeypatch):
+    body = {
+        "model": MODEL,
+        "max_tokens": 256,
+        "messages": [message.model_dump() for message in tool_result_request(LINES).messages],
+    }
+
+    def count():
+        response = client.post("/v1/messages/count_tokens", json=body, headers=auth_headers)
+        assert response.status_code == 200
+        return response.json()["input_tokens"]
+
+    whole = count()
+    monkeypatch.setattr(tool_utils, "TOOL_RESULT_SPLIT_BYTES", SPLIT_BYTES)
+    assert count() > whole
@@ -0,0 +1,167 @@
+"""
+Claude 接口的 tool_use id：上游的 toolUseId 转换为 toolu_ 开头的合法 id，同一条消息内重复的 id 加后缀保证唯一；
+客户端下一轮带回转换后的 id 时，发往上游前还原为上游原始的 id
+"""
+
+import re
+
+import pytest
+
+from models.claude_schemas import ClaudeMessage, ClaudeRequest
+from services import demo_upstream
+from services.claude_converter import convert_claude_to_codewhisperer_request
+from services.claude_stream_handler import ClaudeStreamHandler, assemble_claude_message
+from services.demo_upstream import encode_event_stream_message
+from services.tool_utils import normalize_tool_use_id, ToolUseIdMap, ToolUseIdRegistry
+from tests.helpers import claude_events
+
+MODEL = "claude-sonnet-4-5-20250929"
+CLAUDE_ID = re.compile(r"^toolu_[A-Za-z0-9_-]+$")
+# 上游重复使用了同一个 id，第三个 id 含有非法字符
+UPSTREAM_IDS = ["tooluse_dup", "tooluse_dup", "call:1/2"]
+EXPECTED_IDS = ["toolu_dup", "toolu_dup_2", "toolu_call_1_2"]
+
+
+@pytest.mark.parametrize("upstream_id, expected", [
+    ("tooluse_abc-1", "toolu_abc-1"),
+    ("toolu_ok_1", "toolu_ok_1"),
+    ("toolu_bad.id", "toolu_toolu_bad_id"),
+    ("call:1/2", "toolu_call_1_2"),
+])
+def test_normalize(upstream_id, expected):
+    assert normalize_tool_use_id(upstream_id) == expected
+
+
+@pytest.mark.parametrize("upstream_id", [None, "", "tooluse_"])
+def test_missing_id_is_generated(upstream_id):
+    generated = normalize_tool_use_id(upstream_id)
+    assert CLAUDE_ID.match(generated)
+    assert generated != normalize_tool_use_id(upstream_id)
+
+
+def test_duplicates_get_suffixes_and_map_back():
+    registry = ToolUseIdRegistry()
+    ids = ToolUseIdMap(registry)
+    assert [ids.assign(upstream_id) for upstream_id in UPSTREAM_IDS] == EXPECTED_IDS
+    assert [registry.upstream_id(client_id) for client_id in EXPECTED_IDS] == UPSTREAM_IDS
+    # 客户端自己生成的 id 原样使用
+    assert registry.upstream_id("toolu_from_client") == "toolu_from_client"
+
+
+def test_registry_evicts_oldest():
+    registry = ToolUseIdRegistry(max_size=2)
+    for i in range(3):
+        registry.remember(f"toolu_{i}", f"tooluse_{i}")
+    assert registry.upstream_id("toolu_0") == "toolu_0"
+    assert registry.upstream_id("toolu_2") == "tooluse_2"
+
+
+def tool_use_frames():
+    frames = [encode_event_stream_message("messageMetadataEvent", {"conversationId": "demo-tool-use-ids"})]
+    for upstream_id in UPSTREAM_IDS:
+        tool_use = {"name": "get_time", "toolUseId": upstream_id}
+        frames.append(encode_event_stream_message("toolUseEvent", {**tool_use, "input": "{}"}))
+        frames.append(encode_event_stream_message("toolUseEvent", {**tool_use, "stop": True}))
+    return frames
+
+
+def tool_request():
+    return ClaudeRequest(
+        model=MODEL, max_tokens=256, messages=[ClaudeMessage(role="user", content="what time is it?")],
+        tools=[{"name": "get_time", "description": "time", "input_schema": {"type": "object"}}],
+    )
+
+
+def handler_events():
+    handler = ClaudeStreamHandler(MODEL, tool_request())
+    events = []
+    for frame in tool_use_frames():
+        events.extend(handler.handle_chunk(frame))
+    events.extend(handler.finalize())
+    return handler, events
+
+
+def test_stream_handler_ids():
+    _, events = handler_events()
+    starts = [
+        data["content_block"]["id"] for event, data in claude_events("".join(events))
+        if event == "content_block_start" and data["content_block"]["type"] == "tool_use"
+    ]
+    assert starts == EXPECTED_IDS
+
+
+def test_non_stream_message_ids():
+    handler, events = handler_events()
+    message = assemble_claude_message(events, handler)
+    assert [block["id"] for block in message["content"] if block["type"] == "tool_use"] == EXPECTED_IDS
+
+
+def test_next_turn_restores_upstream_ids():
+    handler_events()
+    request = ClaudeRequest(model=MODEL, max_tokens=256, messages=[
+        ClaudeMessage(role="user", content="what time is it?"),
+        ClaudeMessage(role="assistant", content=[
+            {"type": "tool_use", "id": client_id, "name": "get_time", "input": {}} for client_id in EXPECTED_IDS
+        ]),
+        ClaudeMessage(role="user", content=[
+            {"type": "tool_result", "tool_use_id": client_id, "content": "12:00"} for client_id in EXPECTED_IDS
+        ]),
+    ])
+    content = convert_claude_to_codewhisperer_request(request)["conversationState"]["currentMessage"]["userInputMessage"]["content"]
+    for upstream_id in UPSTREAM_IDS:
+        assert f"[Tool execution completed for {upstream_id}]" in content
+    assert "toolu_dup_2" not in content
+
+
+# ---------------------------------------------------------------------------
+# 路由
+# ---------------------------------------------------------------------------
+
+@pytest.fixture
+def upstream_requests(monkeypatch):
+    """假上游返回上面的工具调用，并记录收到的请求"""
+    received = []
+
+    def build(request_data, options=None):
+        received.append(request_data)
+        return [(frame, 0.0) for frame in tool_use_frames()]
+
+    monkeypatch.setattr(demo_upstream, "build_demo_events", build)
+    return received
+
+
+def message_body(stream, messages=None):
+    return {
+        "model": MODEL, "max_tokens": 256, "stream": stream,
+        "messages": messages or [{"role": "user", "content": "what time is it?"}],
+        "tools": [{"name": "get_time", "description": "time", "input_schema": {"type": "object"}}],
+    }
+
+
+def test_stream_route(client, auth_headers, upstream_requests):
+    response = client.post("/v1/messages", json=message_body(True), headers=auth_headers)
+    ids = [
+        data["content_block"]["id"] for event, data in claude_events(response.text)
+        if event == "content_block_start" and data["content_block"]["type"] == "tool_use"
+    ]
+    assert ids == EXPECTED_IDS
+
+
+def test_non_stream_route_and_next_turn(client, auth_headers, upstream_requests):
+    message = client.post("/v1/messages", json=message_body(False), headers=auth_headers).json()
+    tool_uses = [block for block in message["content"] if block["type"] == "tool_use"]
+    assert [block["id"] for block in tool_uses] == EXPECTED_IDS
+    assert all(CLAUDE_ID.match(block["id"]) for block in tool_uses)
+
+    # 下一轮带回转换后的 id，上游收到的是原始 id
+    next_turn = [
+        {"role": "user", "content": "what time is it?"},
+        {"role": "assistant", "content": tool_uses},
+        {"role": "user", "content": [
+            {"type": "tool_result", "tool_use_id": block["id"], "content": "12:00"} for block in tool_uses
+        ]},
+    ]
+    assert client.post("/v1/messages", json=message_body(False, next_turn), headers=auth_headers).status_code == 200
+    content = upstream_requests[-1]["conversationState"]["currentMessage"]["userInputMessage"]["content"]
+    for upstream_id in UPSTREAM_IDS:
+        assert f"[Tool execution completed for {upstream_id}]" in content
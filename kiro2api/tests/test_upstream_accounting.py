@@ -0,0 +1,109 @@
+"""上游调用级计量：每条记录的账号是发起该次调用的账号，而不是并发请求最近选中的账号"""
+
+import asyncio
+
+import pytest
+
+from services import upstream
+from services.accounting import (
+    RequestAccounting,
+    FANOUT_PRIMARY,
+    FANOUT_RETRY_FORBIDDEN,
+    FANOUT_RETRY_RATE_LIMITED,
+    FANOUT_RETRY_TRANSIENT,
+    DECISION_ACCEPT,
+    DECISION_RETRY,
+    DECISION_FALLBACK,
+)
+from services.circuit_breaker import CircuitBreaker
+from services.upstream import send_with_retries
+from tests.helpers import make_manager, FakeUpstreamClient
+
+MODEL = "claude-sonnet-4-5-20250929"
+REQUEST_DATA = {"conversationState": {"conversationId": "conv-test", "currentMessage": {}}}
+
+
+@pytest.fixture
+def manager(monkeypatch):
+    monkeypatch.setattr(upstream, "upstream_breaker", CircuitBreaker(failure_threshold=0))
+    monkeypatch.setattr(upstream, "retry_delay", lambda attempt: 0)
+    manager = make_manager(monkeypatch, "a", "b")
+    monkeypatch.setattr(upstream, "token_manager", manager)
+    return manager
+
+
+def attempts(accounting):
+    return [(a["account"], a["fanout"], a["status"], a["decision"]) for a in accounting.attempts]
+
+
+def send(client, accounting, token=None):
+    return send_with_retries(client, dict(REQUEST_DATA), token, accounting=accounting)
+
+
+def test_primary_call(manager):
+    accounting = RequestAccounting("openai", MODEL, False)
+    asyncio.run(send(FakeUpstreamClient(), accounting))
+    assert attempts(accounting) == [("a", FANOUT_PRIMARY, 200, DECISION_ACCEPT)]
+    assert accounting.attempts[0]["token"]
+
+
+def test_forbidden_fallback_records_each_account(manager):
+    accounting = RequestAccounting("openai", MODEL, False)
+    asyncio.run(send(FakeUpstreamClient({"a": [403]}), accounting))
+    assert attempts(accounting) == [
+        ("a", FANOUT_PRIMARY, 403, DECISION_FALLBACK),
+        ("b", FANOUT_RETRY_FORBIDDEN, 200, DECISION_ACCEPT),
+    ]
+
+
+def test_rate_limited_fallback_records_each_account(manager):
+    accounting = RequestAccounting("claude", MODEL, True)
+    asyncio.run(send(FakeUpstreamClient({"a": [429]}), accounting))
+    assert attempts(accounting) == [
+        ("a", FANOUT_PRIMARY, 429, DECISION_FALLBACK),
+        ("b", FANOUT_RETRY_RATE_LIMITED, 200, DECISION_ACCEPT),
+    ]
+
+
+def test_transient_retry_keeps_account(manager):
+    accounting = RequestAccounting("openai", MODEL, False)
+    asyncio.run(send(FakeUpstreamClient({"a": [503]}), accounting))
+    assert attempts(accounting) == [
+        ("a", FANOUT_PRIMARY, 503, DECISION_RETRY),
+        ("a", FANOUT_RETRY_TRANSIENT, 200, DECISION_ACCEPT),
+    ]
+
+
+def test_concurrent_calls_record_their_own_account(manager):
+    """n=2：两个并发调用分别使用 a 和 b，a 的调用进行期间 current_index 已经指向 b"""
+    first, second = RequestAccounting("openai", MODEL, False), RequestAccounting("openai", MODEL, False)
+
+    async def run():
+        a = await manager.get_token()
+        manager.current_index = 1
+        b = await manager.get_token()
+        client = FakeUpstreamClient()
+        await asyncio.gather(send(client, first, a), send(client, second, b))
+        return client
+
+    client = asyncio.run(run())
+    assert sorted(client.calls) == ["a", "b"]
+    assert attempts(first) == [("a", FANOUT_PRIMARY, 200, DECISION_ACCEPT)]
+    assert attempts(second) == [("b", FANOUT_PRIMARY, 200, DECISION_ACCEPT)]
+
+
+def test_concurrent_fallback_records_the_switched_account(manager):
+    """n=2：一个调用 403 后换到 b 重试，另一个在 a 上成功；每条记录都对应实际发出调用的账号"""
+    first, second = RequestAccounting("openai", MODEL, False), RequestAccounting("openai", MODEL, False)
+
+    async def run():
+        a = await manager.get_token()
+        client = FakeUpstreamClient({"a": [403]})
+        await asyncio.gather(send(client, first, a), send(client, second, a))
+
+    asyncio.run(run())
+    assert attempts(first) == [
+        ("a", FANOUT_PRIMARY, 403, DECISION_FALLBACK),
+        ("b", FANOUT_RETRY_FORBIDDEN, 200, DECISION_ACCEPT),
+    ]
+    assert attempts(second) == [("a", FANOUT_PRIMARY, 200, DECISION_ACCEPT)]
@@ -0,0 +1,115 @@
+"""上游 403 / 429 重试：隔离或刷新发起该次调用的账号，并在下一个健康账号上重试"""
+
+import asyncio
+from datetime import timedelta
+
+import pytest
+
+from services import upstream
+from services.circuit_breaker import CircuitBreaker
+from services.upstream import send_with_retries, TokenInvalidError, RateLimitedError
+from tests.helpers import make_manager, FakeUpstreamClient
+
+REQUEST_DATA = {"conversationState": {"conversationId": "conv-test", "currentMessage": {}}}
+
+
+@pytest.fixture(autouse=True)
+def isolated_breaker(monkeypatch):
+    monkeypatch.setattr(upstream, "upstream_breaker", CircuitBreaker(failure_threshold=0))
+
+
+def use_manager(monkeypatch, *names):
+    manager = make_manager(monkeypatch, *names)
+    monkeypatch.setattr(upstream, "token_manager", manager)
+    return manager
+
+
+def age_token(manager, name):
+    """让账号的 token 看起来不是刚刷新的，403 时先刷新而不是直接隔离"""
+    cached = manager.cached_tokens[name]
+    cached.cached_at -= timedelta(hours=1)
+    cached.expires_at = cached.cached_at + timedelta(hours=2)
+
+
+def send(client, token=None):
+    return asyncio.run(send_with_retries(client, REQUEST_DATA, token))
+
+
+def test_403_then_success_on_second_token(monkeypatch):
+    manager = use_manager(monkeypatch, "a", "b")
+    client = FakeUpstreamClient({"a": [403]})
+    response = send(client)
+    assert response.status_code == 200
+    assert client.calls == ["a", "b"]
+    # a 的 token 刚刷新过仍然 403：进入冷却，冷却期内不会被选中
+    assert manager.cached_tokens["a"].is_cooling_down()
+    assert asyncio.run(manager.get_token()).name == "b"
+
+
+def test_403_refreshes_stale_token_and_retries_same_account(monkeypatch):
+    manager = use_manager(monkeypatch, "a", "b")
+    asyncio.run(manager.get_token())
+    age_token(manager, "a")
+    client = FakeUpstreamClient({"a": [403]})
+    assert send(client).status_code == 200
+    assert client.calls == ["a", "a"]
+    assert manager.refresh_count == 2
+    assert not manager.cached_tokens["a"].is_cooling_down()
+
+
+def test_403_after_refresh_switches_account(monkeypatch):
+    manager = use_manager(monkeypatch, "a", "b")
+    asyncio.run(manager.get_token())
+    age_token(manager, "a")
+    client = FakeUpstreamClient({"a": [403, 403]})
+    assert send(client).status_code == 200
+    assert client.calls == ["a", "a", "b"]
+    assert manager.cached_tokens["a"].is_cooling_down()
+
+
+def test_403_after_switching_gives_up(monkeypatch):
+    manager = use_manager(monkeypatch, "a", "b")
+    client = FakeUpstreamClient({"a": [403], "b": [403]})
+    with pytest.raises(TokenInvalidError):
+        send(client)
+    assert client.calls == ["a", "b"]
+    # b 已是最后一个可用账号，不再隔离
+    assert not manager.cached_tokens["b"].is_cooling_down()
+
+
+def test_403_single_account_is_not_quarantined(monkeypatch):
+    manager = use_manager(monkeypatch, "only")
+    client = FakeUpstreamClient({"only": [403, 403, 403]})
+    with pytest.raises(TokenInvalidError):
+        send(client)
+    assert len(client.calls) == 2
+    assert not manager.cached_tokens["only"].is_cooling_down()
+    assert asyncio.run(manager.get_token()).name == "only"
+
+
+def test_429_switches_account(monkeypatch):
+    manager = use_manager(monkeypatch, "a", "b")
+    client = FakeUpstreamClient({"a": [429]})
+    assert send(client).status_code == 200
+    assert client.calls == ["a", "b"]
+    assert manager.cached_tokens["a"].is_exhausted
+
+
+def test_429_on_all_accounts(monkeypatch):
+    use_manager(monkeypatch, "a", "b")
+    client = FakeUpstreamClient({"a": [429], "b": [429]})
+    with pytest.raises(RateLimitedError):
+        send(client)
+    assert client.calls == ["a", "b"]
+
+
+def test_marks_the_attempt_account_not_the_latest_selection(monkeypatch):
+    manager = use_manager(monkeypatch, "a", "b")
+    a = asyncio.run(manager.get_token())
+    # 并发的另一个请求在这次调用进行期间选中了 b
+    manager.current_index = 1
+    asyncio.run(manager.get_token())
+    client = FakeUpstreamClient({"a": [429]})
+    assert send(client, a).status_code == 200
+    assert manager.cached_tokens["a"].is_exhausted
+    assert not manager.cached_tokens["b"].is_exhausted